@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Aggregates sum the indicators of the Gemeinden by Bundesland or Bezirk,
+// the first three digits of the Gemeinde code. Wien is in the GeoPackage
+// both as a whole and as its districts, which are Bezirke of their own;
+// the whole city is left out so it isn't counted twice.
+
+const wienWhole = "90001"
+
+// aggregateLevels are the values of ?by= and the SQL expression grouping
+// by them.
+var aggregateLevels = map[string]string{
+	"state":  "state",
+	"bezirk": "substr(iso, 1, 3)",
+}
+
+// aggregateValue is an indicator summed over a group, its mean per
+// Gemeinde and its sum per inhabitant.
+type aggregateValue struct {
+	Sum       *float64 `json:"sum"`
+	Mean      *float64 `json:"mean"`
+	PerCapita *float64 `json:"per_capita"`
+}
+
+type aggregateGroup struct {
+	Key        string `json:"key"`
+	Gemeinden  int64  `json:"gemeinden"`
+	Population int64  `json:"population"`
+	// Values by year and indicator
+	Years map[string]map[string]aggregateValue `json:"years"`
+}
+
+// handleAggregate sums the indicators in ?indicators= (all by default)
+// for the years in ?years= (all by default) over the Gemeinden of each
+// Bundesland or Bezirk, as ?by= says.
+func handleAggregate(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	by := query.Get("by")
+	if by == "" {
+		by = "state"
+	}
+	groupExpr, ok := aggregateLevels[by]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "by must be state or bezirk")
+		return
+	}
+	available, err := datasetYears()
+	if err != nil {
+		log.Printf("Reading dataset years failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to aggregate")
+		return
+	}
+	years := splitParam(query.Get("years"))
+	for _, year := range years {
+		if !slices.Contains(available, year) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("no data for year %q", year))
+			return
+		}
+	}
+	if len(years) == 0 {
+		years = available
+	}
+	// Per-capita indicators don't add up; their totals come from
+	// per_capita of the absolute indicator
+	selected := splitParam(query.Get("indicators"))
+	for _, indicator := range selected {
+		switch {
+		case strings.HasSuffix(indicator, "_per_capita") && slices.Contains(indicators, indicator):
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s can't be summed; use per_capita of the absolute indicator", indicator))
+			return
+		case !slices.Contains(indicators, indicator):
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown indicator %q", indicator))
+			return
+		}
+	}
+	if len(selected) == 0 {
+		for _, indicator := range indicators {
+			if !strings.HasSuffix(indicator, "_per_capita") {
+				selected = append(selected, indicator)
+			}
+		}
+	}
+
+	columns := []string{groupExpr, "COUNT(*)", "COALESCE(SUM(population), 0)"}
+	for _, year := range years {
+		for _, indicator := range selected {
+			column := fmt.Sprintf("%q", indicator+"_"+year)
+			columns = append(columns, "SUM("+column+")", "AVG("+column+")")
+		}
+	}
+	where := "iso <> '" + wienWhole + "'"
+	if cond := dataScopeCondition(r); cond != "" {
+		where += " AND " + cond
+	}
+	rows, err := gpkgDB().Query(fmt.Sprintf("SELECT %s FROM gemeinden WHERE %s GROUP BY 1 ORDER BY 1",
+		strings.Join(columns, ", "), where))
+	if err != nil {
+		log.Printf("Aggregating Gemeinden failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to aggregate")
+		return
+	}
+	defer rows.Close()
+	groups := []aggregateGroup{}
+	for rows.Next() {
+		var g aggregateGroup
+		values := make([]sql.NullFloat64, len(columns)-3)
+		dest := []interface{}{&g.Key, &g.Gemeinden, &g.Population}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Aggregating Gemeinden failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to aggregate")
+			return
+		}
+		g.Years = make(map[string]map[string]aggregateValue, len(years))
+		i := 0
+		for _, year := range years {
+			g.Years[year] = make(map[string]aggregateValue, len(selected))
+			for _, indicator := range selected {
+				var v aggregateValue
+				if sum := values[i]; sum.Valid {
+					v.Sum = roundDerived(sum.Float64)
+					if g.Population > 0 {
+						v.PerCapita = roundDerived(sum.Float64 / float64(g.Population))
+					}
+				}
+				if mean := values[i+1]; mean.Valid {
+					v.Mean = roundDerived(mean.Float64)
+				}
+				g.Years[year][indicator] = v
+				i += 2
+			}
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Aggregating Gemeinden failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to aggregate")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"by":     by,
+		"years":  years,
+		"groups": groups,
+	})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes an API key can be granted
+const (
+	scopeExport   = "export"
+	scopeData     = "data"
+	scopePipeline = "pipeline"
+	scopeAdmin    = "admin"
+)
+
+var knownScopes = map[string]bool{scopeExport: true, scopeData: true, scopePipeline: true, scopeAdmin: true}
+
+// Every issued key starts with this, so keys are recognizable in configs
+// and as Basic auth passwords
+const apiKeyPrefix = "hzk_"
+
+// APIKey is a long-lived credential for scripts, sent as
+// "Authorization: Bearer <key>". Only the SHA-256 of the key is stored;
+// keys are random, so a fast hash is enough.
+type APIKey struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Username string   `json:"username"`
+	Scopes   []string `json:"scopes"`
+	// Further limits the owner's data scope
+	DataScope  *DataScope `json:"data_scope,omitempty"`
+	KeyHash    string     `json:"key_hash"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func (k APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyStore struct {
+	mu    sync.Mutex
+	path  string
+	keys  map[string]*APIKey // by key hash
+	dirty bool
+}
+
+var apiKeys = &apiKeyStore{keys: make(map[string]*APIKey)}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *apiKeyStore) Load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*APIKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, k := range list {
+		s.keys[k.KeyHash] = k
+	}
+	return nil
+}
+
+// saveLocked writes the store; the caller holds s.mu.
+func (s *apiKeyStore) saveLocked() error {
+	list := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Lookup resolves a presented key and records its use.
+func (s *apiKeyStore) Lookup(key string) (APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[hashAPIKey(key)]
+	if !ok {
+		return APIKey{}, false
+	}
+	now := time.Now().UTC()
+	k.LastUsedAt = &now
+	s.dirty = true
+	return *k, true
+}
+
+func (s *apiKeyStore) Create(name, username string, scopes []string, dataScope *DataScope) (APIKey, string, error) {
+	key := apiKeyPrefix + generateToken()
+	k := &APIKey{
+		ID:        generateToken()[:12],
+		Name:      name,
+		Username:  username,
+		Scopes:    scopes,
+		DataScope: dataScope,
+		KeyHash:   hashAPIKey(key),
+		CreatedAt: time.Now().UTC(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.KeyHash] = k
+	if err := s.saveLocked(); err != nil {
+		delete(s.keys, k.KeyHash)
+		return APIKey{}, "", err
+	}
+	return *k, key, nil
+}
+
+func (s *apiKeyStore) Revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, k := range s.keys {
+		if k.ID == id {
+			delete(s.keys, hash)
+			return true, s.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+func (s *apiKeyStore) List() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, *k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// startAPIKeyPersistence saves last-used timestamps once a minute, so
+// that key use doesn't rewrite the file on every request.
+func startAPIKeyPersistence() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			apiKeys.mu.Lock()
+			if apiKeys.dirty {
+				if err := apiKeys.saveLocked(); err != nil {
+					log.Printf("Failed to save API keys: %v", err)
+				}
+			}
+			apiKeys.mu.Unlock()
+		}
+	}()
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+// apiKeyView is the listing form of a key, without its hash.
+type apiKeyView struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Username   string     `json:"username"`
+	Scopes     []string   `json:"scopes"`
+	DataScope  *DataScope `json:"data_scope,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func viewAPIKey(k APIKey) apiKeyView {
+	return apiKeyView{k.ID, k.Name, k.Username, k.Scopes, k.DataScope, k.CreatedAt, k.LastUsedAt}
+}
+
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	views := []apiKeyView{}
+	for _, k := range apiKeys.List() {
+		views = append(views, viewAPIKey(k))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name      string     `json:"name"`
+		Username  string     `json:"username"`
+		Scopes    []string   `json:"scopes"`
+		DataScope *DataScope `json:"data_scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Name == "" || len(req.Scopes) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "name and scopes are required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !knownScopes[scope] {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown scope %q", scope))
+			return
+		}
+	}
+	if err := req.DataScope.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	user, ok := users.Get(req.Username)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "unknown user")
+		return
+	}
+	if slices.Contains(req.Scopes, scopePipeline) && (req.DataScope != nil || user.DataScope != nil) {
+		writeJSONError(w, http.StatusBadRequest, "the pipeline scope is not available with a data scope")
+		return
+	}
+
+	k, key, err := apiKeys.Create(req.Name, user.Username, req.Scopes, req.DataScope)
+	if err != nil {
+		log.Printf("Failed to create API key: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to store API key")
+		return
+	}
+	log.Printf("Created API key %s (%s) for user %s", k.ID, k.Name, k.Username)
+	audit(r, "api_key_created", "", map[string]interface{}{"id": k.ID, "name": k.Name, "owner": k.Username, "scopes": k.Scopes})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		apiKeyView
+		Key string `json:"key"`
+	}{viewAPIKey(k), key})
+}
+
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	found, err := apiKeys.Revoke(r.PathValue("id"))
+	if err != nil {
+		log.Printf("Failed to save API keys: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to store API keys")
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	log.Printf("Revoked API key %s", r.PathValue("id"))
+	audit(r, "api_key_revoked", "", map[string]interface{}{"id": r.PathValue("id")})
+	w.WriteHeader(http.StatusNoContent)
+}
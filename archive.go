@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Files in dataDir with a request in flight, keyed by name relative to dataDir
+var (
+	servingFiles      = make(map[string]int)
+	servingFilesMutex sync.Mutex
+)
+
+func acquireServing(name string) {
+	servingFilesMutex.Lock()
+	servingFiles[name]++
+	servingFilesMutex.Unlock()
+}
+
+func releaseServing(name string) {
+	servingFilesMutex.Lock()
+	if servingFiles[name]--; servingFiles[name] <= 0 {
+		delete(servingFiles, name)
+	}
+	servingFilesMutex.Unlock()
+}
+
+func isServing(name string) bool {
+	servingFilesMutex.Lock()
+	defer servingFilesMutex.Unlock()
+	return servingFiles[name] > 0
+}
+
+var archiveNamePattern = regexp.MustCompile(`^data_archive_\d{8}(_\d+)?\.zip$`)
+
+// Data files the frontend or the processing scripts read. Most are inputs
+// that are never rewritten, so their age says nothing about whether they
+// are still needed; they are never archived, whatever
+// archive_data_patterns matches.
+var protectedDataFiles = []string{
+	"austria_gemeinden.geojson",
+	"austria_states.geojson",
+	"carbon_flux_by_gemeinde.json",
+	"carbon_flux_status.json",
+	"emissions_meta.json",
+	"gemeinde_analysis.json",
+	"gemeinde_emissions.json",
+	"gemeinde_emissions_scaled.json",
+	"gemeinde_lookup.json",
+	"gemeinde_map.json",
+	"gemeinde_yearly_loss.json",
+	"gemeinde_yearly_map.json",
+	"hansen_state_analysis.json",
+	"historical_harvest.json",
+	"historical_harvest_full.json",
+	"holzeinschlag_full.json",
+	"population.json",
+	"timber_values.json",
+	"year_*.json",
+}
+
+// archivable reports whether a data file matches archive_data_patterns and
+// isn't one of the protected files.
+func archivable(name string) bool {
+	for _, pattern := range protectedDataFiles {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	for _, pattern := range config.ArchiveDataPatterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func archiveDir() string {
+	return filepath.Join(config.ProcessingDir, "data_archives")
+}
+
+// startDataArchiver archives stale data files once at startup and then
+// daily. It does nothing unless archive_data_after_days and
+// archive_data_patterns are set.
+func startDataArchiver() {
+	if config.ArchiveDataAfterDays <= 0 {
+		return
+	}
+	if len(config.ArchiveDataPatterns) == 0 {
+		log.Printf("archive_data_after_days is set but archive_data_patterns is empty, no data files are archived")
+		return
+	}
+	go func() {
+		for {
+			if err := archiveOldDataFiles(); err != nil {
+				log.Printf("Data archiving failed: %v", err)
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+// archiveOldDataFiles moves top-level files in dataDir matching
+// ArchiveDataPatterns that haven't been modified for ArchiveDataAfterDays
+// into a dated ZIP archive.
+func archiveOldDataFiles() error {
+	cutoff := time.Now().AddDate(0, 0, -config.ArchiveDataAfterDays)
+	entries, err := os.ReadDir(config.DataDir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !archivable(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) || isServing(entry.Name()) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(archiveDir(), 0755); err != nil {
+		return err
+	}
+	base := "data_archive_" + time.Now().Format("20060102")
+	archivePath := filepath.Join(archiveDir(), base+".zip")
+	for i := 2; ; i++ {
+		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+			break
+		}
+		archivePath = filepath.Join(archiveDir(), fmt.Sprintf("%s_%d.zip", base, i))
+	}
+
+	staging := archivePath + ".tmp"
+	if err := writeZip(staging, config.DataDir, names); err != nil {
+		os.Remove(staging)
+		return err
+	}
+	if err := os.Rename(staging, archivePath); err != nil {
+		os.Remove(staging)
+		return err
+	}
+
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(config.DataDir, name)); err != nil {
+			log.Printf("Failed to remove archived file %s: %v", name, err)
+		}
+	}
+	log.Printf("Archived %d data files to %s", len(names), archivePath)
+	return nil
+}
+
+func writeZip(zipPath, dir string, names []string) error {
+	out, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, name := range names {
+		if err := addFileToZip(zw, filepath.Join(dir, name), name); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func addFileToZip(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func handleListArchives(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(archiveDir())
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to list archives", http.StatusInternalServerError)
+		return
+	}
+	archives := []map[string]interface{}{}
+	for _, entry := range entries {
+		if !archiveNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		archives = append(archives, map[string]interface{}{
+			"name":       entry.Name(),
+			"size_bytes": info.Size(),
+			"created_at": info.ModTime().UTC().Format(time.RFC3339),
+		})
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i]["name"].(string) < archives[j]["name"].(string)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archives)
+}
+
+func handleGetArchive(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !archiveNamePattern.MatchString(name) {
+		http.Error(w, "Archive not found", http.StatusNotFound)
+		return
+	}
+	audit(r, "archive_download", "", map[string]interface{}{"archive": name})
+	if info, err := os.Stat(filepath.Join(archiveDir(), name)); err == nil {
+		w.Header().Set("ETag", fileETag(info))
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	http.ServeFile(w, r, filepath.Join(archiveDir(), name))
+}
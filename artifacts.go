@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry of the files pipeline runs produce, so clients can verify
+// downloads and notice new releases. Runs report their outputs on the
+// status pipe; once a run succeeds each of them is hashed and described
+// in processing/artifacts.json.
+
+type artifactLayer struct {
+	Name     string `json:"name"`
+	Features int64  `json:"features"`
+}
+
+type artifact struct {
+	// Relative to the directory holding the processing directory
+	Path string `json:"path"`
+	// Where the file is served, for files in public_dir and data_dir
+	URL      string    `json:"url,omitempty"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Modified time.Time `json:"modified"`
+	// Layers of GeoPackages, features of GeoJSON files
+	Layers   []artifactLayer `json:"layers,omitempty"`
+	Features *int64          `json:"features,omitempty"`
+	// Run that last registered the file, and when and by which run its
+	// content last changed
+	RunID      string    `json:"run_id"`
+	Changed    time.Time `json:"changed"`
+	ChangedRun string    `json:"changed_run"`
+}
+
+type artifactRegistry struct {
+	Updated   time.Time  `json:"updated"`
+	Artifacts []artifact `json:"artifacts"`
+}
+
+var artifactsMutex sync.Mutex
+
+func artifactsPath() string {
+	return filepath.Join(config.ProcessingDir, "artifacts.json")
+}
+
+func loadArtifacts() (*artifactRegistry, error) {
+	reg := &artifactRegistry{Artifacts: []artifact{}}
+	data, err := os.ReadFile(artifactsPath())
+	if os.IsNotExist(err) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, reg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", artifactsPath(), err)
+	}
+	return reg, nil
+}
+
+// registerArtifacts describes outputs of run runID and records them in
+// the registry. Files that cannot be read are logged and left out.
+func registerArtifacts(runID string, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	artifactsMutex.Lock()
+	defer artifactsMutex.Unlock()
+	reg, err := loadArtifacts()
+	if err != nil {
+		log.Printf("Failed to load artifacts: %v", err)
+		return
+	}
+	index := make(map[string]int)
+	for i, a := range reg.Artifacts {
+		index[a.Path] = i
+	}
+
+	now := time.Now().UTC()
+	for _, p := range paths {
+		a, err := describeArtifact(p)
+		if err != nil {
+			log.Printf("Not registering artifact %s of run %s: %v", p, runID, err)
+			continue
+		}
+		a.RunID = runID
+		i, known := index[a.Path]
+		if known && reg.Artifacts[i].SHA256 == a.SHA256 {
+			a.Changed, a.ChangedRun = reg.Artifacts[i].Changed, reg.Artifacts[i].ChangedRun
+		} else {
+			a.Changed, a.ChangedRun = now, runID
+		}
+		if known {
+			reg.Artifacts[i] = *a
+		} else {
+			index[a.Path] = len(reg.Artifacts)
+			reg.Artifacts = append(reg.Artifacts, *a)
+		}
+	}
+	sort.Slice(reg.Artifacts, func(i, j int) bool { return reg.Artifacts[i].Path < reg.Artifacts[j].Path })
+	reg.Updated = now
+
+	data, err := json.MarshalIndent(reg, "", "  ")
+	if err == nil {
+		if err = os.WriteFile(artifactsPath()+".tmp", data, 0644); err == nil {
+			err = os.Rename(artifactsPath()+".tmp", artifactsPath())
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save artifacts: %v", err)
+	}
+}
+
+// describeArtifact hashes a reported output, given relative to the
+// processing directory, and reads its layers or features.
+func describeArtifact(reported string) (*artifact, error) {
+	processing, err := filepath.Abs(config.ProcessingDir)
+	if err != nil {
+		return nil, err
+	}
+	path := reported
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(processing, path)
+	}
+	base := filepath.Dir(processing)
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("outside of %s", base)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file")
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	a := &artifact{
+		Path:     filepath.ToSlash(rel),
+		URL:      artifactURL(path),
+		Size:     info.Size(),
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+		Modified: info.ModTime().UTC(),
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpkg":
+		if a.Layers, err = geoPackageLayers(path); err != nil {
+			return nil, fmt.Errorf("reading layers: %w", err)
+		}
+	case ".geojson":
+		var fc struct {
+			Features []json.RawMessage `json:"features"`
+		}
+		data, err := os.ReadFile(path)
+		if err == nil && json.Unmarshal(data, &fc) == nil && fc.Features != nil {
+			n := int64(len(fc.Features))
+			a.Features = &n
+		}
+	}
+	return a, nil
+}
+
+// artifactURL returns where a file is served, if it is.
+func artifactURL(path string) string {
+	for _, d := range []struct{ dir, prefix string }{
+		{config.PublicDir, "/"},
+		{config.DataDir, "/data/"},
+	} {
+		dir, err := filepath.Abs(d.dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return d.prefix + filepath.ToSlash(rel)
+		}
+	}
+	return ""
+}
+
+// geoPackageLayers lists the feature and attribute tables of a
+// GeoPackage with their row counts.
+func geoPackageLayers(path string) ([]artifactLayer, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT table_name FROM gpkg_contents ORDER BY table_name")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	layers := []artifactLayer{}
+	for _, name := range names {
+		var n int64
+		q := `SELECT COUNT(*) FROM "` + strings.ReplaceAll(name, `"`, `""`) + `"`
+		if err := db.QueryRow(q).Scan(&n); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		layers = append(layers, artifactLayer{Name: name, Features: n})
+	}
+	return layers, nil
+}
+
+// handleArtifacts lists the registered artifacts. The ETag changes with
+// every registration, so clients can poll cheaply for new releases.
+func handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	artifactsMutex.Lock()
+	reg, err := loadArtifacts()
+	artifactsMutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to load artifacts: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to load artifacts")
+		return
+	}
+	etag := fmt.Sprintf(`"%d"`, reg.Updated.UnixNano())
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reg)
+}
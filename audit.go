@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The audit log is append-only JSON lines in the processing directory,
+// one entry per login, export, pipeline or admin action.
+type auditEntry struct {
+	Time   time.Time              `json:"time"`
+	Action string                 `json:"action"`
+	User   string                 `json:"user,omitempty"`
+	APIKey string                 `json:"api_key,omitempty"`
+	IP     string                 `json:"ip,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+const (
+	auditDefaultPageSize = 50
+	auditMaxPageSize     = 500
+)
+
+var auditLogMutex sync.Mutex
+
+func auditLogPath() string {
+	return filepath.Join(config.ProcessingDir, "audit.log")
+}
+
+// audit records an action taken by the caller of r. username is used
+// when the request doesn't carry credentials yet (logins).
+func audit(r *http.Request, action, username string, params map[string]interface{}) {
+	entry := auditEntry{Action: action, User: username, IP: clientIP(r).String(), Params: params}
+	if p, ok := authenticate(r); ok {
+		entry.User = p.User.Username
+		if p.APIKey != nil {
+			entry.APIKey = p.APIKey.ID
+		}
+	}
+	appendAuditLog(entry)
+}
+
+// appendAuditLog writes one JSON line to the audit log.
+func appendAuditLog(entry auditEntry) {
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+	f, err := os.OpenFile(auditLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// handleAuditLog returns audit entries newest first, optionally filtered
+// by ?user= and ?action=, in pages of ?per_page= entries.
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	page, perPage, ok := pageParams(w, r, auditDefaultPageSize, auditMaxPageSize)
+	if !ok {
+		return
+	}
+	user, action := r.URL.Query().Get("user"), r.URL.Query().Get("action")
+
+	var matched []json.RawMessage
+	auditLogMutex.Lock()
+	f, err := os.Open(auditLogPath())
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry auditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			if (user != "" && entry.User != user) || (action != "" && entry.Action != action) {
+				continue
+			}
+			matched = append(matched, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+		}
+		err = scanner.Err()
+		f.Close()
+	}
+	auditLogMutex.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to read audit log: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read audit log")
+		return
+	}
+
+	total := len(matched)
+	entries := []json.RawMessage{}
+	for i := total - 1 - (page-1)*perPage; i >= 0 && len(entries) < perPage; i-- {
+		entries = append(entries, matched[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":  entries,
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+// pageParams reads ?page= (default 1) and ?per_page=, replying 400 when
+// either is out of range.
+func pageParams(w http.ResponseWriter, r *http.Request, defaultSize, maxSize int) (page, perPage int, ok bool) {
+	q := r.URL.Query()
+	page, err := strconv.Atoi(q.Get("page"))
+	if q.Get("page") == "" {
+		page, err = 1, nil
+	}
+	if err != nil || page < 1 {
+		writeJSONError(w, http.StatusBadRequest, "page must be a positive number")
+		return 0, 0, false
+	}
+	perPage, err = strconv.Atoi(q.Get("per_page"))
+	if q.Get("per_page") == "" {
+		perPage, err = defaultSize, nil
+	}
+	if err != nil || perPage < 1 || perPage > maxSize {
+		writeJSONError(w, http.StatusBadRequest, "per_page must be between 1 and "+strconv.Itoa(maxSize))
+		return 0, 0, false
+	}
+	return page, perPage, true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// principal is whoever a request acts on behalf of: a logged-in user, or
+// the owner of the API key it presented.
+type principal struct {
+	User   User
+	APIKey *APIKey
+}
+
+// can reports whether the principal may use routes requiring scope.
+// Session users hold every scope their role allows; pipeline control is
+// for admins, and for API keys an admin granted it. Accounts and keys
+// with a data scope never control the pipeline.
+func (p principal) can(scope string) bool {
+	if scope == scopeAdmin && p.User.Role != roleAdmin {
+		return false
+	}
+	if scope == scopePipeline && len(p.dataScopes()) > 0 {
+		return false
+	}
+	if p.APIKey != nil {
+		return p.APIKey.hasScope(scope)
+	}
+	return scope != scopePipeline || p.User.Role == roleAdmin
+}
+
+// authenticate identifies the caller from a bearer API key, Basic
+// credentials (API, data and OGC API routes only) or the session
+// cookie. Explicit credentials that don't check out are a failure, even
+// if a session cookie is present.
+func authenticate(r *http.Request) (principal, bool) {
+	if key, ok := bearerToken(r); ok {
+		k, ok := apiKeys.Lookup(key)
+		if !ok {
+			return principal{}, false
+		}
+		user, ok := users.Get(k.Username)
+		if !ok {
+			return principal{}, false
+		}
+		return principal{User: user, APIKey: &k}, true
+	}
+	if username, password, ok := r.BasicAuth(); ok && basicAuthPath(r.URL.Path) {
+		return basicAuthPrincipal(r, username, password)
+	}
+	user, ok := sessionUser(r)
+	return principal{User: user}, ok
+}
+
+// scopeForPath maps a route to the API key scope it requires.
+func scopeForPath(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/admin/"), strings.HasPrefix(path, "/api/metrics/"):
+		return scopeAdmin
+	case strings.HasPrefix(path, "/api/export"):
+		return scopeExport
+	case strings.HasPrefix(path, "/api/pipeline"), path == "/api/start-pipeline", path == "/api/cancel-pipeline", path == "/api/status", path == "/ws/pipeline", path == "/api/schedule", strings.HasPrefix(path, "/api/runs"), strings.HasPrefix(path, "/api/jobs"):
+		return scopePipeline
+	default:
+		return scopeData
+	}
+}
+
+const (
+	accessPublic = "public"
+	accessLogin  = "login"
+)
+
+// RoutePolicy declares whether a path needs a login. Path matches exactly,
+// or as a prefix when it ends in "*" ("/data/*").
+type RoutePolicy struct {
+	Path   string `json:"path"`
+	Access string `json:"access"`
+}
+
+// Reachable without a login whatever the configuration says
+var builtinPublicPaths = []RoutePolicy{
+	{Path: "/login", Access: accessPublic},
+	{Path: "/login/totp", Access: accessPublic},
+	{Path: "/login/oidc*", Access: accessPublic},
+	{Path: "/logout", Access: accessPublic},
+	{Path: "/invite/*", Access: accessPublic},
+}
+
+func (p RoutePolicy) matches(path string) bool {
+	if prefix, ok := strings.CutSuffix(p.Path, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == p.Path
+}
+
+// routeAccess returns the access policy for a path. The most specific
+// (longest) matching policy wins; without a match require_login decides.
+func routeAccess(path string) string {
+	for _, p := range builtinPublicPaths {
+		if p.matches(path) {
+			return accessPublic
+		}
+	}
+
+	best, bestLen := "", -1
+	consider := func(p RoutePolicy) {
+		if p.matches(path) && len(p.Path) > bestLen {
+			best, bestLen = p.Access, len(p.Path)
+		}
+	}
+	for _, prefix := range config.PublicPaths {
+		consider(RoutePolicy{Path: prefix + "*", Access: accessPublic})
+	}
+	for _, p := range config.RoutePolicies {
+		consider(p)
+	}
+	if best != "" {
+		return best
+	}
+	if config.RequireLogin {
+		return accessLogin
+	}
+	return accessPublic
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxBackups = 5
+
+func backupDir() string {
+	return filepath.Join(config.ProcessingDir, "backups")
+}
+
+// copyFile copies src to dst through a staging file in the destination
+// directory, so dst never exists half-written.
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	staging := dst + ".tmp"
+	out, err := os.Create(staging)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(staging)
+		return 0, err
+	}
+	if err := os.Rename(staging, dst); err != nil {
+		os.Remove(staging)
+		return 0, err
+	}
+	return n, nil
+}
+
+// listBackups returns the GeoPackage backups, oldest first.
+func listBackups() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(backupDir(), "holzeinschlag_austria_*.gpkg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func backupTimestamp(backupPath string) string {
+	name := strings.TrimSuffix(filepath.Base(backupPath), ".gpkg")
+	return strings.TrimPrefix(name, "holzeinschlag_austria_")
+}
+
+func isPipelineRunning() bool {
+	return jobs.isRunning("pipeline") || lockedElsewhere()
+}
+
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if isPipelineRunning() {
+		writeJSONError(w, http.StatusConflict, "pipeline is running")
+		return
+	}
+	result, err := createBackup()
+	if err != nil {
+		log.Printf("GeoPackage backup failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to back up GeoPackage")
+		return
+	}
+	audit(r, "backup", "", map[string]interface{}{"backup": filepath.Base(result.BackupPath)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Serializes backups, so two taken in the same second get different names
+var backupMutex sync.Mutex
+
+// backupStamp names a backup taken at t after its time, adding a counter
+// when one was already taken in the same second. The counter is two
+// digits wide so the names still sort oldest first.
+func backupStamp(t time.Time) string {
+	base := t.Format("20060102_150405")
+	stamp := base
+	for n := 2; ; n++ {
+		name := fmt.Sprintf("holzeinschlag_austria_%s.gpkg", stamp)
+		if _, err := os.Stat(filepath.Join(backupDir(), name)); err != nil {
+			return stamp
+		}
+		stamp = fmt.Sprintf("%s_%02d", base, n)
+	}
+}
+
+type backupResult struct {
+	BackupPath  string `json:"backup_path"`
+	SizeBytes   int64  `json:"size_bytes"`
+	BackupCount int    `json:"backup_count"`
+}
+
+// createBackup copies the GeoPackage and status.json into the backup
+// directory, keeping the newest maxBackups.
+func createBackup() (*backupResult, error) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+	if err := os.MkdirAll(backupDir(), 0755); err != nil {
+		return nil, err
+	}
+
+	stamp := backupStamp(time.Now())
+	backupPath := filepath.Join(backupDir(), fmt.Sprintf("holzeinschlag_austria_%s.gpkg", stamp))
+	size, err := copyFile(geoPackagePath(), backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	statusFile := filepath.Join(config.ProcessingDir, "status.json")
+	if _, err := os.Stat(statusFile); err == nil {
+		statusBackup := filepath.Join(backupDir(), fmt.Sprintf("status_%s.json", stamp))
+		if _, err := copyFile(statusFile, statusBackup); err != nil {
+			log.Printf("status.json backup failed: %v", err)
+		}
+	}
+
+	backups, err := listBackups()
+	if err != nil {
+		log.Printf("Failed to list backups: %v", err)
+	}
+	for len(backups) > maxBackups {
+		oldest := backups[0]
+		backups = backups[1:]
+		os.Remove(oldest)
+		os.Remove(filepath.Join(backupDir(), fmt.Sprintf("status_%s.json", backupTimestamp(oldest))))
+		log.Printf("Removed old backup %s", filepath.Base(oldest))
+	}
+
+	log.Printf("Created backup %s (%d bytes)", backupPath, size)
+	return &backupResult{BackupPath: backupPath, SizeBytes: size, BackupCount: len(backups)}, nil
+}
+
+var backupNamePattern = regexp.MustCompile(`^holzeinschlag_austria_\d{8}_\d{6}(_\d{2,})?\.gpkg$`)
+
+// invalidateCaches drops everything derived from the published GeoPackage.
+func invalidateCaches() {
+	if err := reloadDB(); err != nil {
+		log.Printf("Failed to reopen GeoPackage: %v", err)
+	}
+	clearExportCache()
+	// Build the summary now rather than on the first request
+	go func() {
+		if _, err := nationalSummary(); err != nil {
+			log.Printf("Building summary failed: %v", err)
+		}
+	}()
+}
+
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Backup string `json:"backup"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if !backupNamePattern.MatchString(req.Backup) {
+		writeJSONError(w, http.StatusBadRequest, "invalid backup name")
+		return
+	}
+	if isPipelineRunning() {
+		writeJSONError(w, http.StatusConflict, "pipeline is running")
+		return
+	}
+
+	backupPath := filepath.Join(backupDir(), req.Backup)
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "backup not found")
+		return
+	}
+
+	// Stage next to the live file so the final rename is atomic
+	if _, err := copyFile(backupPath, geoPackagePath()); err != nil {
+		log.Printf("Restore of %s failed: %v", req.Backup, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to restore backup")
+		return
+	}
+	invalidateCaches()
+
+	log.Printf("Restored GeoPackage from %s", req.Backup)
+	audit(r, "restore", "", map[string]interface{}{"backup": req.Backup})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backup":      req.Backup,
+		"size_bytes":  info.Size(),
+		"created_at":  info.ModTime().UTC().Format(time.RFC3339),
+		"restored_at": time.Now().UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP Basic credentials are accepted on API, data and OGC API routes
+// for desktop GIS clients that can't do the cookie login. The password
+// may be the account password or one of the user's API keys. Accounts
+// with two-factor login must use an API key.
+
+const basicAuthRealm = `Basic realm="Holzeinschlag Österreich", charset="UTF-8"`
+
+// Clients send the credentials with every request; checked ones are
+// remembered for a while to avoid a password hash per request, and
+// rejected ones briefly so a single bad request isn't counted as several
+// failed logins.
+const (
+	basicAuthCacheTTL    = 5 * time.Minute
+	basicAuthNegativeTTL = 10 * time.Second
+)
+
+type basicAuthResult struct {
+	ok bool
+	// The user as checked; for local users a changed password hash
+	// invalidates the entry
+	user    User
+	expires time.Time
+}
+
+var (
+	basicAuthCache      = make(map[[32]byte]basicAuthResult)
+	basicAuthCacheMutex sync.Mutex
+)
+
+func basicAuthPath(path string) bool {
+	return strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/data/") ||
+		path == "/ogc" || strings.HasPrefix(path, "/ogc/")
+}
+
+// wantsBasicChallenge reports whether an unauthenticated request should
+// get a WWW-Authenticate challenge rather than the login redirect.
+// Browsers (which send Sec-Fetch-Mode) would pop up a password dialog
+// for their own API calls, so only other clients are challenged.
+func wantsBasicChallenge(r *http.Request) bool {
+	if !basicAuthPath(r.URL.Path) {
+		return false
+	}
+	if _, _, ok := r.BasicAuth(); ok {
+		return true
+	}
+	return r.Header.Get("Sec-Fetch-Mode") == "" && !strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func basicAuthPrincipal(r *http.Request, username, password string) (principal, bool) {
+	if strings.HasPrefix(password, apiKeyPrefix) {
+		k, ok := apiKeys.Lookup(password)
+		if !ok || k.Username != username {
+			return principal{}, false
+		}
+		user, ok := users.Get(k.Username)
+		if !ok {
+			return principal{}, false
+		}
+		return principal{User: user, APIKey: &k}, true
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+	basicAuthCacheMutex.Lock()
+	cached, hit := basicAuthCache[key]
+	basicAuthCacheMutex.Unlock()
+	if hit && now.Before(cached.expires) {
+		if !cached.ok {
+			return principal{}, false
+		}
+		if cached.user.Provider != "" {
+			return principal{User: cached.user}, true
+		}
+		user, ok := users.Get(username)
+		if ok && user.PasswordHash == cached.user.PasswordHash {
+			return principal{User: user}, user.TOTPSecret == ""
+		}
+	}
+
+	limitKeys := loginLimitKeys(r)
+	if loginAllowedIn(limitKeys) > 0 {
+		return principal{}, false
+	}
+	user, ok := authenticatePassword(username, password)
+	if ok && user.TOTPSecret != "" {
+		ok = false
+	}
+	result := basicAuthResult{ok: ok, user: user, expires: now.Add(basicAuthCacheTTL)}
+	if ok {
+		resetLoginFailures(limitKeys)
+	} else {
+		result.expires = now.Add(basicAuthNegativeTTL)
+		recordLoginFailure(r, limitKeys, username)
+	}
+
+	basicAuthCacheMutex.Lock()
+	for k, v := range basicAuthCache {
+		if now.After(v.expires) {
+			delete(basicAuthCache, k)
+		}
+	}
+	basicAuthCache[key] = result
+	basicAuthCacheMutex.Unlock()
+	return principal{User: user}, ok
+}
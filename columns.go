@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+type columnLabel struct {
+	De   string
+	En   string
+	Unit string
+}
+
+// Labels for the per-Gemeinde attributes
+var baseColumnLabels = map[string]columnLabel{
+	"fid":        {"Objekt-ID", "Feature ID", ""},
+	"geom":       {"Geometrie", "Geometry", ""},
+	"name":       {"Gemeinde", "Municipality", ""},
+	"iso":        {"Gemeindekennziffer", "Municipality code", ""},
+	"state":      {"Bundesland", "State", ""},
+	"population": {"Einwohner", "Population", ""},
+}
+
+// Labels for the yearly indicators, stored as <indicator>_<year> columns
+var indicatorLabels = map[string]columnLabel{
+	"loss_pixels":    {"Verlustpixel", "Loss pixels", "px"},
+	"loss_area_ha":   {"Verlustfläche", "Forest loss area", "ha"},
+	"harvest_efm":    {"Geschätzter Einschlag", "Estimated harvest", "Efm"},
+	"value_eur":      {"Holzwert", "Timber value", "EUR"},
+	"co2_tonnes":     {"CO₂-Emissionen", "CO₂ emissions", "t"},
+	"ets_eur":        {"ETS-Haftung", "ETS liability", "EUR"},
+	"ets_per_capita": {"ETS pro Einwohner", "ETS per capita", "EUR"},
+}
+
+// The yearly indicators in column order
+var indicators = []string{"loss_pixels", "loss_area_ha", "harvest_efm", "value_eur", "co2_tonnes", "ets_eur", "ets_per_capita"}
+
+var yearColumnPattern = regexp.MustCompile(`^(.+)_(\d{4})$`)
+
+// datasetYears returns the years the GeoPackage has every indicator for,
+// in order.
+func datasetYears() ([]string, error) {
+	rows, err := gpkgDB().Query("SELECT name FROM pragma_table_info('gemeinden')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	count := make(map[string]int)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if m := yearColumnPattern.FindStringSubmatch(name); m != nil && slices.Contains(indicators, m[1]) {
+			count[m[2]]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var years []string
+	for year, n := range count {
+		if n == len(indicators) {
+			years = append(years, year)
+		}
+	}
+	slices.Sort(years)
+	return years, nil
+}
+
+type columnInfo struct {
+	Name    string `json:"name"`
+	LabelDE string `json:"label_de"`
+	LabelEN string `json:"label_en"`
+	Type    string `json:"type"`
+	Unit    string `json:"unit,omitempty"`
+}
+
+func describeColumn(name, colType string) columnInfo {
+	info := columnInfo{Name: name, LabelDE: name, LabelEN: name, Type: colType}
+	if label, ok := baseColumnLabels[name]; ok {
+		info.LabelDE, info.LabelEN, info.Unit = label.De, label.En, label.Unit
+		return info
+	}
+	if m := yearColumnPattern.FindStringSubmatch(name); m != nil {
+		if label, ok := indicatorLabels[m[1]]; ok {
+			info.LabelDE = fmt.Sprintf("%s %s", label.De, m[2])
+			info.LabelEN = fmt.Sprintf("%s %s", label.En, m[2])
+			if label.Unit != "" {
+				info.LabelDE += " (" + label.Unit + ")"
+				info.LabelEN += " (" + label.Unit + ")"
+			}
+			info.Unit = label.Unit
+		}
+	}
+	return info
+}
+
+func handleExportColumns(w http.ResponseWriter, r *http.Request) {
+	rows, err := gpkgDB().Query("SELECT name, type FROM pragma_table_info('gemeinden') ORDER BY cid")
+	if err != nil {
+		log.Printf("Failed to read columns: %v", err)
+		http.Error(w, "Failed to read columns", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	columns := []columnInfo{}
+	for rows.Next() {
+		var name, colType string
+		if err := rows.Scan(&name, &colType); err != nil {
+			log.Printf("Failed to read columns: %v", err)
+			http.Error(w, "Failed to read columns", http.StatusInternalServerError)
+			return
+		}
+		columns = append(columns, describeColumn(name, colType))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(columns)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Config holds deployment-specific settings. It is read once at startup
+// from the JSON file named by HOLZEINSCHLAG_CONFIG (default: config.json);
+// a missing file means all defaults.
+type Config struct {
+	// Static frontend and the published GeoPackage
+	PublicDir string `json:"public_dir"`
+	// JSON data files served under /data/
+	DataDir string `json:"data_dir"`
+	// Pipeline scripts, status and logs
+	ProcessingDir string `json:"processing_dir"`
+
+	// GDAL support files directory, exported to ogr2ogr as GDAL_DATA
+	GDALDataPath string `json:"gdal_data_path"`
+	// PROJ database directory, exported to ogr2ogr as PROJ_LIB
+	ProjLib string `json:"proj_lib"`
+
+	// JSON file with the user accounts; it is not in the repository and
+	// must exist at startup
+	UsersFile string `json:"users_file"`
+	// JSON file where API keys are stored (hashed)
+	APIKeysFile string `json:"api_keys_file"`
+	// Key for signing invitation links; without it links are only valid
+	// until the server restarts
+	InvitationSecret string `json:"invitation_secret"`
+	// Failed logins (per client IP or session cookie) before a lockout,
+	// and how long the lockout lasts
+	LoginMaxFailures    int `json:"login_max_failures"`
+	LoginLockoutMinutes int `json:"login_lockout_minutes"`
+
+	// OpenID Connect single sign-on, enabled when the issuer is set
+	OIDCIssuerURL    string `json:"oidc_issuer_url"`
+	OIDCClientID     string `json:"oidc_client_id"`
+	OIDCClientSecret string `json:"oidc_client_secret"`
+	// Must point at /login/oidc/callback on this server
+	OIDCRedirectURL string `json:"oidc_redirect_url"`
+	// ID token claim used as the username
+	OIDCUsernameClaim string `json:"oidc_username_claim"`
+	// ID token claim holding roles or groups, and how its values map to
+	// local roles
+	OIDCRoleClaim   string            `json:"oidc_role_claim"`
+	OIDCRoleMapping map[string]string `json:"oidc_role_mapping"`
+	// Role for users without a mapped claim value; empty denies them
+	OIDCDefaultRole string `json:"oidc_default_role"`
+
+	// Sessions end after this many minutes without a request, and at the
+	// latest this many hours after login
+	SessionIdleMinutes int `json:"session_idle_minutes"`
+	SessionMaxHours    int `json:"session_max_hours"`
+	// Lifetime of "remember me" sessions, which have no shorter idle timeout
+	SessionRememberDays int `json:"session_remember_days"`
+
+	// Mail server for notifications; From is the sender address. Without
+	// a host no mail is sent.
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     int    `json:"smtp_port"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+	SMTPFrom     string `json:"smtp_from"`
+
+	// LDAP / Active Directory login for users not in the users file,
+	// enabled when the URL (ldap:// or ldaps://) is set
+	LDAPURL                string `json:"ldap_url"`
+	LDAPStartTLS           bool   `json:"ldap_start_tls"`
+	LDAPInsecureSkipVerify bool   `json:"ldap_insecure_skip_verify"`
+	// Service account for looking up users; without it users bind as the
+	// DN from the template, e.g. "%s@agency.local" or
+	// "uid=%s,ou=people,dc=agency,dc=at"
+	LDAPBindDN         string `json:"ldap_bind_dn"`
+	LDAPBindPassword   string `json:"ldap_bind_password"`
+	LDAPUserDNTemplate string `json:"ldap_user_dn_template"`
+	// Where and how user entries are searched; %s is the username
+	LDAPBaseDN     string `json:"ldap_base_dn"`
+	LDAPUserFilter string `json:"ldap_user_filter"`
+	// Attribute listing the user's groups, and how group DNs or CNs map to
+	// local roles
+	LDAPGroupAttribute string            `json:"ldap_group_attribute"`
+	LDAPRoleMapping    map[string]string `json:"ldap_role_mapping"`
+	// Role for users without a mapped group; empty denies them
+	LDAPDefaultRole string `json:"ldap_default_role"`
+
+	// Access policy for paths no route policy matches: login is required
+	// when set, everything is public otherwise
+	RequireLogin bool `json:"require_login"`
+	// Per-path access ("public" or "login"); see routeAccess
+	RoutePolicies []RoutePolicy `json:"route_policies"`
+	// Path prefixes that stay public; shorthand for public route policies
+	// ending in "*"
+	PublicPaths []string `json:"public_paths"`
+	// Session cookie SameSite policy ("Lax", "Strict", "None"); empty picks
+	// None behind HTTPS and Lax otherwise
+	CookieSameSite string `json:"cookie_samesite"`
+	// Reverse proxy addresses (IPs or CIDR ranges) whose headers are trusted
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Extra TLS-termination headers and the values that mean HTTPS, e.g.
+	// {"X-Forwarded-SSL": "on"}; only honored from trusted proxies
+	TrustedSSLHeaders map[string]string `json:"trusted_ssl_headers"`
+	// Client address restrictions per route group, e.g. pipeline routes
+	// only from partner networks; the first rule matching a path applies
+	IPRules []IPRule `json:"ip_rules"`
+	// X-Frame-Options header value ("DENY", "SAMEORIGIN"); empty omits it
+	XFrameOptions string `json:"x_frame_options"`
+
+	// Move data files untouched for this many days into ZIP archives;
+	// 0 disables archiving
+	ArchiveDataAfterDays int `json:"archive_data_after_days"`
+	// Name patterns (path.Match syntax, e.g. "report_*.json") of the data
+	// files that may be archived; nothing else is
+	ArchiveDataPatterns []string `json:"archive_data_patterns"`
+
+	// Upper bound for POST/PUT request bodies
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes"`
+	// Upper bound for files sent to POST /api/upload
+	MaxUploadBytes int64 `json:"max_upload_bytes"`
+
+	// Output size relative to the raw selection size, per export format,
+	// used by the size estimate endpoints
+	ExportSizeRatios map[string]float64 `json:"export_size_ratios"`
+	// Raw selection bytes an export gets through per second, and the
+	// estimated duration above which an export job is recommended
+	ExportBytesPerSecond int64 `json:"export_bytes_per_second"`
+	ExportAsyncSeconds   int   `json:"export_async_seconds"`
+	// Total size of cached exports; 0 turns the cache off
+	ExportCacheMaxBytes int64 `json:"export_cache_max_bytes"`
+	// Hours the files of export jobs can be downloaded
+	ExportJobHours int `json:"export_job_hours"`
+	// Exports generated at the same time, and requests that may wait for
+	// one of them before being turned away
+	ExportWorkers   int `json:"export_workers"`
+	ExportQueueSize int `json:"export_queue_size"`
+	// Key for signing export download links; without it links are only
+	// valid until the server restarts
+	DownloadSecret string `json:"download_secret"`
+	// Exports per hour and bytes per day for each client, and other
+	// limits for some clients ("user:<name>", "key:<id>", "ip:<addr>")
+	ExportQuota          exportQuota            `json:"export_quota"`
+	ExportQuotaOverrides map[string]exportQuota `json:"export_quota_overrides"`
+	// License stated in export manifests
+	ExportLicense string `json:"export_license"`
+
+	// Pipeline scripts by name, relative to the processing directory, or
+	// "builtin:hansen" for the Go pipeline engine
+	Pipelines map[string]string `json:"pipelines"`
+	// Number of recent pipeline log lines kept in memory for clients that
+	// start following the log mid-run
+	PipelineLogBufferLines int `json:"pipeline_log_buffer_lines"`
+	// Validation script run before each pipeline start; the run is
+	// refused unless it exits 0
+	PipelinePreFlight string `json:"pipeline_preflight"`
+	// Keep validated outputs of pipeline runs staged until they are
+	// published through POST /api/publish, instead of publishing them
+	// right after the run
+	PipelineManualPublish bool `json:"pipeline_manual_publish"`
+	// Hook script run after a successful pipeline run, with PIPELINE_NAME
+	// and PIPELINE_EXIT_CODE in its environment
+	PipelinePostFlight string `json:"pipeline_postflight"`
+	// Minutes a pipeline run may take before it is stopped, retries
+	// included; 0 for no limit. Runs can ask for a different limit.
+	PipelineTimeoutMinutes int `json:"pipeline_timeout_minutes"`
+	// Notified when pipeline runs start, succeed or fail
+	PipelineWebhooks []PipelineWebhook `json:"pipeline_webhooks"`
+	// Mailed a summary of every failed pipeline run, at most
+	// pipeline_failure_mails_per_hour times an hour
+	PipelineFailureMailTo       []string `json:"pipeline_failure_mail_to"`
+	PipelineFailureMailsPerHour int      `json:"pipeline_failure_mails_per_hour"`
+	// Stages of built-in pipelines run at the same time at most
+	PipelineWorkers int `json:"pipeline_workers"`
+	// Priority of pipeline processes: nice level 0-19, I/O class
+	// "best-effort" (with level 0-7) or "idle", and the threads GDAL and
+	// numpy may use; 0 and empty leave them alone
+	PipelineNice    int    `json:"pipeline_nice"`
+	PipelineIOClass string `json:"pipeline_io_class"`
+	PipelineIOLevel int    `json:"pipeline_io_level"`
+	PipelineThreads int    `json:"pipeline_threads"`
+	// cgroup v2 directory pipeline processes are started in, set up with
+	// the CPU and memory limits they should get (Linux only)
+	PipelineCgroup string `json:"pipeline_cgroup"`
+	// Answer GeoPackage exports with 503 while a pipeline runs
+	PauseExportsDuringPipeline bool `json:"pause_exports_during_pipeline"`
+	// Seconds without a heartbeat after which the pipeline lock of another
+	// instance is considered stale and taken over
+	PipelineLockStaleSeconds int `json:"pipeline_lock_stale_seconds"`
+	// Retrying failed pipeline runs
+	PipelineRetry RetryPolicy `json:"pipeline_retry"`
+	// Number of past runs kept in processing/runs; 0 keeps all
+	PipelineRunHistory int `json:"pipeline_run_history"`
+	// Jobs of each type running at once, default 1; pipeline runs and
+	// backups are never run in parallel
+	JobConcurrency map[string]int `json:"job_concurrency"`
+	// Checking for new releases of the Hansen data. Runs it starts get
+	// the release as their release parameter, PIPELINE_RELEASE for
+	// scripts.
+	UpstreamWatch UpstreamWatch `json:"upstream_watch"`
+	// Pipeline runs started by the built-in scheduler; replaced at runtime
+	// through PUT /api/schedule
+	Schedules []Schedule `json:"schedules"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		PublicDir:                   "public",
+		DataDir:                     "data",
+		ProcessingDir:               "processing",
+		UsersFile:                   "users.json",
+		APIKeysFile:                 "api_keys.json",
+		LoginMaxFailures:            10,
+		LoginLockoutMinutes:         15,
+		SessionIdleMinutes:          120,
+		SessionMaxHours:             24,
+		SessionRememberDays:         30,
+		OIDCUsernameClaim:           "preferred_username",
+		OIDCRoleClaim:               "groups",
+		SMTPPort:                    587,
+		LDAPUserFilter:              "(sAMAccountName=%s)",
+		LDAPGroupAttribute:          "memberOf",
+		XFrameOptions:               "DENY",
+		MaxRequestBodyBytes:         1 << 20,
+		MaxUploadBytes:              256 << 20,
+		ExportCacheMaxBytes:         2 << 30,
+		ExportJobHours:              24,
+		ExportWorkers:               2,
+		ExportQueueSize:             10,
+		ExportBytesPerSecond:        20 << 20,
+		ExportAsyncSeconds:          30,
+		ExportQuota:                 exportQuota{PerHour: 60, BytesPerDay: 20 << 30},
+		ExportLicense:               "CC BY 4.0, https://creativecommons.org/licenses/by/4.0/. Please cite the sources listed.",
+		Pipelines:                   map[string]string{"default": "run_pipeline.sh"},
+		PipelineLogBufferLines:      200,
+		PipelineRunHistory:          200,
+		PipelineWorkers:             2,
+		PipelineLockStaleSeconds:    120,
+		PipelineFailureMailsPerHour: 4,
+		PipelineRetry: RetryPolicy{
+			MaxAttempts:         1,
+			InitialDelaySeconds: 60,
+			MaxDelaySeconds:     1800,
+			Multiplier:          2,
+			OnlyFailedStage:     true,
+		},
+		// Measured against the full 2001-2024 national export
+		ExportSizeRatios: map[string]float64{
+			"gpkg":    0.8,
+			"geojson": 3.0,
+			"shp_zip": 0.5,
+			"csv":     1.6,
+			"fgb":     1.0,
+			// Scaled from their size relative to CSV
+			"json": 7.7,
+			"xlsx": 3.7,
+		},
+	}
+}
+
+func (c Config) validate() error {
+	switch c.CookieSameSite {
+	case "", "Lax", "Strict", "None":
+	default:
+		return fmt.Errorf("cookie_samesite must be Lax, Strict or None, got %q", c.CookieSameSite)
+	}
+	if c.OIDCIssuerURL != "" && (c.OIDCClientID == "" || c.OIDCRedirectURL == "") {
+		return errors.New("oidc_issuer_url requires oidc_client_id and oidc_redirect_url")
+	}
+	if c.LDAPURL != "" {
+		if c.LDAPBaseDN == "" {
+			return errors.New("ldap_url requires ldap_base_dn")
+		}
+		if c.LDAPBindDN == "" && c.LDAPUserDNTemplate == "" {
+			return errors.New("ldap_url requires ldap_bind_dn or ldap_user_dn_template")
+		}
+	}
+	switch c.OIDCDefaultRole {
+	case "", roleAdmin, roleUser:
+	default:
+		return fmt.Errorf("oidc_default_role must be admin, user or empty, got %q", c.OIDCDefaultRole)
+	}
+	switch c.LDAPDefaultRole {
+	case "", roleAdmin, roleUser:
+	default:
+		return fmt.Errorf("ldap_default_role must be admin, user or empty, got %q", c.LDAPDefaultRole)
+	}
+	if c.SessionIdleMinutes <= 0 || c.SessionMaxHours <= 0 || c.SessionRememberDays <= 0 {
+		return errors.New("session_idle_minutes, session_max_hours and session_remember_days must be positive")
+	}
+	for _, pattern := range c.ArchiveDataPatterns {
+		if _, err := path.Match(pattern, ""); err != nil || strings.Contains(pattern, "/") {
+			return fmt.Errorf("archive_data_patterns: invalid pattern %q", pattern)
+		}
+	}
+	if c.ExportJobHours <= 0 {
+		return errors.New("export_job_hours must be positive")
+	}
+	for client, q := range c.ExportQuotaOverrides {
+		if q.PerHour < 0 || q.BytesPerDay < 0 {
+			return fmt.Errorf("export_quota_overrides: limits for %q must not be negative", client)
+		}
+	}
+	if c.ExportQuota.PerHour < 0 || c.ExportQuota.BytesPerDay < 0 {
+		return errors.New("export_quota limits must not be negative")
+	}
+	if c.ExportBytesPerSecond <= 0 || c.ExportAsyncSeconds < 0 {
+		return errors.New("export_bytes_per_second must be positive and export_async_seconds not negative")
+	}
+	if c.ExportWorkers <= 0 || c.ExportQueueSize < 0 {
+		return errors.New("export_workers must be positive and export_queue_size not negative")
+	}
+	for _, p := range c.RoutePolicies {
+		if !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("route_policies: path %q must start with /", p.Path)
+		}
+		if p.Access != accessPublic && p.Access != accessLogin {
+			return fmt.Errorf("route_policies: access for %q must be public or login, got %q", p.Path, p.Access)
+		}
+	}
+	for name, script := range c.Pipelines {
+		if strings.HasPrefix(script, builtinPipelinePrefix) {
+			p, ok := builtinPipeline(script)
+			if !ok {
+				return fmt.Errorf("pipelines: %q names an unknown built-in pipeline %q", name, script)
+			}
+			if _, err := p.Order(); err != nil {
+				return err
+			}
+		}
+	}
+	if c.PipelineTimeoutMinutes < 0 {
+		return errors.New("pipeline_timeout_minutes must not be negative")
+	}
+	if len(c.PipelineFailureMailTo) > 0 && (c.SMTPHost == "" || c.SMTPFrom == "") {
+		return errors.New("pipeline_failure_mail_to requires smtp_host and smtp_from")
+	}
+	if c.PipelineFailureMailsPerHour < 0 {
+		return errors.New("pipeline_failure_mails_per_hour must not be negative")
+	}
+	for _, h := range c.PipelineWebhooks {
+		if err := h.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateThrottle(c); err != nil {
+		return err
+	}
+	if c.PipelineWorkers < 1 {
+		return errors.New("pipeline_workers must be at least 1")
+	}
+	if c.PipelineLockStaleSeconds < 30 {
+		return errors.New("pipeline_lock_stale_seconds must be at least 30")
+	}
+	if err := c.PipelineRetry.validate(); err != nil {
+		return err
+	}
+	if err := validateSchedules(c.Schedules, c.Pipelines); err != nil {
+		return err
+	}
+	if err := c.UpstreamWatch.validate(c.Pipelines); err != nil {
+		return err
+	}
+	switch c.XFrameOptions {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		return fmt.Errorf("x_frame_options must be DENY, SAMEORIGIN or empty, got %q", c.XFrameOptions)
+	}
+	return nil
+}
+
+func (c Config) rememberDuration() time.Duration {
+	return time.Duration(c.SessionRememberDays) * 24 * time.Hour
+}
+
+func configPath() string {
+	if p := os.Getenv("HOLZEINSCHLAG_CONFIG"); p != "" {
+		return p
+	}
+	return "config.json"
+}
+
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, cfg.validate()
+}
+
+// validateDirectories checks that every working directory exists and is
+// writable, reporting all problems at once.
+func validateDirectories(cfg Config) error {
+	var errs []error
+	for _, dir := range []struct{ key, path string }{
+		{"public_dir", cfg.PublicDir},
+		{"data_dir", cfg.DataDir},
+		{"processing_dir", cfg.ProcessingDir},
+	} {
+		info, err := os.Stat(dir.path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %q: %w", dir.key, dir.path, err))
+			continue
+		}
+		if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("%s %q is not a directory", dir.key, dir.path))
+			continue
+		}
+		f, err := os.CreateTemp(dir.path, ".writecheck-*")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %q is not writable: %w", dir.key, dir.path, err))
+			continue
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return errors.Join(errs...)
+}
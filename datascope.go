@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Values of the state column
+var bundeslaender = map[string]bool{
+	"Burgenland": true, "Kärnten": true, "Niederösterreich": true,
+	"Oberösterreich": true, "Salzburg": true, "Steiermark": true,
+	"Tirol": true, "Vorarlberg": true, "Wien": true,
+}
+
+var isoPattern = regexp.MustCompile(`^\d{5}$`)
+
+// DataScope limits which Gemeinden a user or API key may get data for:
+// those listed, plus all Gemeinden of the listed states. A nil scope
+// means no limit.
+type DataScope struct {
+	Gemeinden []string `json:"gemeinden,omitempty"`
+	States    []string `json:"states,omitempty"`
+}
+
+func (s *DataScope) validate() error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Gemeinden) == 0 && len(s.States) == 0 {
+		return fmt.Errorf("data_scope must list gemeinden or states")
+	}
+	for _, iso := range s.Gemeinden {
+		if !isoPattern.MatchString(iso) {
+			return fmt.Errorf("data_scope: invalid Gemeinde code %q", iso)
+		}
+	}
+	for _, state := range s.States {
+		if !bundeslaender[state] {
+			return fmt.Errorf("data_scope: unknown state %q", state)
+		}
+	}
+	return nil
+}
+
+// sqlCondition is a WHERE condition on the gemeinden table selecting the
+// scope. The values are validated, so they can be inlined for ogr2ogr.
+func (s *DataScope) sqlCondition() string {
+	var parts []string
+	if len(s.Gemeinden) > 0 {
+		parts = append(parts, "iso IN ("+sqlQuoteList(s.Gemeinden)+")")
+	}
+	if len(s.States) > 0 {
+		parts = append(parts, "state IN ("+sqlQuoteList(s.States)+")")
+	}
+	return "(" + strings.Join(parts, " OR ") + ")"
+}
+
+func sqlQuoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	}
+	return strings.Join(quoted, ",")
+}
+
+// dataScopes returns the limits on a principal: the user's and, for API
+// key requests, the key's. Both apply.
+func (p principal) dataScopes() []*DataScope {
+	var scopes []*DataScope
+	if p.User.DataScope != nil {
+		scopes = append(scopes, p.User.DataScope)
+	}
+	if p.APIKey != nil && p.APIKey.DataScope != nil {
+		scopes = append(scopes, p.APIKey.DataScope)
+	}
+	return scopes
+}
+
+// dataScopeCondition returns the SQL condition for the request's data
+// scope, or "" when it may see everything.
+func dataScopeCondition(r *http.Request) string {
+	p, ok := authenticate(r)
+	if !ok {
+		return ""
+	}
+	var conds []string
+	for _, s := range p.dataScopes() {
+		conds = append(conds, s.sqlCondition())
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// outOfScope returns the requested Gemeinden outside cond.
+func outOfScope(isos []string, cond string) ([]string, error) {
+	if cond == "" || len(isos) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(isos))
+	for i, iso := range isos {
+		args[i] = iso
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(isos)), ",")
+	rows, err := gpkgDB().Query("SELECT iso FROM gemeinden WHERE iso IN ("+placeholders+") AND "+cond, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	inScope := make(map[string]bool)
+	for rows.Next() {
+		var iso string
+		if err := rows.Scan(&iso); err != nil {
+			return nil, err
+		}
+		inScope[iso] = true
+	}
+	var outside []string
+	for _, iso := range isos {
+		if !inScope[iso] {
+			outside = append(outside, iso)
+		}
+	}
+	return outside, rows.Err()
+}
+
+// unscopedOnly guards routes serving national data files, which can't be
+// cut down to a data scope.
+func unscopedOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dataScopeCondition(r) != "" {
+			http.Error(w, "Forbidden: data files are not available to accounts with a data scope", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Extensions of the files in the public directory that hold data, like
+// the published GeoPackage, rather than belonging to the site
+var publicDataExtensions = []string{".gpkg", ".geojson", ".json", ".csv", ".xlsx", ".zip", ".fgb"}
+
+// unscopedDataFiles applies unscopedOnly to the data files among the
+// static files of next; pages and images are served to everyone.
+func unscopedDataFiles(next http.Handler) http.Handler {
+	guarded := unscopedOnly(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(publicDataExtensions, strings.ToLower(path.Ext(r.URL.Path))) {
+			guarded.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const gpkgName = "holzeinschlag_austria.gpkg"
+
+func geoPackagePath() string {
+	return filepath.Join(config.PublicDir, gpkgName)
+}
+
+// Read-only connection pool on the GeoPackage, shared by all handlers.
+// It is swapped out when the GeoPackage file is replaced.
+var dbPool atomic.Pointer[sql.DB]
+
+func gpkgDB() *sql.DB {
+	return dbPool.Load()
+}
+
+// reloadDB points the pool at the current GeoPackage file. Connections
+// still open on the replaced file finish their queries and are closed.
+func reloadDB() error {
+	conn, err := openDB(geoPackagePath())
+	if err != nil {
+		return err
+	}
+	if old := dbPool.Swap(conn); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Columns every handler relies on, independent of the available years
+var requiredColumns = []string{"fid", "geom", "name", "iso", "state", "population"}
+
+func openDB(gpkgPath string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", "file:"+gpkgPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(4)
+	conn.SetMaxIdleConns(4)
+	return conn, nil
+}
+
+// warmupDB opens a first connection so the first real request doesn't pay
+// for it, and makes sure the GeoPackage has the schema we expect.
+func warmupDB(db *sql.DB) {
+	start := time.Now()
+	count, err := checkGeoPackage(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Database ready: %d features, warmup took %v", count, time.Since(start))
+}
+
+// checkGeoPackage makes sure the gemeinden table has the columns every
+// handler relies on and returns its number of features.
+func checkGeoPackage(db *sql.DB) (int, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('gemeinden')")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read GeoPackage schema: %w", err)
+	}
+	present := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to read GeoPackage schema: %w", err)
+		}
+		present[name] = true
+	}
+	rows.Close()
+
+	var missing []string
+	for _, col := range requiredColumns {
+		if !present[col] {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		return 0, fmt.Errorf("GeoPackage table gemeinden is missing columns: %s", strings.Join(missing, ", "))
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM gemeinden").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to query gemeinden: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"holzeinschlag-austria/pipeline"
+)
+
+// Dry runs of the pipeline: POST /api/start-pipeline with "dry_run"
+// resolves the inputs a run would read, checks that the tools, disk
+// space and the Hansen bucket are there and lists the stages it would
+// run, without starting it or touching any data.
+
+// dryRunMinFreeBytes is the free disk space a run needs: a release's
+// tiles for Austria and their clipped copies take well under 1 GB.
+const dryRunMinFreeBytes = 1 << 30
+
+// Programs the processing stages and scripts call
+var pipelineTools = []string{"bash", "python3", "gdalwarp", "ogr2ogr"}
+
+type dryRunInput struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+	Size   int64  `json:"size,omitempty"`
+	// "data", "upload" or "download" for tiles fetched if missing
+	Source string `json:"source"`
+}
+
+type dryRunCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type dryRun struct {
+	Pipeline   string                  `json:"pipeline"`
+	Parameters *pipeline.Params        `json:"parameters,omitempty"`
+	Stages     []pipeline.PlannedStage `json:"stages"`
+	Inputs     []dryRunInput           `json:"inputs"`
+	Checks     []dryRunCheck           `json:"checks"`
+	// Whether every check passed
+	OK bool `json:"ok"`
+}
+
+func (d *dryRun) check(name string, ok bool, detail string) {
+	d.Checks = append(d.Checks, dryRunCheck{Name: name, OK: ok, Detail: detail})
+}
+
+// dryRunPipeline plans a run of the named pipeline with params.
+func dryRunPipeline(name string, params *pipeline.Params) (*dryRun, error) {
+	processingDir := config.ProcessingDir
+	d := &dryRun{Pipeline: name, Parameters: params}
+
+	if p, ok := builtinPipeline(config.Pipelines[name]); ok {
+		stages, err := p.Plan(&pipeline.Env{Dir: processingDir, Params: params})
+		if err != nil {
+			return nil, err
+		}
+		d.Stages = stages
+	} else {
+		script, err := pipelineScriptPath(processingDir, name)
+		if err != nil {
+			return nil, err
+		}
+		d.Stages = []pipeline.PlannedStage{{Name: "script", Action: "bash " + script}}
+	}
+	if config.PipelinePreFlight != "" {
+		d.Stages = slices.Insert(d.Stages, 0, pipeline.PlannedStage{Name: "preflight", Action: "bash " + config.PipelinePreFlight})
+	}
+	if config.PipelinePostFlight != "" {
+		d.Stages = append(d.Stages, pipeline.PlannedStage{Name: "postflight", Action: "bash " + config.PipelinePostFlight})
+	}
+
+	d.resolveInputs(processingDir, params)
+	d.runChecks(processingDir, params)
+	d.OK = true
+	for _, c := range d.Checks {
+		d.OK = d.OK && c.OK
+	}
+	return d, nil
+}
+
+// resolveInputs lists the boundary files the scripts would read, and
+// the Hansen tiles.
+func (d *dryRun) resolveInputs(processingDir string, params *pipeline.Params) {
+	names := make([]string, 0, len(uploadInputs))
+	for name := range uploadInputs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var missing []string
+	for _, name := range names {
+		in := dryRunInput{Name: name, Path: filepath.Join(processingDir, "..", "data", name), Source: "data"}
+		if params != nil && params.Inputs {
+			if uploaded := filepath.Join(inputsDir(), name); fileExists(uploaded) {
+				in.Path, in.Source = uploaded, "upload"
+			}
+		}
+		if info, err := os.Stat(in.Path); err == nil {
+			in.Exists, in.Size = true, info.Size()
+		} else {
+			missing = append(missing, name)
+		}
+		d.Inputs = append(d.Inputs, in)
+	}
+	for _, layer := range pipeline.Layers {
+		path := pipeline.TilePath(processingDir, layer)
+		in := dryRunInput{Name: filepath.Base(path), Path: path, Source: "download"}
+		if info, err := os.Stat(path); err == nil {
+			in.Exists, in.Size = true, info.Size()
+		}
+		d.Inputs = append(d.Inputs, in)
+	}
+	if len(missing) > 0 {
+		d.check("inputs", false, "missing "+strings.Join(missing, ", "))
+	} else {
+		d.check("inputs", true, "all boundary files present")
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// runChecks checks that nothing else is running and that the tools,
+// disk space and the bucket are available.
+func (d *dryRun) runChecks(processingDir string, params *pipeline.Params) {
+	if isPipelineRunning() {
+		d.check("idle", false, "a pipeline run is in progress")
+	} else {
+		d.check("idle", true, "no pipeline run in progress")
+	}
+
+	for _, tool := range pipelineTools {
+		if path, err := exec.LookPath(tool); err != nil {
+			d.check("tool:"+tool, false, "not found in PATH")
+		} else {
+			d.check("tool:"+tool, true, path)
+		}
+	}
+
+	// Tiles go to ../raster, outputs to the processing directory
+	rasterDir := filepath.Join(processingDir, "..", "raster")
+	if !fileExists(rasterDir) {
+		rasterDir = filepath.Dir(rasterDir)
+	}
+	for _, disk := range []struct{ name, dir string }{{"disk:processing", processingDir}, {"disk:raster", rasterDir}} {
+		free, err := freeDiskSpace(disk.dir)
+		switch {
+		case err != nil:
+			d.check(disk.name, false, err.Error())
+		case free < dryRunMinFreeBytes:
+			d.check(disk.name, false, fmt.Sprintf("%.1f GB free, %.1f GB needed", gigabytes(free), gigabytes(dryRunMinFreeBytes)))
+		default:
+			d.check(disk.name, true, fmt.Sprintf("%.1f GB free", gigabytes(free)))
+		}
+	}
+
+	release := pipeline.Release
+	if params != nil && params.Release != "" {
+		release = params.Release
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch ok, err := releaseExists(client, release); {
+	case err != nil:
+		d.check("network", false, err.Error())
+	case !ok:
+		d.check("network", false, release+" not found in the Hansen bucket")
+	default:
+		d.check("network", true, release+" is available")
+	}
+}
+
+func gigabytes(n uint64) float64 {
+	return float64(n) / (1 << 30)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitParam splits a comma-separated query parameter, dropping blanks.
+func splitParam(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Number of columns exported per selected year, one per indicator
+const columnsPerYear = 7
+
+// Base columns exported alongside the yearly ones (fid, geom, name, iso,
+// state, population)
+const baseColumnCount = 6
+
+// selectionSize returns the number of rows of a layer matching where and
+// their raw size: geometry blob bytes, and eight bytes per value of the
+// given number of columns, all of the layer's if 0.
+func selectionSize(layer, where string, columns int64) (rows, geomBytes, attrBytes int64, err error) {
+	var geom string
+	if err := gpkgDB().QueryRow("SELECT column_name FROM gpkg_geometry_columns WHERE table_name = ?", layer).Scan(&geom); err != nil {
+		return 0, 0, 0, err
+	}
+	query := fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(LENGTH(%q)), 0) FROM %q WHERE %s", geom, layer, where)
+	if err := gpkgDB().QueryRow(query).Scan(&rows, &geomBytes); err != nil {
+		return 0, 0, 0, err
+	}
+	if columns == 0 {
+		if err := gpkgDB().QueryRow("SELECT COUNT(*) FROM pragma_table_info(?)", layer).Scan(&columns); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return rows, geomBytes, rows * (columns - 1) * 8, nil
+}
+
+// handleExportSizeEstimate answers the predicted size of the export of
+// the selected years and Gemeinden in each format, as estimated by
+// estimateExport. Shapefiles keep their ratio's name shp_zip here.
+func handleExportSizeEstimate(w http.ResponseWriter, r *http.Request) {
+	req, err := parseExportRequest(r.URL.Query(), nil, dataScopeCondition(r))
+	if err != nil {
+		var exportErr *exportError
+		errors.As(err, &exportErr)
+		writeExportError(w, exportErr)
+		return
+	}
+	est, err := estimateExport(req)
+	if err != nil {
+		log.Printf("Export size estimate failed: %v", err)
+		writeExportError(w, errExportFailed)
+		return
+	}
+	sizes := make(map[string]int64, len(est.Bytes))
+	for name, size := range est.Bytes {
+		if name == "shp" {
+			name = "shp_zip"
+		}
+		sizes[name] = size
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sizes)
+}
+
+// exportEstimate is the answer of /api/export/estimate.
+type exportEstimate struct {
+	Format string `json:"format"`
+	// Features in all and per layer, the merged feature included
+	Features int64            `json:"features"`
+	Layers   map[string]int64 `json:"layers"`
+	// Predicted size in each format with a ratio in export_size_ratios,
+	// and of the requested export
+	Bytes            map[string]int64 `json:"bytes"`
+	EstimatedBytes   int64            `json:"estimated_bytes,omitempty"`
+	EstimatedSeconds float64          `json:"estimated_seconds"`
+	Cached           bool             `json:"cached"`
+	AsyncRecommended bool             `json:"async_recommended"`
+}
+
+// estimateExport predicts the size and duration of the export of req
+// from the raw size of its selection, without generating anything.
+func estimateExport(req exportRequest) (exportEstimate, error) {
+	est := exportEstimate{Format: req.formatName, Layers: make(map[string]int64), Bytes: make(map[string]int64)}
+	var geomBytes, attrBytes int64
+	for _, layer := range req.layers {
+		where, columns := "1", int64(0)
+		if layer == "gemeinden" {
+			var err error
+			if where, err = req.where(); err != nil {
+				return est, err
+			}
+			if len(req.yearList) > 0 {
+				columns = baseColumnCount + columnsPerYear*int64(len(req.yearList))
+			}
+		}
+		rows, g, a, err := selectionSize(layer, where, columns)
+		if err != nil {
+			return est, err
+		}
+		// Several Gemeinden get a merged feature
+		if layer == "gemeinden" && len(req.yearList) > 0 && strings.Count(req.gemeinden, ",") > 0 {
+			rows++
+		}
+		est.Layers[layer] = rows
+		est.Features += rows
+		geomBytes += g
+		attrBytes += a
+	}
+
+	for name, format := range exportFormats {
+		// The ratio of Shapefiles is named after their old format name
+		ratio, ok := config.ExportSizeRatios[name]
+		if name == "shp" {
+			ratio, ok = config.ExportSizeRatios["shp_zip"]
+		}
+		if !ok {
+			continue
+		}
+		raw := geomBytes + attrBytes
+		if format.attributes {
+			raw = attrBytes
+		}
+		est.Bytes[name] = int64(float64(raw) * ratio)
+	}
+	for _, name := range req.outputFormats() {
+		est.EstimatedBytes += est.Bytes[name]
+	}
+
+	if config.ExportCacheMaxBytes > 0 {
+		_, err := os.Stat(filepath.Join(exportCacheDir(), exportCacheKey(req)+".meta"))
+		est.Cached = err == nil
+	}
+	if !est.Cached {
+		// Reprojecting or simplifying, and each conversion by ogr2ogr,
+		// take about as long again as writing the GeoPackage
+		write := float64(geomBytes+attrBytes) / float64(config.ExportBytesPerSecond)
+		seconds := write
+		if len(geometryArgs(req.opts)) > 0 {
+			seconds += write
+		}
+		for _, name := range req.outputFormats() {
+			if exportFormats[name].ogr2ogr {
+				seconds += write
+			}
+		}
+		est.EstimatedSeconds = math.Round(seconds*10) / 10
+	}
+	est.AsyncRecommended = est.EstimatedSeconds > float64(config.ExportAsyncSeconds)
+	return est, nil
+}
+
+// handleExportEstimate answers how large and how slow the export with
+// the parameters of /api/export would be, and whether to run it as an
+// export job instead.
+func handleExportEstimate(w http.ResponseWriter, r *http.Request) {
+	req, err := parseExportRequest(r.URL.Query(), nil, dataScopeCondition(r))
+	if err != nil {
+		var exportErr *exportError
+		errors.As(err, &exportErr)
+		writeExportError(w, exportErr)
+		return
+	}
+	est, err := estimateExport(req)
+	if err != nil {
+		log.Printf("Export estimate failed: %v", err)
+		writeExportError(w, errExportFailed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(est)
+}
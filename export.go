@@ -0,0 +1,917 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// exportFormat is an output format of /api/export. Exports are first
+// written as a GeoPackage; other formats are converted from that file.
+type exportFormat struct {
+	ext         string
+	contentType string
+	// convert writes the format to dst from the GeoPackage src and
+	// returns warnings about lost information; nil for the GeoPackage
+	// itself
+	convert func(src, dst string, opts exportOptions) ([]string, error)
+	// Whether convert runs ogr2ogr, and whether the format leaves out
+	// the geometry
+	ogr2ogr    bool
+	attributes bool
+}
+
+var exportFormats = map[string]exportFormat{
+	"gpkg":    {ext: ".gpkg", contentType: "application/geopackage+sqlite3"},
+	"geojson": {ext: ".geojson", contentType: "application/geo+json", convert: convertGeoJSON, ogr2ogr: true},
+	"shp":     {ext: ".shp.zip", contentType: "application/zip", convert: convertShapefile, ogr2ogr: true},
+	"csv":     {ext: ".csv", contentType: "text/csv; charset=utf-8", convert: convertCSV, attributes: true},
+	"json":    {ext: ".json", contentType: "application/json", convert: convertJSON, attributes: true},
+	"fgb":     {ext: ".fgb", contentType: "application/flatgeobuf", convert: convertFlatGeobuf, ogr2ogr: true},
+	"parquet": {ext: ".parquet", contentType: "application/vnd.apache.parquet", convert: convertGeoParquet, ogr2ogr: true},
+	"kml":     {ext: ".kml", contentType: "application/vnd.google-earth.kml+xml", convert: convertKML, ogr2ogr: true},
+	"kmz":     {ext: ".kmz", contentType: "application/vnd.google-earth.kmz", convert: convertKMZ, ogr2ogr: true},
+	"xlsx":    {ext: ".xlsx", contentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", convert: convertXLSX, attributes: true},
+	// A zip of the formats listed in the formats parameter
+	"bundle": {ext: ".zip", contentType: "application/zip"},
+}
+
+// exportOptions are the format-specific parameters of an export.
+type exportOptions struct {
+	// Decimal places of coordinates; -1 keeps the driver's default
+	precision int
+	// Simplification tolerance in metres; 0 keeps the full geometry
+	simplify float64
+	// Target CRS, one of exportSRS; empty keeps WGS 84
+	srs string
+	// CSV field separator, and whether to start with a byte order mark
+	// so Excel detects UTF-8
+	delimiter rune
+	bom       bool
+}
+
+// csvDelimiters are the accepted values of the delimiter parameter;
+// German Excel expects semicolons.
+var csvDelimiters = map[string]rune{
+	"comma":     ',',
+	",":         ',',
+	"semicolon": ';',
+	";":         ';',
+	"tab":       '\t',
+}
+
+// exportSRS are the coordinate reference systems exports can be
+// reprojected to. The GeoPackage is in WGS 84.
+var exportSRS = map[string]string{
+	"EPSG:4326":  "WGS 84",
+	"EPSG:3857":  "WGS 84 / Pseudo-Mercator",
+	"EPSG:3035":  "ETRS89 / LAEA Europe",
+	"EPSG:3416":  "ETRS89 / Austria Lambert",
+	"EPSG:31287": "MGI / Austria Lambert",
+	"EPSG:31254": "MGI / Austria GK West",
+	"EPSG:31255": "MGI / Austria GK Central",
+	"EPSG:31256": "MGI / Austria GK East",
+	"EPSG:32632": "WGS 84 / UTM zone 32N",
+	"EPSG:32633": "WGS 84 / UTM zone 33N",
+}
+
+// parseExportOptions reads and validates the format-specific parameters.
+func parseExportOptions(query url.Values) (exportOptions, error) {
+	opts := exportOptions{precision: -1, delimiter: ','}
+	if p := query.Get("precision"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 15 {
+			return opts, badParam("precision", "precision must be between 0 and 15")
+		}
+		opts.precision = n
+	}
+	if d := query.Get("delimiter"); d != "" {
+		delimiter, ok := csvDelimiters[d]
+		if !ok {
+			return opts, badParam("delimiter", "delimiter must be comma, semicolon or tab")
+		}
+		opts.delimiter = delimiter
+	}
+	if s := query.Get("simplify"); s != "" {
+		tolerance, err := strconv.ParseFloat(s, 64)
+		if err != nil || tolerance < 0 || tolerance > maxSimplifyMetres {
+			return opts, badParam("simplify", fmt.Sprintf("simplify must be a tolerance between 0 and %d metres", maxSimplifyMetres))
+		}
+		opts.simplify = tolerance
+	}
+	if srs := strings.ToUpper(query.Get("srs")); srs != "" && srs != "EPSG:4326" {
+		if _, ok := exportSRS[srs]; !ok {
+			var supported []string
+			for code := range exportSRS {
+				supported = append(supported, code)
+			}
+			slices.Sort(supported)
+			return opts, badParam("srs", "srs must be one of "+strings.Join(supported, ", "))
+		}
+		opts.srs = srs
+	}
+	opts.bom = query.Get("bom") == "1"
+	return opts, nil
+}
+
+// Beyond this, small Gemeinden collapse
+const maxSimplifyMetres = 5000
+
+// Metres per degree of latitude, for turning tolerances into degrees
+const metresPerDegree = 111320
+
+// geometryArgs are the ogr2ogr arguments reprojecting and simplifying
+// geometries for opts. ogr2ogr keeps each geometry valid, but simplifies
+// neighbouring Gemeinden independently, so a coarse tolerance opens
+// slivers along shared borders. The tolerance is in the units of the
+// data, degrees; east-west it is stricter than asked by the cosine of
+// the latitude. ogr2ogr simplifies before reprojecting, so this holds
+// for any srs.
+func geometryArgs(opts exportOptions) []string {
+	var args []string
+	if opts.srs != "" {
+		args = append(args, "-t_srs", opts.srs)
+	}
+	if opts.simplify > 0 {
+		args = append(args, "-simplify", strconv.FormatFloat(opts.simplify/metresPerDegree, 'g', -1, 64))
+	}
+	return args
+}
+
+// convertGeoJSON writes RFC 7946 GeoJSON, rounded to the requested
+// precision. RFC 7946 only allows WGS 84; reprojected exports are plain
+// GeoJSON naming their CRS.
+func convertGeoJSON(src, dst string, opts exportOptions) ([]string, error) {
+	args := []string{"-f", "GeoJSON", dst, src, "gemeinden"}
+	if opts.srs == "" {
+		args = append(args, "-lco", "RFC7946=YES")
+	}
+	if opts.precision >= 0 {
+		args = append(args, "-lco", fmt.Sprintf("COORDINATE_PRECISION=%d", opts.precision))
+	}
+	return nil, runOgr2ogr(args...)
+}
+
+// convertFlatGeobuf writes FlatGeobuf with its packed R-tree, so clients
+// can fetch the features of an area with range requests.
+func convertFlatGeobuf(src, dst string, opts exportOptions) ([]string, error) {
+	return nil, runOgr2ogr("-f", "FlatGeobuf", dst, src, "gemeinden", "-lco", "SPATIAL_INDEX=YES")
+}
+
+// convertGeoParquet writes GeoParquet with WKB geometries, the geo
+// metadata and snappy compression. It needs GDAL built with Arrow.
+func convertGeoParquet(src, dst string, opts exportOptions) ([]string, error) {
+	return nil, runOgr2ogr("-f", "Parquet", dst, src, "gemeinden",
+		"-lco", "COMPRESSION=SNAPPY", "-lco", "GEOMETRY_ENCODING=WKB", "-lco", "GEOMETRY_NAME=geometry")
+}
+
+// runOgr2ogr runs ogr2ogr, logging its output if it fails.
+func runOgr2ogr(args ...string) error {
+	output, err := ogr2ogrCommand(args...).CombinedOutput()
+	if err != nil {
+		log.Printf("ogr2ogr error: %v, output: %s", err, string(output))
+	}
+	return err
+}
+
+// stableExportName derives the export filename from a hash of the filter
+// parameters, so identical requests map to identical, cacheable URLs. The
+// GeoPackage modification time is part of the hash: the name changes
+// whenever the pipeline publishes new data.
+func stableExportName(query url.Values, area, gpkgPath, ext string) string {
+	h := sha256.New()
+	for _, key := range []string{"years", "gemeinden"} {
+		fmt.Fprintf(h, "%s=%s\n", key, query.Get(key))
+	}
+	// Only hashed when set, so GeoPackage names stay what they were
+	for _, key := range []string{"format", "precision", "delimiter", "bom", "states", "simplify", "srs", "layers", "manifest"} {
+		if value := query.Get(key); value != "" {
+			fmt.Fprintf(h, "%s=%s\n", key, value)
+		}
+	}
+	if area != "" {
+		fmt.Fprintf(h, "area=%s\n", area)
+	}
+	if info, err := os.Stat(gpkgPath); err == nil {
+		fmt.Fprintf(h, "mtime=%d\n", info.ModTime().UnixNano())
+	}
+	return "holzeinschlag_export_" + hex.EncodeToString(h.Sum(nil)) + ext
+}
+
+// exportRequest is a validated export: the filter parameters, the output
+// format and the data scope condition of the caller.
+type exportRequest struct {
+	// Validated years and Gemeinde codes, comma-separated
+	years      string
+	gemeinden  string
+	yearList   []string
+	formatName string
+	format     exportFormat
+	opts       exportOptions
+	scopeCond  string
+	query      url.Values
+	// Bundesländer the export is limited to, and the condition selecting
+	// them along with the Gemeinden listed separately
+	states     []string
+	statesCond string
+	// Spatial filter: only Gemeinden intersecting area are exported.
+	// areaKey identifies it in cache keys and stable names.
+	area    multiPolygon
+	areaKey string
+	// Layers of the GeoPackage to export; the filters apply to gemeinden,
+	// other layers are exported whole
+	layers []string
+	// Whether the file is zipped with its manifest, and the formats
+	// zipped together for the bundle format
+	bundle  bool
+	formats []string
+}
+
+// exportError is a rejected export request, with the status to answer
+// and the parameter at fault, if any.
+type exportError struct {
+	status int
+	msg    string
+	param  string
+	// Set where the status doesn't tell the error apart
+	code string
+	// Seconds to wait before retrying, for 429
+	retryAfter int
+}
+
+func (e *exportError) Error() string { return e.msg }
+
+func badParam(param, msg string) *exportError {
+	return &exportError{status: http.StatusBadRequest, msg: msg, param: param}
+}
+
+var errExportFailed = &exportError{status: http.StatusInternalServerError, msg: "Failed to generate export"}
+
+// writeExportError answers with err as JSON: {"error": ..., "code": ...,
+// "param": ...}, code being invalid_parameter, outside_data_scope,
+// needs_gdal, queue_full, quota_exceeded or export_failed.
+func writeExportError(w http.ResponseWriter, err *exportError) {
+	code := "export_failed"
+	switch err.status {
+	case http.StatusBadRequest:
+		code = "invalid_parameter"
+	case http.StatusForbidden:
+		code = "outside_data_scope"
+	case http.StatusNotImplemented:
+		code = "needs_gdal"
+	}
+	if err.code != "" {
+		code = err.code
+	}
+	if err.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(err.retryAfter))
+	}
+	resp := map[string]string{"error": err.msg, "code": code}
+	if err.param != "" {
+		resp["param"] = err.param
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseExportRequest validates the parameters of an export for a caller
+// limited to the Gemeinden of scopeCond. polygon is the GeoJSON area of
+// POST requests, if any.
+func parseExportRequest(query url.Values, polygon []byte, scopeCond string) (exportRequest, error) {
+	req := exportRequest{
+		formatName: query.Get("format"),
+		scopeCond:  scopeCond,
+		query:      query,
+	}
+	if req.formatName == "" {
+		req.formatName = "gpkg"
+	}
+	var ok bool
+	req.format, ok = exportFormats[req.formatName]
+	if !ok {
+		return req, badParam("format", "Unknown export format")
+	}
+	if req.formatName == "bundle" {
+		if err := req.parseFormats(splitParam(query.Get("formats"))); err != nil {
+			return req, err
+		}
+	} else if query.Get("formats") != "" {
+		return req, badParam("formats", "formats is only for format=bundle")
+	}
+	// geometry=false asks for attributes only, which some formats are
+	switch geometry := query.Get("geometry"); {
+	case geometry != "" && geometry != "true" && geometry != "false":
+		return req, badParam("geometry", "geometry must be true or false")
+	case geometry != "" && req.formatName == "bundle":
+		return req, badParam("geometry", "bundles hold each format as it is; leave out geometry")
+	case geometry == "true" && req.format.attributes:
+		return req, badParam("geometry", req.formatName+" exports have no geometry; use geojson or gpkg")
+	case geometry == "false" && !req.format.attributes:
+		return req, badParam("geometry", req.formatName+" exports always have geometry; use json, csv or xlsx for attributes only")
+	}
+	var err error
+	req.opts, err = parseExportOptions(query)
+	if err != nil {
+		return req, err
+	}
+	// Without GDAL only the filtering works
+	if !ogr2ogrAvailable() {
+		for _, name := range req.outputFormats() {
+			if !exportFormats[name].ogr2ogr {
+				continue
+			}
+			param := "format"
+			if req.formatName == "bundle" {
+				param = "formats"
+			}
+			return req, &exportError{status: http.StatusNotImplemented, msg: "Exporting " + name + " needs GDAL, which is not installed on this server", param: param}
+		}
+		if req.opts.srs != "" {
+			return req, &exportError{status: http.StatusNotImplemented, msg: "Reprojecting needs GDAL, which is not installed on this server", param: "srs"}
+		}
+		if req.opts.simplify > 0 {
+			return req, &exportError{status: http.StatusNotImplemented, msg: "Simplifying needs GDAL, which is not installed on this server", param: "simplify"}
+		}
+	}
+	if err := req.parseArea(query.Get("bbox"), polygon); err != nil {
+		return req, err
+	}
+	if err := req.parseLayers(splitParam(query.Get("layers"))); err != nil {
+		return req, err
+	}
+	switch query.Get("manifest") {
+	case "":
+	case "zip":
+		req.bundle = true
+	default:
+		return req, badParam("manifest", "manifest must be zip")
+	}
+
+	// Years and Gemeinden end up in SQL: only known years and well-formed
+	// codes get through
+	if years := splitParam(query.Get("years")); len(years) > 0 {
+		available, err := datasetYears()
+		if err != nil {
+			log.Printf("Reading dataset years failed: %v", err)
+			return req, errExportFailed
+		}
+		if len(available) == 0 {
+			return req, badParam("years", "The dataset has no yearly data")
+		}
+		for _, year := range years {
+			if !slices.Contains(available, year) {
+				return req, badParam("years", fmt.Sprintf("No data for year %q; years must be between %s and %s", year, available[0], available[len(available)-1]))
+			}
+			if !slices.Contains(req.yearList, year) {
+				req.yearList = append(req.yearList, year)
+			}
+		}
+		req.years = strings.Join(req.yearList, ",")
+	}
+	isos := splitParam(query.Get("gemeinden"))
+	for _, iso := range isos {
+		if !isoPattern.MatchString(iso) {
+			return req, badParam("gemeinden", fmt.Sprintf("Invalid Gemeinde code %q; codes have five digits", iso))
+		}
+	}
+	req.gemeinden = strings.Join(isos, ",")
+
+	// Accounts with a data scope only get their Gemeinden
+	if req.gemeinden != "" && scopeCond != "" {
+		outside, err := outOfScope(isos, scopeCond)
+		if err != nil {
+			log.Printf("Data scope check failed: %v", err)
+			return req, errExportFailed
+		}
+		if len(outside) > 0 {
+			return req, &exportError{status: http.StatusForbidden, msg: "Gemeinden outside your data scope: " + strings.Join(outside, ","), param: "gemeinden"}
+		}
+	}
+	if states := query.Get("states"); states != "" {
+		if err := req.expandStates(splitParam(states)); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// parseFormats sets the formats of a bundle, which is always zipped with
+// its manifest.
+func (req *exportRequest) parseFormats(formats []string) error {
+	if len(formats) == 0 {
+		return badParam("formats", "Bundles need formats, e.g. formats=gpkg,csv")
+	}
+	for _, name := range formats {
+		if _, ok := exportFormats[name]; !ok || name == "bundle" {
+			return badParam("formats", fmt.Sprintf("Unknown export format %q", name))
+		}
+		if !slices.Contains(req.formats, name) {
+			req.formats = append(req.formats, name)
+		}
+	}
+	req.bundle = true
+	return nil
+}
+
+// outputFormats are the formats the export is written in: those of a
+// bundle, or else its format.
+func (req exportRequest) outputFormats() []string {
+	if req.formatName == "bundle" {
+		return req.formats
+	}
+	return []string{req.formatName}
+}
+
+// parseLayers checks the requested layers against those of the
+// GeoPackage; without any, only gemeinden is exported. Other formats
+// than GeoPackage hold a single layer, and the other layers aren't
+// limited to a data scope, so they are for GeoPackages of unrestricted
+// accounts only.
+func (req *exportRequest) parseLayers(layers []string) error {
+	if len(layers) == 0 {
+		req.layers = []string{"gemeinden"}
+		return nil
+	}
+	available, err := featureLayers()
+	if err != nil {
+		log.Printf("Reading GeoPackage layers failed: %v", err)
+		return errExportFailed
+	}
+	for _, layer := range layers {
+		if !slices.Contains(available, layer) {
+			return badParam("layers", fmt.Sprintf("Unknown layer %q; layers are %s", layer, strings.Join(available, ", ")))
+		}
+		if !slices.Contains(req.layers, layer) {
+			req.layers = append(req.layers, layer)
+		}
+	}
+	if len(req.layers) == 1 && req.layers[0] == "gemeinden" {
+		return nil
+	}
+	if req.formatName != "gpkg" {
+		return badParam("layers", "Only GeoPackage exports can hold other layers than gemeinden")
+	}
+	if req.scopeCond != "" {
+		return &exportError{status: http.StatusForbidden, msg: "Your data scope only allows exporting gemeinden", param: "layers"}
+	}
+	return nil
+}
+
+// expandStates limits the export to the given Bundesländer, plus the
+// Gemeinden listed separately, and adds their Gemeinden (within the data
+// scope) to the selected ones, as if they had been listed in the
+// gemeinden parameter.
+func (req *exportRequest) expandStates(states []string) error {
+	for _, state := range states {
+		if !bundeslaender[state] {
+			return badParam("states", fmt.Sprintf("Unknown Bundesland %q", state))
+		}
+	}
+	cond := "state IN (" + sqlQuoteList(states) + ")"
+	if req.scopeCond != "" {
+		cond += " AND " + req.scopeCond
+	}
+	rows, err := gpkgDB().Query("SELECT iso, state FROM gemeinden WHERE " + cond + " ORDER BY iso")
+	if err != nil {
+		log.Printf("Expanding states failed: %v", err)
+		return errExportFailed
+	}
+	defer rows.Close()
+	isos := splitParam(req.gemeinden)
+	req.statesCond = "state IN (" + sqlQuoteList(states) + ")"
+	if len(isos) > 0 {
+		req.statesCond = "(" + req.statesCond + " OR iso IN (" + sqlQuoteList(isos) + "))"
+	}
+	found := make(map[string]bool)
+	for rows.Next() {
+		var iso, state string
+		if err := rows.Scan(&iso, &state); err != nil {
+			log.Printf("Expanding states failed: %v", err)
+			return errExportFailed
+		}
+		found[state] = true
+		if !slices.Contains(isos, iso) {
+			isos = append(isos, iso)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Expanding states failed: %v", err)
+		return errExportFailed
+	}
+	var outside []string
+	for _, state := range states {
+		if !found[state] {
+			outside = append(outside, state)
+		}
+	}
+	if len(outside) > 0 {
+		return &exportError{status: http.StatusForbidden, msg: "Bundesländer outside your data scope: " + strings.Join(outside, ","), param: "states"}
+	}
+	req.states = states
+	req.gemeinden = strings.Join(isos, ",")
+	return nil
+}
+
+// parseArea sets the spatial filter from a bbox parameter
+// (minx,miny,maxx,maxy in WGS84) or a GeoJSON polygon.
+func (req *exportRequest) parseArea(bbox string, polygon []byte) error {
+	switch {
+	case bbox != "" && len(polygon) > 0:
+		return badParam("bbox", "use either bbox or a polygon, not both")
+	case bbox != "":
+		b, err := parseBBox(bbox)
+		if err != nil {
+			return badParam("bbox", err.Error())
+		}
+		req.area = bboxPolygon(b)
+		req.areaKey = "bbox=" + bbox
+	case len(polygon) > 0:
+		area, err := parseGeoJSONArea(polygon)
+		if err != nil {
+			return badParam("polygon", err.Error())
+		}
+		// Hash the coordinates, not the formatting of the request
+		canonical, _ := json.Marshal(area)
+		sum := sha256.Sum256(canonical)
+		req.area = area
+		req.areaKey = "polygon=" + hex.EncodeToString(sum[:])
+	}
+	return nil
+}
+
+// parseBBox reads a bbox parameter, minx,miny,maxx,maxy in WGS84.
+func parseBBox(bbox string) ([4]float64, error) {
+	var b [4]float64
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return b, errors.New("bbox must be minx,miny,maxx,maxy")
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return b, errors.New("bbox must be minx,miny,maxx,maxy")
+		}
+		b[i] = v
+	}
+	// Written so NaN fails too
+	if !(b[0] <= b[2] && b[1] <= b[3] && b[0] >= -180 && b[2] <= 180 && b[1] >= -90 && b[3] <= 90) {
+		return b, errors.New("bbox must be minx,miny,maxx,maxy in degrees, with min below max")
+	}
+	return b, nil
+}
+
+// gemeindenInArea returns the fids of the Gemeinden intersecting area.
+// The spatial index of the GeoPackage, where there is one, narrows down
+// the outlines that have to be read.
+func gemeindenInArea(area multiPolygon) ([]string, error) {
+	query := "SELECT fid, geom FROM gemeinden"
+	var args []interface{}
+	var indexed bool
+	// GeoPackages without extensions have no gpkg_extensions table
+	gpkgDB().QueryRow("SELECT COUNT(*) > 0 FROM gpkg_extensions WHERE table_name = 'gemeinden' AND column_name = 'geom' AND extension_name = 'gpkg_rtree_index'").Scan(&indexed)
+	if indexed {
+		b := area.bounds()
+		query += " WHERE fid IN (SELECT id FROM rtree_gemeinden_geom WHERE minx <= ? AND maxx >= ? AND miny <= ? AND maxy >= ?)"
+		args = []interface{}{b[2], b[0], b[3], b[1]}
+	}
+	rows, err := gpkgDB().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fids := []string{}
+	for rows.Next() {
+		var fid int64
+		var geom []byte
+		if err := rows.Scan(&fid, &geom); err != nil {
+			return nil, err
+		}
+		shape, err := parseGeoPackageGeometry(geom)
+		if err != nil {
+			return nil, fmt.Errorf("geometry of feature %d: %w", fid, err)
+		}
+		if shape.intersects(area) {
+			fids = append(fids, strconv.FormatInt(fid, 10))
+		}
+	}
+	return fids, rows.Err()
+}
+
+// where is the SQL condition selecting the exported Gemeinden: those of
+// the data scope, the states and the area.
+func (req exportRequest) where() (string, error) {
+	var conds []string
+	if req.scopeCond != "" {
+		conds = append(conds, req.scopeCond)
+	}
+	if req.statesCond != "" {
+		conds = append(conds, req.statesCond)
+	}
+	if req.area != nil {
+		fids, err := gemeindenInArea(req.area)
+		if err != nil {
+			return "", err
+		}
+		if len(fids) == 0 {
+			conds = append(conds, "0")
+		} else {
+			conds = append(conds, "fid IN ("+strings.Join(fids, ",")+")")
+		}
+	}
+	if len(conds) == 0 {
+		return "1", nil
+	}
+	return strings.Join(conds, " AND "), nil
+}
+
+// filename is the name the export is downloaded as.
+func (req exportRequest) filename() string {
+	if req.query.Get("stable_name") == "1" {
+		return stableExportName(req.query, req.areaKey, geoPackagePath(), req.ext())
+	}
+	filename := "holzeinschlag_austria"
+	if years := req.yearList; len(years) > 0 {
+		if len(years) > 3 {
+			filename += fmt.Sprintf("_%s-%s", years[0], years[len(years)-1])
+		} else {
+			filename += "_" + strings.ReplaceAll(req.years, ",", "-")
+		}
+	}
+	return filename + req.ext()
+}
+
+// ext is the extension of the exported file: the format's, or .zip if
+// it is bundled with the manifest.
+func (req exportRequest) ext() string {
+	if req.bundle && !strings.HasSuffix(req.format.ext, ".zip") {
+		return req.format.ext + ".zip"
+	}
+	return req.format.ext
+}
+
+func (req exportRequest) contentType() string {
+	if req.bundle {
+		return "application/zip"
+	}
+	return req.format.contentType
+}
+
+// generateExport writes the export into dir and returns the path of the
+// file and the warnings of the format conversion. progress, if set, is
+// called with the name of each step as it starts.
+func generateExport(ctx context.Context, dir string, req exportRequest, progress func(step string)) (string, []string, error) {
+	step := func(name string) error {
+		if progress != nil {
+			progress(name)
+		}
+		return ctx.Err()
+	}
+	gpkgPath := geoPackagePath()
+	tmpPath := filepath.Join(dir, "export.gpkg")
+	// Reprojecting and simplifying is left to ogr2ogr, from a first
+	// filtered copy
+	geomArgs := geometryArgs(req.opts)
+	filteredPath := tmpPath
+	if len(geomArgs) > 0 {
+		filteredPath = filepath.Join(dir, "filtered.gpkg")
+	}
+
+	// Build column selection based on years. The SQL is put together
+	// from validated years and codes only.
+	var columns []string
+	if len(req.yearList) > 0 {
+		columns = slices.Clone(requiredColumns)
+		for _, y := range req.yearList {
+			for _, indicator := range indicators {
+				columns = append(columns, indicator+"_"+y)
+			}
+		}
+	}
+
+	// First: export all municipalities
+	if err := step("filtering"); err != nil {
+		return "", nil, err
+	}
+	where, err := req.where()
+	if err != nil {
+		log.Printf("Spatial filter failed: %v", err)
+		return "", nil, err
+	}
+	gpkg, err := createGeoPackage(ctx, filteredPath, gpkgPath)
+	if err != nil {
+		log.Printf("Export failed: %v", err)
+		return "", nil, err
+	}
+	for _, layer := range req.layers {
+		layerColumns, layerWhere := []string(nil), "1"
+		if layer == "gemeinden" {
+			layerColumns, layerWhere = columns, where
+		}
+		err := gpkg.addLayer(layer, layerColumns)
+		if err == nil {
+			err = gpkg.copyFeatures(layer, layerWhere)
+		}
+		if err != nil {
+			gpkg.db.Close()
+			log.Printf("Export failed: %v", err)
+			return "", nil, err
+		}
+	}
+
+	// If gemeinden are specified, add a merged feature
+	if req.gemeinden != "" && len(req.yearList) > 0 && slices.Contains(req.layers, "gemeinden") {
+		isos := strings.Split(req.gemeinden, ",")
+		if len(isos) > 1 {
+			if err := step("merging"); err != nil {
+				gpkg.db.Close()
+				return "", nil, err
+			}
+			whereClause := "iso IN (" + sqlQuoteList(isos) + ")"
+			if req.scopeCond != "" {
+				whereClause += " AND " + req.scopeCond
+			}
+			if err := gpkg.appendMerged(whereClause); err != nil {
+				log.Printf("Merging Gemeinden failed: %v", err)
+				// Continue anyway - we still have the base export
+			}
+		}
+	}
+	if err := gpkg.close(); err != nil {
+		log.Printf("Export failed: %v", err)
+		return "", nil, err
+	}
+	if len(geomArgs) > 0 {
+		if err := runOgr2ogr(append([]string{"-f", "GPKG", tmpPath, filteredPath}, geomArgs...)...); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// Data files are named after the download, within the zip if there
+	// is one
+	base := strings.TrimSuffix(req.filename(), req.ext())
+	var files []bundleFile
+	var warnings []string
+	for _, name := range req.outputFormats() {
+		format := exportFormats[name]
+		file := bundleFile{path: tmpPath, name: base + format.ext}
+		if format.convert != nil {
+			if err := step("converting"); err != nil {
+				return "", nil, err
+			}
+			file.path = filepath.Join(dir, "export"+format.ext)
+			converted, err := format.convert(tmpPath, file.path, req.opts)
+			if err != nil {
+				log.Printf("Converting export to %s failed: %v", name, err)
+				return "", nil, err
+			}
+			for _, warning := range converted {
+				if len(req.formats) > 0 {
+					warning = name + ": " + warning
+				}
+				warnings = append(warnings, warning)
+			}
+		}
+		files = append(files, file)
+	}
+
+	manifest := buildExportManifest(req, files)
+	if slices.Contains(req.outputFormats(), "gpkg") {
+		if err := embedManifest(tmpPath, manifest); err != nil {
+			log.Printf("Embedding export manifest failed: %v", err)
+			return "", nil, err
+		}
+	}
+	outPath := files[0].path
+	if req.bundle {
+		if err := step("bundling"); err != nil {
+			return "", nil, err
+		}
+		bundled := filepath.Join(dir, "bundle"+req.ext())
+		if err := bundleExport(bundled, files, manifest); err != nil {
+			log.Printf("Bundling export failed: %v", err)
+			return "", nil, err
+		}
+		outPath = bundled
+	}
+	return outPath, warnings, nil
+}
+
+// handleExport serves the dataset filtered by years and Gemeinden in the
+// requested format. Several Gemeinden also get a merged feature. POST
+// requests carry a GeoJSON polygon limiting the export to the Gemeinden
+// it touches.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	var polygon []byte
+	if r.Method == http.MethodPost {
+		var err error
+		if polygon, err = io.ReadAll(r.Body); err != nil {
+			if isBodyTooLarge(err) {
+				writeBodyTooLarge(w)
+				return
+			}
+			writeExportError(w, badParam("polygon", "Failed to read request body"))
+			return
+		}
+		if len(bytes.TrimSpace(polygon)) == 0 {
+			writeExportError(w, badParam("polygon", "POST requests need a GeoJSON polygon"))
+			return
+		}
+	}
+	req, err := parseExportRequest(r.URL.Query(), polygon, dataScopeCondition(r))
+	if err != nil {
+		var exportErr *exportError
+		errors.As(err, &exportErr)
+		writeExportError(w, exportErr)
+		return
+	}
+	client, quotaHeaders, err := chargeExport(r)
+	for key, values := range quotaHeaders {
+		w.Header()[key] = values
+	}
+	if err != nil {
+		writeExportError(w, err.(*exportError))
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "export_")
+	if err != nil {
+		log.Printf("Failed to create export directory: %v", err)
+		writeExportError(w, errExportFailed)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	outPath, warnings, hit, err := cachedOrGenerateExport(r.Context(), tmpDir, req, false, nil)
+	if errors.Is(err, errExportQueueFull) {
+		writeExportError(w, &exportError{status: http.StatusTooManyRequests, msg: "Too many exports in progress, please retry later", code: "queue_full", retryAfter: exportRetryAfter})
+		return
+	}
+	if err != nil {
+		writeExportError(w, errExportFailed)
+		return
+	}
+
+	// Stream the file from disk; national exports are too large to buffer
+	f, err := os.Open(outPath)
+	if err != nil {
+		writeExportError(w, errExportFailed)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeExportError(w, errExportFailed)
+		return
+	}
+	filename := req.filename()
+
+	recordExport(exportMetricKey{
+		Format:       req.formatName,
+		HasYears:     req.years != "",
+		HasGemeinden: req.gemeinden != "",
+		HasBBox:      req.area != nil,
+	})
+	recordExportBytes(client, info.Size())
+	audit(r, "export", "", map[string]interface{}{
+		"format":    req.formatName,
+		"years":     req.years,
+		"gemeinden": req.gemeinden,
+		"bytes":     info.Size(),
+		"cached":    hit,
+	})
+
+	if len(warnings) > 0 {
+		w.Header().Set("X-Export-Warning", strings.Join(warnings, "; "))
+	}
+	if hit {
+		w.Header().Set("X-Export-Cache", "hit")
+	} else {
+		w.Header().Set("X-Export-Cache", "miss")
+	}
+	w.Header().Set("Content-Type", req.contentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	// ServeContent sets Content-Length and answers range requests, so
+	// interrupted downloads can resume. Exports that aren't cached are
+	// generated anew for each request, with other timestamps inside, so
+	// they are always sent whole.
+	etag, modified, ok := cachedExportVersion(outPath)
+	if ok {
+		w.Header().Set("ETag", etag)
+	} else {
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, filename, modified, f)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Generated exports are cached in processing/export_cache, keyed by a
+// hash of everything that shapes the file: format and options, the
+// filter, the caller's data scope and the dataset version, taken from
+// the GeoPackage's size and modification time. Each entry is the file
+// plus a <key>.meta with its warnings. invalidateCaches empties the
+// cache when data is published, rolled back or restored; beyond
+// export_cache_max_bytes the least recently used entries are evicted.
+
+// Guards the cache directory
+var exportCacheMutex sync.Mutex
+
+type exportCacheEntry struct {
+	File     string    `json:"file"`
+	Warnings []string  `json:"warnings,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+func exportCacheDir() string {
+	return filepath.Join(config.ProcessingDir, "export_cache")
+}
+
+// exportCacheKey hashes the parameters of req and the dataset version.
+func exportCacheKey(req exportRequest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "format=%s\nyears=%s\ngemeinden=%s\nstates=%s\n", req.formatName, req.years, req.gemeinden, strings.Join(req.states, ","))
+	fmt.Fprintf(h, "precision=%d\ndelimiter=%c\nbom=%t\nsimplify=%g\nsrs=%s\n", req.opts.precision, req.opts.delimiter, req.opts.bom, req.opts.simplify, req.opts.srs)
+	fmt.Fprintf(h, "scope=%s\narea=%s\nlayers=%s\nbundle=%t\nformats=%s\n", req.scopeCond, req.areaKey, strings.Join(req.layers, ","), req.bundle, strings.Join(req.formats, ","))
+	if info, err := os.Stat(geoPackagePath()); err == nil {
+		fmt.Fprintf(h, "size=%d\nmtime=%d\n", info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedExport returns the cached file and warnings for key, marking the
+// entry as used.
+func cachedExport(key string) (string, []string, bool) {
+	if config.ExportCacheMaxBytes <= 0 {
+		return "", nil, false
+	}
+	exportCacheMutex.Lock()
+	defer exportCacheMutex.Unlock()
+	data, err := os.ReadFile(filepath.Join(exportCacheDir(), key+".meta"))
+	if err != nil {
+		return "", nil, false
+	}
+	var entry exportCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return "", nil, false
+	}
+	path := filepath.Join(exportCacheDir(), entry.File)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return "", nil, false
+	}
+	return path, entry.Warnings, true
+}
+
+// cachedExportVersion returns the entity tag and creation time of the
+// cached export at path, which change whenever it is generated anew; ok
+// is false for files outside the cache.
+func cachedExportVersion(path string) (etag string, created time.Time, ok bool) {
+	if filepath.Dir(path) != exportCacheDir() {
+		return "", time.Time{}, false
+	}
+	name := filepath.Base(path)
+	key, _, _ := strings.Cut(name, ".")
+	exportCacheMutex.Lock()
+	data, err := os.ReadFile(filepath.Join(exportCacheDir(), key+".meta"))
+	exportCacheMutex.Unlock()
+	var entry exportCacheEntry
+	if err != nil || json.Unmarshal(data, &entry) != nil || entry.File != name {
+		return "", time.Time{}, false
+	}
+	return fmt.Sprintf(`"%s-%x"`, key, entry.Created.UnixNano()), entry.Created, true
+}
+
+// storeExport moves the generated file at path into the cache and
+// returns its new path. If the cache is disabled or the file can't be
+// kept, path is returned unchanged.
+func storeExport(key, path string, warnings []string) string {
+	if config.ExportCacheMaxBytes <= 0 {
+		return path
+	}
+	exportCacheMutex.Lock()
+	defer exportCacheMutex.Unlock()
+	if err := os.MkdirAll(exportCacheDir(), 0755); err != nil {
+		log.Printf("Failed to create export cache: %v", err)
+		return path
+	}
+	// Keep the extension, .shp.zip included
+	name := filepath.Base(path)
+	if i := strings.Index(name, "."); i >= 0 {
+		name = key + name[i:]
+	} else {
+		name = key
+	}
+	cached := filepath.Join(exportCacheDir(), name)
+	if err := moveFile(path, cached); err != nil {
+		log.Printf("Failed to cache export: %v", err)
+		return path
+	}
+	data, _ := json.Marshal(exportCacheEntry{File: name, Warnings: warnings, Created: time.Now().UTC()})
+	meta := filepath.Join(exportCacheDir(), key+".meta")
+	err := os.WriteFile(meta+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(meta+".tmp", meta)
+	}
+	if err != nil {
+		log.Printf("Failed to cache export: %v", err)
+	}
+	evictExportCacheLocked(name)
+	return cached
+}
+
+// cachedOrGenerateExport returns the export for req from the cache, or
+// generates it into dir and caches it; hit tells which. Generating waits
+// for an export worker, if the queue isn't full or wait is set.
+func cachedOrGenerateExport(ctx context.Context, dir string, req exportRequest, wait bool, progress func(step string)) (path string, warnings []string, hit bool, err error) {
+	key := exportCacheKey(req)
+	if path, warnings, ok := cachedExport(key); ok {
+		return path, warnings, true, nil
+	}
+	if progress != nil {
+		progress("queued")
+	}
+	release, err := acquireExportWorker(ctx, wait)
+	if err != nil {
+		return "", nil, false, err
+	}
+	defer release()
+	path, warnings, err = generateExport(ctx, dir, req, progress)
+	if err != nil {
+		return "", nil, false, err
+	}
+	return storeExport(key, path, warnings), warnings, false, nil
+}
+
+// evictExportCacheLocked removes the least recently used entries until
+// the cache fits export_cache_max_bytes, sparing the entry just stored.
+func evictExportCacheLocked(keep string) {
+	entries, err := os.ReadDir(exportCacheDir())
+	if err != nil {
+		return
+	}
+	type cachedFile struct {
+		name  string
+		size  int64
+		mtime time.Time
+	}
+	var files []cachedFile
+	var total int64
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".meta") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cachedFile{e.Name(), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].mtime.Before(files[b].mtime) })
+	for _, f := range files {
+		if total <= config.ExportCacheMaxBytes {
+			break
+		}
+		if f.name == keep {
+			continue
+		}
+		key, _, _ := strings.Cut(f.name, ".")
+		os.Remove(filepath.Join(exportCacheDir(), key+".meta"))
+		os.Remove(filepath.Join(exportCacheDir(), f.name))
+		total -= f.size
+	}
+}
+
+// clearExportCache removes all cached exports and returns how many
+// there were.
+func clearExportCache() int {
+	exportCacheMutex.Lock()
+	defer exportCacheMutex.Unlock()
+	entries, err := os.ReadDir(exportCacheDir())
+	if err != nil {
+		return 0
+	}
+	cleared := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".meta") {
+			cleared++
+		}
+	}
+	if err := os.RemoveAll(exportCacheDir()); err != nil {
+		log.Printf("Failed to clear export cache: %v", err)
+	}
+	return cleared
+}
+
+// handleClearExportCache empties the export cache and reopens the
+// GeoPackage, for data replaced outside of publish and restore.
+func handleClearExportCache(w http.ResponseWriter, r *http.Request) {
+	cleared := clearExportCache()
+	invalidateCaches()
+	audit(r, "clear_export_cache", "", map[string]interface{}{"cleared": cleared})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"cleared": cleared})
+}
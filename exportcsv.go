@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Attribute exports without geometry, read straight from the filtered
+// GeoPackage.
+
+// readExportRows reads the features of the GeoPackage export at path,
+// leaving out the geometry: header gets the column names, then row the
+// values of each feature.
+func readExportRows(path string, header func(columns []string) error, row func(values []interface{}) error) error {
+	db, err := openDB(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT * FROM gemeinden ORDER BY fid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	all, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	// Scan everything, pass on all but geom
+	var columns []string
+	var keep []int
+	for i, name := range all {
+		if name != "geom" {
+			columns = append(columns, name)
+			keep = append(keep, i)
+		}
+	}
+	if err := header(columns); err != nil {
+		return err
+	}
+	scanned := make([]interface{}, len(all))
+	dest := make([]interface{}, len(all))
+	for i := range dest {
+		dest[i] = &scanned[i]
+	}
+	values := make([]interface{}, len(keep))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, idx := range keep {
+			values[i] = scanned[idx]
+		}
+		if err := row(values); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// formatCSVValue formats an attribute value; NULL becomes empty.
+func formatCSVValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func convertCSV(src, dst string, opts exportOptions) ([]string, error) {
+	f, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := bufio.NewWriter(f)
+	if opts.bom {
+		buf.WriteString("\ufeff")
+	}
+	cw := csv.NewWriter(buf)
+	cw.Comma = opts.delimiter
+
+	var record []string
+	err = readExportRows(src, cw.Write, func(values []interface{}) error {
+		record = record[:0]
+		for _, v := range values {
+			record = append(record, formatCSVValue(v))
+		}
+		return cw.Write(record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return nil, err
+	}
+	if err := buf.Flush(); err != nil {
+		return nil, err
+	}
+	return nil, f.Close()
+}
+
+// convertJSON writes the attributes as a JSON array of records, one
+// object per Gemeinde with the columns in export order, for dashboards
+// that bring their own geometries.
+func convertJSON(src, dst string, opts exportOptions) ([]string, error) {
+	f, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := bufio.NewWriter(f)
+
+	var keys [][]byte
+	first := true
+	buf.WriteString("[")
+	err = readExportRows(src, func(columns []string) error {
+		for _, c := range columns {
+			key, _ := json.Marshal(c)
+			keys = append(keys, key)
+		}
+		return nil
+	}, func(values []interface{}) error {
+		if !first {
+			buf.WriteString(",")
+		}
+		first = false
+		buf.WriteString("\n{")
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			value, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.Write(keys[i])
+			buf.WriteString(":")
+			buf.Write(value)
+		}
+		buf.WriteString("}")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n]\n")
+	if err := buf.Flush(); err != nil {
+		return nil, err
+	}
+	return nil, f.Close()
+}
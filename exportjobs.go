@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export jobs generate large exports in the background instead of
+// within the request. The finished file is kept in processing/exports
+// for export_job_hours and fetched from a signed download link, so it
+// can be handed to a download manager without credentials. Jobs are
+// cancelled through DELETE /api/jobs/{id}.
+
+// Key the download links are signed with; from config, or random per
+// process
+var downloadKey []byte
+
+func initDownloadKey() {
+	if config.DownloadSecret != "" {
+		downloadKey = []byte(config.DownloadSecret)
+		return
+	}
+	downloadKey = []byte(generateToken())
+	log.Printf("download_secret is not set, export download links are only valid until restart")
+}
+
+func exportJobsDir() string {
+	return filepath.Join(config.ProcessingDir, "exports")
+}
+
+// exportJobParams are the stored parameters of an export job: the
+// /api/export query, its GeoJSON polygon, and the data scope and quota
+// client of the user who submitted it.
+type exportJobParams struct {
+	Query   string          `json:"query"`
+	Polygon json.RawMessage `json:"polygon,omitempty"`
+	Scope   string          `json:"scope,omitempty"`
+	Client  string          `json:"client,omitempty"`
+}
+
+type exportJobResult struct {
+	// Name in exportJobsDir, and the name the file is downloaded as
+	File        string    `json:"file"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Bytes       int64     `json:"bytes"`
+	Warnings    []string  `json:"warnings,omitempty"`
+	Expires     time.Time `json:"expires"`
+}
+
+// submitExportJob queues an export. The parameters are those of
+// /api/export as a JSON object, e.g. {"years": "2022,2023", "format":
+// "csv", "precision": 5}, with the GeoJSON area of POST requests as
+// "polygon".
+func submitExportJob(r *http.Request, j *job) error {
+	var raw map[string]json.RawMessage
+	if len(j.Params) > 0 && string(j.Params) != "null" {
+		if err := json.Unmarshal(j.Params, &raw); err != nil {
+			return fmt.Errorf("invalid export parameters: %w", err)
+		}
+	}
+	params := exportJobParams{Polygon: raw["polygon"], Scope: dataScopeCondition(r)}
+	delete(raw, "polygon")
+	query := url.Values{}
+	for key, value := range raw {
+		dec := json.NewDecoder(bytes.NewReader(value))
+		dec.UseNumber()
+		var v interface{}
+		dec.Decode(&v)
+		switch v := v.(type) {
+		case string:
+			query.Set(key, v)
+		case json.Number:
+			query.Set(key, v.String())
+		default:
+			return fmt.Errorf("export parameter %s must be a string or number", key)
+		}
+	}
+	if _, err := parseExportRequest(query, params.Polygon, params.Scope); err != nil {
+		return err
+	}
+	// Submitting counts as an export; the size is charged when it is done
+	client, _, err := chargeExport(r)
+	if err != nil {
+		return err
+	}
+	params.Client = client
+	params.Query = query.Encode()
+	j.Params, _ = json.Marshal(params)
+	return jobs.submit(j, false)
+}
+
+func runExportJob(ctx context.Context, j *job) (interface{}, error) {
+	var params exportJobParams
+	if err := json.Unmarshal(j.Params, &params); err != nil {
+		return nil, err
+	}
+	query, err := url.ParseQuery(params.Query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseExportRequest(query, params.Polygon, params.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := exportJobsDir()
+	tmpDir := filepath.Join(dir, j.ID+".tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	outPath, warnings, _, err := cachedOrGenerateExport(ctx, tmpDir, req, true, func(step string) {
+		jobs.setProgress(j.ID, step)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("failed to generate export")
+	}
+	// The file may be in the export cache, which can evict it any time
+	file := j.ID + req.ext()
+	if err := os.Link(outPath, filepath.Join(dir, file)); err != nil {
+		if _, err := copyFile(outPath, filepath.Join(dir, file)); err != nil {
+			return nil, err
+		}
+	}
+	info, err := os.Stat(filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	recordExportBytes(params.Client, info.Size())
+
+	recordExport(exportMetricKey{
+		Format:       req.formatName,
+		HasYears:     req.years != "",
+		HasGemeinden: req.gemeinden != "",
+		HasBBox:      req.area != nil,
+	})
+	return exportJobResult{
+		File:        file,
+		Filename:    req.filename(),
+		ContentType: req.contentType(),
+		Bytes:       info.Size(),
+		Warnings:    warnings,
+		Expires:     time.Now().UTC().Add(time.Duration(config.ExportJobHours) * time.Hour),
+	}, nil
+}
+
+// downloadSignature signs the download link of an export job.
+func downloadSignature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, downloadKey)
+	fmt.Fprintf(mac, "%s\n%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func downloadURL(id string, expires time.Time) string {
+	return fmt.Sprintf("/api/export/jobs/%s/download?expires=%d&signature=%s",
+		url.PathEscape(id), expires.Unix(), downloadSignature(id, expires.Unix()))
+}
+
+// exportJobFor returns the export job id if the caller of r submitted it
+// or is an admin.
+func exportJobFor(r *http.Request, id string) (job, bool) {
+	j, ok := jobs.get(id)
+	if !ok || j.Type != "export" {
+		return job{}, false
+	}
+	p, _ := authenticate(r)
+	if p.User.Username != j.User && p.User.Role != roleAdmin {
+		return job{}, false
+	}
+	return j, true
+}
+
+// handleSubmitExportJob queues an export; the body holds the parameters
+// of /api/export as a JSON object.
+func handleSubmitExportJob(w http.ResponseWriter, r *http.Request) {
+	var params json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	p, _ := authenticate(r)
+	j := &job{Type: "export", Params: params, User: p.User.Username}
+	var exportErr *exportError
+	err := submitExportJob(r, j)
+	switch {
+	case errors.As(err, &exportErr):
+		writeExportError(w, exportErr)
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit(r, "export_job_submit", "", map[string]interface{}{"job": j.ID, "params": string(j.Params)})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/export/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     j.ID,
+		"status": "queued",
+	})
+}
+
+// handleGetExportJob reports the progress of an export job and, once it
+// is done, the download link.
+func handleGetExportJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := exportJobFor(r, r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "export job not found")
+		return
+	}
+	resp := map[string]interface{}{
+		"id":       j.ID,
+		"status":   j.Status,
+		"created":  j.Created,
+		"started":  j.Started,
+		"finished": j.Finished,
+	}
+	if j.Progress != "" {
+		resp["progress"] = j.Progress
+	}
+	if j.Error != "" {
+		resp["error"] = j.Error
+	}
+	var result exportJobResult
+	if j.Status == "done" && json.Unmarshal(j.Result, &result) == nil {
+		resp["filename"] = result.Filename
+		resp["bytes"] = result.Bytes
+		resp["expires"] = result.Expires
+		if len(result.Warnings) > 0 {
+			resp["warnings"] = result.Warnings
+		}
+		if time.Now().Before(result.Expires) {
+			resp["download_url"] = downloadURL(j.ID, result.Expires)
+		} else {
+			resp["status"] = "expired"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleExportDownload serves the file of a finished export job. The
+// signature takes the place of credentials.
+func handleExportDownload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	signature, _ := hex.DecodeString(r.URL.Query().Get("signature"))
+	want, _ := hex.DecodeString(downloadSignature(id, expires))
+	if err != nil || !hmac.Equal(signature, want) {
+		writeJSONError(w, http.StatusForbidden, "invalid download link")
+		return
+	}
+	if time.Now().Unix() > expires {
+		writeJSONError(w, http.StatusGone, "download link has expired")
+		return
+	}
+	j, ok := jobs.get(id)
+	var result exportJobResult
+	if !ok || j.Status != "done" || json.Unmarshal(j.Result, &result) != nil {
+		writeJSONError(w, http.StatusNotFound, "export not found")
+		return
+	}
+	f, err := os.Open(filepath.Join(exportJobsDir(), result.File))
+	if err != nil {
+		writeJSONError(w, http.StatusGone, "export file has been removed")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read export file")
+		return
+	}
+	audit(r, "export_download", j.User, map[string]interface{}{"job": j.ID, "bytes": info.Size()})
+
+	if len(result.Warnings) > 0 {
+		w.Header().Set("X-Export-Warning", strings.Join(result.Warnings, "; "))
+	}
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Content-Type", result.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", result.Filename))
+	http.ServeContent(w, r, result.Filename, info.ModTime(), f)
+}
+
+// removeExpiredExports deletes export files whose job is gone, failed or
+// past its expiry, and work directories of jobs no longer running.
+func removeExpiredExports() {
+	entries, err := os.ReadDir(exportJobsDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to list export files: %v", err)
+		}
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		id, _, _ := strings.Cut(e.Name(), ".")
+		j, ok := jobs.get(id)
+		if ok && j.active() {
+			continue
+		}
+		var result exportJobResult
+		if ok && j.Status == "done" && json.Unmarshal(j.Result, &result) == nil &&
+			e.Name() == result.File && now.Before(result.Expires) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(exportJobsDir(), e.Name())); err != nil {
+			log.Printf("Failed to remove expired export %s: %v", e.Name(), err)
+		}
+	}
+}
+
+// startExportCleanup removes expired export files now and then every ten
+// minutes.
+func startExportCleanup() {
+	go func() {
+		removeExpiredExports()
+		for range time.Tick(10 * time.Minute) {
+			removeExpiredExports()
+		}
+	}()
+}
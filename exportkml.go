@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KML exports for Google Earth. Each Gemeinde is a placemark named after
+// it, described by its code, Bundesland and loss area, and filled in the
+// colour of its loss area class. KMZ is the same KML zipped as doc.kml.
+
+// lossAreaClasses colour placemarks by forest loss over the exported
+// years, from the highest class down; OGR style colours are #RRGGBBAA.
+var lossAreaClasses = []struct {
+	minHa float64
+	color string
+}{
+	{200, "#99000db0"},
+	{50, "#e34a33b0"},
+	{10, "#fc8d59b0"},
+	{1, "#fdcc8ab0"},
+	{0, "#fef0d9b0"},
+}
+
+// lossAreaExpr sums the loss area columns of the export at path.
+func lossAreaExpr(path string) (string, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT name FROM pragma_table_info('gemeinden') ORDER BY cid")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var terms []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		if m := yearColumnPattern.FindStringSubmatch(name); m != nil && m[1] == "loss_area_ha" {
+			terms = append(terms, "COALESCE("+name+", 0)")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if len(terms) == 0 {
+		return "0", nil
+	}
+	return strings.Join(terms, " + "), nil
+}
+
+func convertKML(src, dst string, opts exportOptions) ([]string, error) {
+	loss, err := lossAreaExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	var style strings.Builder
+	style.WriteString("CASE")
+	for _, class := range lossAreaClasses {
+		fmt.Fprintf(&style, " WHEN loss >= %g THEN 'BRUSH(fc:%s);PEN(c:#333333ff,w:1px)'", class.minHa, class.color)
+	}
+	style.WriteString(" END")
+	sql := fmt.Sprintf("SELECT geom, name, iso, state, population, ROUND(loss, 1) AS loss_area_ha, "+
+		"'Gemeindekennziffer ' || iso || ', ' || state || ': ' || printf('%%.1f', loss) || ' ha Waldverlust' AS description, "+
+		"%s AS OGR_STYLE FROM (SELECT *, %s AS loss FROM gemeinden)", style.String(), loss)
+	// The driver reprojects to WGS 84, the only CRS KML knows
+	var warnings []string
+	if opts.srs != "" {
+		warnings = append(warnings, "KML is always in WGS 84, srs was ignored")
+	}
+	return warnings, runOgr2ogr("-f", "KML", dst, src, "-dialect", "SQLite", "-sql", sql, "-nln", "gemeinden",
+		"-dsco", "NameField=name", "-dsco", "DescriptionField=description")
+}
+
+func convertKMZ(src, dst string, opts exportOptions) ([]string, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(dst), "kmz_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	warnings, err := convertKML(src, filepath.Join(dir, "doc.kml"), opts)
+	if err != nil {
+		return nil, err
+	}
+	return warnings, writeZip(dst, dir, []string{"doc.kml"})
+}
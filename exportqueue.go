@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Exports are generated by at most export_workers at a time, so a burst
+// of requests doesn't start one ogr2ogr process each. Further requests
+// wait for a worker; once export_queue_size are waiting, /api/export
+// answers 429. Export jobs are already queued by the job runner and
+// always wait.
+
+var (
+	exportWorkers  chan struct{}
+	exportWaiting  atomic.Int64
+	exportRejected atomic.Int64
+)
+
+var errExportQueueFull = errors.New("export queue is full")
+
+// Seconds clients are asked to wait when the queue is full
+const exportRetryAfter = 30
+
+func initExportWorkers() {
+	exportWorkers = make(chan struct{}, config.ExportWorkers)
+}
+
+// acquireExportWorker waits for a free worker and returns the function
+// releasing it. Unless wait is set, it gives up right away if the queue
+// is full.
+func acquireExportWorker(ctx context.Context, wait bool) (func(), error) {
+	release := func() { <-exportWorkers }
+	select {
+	case exportWorkers <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if n := exportWaiting.Add(1); !wait && n > int64(config.ExportQueueSize) {
+		exportWaiting.Add(-1)
+		exportRejected.Add(1)
+		return nil, errExportQueueFull
+	}
+	defer exportWaiting.Add(-1)
+	select {
+	case exportWorkers <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The Gemeinden API serves the attributes of the Gemeinden as JSON, so
+// pages can fill lists and tables without downloading the GeoPackage.
+// Like exports it only covers the Gemeinden of the caller's data scope.
+
+const (
+	defaultGemeindenLimit = 50
+	maxGemeindenLimit     = 500
+)
+
+type gemeindeItem struct {
+	ID         int64               `json:"id"`
+	Name       string              `json:"name"`
+	ISO        string              `json:"iso"`
+	State      string              `json:"state"`
+	Population *int64              `json:"population"`
+	Indicators map[string]*float64 `json:"indicators,omitempty"`
+}
+
+// gemeindenFilter is the SQL condition of the filter parameters, with
+// its arguments.
+type gemeindenFilter struct {
+	conds []string
+	args  []interface{}
+}
+
+// parseGemeindenFilter reads the filter parameters: state and iso, each
+// a comma-separated list, name, a part of the name, and population_min
+// and population_max.
+func parseGemeindenFilter(query url.Values) (gemeindenFilter, error) {
+	var f gemeindenFilter
+	if states := splitParam(query.Get("state")); len(states) > 0 {
+		for _, state := range states {
+			if !bundeslaender[state] {
+				return f, fmt.Errorf("unknown Bundesland %q", state)
+			}
+		}
+		f.conds = append(f.conds, "state IN ("+sqlQuoteList(states)+")")
+	}
+	if isos := splitParam(query.Get("iso")); len(isos) > 0 {
+		for _, iso := range isos {
+			if !isoPattern.MatchString(iso) {
+				return f, fmt.Errorf("invalid Gemeinde code %q; codes have five digits", iso)
+			}
+		}
+		f.conds = append(f.conds, "iso IN ("+sqlQuoteList(isos)+")")
+	}
+	if name := strings.TrimSpace(query.Get("name")); name != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(name)
+		f.conds = append(f.conds, `name LIKE ? ESCAPE '\'`)
+		f.args = append(f.args, "%"+escaped+"%")
+	}
+	for _, bound := range []struct{ param, op string }{{"population_min", ">="}, {"population_max", "<="}} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("%s must be a whole number", bound.param)
+		}
+		f.conds = append(f.conds, "population "+bound.op+" ?")
+		f.args = append(f.args, n)
+	}
+	return f, nil
+}
+
+// where combines the filter with the data scope condition.
+func (f gemeindenFilter) where(scopeCond string) string {
+	conds := f.conds
+	if scopeCond != "" {
+		conds = append(slices.Clone(conds), scopeCond)
+	}
+	if len(conds) == 0 {
+		return "1"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// indicatorYear returns the year parameter, which must be one of the
+// available years, or else the latest of them.
+func indicatorYear(query url.Values, available []string) (string, error) {
+	year := query.Get("year")
+	switch {
+	case year == "" && len(available) > 0:
+		return available[len(available)-1], nil
+	case year == "":
+		return "", nil
+	case !slices.Contains(available, year):
+		return "", fmt.Errorf("no data for year %q", year)
+	}
+	return year, nil
+}
+
+// gemeindenOrder returns the ORDER BY clause for the sort parameter: a
+// base column or an indicator of the year, descending with a leading
+// "-". Ties are broken by fid.
+func gemeindenOrder(sort, year string) (string, error) {
+	column, desc := strings.CutPrefix(sort, "-")
+	switch {
+	case column == "" || column == "iso":
+		column = "iso"
+	case column == "id":
+		column = "fid"
+	case column == "name" || column == "state" || column == "population":
+	case slices.Contains(indicators, column) && year != "":
+		column += "_" + year
+	default:
+		return "", fmt.Errorf("cannot sort by %q", column)
+	}
+	order := fmt.Sprintf("%q", column)
+	if desc {
+		order += " DESC"
+	}
+	return order + ", fid", nil
+}
+
+// offsetParams reads ?limit= and ?offset= (default 0), replying 400 when
+// either is out of range.
+func offsetParams(w http.ResponseWriter, r *http.Request, defaultSize, maxSize int) (limit, offset int, ok bool) {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if q.Get("limit") == "" {
+		limit, err = defaultSize, nil
+	}
+	if err != nil || limit < 1 || limit > maxSize {
+		writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxSize))
+		return 0, 0, false
+	}
+	offset, err = strconv.Atoi(q.Get("offset"))
+	if q.Get("offset") == "" {
+		offset, err = 0, nil
+	}
+	if err != nil || offset < 0 {
+		writeJSONError(w, http.StatusBadRequest, "offset must not be negative")
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
+
+// handleListGemeinden lists the Gemeinden in pages of ?limit= from
+// ?offset=, with the indicators of ?year= (the latest by default),
+// filtered by the parameters of parseGemeindenFilter and sorted by
+// ?sort=.
+func handleListGemeinden(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := offsetParams(w, r, defaultGemeindenLimit, maxGemeindenLimit)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	available, err := datasetYears()
+	if err != nil {
+		log.Printf("Reading dataset years failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinden")
+		return
+	}
+	year, err := indicatorYear(query, available)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseGemeindenFilter(query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	order, err := gemeindenOrder(query.Get("sort"), year)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	where := filter.where(dataScopeCondition(r))
+	var total int64
+	if err := gpkgDB().QueryRow("SELECT COUNT(*) FROM gemeinden WHERE "+where, filter.args...).Scan(&total); err != nil {
+		log.Printf("Listing Gemeinden failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinden")
+		return
+	}
+	columns := "fid, name, iso, state, population"
+	if year != "" {
+		for _, indicator := range indicators {
+			columns += fmt.Sprintf(", %q", indicator+"_"+year)
+		}
+	}
+	rows, err := gpkgDB().Query("SELECT "+columns+" FROM gemeinden WHERE "+where+" ORDER BY "+order+" LIMIT ? OFFSET ?",
+		append(filter.args, limit, offset)...)
+	if err != nil {
+		log.Printf("Listing Gemeinden failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinden")
+		return
+	}
+	defer rows.Close()
+	gemeinden := []gemeindeItem{}
+	for rows.Next() {
+		var g gemeindeItem
+		var population sql.NullInt64
+		values := make([]sql.NullFloat64, len(indicators))
+		dest := []interface{}{&g.ID, &g.Name, &g.ISO, &g.State, &population}
+		if year != "" {
+			for i := range values {
+				dest = append(dest, &values[i])
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Listing Gemeinden failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinden")
+			return
+		}
+		if population.Valid {
+			g.Population = &population.Int64
+		}
+		if year != "" {
+			g.Indicators = make(map[string]*float64, len(indicators))
+			for i, indicator := range indicators {
+				if values[i].Valid {
+					g.Indicators[indicator] = &values[i].Float64
+				} else {
+					g.Indicators[indicator] = nil
+				}
+			}
+		}
+		gemeinden = append(gemeinden, g)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Listing Gemeinden failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinden")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"gemeinden": gemeinden,
+		"total":     total,
+		"limit":     limit,
+		"offset":    offset,
+		"year":      year,
+	})
+}
+
+// gemeindeDetail is a Gemeinde with all of its attributes.
+type gemeindeDetail struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	ISO        string `json:"iso"`
+	State      string `json:"state"`
+	Population *int64 `json:"population"`
+	// Indicators by year, and the columns that are neither
+	Years      map[string]map[string]interface{} `json:"years"`
+	Attributes map[string]interface{}            `json:"attributes,omitempty"`
+	Geometry   *geoJSONGeometry                  `json:"geometry,omitempty"`
+}
+
+// handleGetGemeinde returns one Gemeinde with the indicators of every
+// year and, unless ?geometry=false, its outline as GeoJSON.
+func handleGetGemeinde(w http.ResponseWriter, r *http.Request) {
+	iso := r.PathValue("iso")
+	if !isoPattern.MatchString(iso) {
+		writeJSONError(w, http.StatusBadRequest, "invalid Gemeinde code; codes have five digits")
+		return
+	}
+	withGeometry := true
+	switch r.URL.Query().Get("geometry") {
+	case "", "true":
+	case "false":
+		withGeometry = false
+	default:
+		writeJSONError(w, http.StatusBadRequest, "geometry must be true or false")
+		return
+	}
+
+	where := "iso = ?"
+	if cond := dataScopeCondition(r); cond != "" {
+		where += " AND " + cond
+	}
+	rows, err := gpkgDB().Query("SELECT * FROM gemeinden WHERE "+where+" ORDER BY fid LIMIT 1", iso)
+	if err != nil {
+		log.Printf("Reading Gemeinde %s failed: %v", iso, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinde")
+		return
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Printf("Reading Gemeinde %s failed: %v", iso, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinde")
+		return
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			log.Printf("Reading Gemeinde %s failed: %v", iso, err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinde")
+			return
+		}
+		writeJSONError(w, http.StatusNotFound, "Gemeinde not found")
+		return
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		log.Printf("Reading Gemeinde %s failed: %v", iso, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinde")
+		return
+	}
+
+	g := gemeindeDetail{Years: make(map[string]map[string]interface{}), Attributes: make(map[string]interface{})}
+	for i, column := range columns {
+		value := values[i]
+		switch column {
+		case "fid":
+			g.ID, _ = value.(int64)
+		case "name":
+			g.Name, _ = value.(string)
+		case "iso":
+			g.ISO, _ = value.(string)
+		case "state":
+			g.State, _ = value.(string)
+		case "population":
+			if n, ok := value.(int64); ok {
+				g.Population = &n
+			}
+		case "geom":
+			blob, _ := value.([]byte)
+			if !withGeometry || blob == nil {
+				continue
+			}
+			shape, err := parseGeoPackageGeometry(blob)
+			if err != nil {
+				log.Printf("Geometry of Gemeinde %s: %v", iso, err)
+				writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinde")
+				return
+			}
+			geometry := shape.geoJSON()
+			g.Geometry = &geometry
+		default:
+			if m := yearColumnPattern.FindStringSubmatch(column); m != nil && slices.Contains(indicators, m[1]) {
+				if g.Years[m[2]] == nil {
+					g.Years[m[2]] = make(map[string]interface{}, len(indicators))
+				}
+				g.Years[m[2]][m[1]] = value
+			} else {
+				g.Attributes[column] = value
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g)
+}
+
+// timeseriesPoint is the value of an indicator in one year, with the
+// derived values asked for.
+type timeseriesPoint struct {
+	Year       int      `json:"year"`
+	Value      *float64 `json:"value"`
+	Cumulative *float64 `json:"cumulative,omitempty"`
+	// Change from the year before; null for the first year or a missing
+	// value
+	Delta *float64 `json:"delta,omitempty"`
+}
+
+// handleGemeindeTimeseries returns the yearly values of the indicators
+// in ?indicator= (all if empty) for one Gemeinde. ?derive= adds
+// cumulative sums ("cumulative") and year-over-year changes ("delta").
+func handleGemeindeTimeseries(w http.ResponseWriter, r *http.Request) {
+	iso := r.PathValue("iso")
+	if !isoPattern.MatchString(iso) {
+		writeJSONError(w, http.StatusBadRequest, "invalid Gemeinde code; codes have five digits")
+		return
+	}
+	query := r.URL.Query()
+	selected := splitParam(query.Get("indicator"))
+	for _, indicator := range selected {
+		if !slices.Contains(indicators, indicator) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown indicator %q; indicators are %s", indicator, strings.Join(indicators, ", ")))
+			return
+		}
+	}
+	if len(selected) == 0 {
+		selected = indicators
+	}
+	var cumulative, delta bool
+	for _, d := range splitParam(query.Get("derive")) {
+		switch d {
+		case "cumulative":
+			cumulative = true
+		case "delta":
+			delta = true
+		default:
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown derived value %q; use cumulative or delta", d))
+			return
+		}
+	}
+
+	years, err := datasetYears()
+	if err != nil {
+		log.Printf("Reading dataset years failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinde")
+		return
+	}
+	columns := []string{"name"}
+	for _, indicator := range selected {
+		for _, year := range years {
+			columns = append(columns, indicator+"_"+year)
+		}
+	}
+	where := "iso = ?"
+	if cond := dataScopeCondition(r); cond != "" {
+		where += " AND " + cond
+	}
+	var name string
+	values := make([]sql.NullFloat64, len(columns)-1)
+	dest := []interface{}{&name}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	err = gpkgDB().QueryRow("SELECT "+quoteIdentifiers(columns)+" FROM gemeinden WHERE "+where+" ORDER BY fid LIMIT 1", iso).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "Gemeinde not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Reading time series of Gemeinde %s failed: %v", iso, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read Gemeinde")
+		return
+	}
+
+	series := make(map[string][]timeseriesPoint, len(selected))
+	for i, indicator := range selected {
+		points := make([]timeseriesPoint, len(years))
+		var sum float64
+		for j, year := range years {
+			p := &points[j]
+			p.Year, _ = strconv.Atoi(year)
+			if v := values[i*len(years)+j]; v.Valid {
+				p.Value = &v.Float64
+				sum += v.Float64
+			}
+			if cumulative {
+				p.Cumulative = roundDerived(sum)
+			}
+			if delta && j > 0 && p.Value != nil && points[j-1].Value != nil {
+				p.Delta = roundDerived(*p.Value - *points[j-1].Value)
+			}
+		}
+		series[indicator] = points
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"iso":    iso,
+		"name":   name,
+		"series": series,
+	})
+}
+
+// roundDerived drops the floating point noise of sums and differences;
+// the indicators have at most a few decimal places.
+func roundDerived(v float64) *float64 {
+	v = math.Round(v*1e6) / 1e6
+	return &v
+}
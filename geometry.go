@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Polygon geometry for spatial filters: decoding GeoPackage geometry
+// blobs and GeoJSON, and testing whether two areas intersect. Gemeinden
+// are (multi)polygons in EPSG:4326, so that is all this handles.
+
+// ring is a closed line of lon/lat positions; a polygon's first ring is
+// its exterior, the others are holes.
+type ring [][2]float64
+type polygon []ring
+type multiPolygon []polygon
+
+var errNotPolygonal = errors.New("geometry is not a Polygon or MultiPolygon")
+
+// bounds returns minx, miny, maxx, maxy.
+func (mp multiPolygon) bounds() [4]float64 {
+	b := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, p := range mp {
+		for _, r := range p {
+			for _, pt := range r {
+				b[0], b[1] = math.Min(b[0], pt[0]), math.Min(b[1], pt[1])
+				b[2], b[3] = math.Max(b[2], pt[0]), math.Max(b[3], pt[1])
+			}
+		}
+	}
+	return b
+}
+
+// Radius of the sphere areas are measured on, that of WGS 84 at the
+// equator
+const earthRadius = 6378137
+
+// areaHectares returns the area on the sphere, holes subtracted.
+func (mp multiPolygon) areaHectares() float64 {
+	var area float64
+	for _, p := range mp {
+		for i, r := range p {
+			if i == 0 {
+				area += r.sphericalArea()
+			} else {
+				area -= r.sphericalArea()
+			}
+		}
+	}
+	return area / 10000
+}
+
+// sphericalArea returns the area enclosed by the ring in square metres,
+// whichever way it winds.
+func (r ring) sphericalArea() float64 {
+	var sum float64
+	for i := 0; i+1 < len(r); i++ {
+		a, b := r[i], r[i+1]
+		sum += (b[0] - a[0]) * math.Pi / 180 *
+			(2 + math.Sin(a[1]*math.Pi/180) + math.Sin(b[1]*math.Pi/180))
+	}
+	return math.Abs(sum) * earthRadius * earthRadius / 2
+}
+
+// bboxPolygon returns the rectangle minx, miny, maxx, maxy as an area.
+func bboxPolygon(b [4]float64) multiPolygon {
+	return multiPolygon{{{{b[0], b[1]}, {b[2], b[1]}, {b[2], b[3]}, {b[0], b[3]}, {b[0], b[1]}}}}
+}
+
+// contains reports whether pt lies in the polygon, outside its holes.
+func (p polygon) contains(pt [2]float64) bool {
+	inside := false
+	for _, r := range p {
+		for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+			a, b := r[i], r[j]
+			if (a[1] > pt[1]) != (b[1] > pt[1]) &&
+				pt[0] < (b[0]-a[0])*(pt[1]-a[1])/(b[1]-a[1])+a[0] {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func (mp multiPolygon) contains(pt [2]float64) bool {
+	for _, p := range mp {
+		if p.contains(pt) {
+			return true
+		}
+	}
+	return false
+}
+
+func orientation(a, b, c [2]float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+func onSegment(a, b, p [2]float64) bool {
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
+
+func segmentsIntersect(p1, p2, q1, q2 [2]float64) bool {
+	d1, d2 := orientation(q1, q2, p1), orientation(q1, q2, p2)
+	d3, d4 := orientation(p1, p2, q1), orientation(p1, p2, q2)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(q1, q2, p1)) || (d2 == 0 && onSegment(q1, q2, p2)) ||
+		(d3 == 0 && onSegment(p1, p2, q1)) || (d4 == 0 && onSegment(p1, p2, q2))
+}
+
+// intersects reports whether the areas overlap or touch. Unless their
+// boundaries cross, every ring lies wholly inside or outside the other
+// area, so one position per ring settles it.
+func (mp multiPolygon) intersects(other multiPolygon) bool {
+	a, b := mp.bounds(), other.bounds()
+	if a[0] > b[2] || b[0] > a[2] || a[1] > b[3] || b[1] > a[3] {
+		return false
+	}
+	for _, p := range mp {
+		for _, r := range p {
+			if len(r) > 0 && other.contains(r[0]) {
+				return true
+			}
+		}
+	}
+	for _, p := range other {
+		for _, r := range p {
+			if len(r) > 0 && mp.contains(r[0]) {
+				return true
+			}
+		}
+	}
+	for _, p := range mp {
+		for _, r := range p {
+			for i := 1; i < len(r); i++ {
+				for _, q := range other {
+					for _, s := range q {
+						for j := 1; j < len(s); j++ {
+							if segmentsIntersect(r[i-1], r[i], s[j-1], s[j]) {
+								return true
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// parseGeoPackageGeometry decodes a GeoPackage geometry blob: the GP
+// header with its optional envelope, then WKB.
+func parseGeoPackageGeometry(blob []byte) (multiPolygon, error) {
+	if len(blob) < 8 || blob[0] != 'G' || blob[1] != 'P' {
+		return nil, errors.New("not a GeoPackage geometry")
+	}
+	flags := blob[3]
+	if flags&0x10 != 0 {
+		return nil, nil
+	}
+	envelope := map[byte]int{0: 0, 1: 32, 2: 48, 3: 48, 4: 64}[(flags>>1)&0x07]
+	if len(blob) < 8+envelope {
+		return nil, errors.New("truncated GeoPackage geometry")
+	}
+	r := &wkbReader{data: blob[8+envelope:]}
+	return r.readPolygonal()
+}
+
+type wkbReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *wkbReader) next(n int) []byte {
+	if r.err != nil || r.pos+n > len(r.data) {
+		if r.err == nil {
+			r.err = errors.New("truncated WKB")
+		}
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// header reads byte order, type and dimensions of a WKB geometry, ISO
+// (type + 1000/2000/3000) or extended (high bits) encoded.
+func (r *wkbReader) header() (binary.ByteOrder, uint32, int) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if r.next(1)[0] == 0 {
+		order = binary.BigEndian
+	}
+	t := order.Uint32(r.next(4))
+	dims := 2
+	if t&0x80000000 != 0 {
+		dims++
+	}
+	if t&0x40000000 != 0 {
+		dims++
+	}
+	t &= 0x0fffffff
+	switch t / 1000 {
+	case 1, 2:
+		dims++
+	case 3:
+		dims += 2
+	}
+	return order, t % 1000, dims
+}
+
+func (r *wkbReader) polygon(order binary.ByteOrder, dims int) polygon {
+	p := make(polygon, order.Uint32(r.next(4)))
+	for i := range p {
+		if r.err != nil {
+			return nil
+		}
+		n := order.Uint32(r.next(4))
+		if int(n)*dims*8 > len(r.data)-r.pos {
+			r.err = errors.New("truncated WKB")
+			return nil
+		}
+		p[i] = make(ring, n)
+		for j := range p[i] {
+			c := r.next(dims * 8)
+			p[i][j] = [2]float64{
+				math.Float64frombits(order.Uint64(c[0:8])),
+				math.Float64frombits(order.Uint64(c[8:16])),
+			}
+		}
+	}
+	return p
+}
+
+func (r *wkbReader) readPolygonal() (multiPolygon, error) {
+	order, t, dims := r.header()
+	var mp multiPolygon
+	switch t {
+	case 3:
+		mp = multiPolygon{r.polygon(order, dims)}
+	case 6:
+		n := order.Uint32(r.next(4))
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			partOrder, partType, partDims := r.header()
+			if partType != 3 {
+				return nil, errNotPolygonal
+			}
+			mp = append(mp, r.polygon(partOrder, partDims))
+		}
+	default:
+		return nil, errNotPolygonal
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return mp, nil
+}
+
+// parseGeoJSONArea reads the polygons of a GeoJSON geometry, Feature or
+// FeatureCollection.
+func parseGeoJSONArea(data []byte) (multiPolygon, error) {
+	var obj struct {
+		Type        string            `json:"type"`
+		Coordinates json.RawMessage   `json:"coordinates"`
+		Geometry    json.RawMessage   `json:"geometry"`
+		Features    []json.RawMessage `json:"features"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+	var mp multiPolygon
+	switch obj.Type {
+	case "Polygon":
+		var coords [][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &coords); err != nil {
+			return nil, fmt.Errorf("invalid Polygon coordinates: %w", err)
+		}
+		mp = multiPolygon{geoJSONPolygon(coords)}
+	case "MultiPolygon":
+		var coords [][][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &coords); err != nil {
+			return nil, fmt.Errorf("invalid MultiPolygon coordinates: %w", err)
+		}
+		for _, p := range coords {
+			mp = append(mp, geoJSONPolygon(p))
+		}
+	case "Feature":
+		return parseGeoJSONArea(obj.Geometry)
+	case "FeatureCollection":
+		for _, f := range obj.Features {
+			part, err := parseGeoJSONArea(f)
+			if err != nil {
+				return nil, err
+			}
+			mp = append(mp, part...)
+		}
+	default:
+		return nil, errNotPolygonal
+	}
+	for _, p := range mp {
+		for _, r := range p {
+			if len(r) < 4 {
+				return nil, errors.New("polygon rings need at least four positions")
+			}
+		}
+	}
+	if len(mp) == 0 {
+		return nil, errors.New("no polygons in GeoJSON")
+	}
+	return mp, nil
+}
+
+func geoJSONPolygon(coords [][][]float64) polygon {
+	p := make(polygon, len(coords))
+	for i, r := range coords {
+		p[i] = make(ring, 0, len(r))
+		for _, pos := range r {
+			if len(pos) >= 2 {
+				p[i] = append(p[i], [2]float64{pos[0], pos[1]})
+			}
+		}
+	}
+	return p
+}
+
+// geoJSONGeometry is an area as a GeoJSON MultiPolygon.
+type geoJSONGeometry struct {
+	Type        string       `json:"type"`
+	Coordinates multiPolygon `json:"coordinates"`
+}
+
+func (mp multiPolygon) geoJSON() geoJSONGeometry {
+	return geoJSONGeometry{Type: "MultiPolygon", Coordinates: mp}
+}
+
+// geoPackageBlob encodes the area as a GeoPackage geometry blob: the GP
+// header with an xy envelope, then a little-endian WKB MultiPolygon.
+func (mp multiPolygon) geoPackageBlob(srsID int32) []byte {
+	le := binary.LittleEndian
+	b := mp.bounds()
+	buf := []byte{'G', 'P', 0, 0x03}
+	buf = le.AppendUint32(buf, uint32(srsID))
+	for _, v := range []float64{b[0], b[2], b[1], b[3]} {
+		buf = le.AppendUint64(buf, math.Float64bits(v))
+	}
+	buf = append(buf, 1)
+	buf = le.AppendUint32(buf, 6)
+	buf = le.AppendUint32(buf, uint32(len(mp)))
+	for _, p := range mp {
+		buf = append(buf, 1)
+		buf = le.AppendUint32(buf, 3)
+		buf = le.AppendUint32(buf, uint32(len(p)))
+		for _, r := range p {
+			buf = le.AppendUint32(buf, uint32(len(r)))
+			for _, pt := range r {
+				buf = le.AppendUint64(buf, math.Float64bits(pt[0]))
+				buf = le.AppendUint64(buf, math.Float64bits(pt[1]))
+			}
+		}
+	}
+	return buf
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Filtered GeoPackages for exports, written with SQLite alone: the
+// selected layers, rows and columns are copied from the published
+// GeoPackage into a new file, along with the GeoPackage metadata and the
+// R-tree indexes. GeoPackage, CSV and Excel exports thus work without
+// GDAL; ogr2ogr is only needed to reproject, simplify and convert to the
+// other formats.
+
+const (
+	// "GPKG" and version 1.2.0, in the SQLite header of a GeoPackage
+	gpkgApplicationID = 0x47504B47
+	gpkgUserVersion   = 10200
+)
+
+// Metadata tables of a GeoPackage with feature tables and their spatial
+// indexes, as in the GeoPackage 1.2 specification
+var gpkgSchema = []string{
+	`CREATE TABLE gpkg_spatial_ref_sys (
+		srs_name TEXT NOT NULL, srs_id INTEGER PRIMARY KEY, organization TEXT NOT NULL,
+		organization_coordsys_id INTEGER NOT NULL, definition TEXT NOT NULL, description TEXT)`,
+	`CREATE TABLE gpkg_contents (
+		table_name TEXT NOT NULL PRIMARY KEY, data_type TEXT NOT NULL, identifier TEXT UNIQUE,
+		description TEXT DEFAULT '', last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+		min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER,
+		CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id))`,
+	`CREATE TABLE gpkg_geometry_columns (
+		table_name TEXT NOT NULL, column_name TEXT NOT NULL, geometry_type_name TEXT NOT NULL,
+		srs_id INTEGER NOT NULL, z TINYINT NOT NULL, m TINYINT NOT NULL,
+		CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+		CONSTRAINT uk_gc_table_name UNIQUE (table_name),
+		CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+		CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id))`,
+	`CREATE TABLE gpkg_extensions (
+		table_name TEXT, column_name TEXT, extension_name TEXT NOT NULL, definition TEXT NOT NULL,
+		scope TEXT NOT NULL, CONSTRAINT ge_tce UNIQUE (table_name, column_name, extension_name))`,
+}
+
+// featureLayers lists the feature tables of the published GeoPackage.
+func featureLayers() ([]string, error) {
+	rows, err := gpkgDB().Query("SELECT table_name FROM gpkg_contents WHERE data_type = 'features' ORDER BY table_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var layers []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		layers = append(layers, name)
+	}
+	return layers, rows.Err()
+}
+
+// gpkgLayer is a feature table being written.
+type gpkgLayer struct {
+	columns []string
+	// Feature id and geometry columns
+	fid   string
+	geom  string
+	srsID int32
+	// Name of its R-tree index, empty if the source has none
+	rtree string
+}
+
+// gpkgWriter writes a filtered copy of the GeoPackage, attached as src.
+type gpkgWriter struct {
+	ctx    context.Context
+	db     *sql.DB
+	layers map[string]*gpkgLayer
+	order  []string
+}
+
+// createGeoPackage creates the GeoPackage dst, without layers yet, for
+// copying from the GeoPackage src.
+func createGeoPackage(ctx context.Context, dst, src string) (*gpkgWriter, error) {
+	db, err := sql.Open("sqlite", "file:"+dst)
+	if err != nil {
+		return nil, err
+	}
+	// The attached database belongs to the connection
+	db.SetMaxOpenConns(1)
+	g := &gpkgWriter{ctx: ctx, db: db, layers: make(map[string]*gpkgLayer)}
+	if err := g.init(src); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create GeoPackage: %w", err)
+	}
+	return g, nil
+}
+
+func (g *gpkgWriter) exec(query string, args ...interface{}) error {
+	_, err := g.db.ExecContext(g.ctx, query, args...)
+	return err
+}
+
+// queryStrings returns the first column of the rows of query.
+func (g *gpkgWriter) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := g.db.QueryContext(g.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+func (g *gpkgWriter) init(src string) error {
+	if err := g.exec(fmt.Sprintf("PRAGMA application_id = %d", gpkgApplicationID)); err != nil {
+		return err
+	}
+	if err := g.exec(fmt.Sprintf("PRAGMA user_version = %d", gpkgUserVersion)); err != nil {
+		return err
+	}
+	if err := g.exec("ATTACH DATABASE ? AS src", "file:"+src+"?mode=ro"); err != nil {
+		return err
+	}
+	for _, stmt := range gpkgSchema {
+		if err := g.exec(stmt); err != nil {
+			return err
+		}
+	}
+	return g.exec("INSERT INTO gpkg_spatial_ref_sys SELECT * FROM src.gpkg_spatial_ref_sys")
+}
+
+// addLayer creates the feature table name with the given columns of the
+// source table, all of them if columns is empty, and its spatial index.
+// name must be one of featureLayers.
+func (g *gpkgWriter) addLayer(name string, columns []string) error {
+	layer := &gpkgLayer{}
+	if err := g.db.QueryRowContext(g.ctx, "SELECT column_name, srs_id FROM src.gpkg_geometry_columns WHERE table_name = ?", name).
+		Scan(&layer.geom, &layer.srsID); err != nil {
+		return fmt.Errorf("layer %s: %w", name, err)
+	}
+
+	// The table keeps the declared types of the columns
+	rows, err := g.db.QueryContext(g.ctx, "SELECT name, type, pk FROM pragma_table_info(?, 'src') ORDER BY cid", name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var defs []string
+	for rows.Next() {
+		var col, colType string
+		var pk bool
+		if err := rows.Scan(&col, &colType, &pk); err != nil {
+			return err
+		}
+		switch {
+		case pk:
+			defs = append(defs, fmt.Sprintf("%q INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL", col))
+			layer.fid = col
+		case len(columns) > 0 && !slices.Contains(columns, col) && col != layer.geom:
+			continue
+		default:
+			defs = append(defs, fmt.Sprintf("%q %s", col, colType))
+		}
+		layer.columns = append(layer.columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if err := g.exec(fmt.Sprintf("CREATE TABLE %q (%s)", name, strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"INSERT INTO gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id) " +
+			"SELECT table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id FROM src.gpkg_contents WHERE table_name = ?",
+		"INSERT INTO gpkg_geometry_columns SELECT * FROM src.gpkg_geometry_columns WHERE table_name = ?",
+	} {
+		if err := g.exec(stmt, name); err != nil {
+			return err
+		}
+	}
+
+	var indexed bool
+	if err := g.db.QueryRowContext(g.ctx, "SELECT COUNT(*) > 0 FROM src.gpkg_extensions WHERE table_name = ? AND extension_name = 'gpkg_rtree_index'", name).
+		Scan(&indexed); err != nil {
+		return err
+	}
+	if indexed {
+		layer.rtree = "rtree_" + name + "_" + layer.geom
+		if err := g.exec(fmt.Sprintf("CREATE VIRTUAL TABLE %q USING rtree(id, minx, maxx, miny, maxy)", layer.rtree)); err != nil {
+			return err
+		}
+		if err := g.exec("INSERT INTO gpkg_extensions SELECT * FROM src.gpkg_extensions WHERE table_name = ? AND extension_name = 'gpkg_rtree_index'", name); err != nil {
+			return err
+		}
+	}
+	g.layers[name] = layer
+	g.order = append(g.order, name)
+	return nil
+}
+
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = fmt.Sprintf("%q", name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// copyFeatures copies the features of the layer matching where, with
+// their entries in the spatial index.
+func (g *gpkgWriter) copyFeatures(name, where string) error {
+	layer := g.layers[name]
+	cols := quoteIdentifiers(layer.columns)
+	if err := g.exec(fmt.Sprintf("INSERT INTO main.%q (%s) SELECT %s FROM src.%q WHERE %s ORDER BY %q", name, cols, cols, name, where, layer.fid)); err != nil {
+		return err
+	}
+	if layer.rtree == "" {
+		return nil
+	}
+	return g.exec(fmt.Sprintf("INSERT INTO main.%q SELECT * FROM src.%q WHERE id IN (SELECT %q FROM main.%q)",
+		layer.rtree, layer.rtree, layer.fid, name))
+}
+
+// appendMerged adds a feature to gemeinden combining the Gemeinden of
+// src matching where: their names, summed population and indicators,
+// and their polygons collected into one MultiPolygon. The polygons
+// aren't dissolved, so the borders between them remain.
+func (g *gpkgWriter) appendMerged(where string) error {
+	layer := g.layers["gemeinden"]
+	blobs, err := g.queryStrings("SELECT geom FROM src.gemeinden WHERE " + where + " ORDER BY fid")
+	if err != nil {
+		return err
+	}
+	var merged multiPolygon
+	for _, blob := range blobs {
+		mp, err := parseGeoPackageGeometry([]byte(blob))
+		if err != nil {
+			return err
+		}
+		merged = append(merged, mp...)
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	cols := []string{"geom", "name", "iso", "state"}
+	values := []string{"?", "'Kombiniert: ' || GROUP_CONCAT(name, ', ')", "'COMBINED'", "'Kombiniert'"}
+	for _, c := range layer.columns {
+		if c == "population" || yearColumnPattern.MatchString(c) {
+			cols = append(cols, fmt.Sprintf("%q", c))
+			values = append(values, fmt.Sprintf("SUM(%q)", c))
+		}
+	}
+	res, err := g.db.ExecContext(g.ctx, fmt.Sprintf("INSERT INTO main.gemeinden (%s) SELECT %s FROM src.gemeinden WHERE %s",
+		strings.Join(cols, ", "), strings.Join(values, ", "), where), merged.geoPackageBlob(layer.srsID))
+	if err != nil {
+		return err
+	}
+	if layer.rtree == "" {
+		return nil
+	}
+	fid, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	b := merged.bounds()
+	return g.exec(fmt.Sprintf("INSERT INTO main.%q VALUES (?, ?, ?, ?, ?)", layer.rtree), fid, b[0], b[2], b[1], b[3])
+}
+
+// close records the extent of the indexed layers, adds the triggers
+// keeping the spatial indexes up to date for later edits and closes the
+// file.
+func (g *gpkgWriter) close() error {
+	defer g.db.Close()
+	for _, name := range g.order {
+		layer := g.layers[name]
+		if layer.rtree == "" {
+			continue
+		}
+		if err := g.exec(fmt.Sprintf("UPDATE gpkg_contents SET (min_x, max_x, min_y, max_y) = "+
+			"(SELECT MIN(minx), MAX(maxx), MIN(miny), MAX(maxy) FROM main.%q) WHERE table_name = ?", layer.rtree), name); err != nil {
+			return err
+		}
+		// They need the ST_ functions GDAL and QGIS provide, so they are
+		// created only once the features are in
+		triggers, err := g.queryStrings("SELECT sql FROM src.sqlite_master WHERE type = 'trigger' AND tbl_name = ? AND name LIKE ? || '%'", name, layer.rtree)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range triggers {
+			if err := g.exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	if err := g.exec("DETACH DATABASE src"); err != nil {
+		return err
+	}
+	return g.db.Close()
+}
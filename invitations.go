@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invitations are signed tokens carrying the new account's username and
+// role and a random nonce. The nonces of accepted invitations are kept in
+// processing/invitations_used.json until the invitation expires, so a
+// link can only be used once, even if its account is removed again.
+
+const defaultInvitationHours = 72
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Key the invitation tokens are signed with; from config, or random per
+// process (links then stop working on restart)
+var invitationKey []byte
+
+type invitation struct {
+	Username string `json:"u"`
+	Role     string `json:"r"`
+	Expiry   int64  `json:"exp"`
+	Nonce    string `json:"n"`
+}
+
+var errInvalidInvitation = errors.New("invalid or expired invitation")
+
+func initInvitationKey() {
+	if config.InvitationSecret != "" {
+		invitationKey = []byte(config.InvitationSecret)
+		return
+	}
+	invitationKey = []byte(generateToken())
+	log.Printf("invitation_secret is not set, invitation links are only valid until restart")
+}
+
+func signInvitation(inv invitation) string {
+	payload, _ := json.Marshal(inv)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, invitationKey)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var usedInvitationsMutex sync.Mutex
+
+func usedInvitationsPath() string {
+	return filepath.Join(config.ProcessingDir, "invitations_used.json")
+}
+
+// loadUsedInvitations returns the expiry of each accepted invitation by
+// nonce, leaving out those that have expired.
+func loadUsedInvitations() (map[string]int64, error) {
+	used := make(map[string]int64)
+	data, err := os.ReadFile(usedInvitationsPath())
+	if os.IsNotExist(err) {
+		return used, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &used); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", usedInvitationsPath(), err)
+	}
+	now := time.Now().Unix()
+	for nonce, expiry := range used {
+		if now > expiry {
+			delete(used, nonce)
+		}
+	}
+	return used, nil
+}
+
+func saveUsedInvitations(used map[string]int64) error {
+	data, _ := json.MarshalIndent(used, "", "  ")
+	tmp := usedInvitationsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, usedInvitationsPath())
+}
+
+func invitationUsed(nonce string) (bool, error) {
+	usedInvitationsMutex.Lock()
+	defer usedInvitationsMutex.Unlock()
+	used, err := loadUsedInvitations()
+	if err != nil {
+		return false, err
+	}
+	_, ok := used[nonce]
+	return ok, nil
+}
+
+// claimInvitation records an invitation as used, failing with
+// errInvalidInvitation if it already was.
+func claimInvitation(inv invitation) error {
+	usedInvitationsMutex.Lock()
+	defer usedInvitationsMutex.Unlock()
+	used, err := loadUsedInvitations()
+	if err != nil {
+		return err
+	}
+	if _, ok := used[inv.Nonce]; ok {
+		return errInvalidInvitation
+	}
+	used[inv.Nonce] = inv.Expiry
+	return saveUsedInvitations(used)
+}
+
+// releaseInvitation makes a claimed invitation usable again, when its
+// account couldn't be created.
+func releaseInvitation(inv invitation) {
+	usedInvitationsMutex.Lock()
+	defer usedInvitationsMutex.Unlock()
+	used, err := loadUsedInvitations()
+	if err == nil {
+		delete(used, inv.Nonce)
+		err = saveUsedInvitations(used)
+	}
+	if err != nil {
+		log.Printf("Failed to release invitation for %s: %v", inv.Username, err)
+	}
+}
+
+// parseInvitation checks a token's signature and expiry, and that it
+// hasn't been used and its account doesn't exist.
+func parseInvitation(token string) (invitation, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return invitation{}, errInvalidInvitation
+	}
+	mac := hmac.New(sha256.New, invitationKey)
+	mac.Write([]byte(encoded))
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return invitation{}, errInvalidInvitation
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return invitation{}, errInvalidInvitation
+	}
+	var inv invitation
+	if err := json.Unmarshal(payload, &inv); err != nil || time.Now().Unix() > inv.Expiry || inv.Nonce == "" {
+		return invitation{}, errInvalidInvitation
+	}
+	if _, exists := users.Get(inv.Username); exists {
+		return invitation{}, errInvalidInvitation
+	}
+	used, err := invitationUsed(inv.Nonce)
+	if err != nil {
+		log.Printf("Reading used invitations failed: %v", err)
+		return invitation{}, errInvalidInvitation
+	}
+	if used {
+		return invitation{}, errInvalidInvitation
+	}
+	return inv, nil
+}
+
+// handleCreateInvitation issues an invitation link for a new account.
+func handleCreateInvitation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username   string `json:"username"`
+		Role       string `json:"role"`
+		ValidHours int    `json:"valid_hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if !usernamePattern.MatchString(req.Username) {
+		writeJSONError(w, http.StatusBadRequest, "username may only contain letters, digits, '.', '_' and '-'")
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleUser
+	}
+	if req.Role != roleAdmin && req.Role != roleUser {
+		writeJSONError(w, http.StatusBadRequest, "role must be admin or user")
+		return
+	}
+	if req.ValidHours <= 0 {
+		req.ValidHours = defaultInvitationHours
+	}
+	if _, exists := users.Get(req.Username); exists {
+		writeJSONError(w, http.StatusConflict, "user already exists")
+		return
+	}
+	if exists, err := ldapUserExists(req.Username); err != nil {
+		log.Printf("LDAP lookup of %q failed: %v", req.Username, err)
+		writeJSONError(w, http.StatusBadGateway, "could not check the directory for this username")
+		return
+	} else if exists {
+		writeJSONError(w, http.StatusConflict, "user exists in the directory")
+		return
+	}
+
+	expiry := time.Now().Add(time.Duration(req.ValidHours) * time.Hour).UTC()
+	path := "/invite/" + signInvitation(invitation{Username: req.Username, Role: req.Role, Expiry: expiry.Unix(), Nonce: generateToken()})
+	scheme := "http"
+	if requestIsSecure(r) {
+		scheme = "https"
+	}
+
+	log.Printf("Created invitation for %s (%s), valid until %s", req.Username, req.Role, expiry.Format(time.RFC3339))
+	audit(r, "invitation_created", "", map[string]interface{}{"username": req.Username, "role": req.Role})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":   req.Username,
+		"role":       req.Role,
+		"url":        scheme + "://" + r.Host + path,
+		"expires_at": expiry,
+	})
+}
+
+// handleInvite shows the set-password form of an invitation and creates
+// the account when it is submitted.
+func handleInvite(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	inv, err := parseInvitation(token)
+	if err != nil {
+		renderLogin(w, r, loginData{Status: http.StatusNotFound, InviteError: "Die Einladung ist ungültig, abgelaufen oder wurde bereits verwendet."})
+		return
+	}
+	data := loginData{Invite: token, Username: inv.Username}
+	if r.Method == "GET" {
+		renderLogin(w, r, data)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+		} else {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+		}
+		return
+	}
+	password := r.FormValue("password")
+	if len([]rune(password)) < minPasswordLength {
+		data.InviteError = fmt.Sprintf("Das Passwort muss mindestens %d Zeichen lang sein.", minPasswordLength)
+		renderLogin(w, r, data)
+		return
+	}
+	if password != r.FormValue("password_confirm") {
+		data.InviteError = "Die Passwörter stimmen nicht überein."
+		renderLogin(w, r, data)
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Password hashing failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// The directory may have gained the name since the invitation was
+	// made; a local account would shadow it
+	if exists, err := ldapUserExists(inv.Username); err != nil || exists {
+		if err != nil {
+			log.Printf("LDAP lookup of %q failed: %v", inv.Username, err)
+		}
+		renderLogin(w, r, loginData{Status: http.StatusConflict, InviteError: "Der Benutzername ist bereits vergeben."})
+		return
+	}
+	if err := claimInvitation(inv); err != nil {
+		if err == errInvalidInvitation {
+			renderLogin(w, r, loginData{Status: http.StatusNotFound, InviteError: "Die Einladung wurde bereits verwendet."})
+			return
+		}
+		log.Printf("Failed to record invitation for %q: %v", inv.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user := User{Username: inv.Username, PasswordHash: hash, Role: inv.Role}
+	if err := users.Create(user); err != nil {
+		if err == errUserExists {
+			renderLogin(w, r, loginData{Status: http.StatusNotFound, InviteError: "Die Einladung wurde bereits verwendet."})
+			return
+		}
+		releaseInvitation(inv)
+		log.Printf("Failed to create user %q: %v", inv.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Invitation accepted: user=%s, role=%s", user.Username, user.Role)
+	audit(r, "invitation_accepted", user.Username, map[string]interface{}{"role": user.Role})
+	createSession(w, r, user, false)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
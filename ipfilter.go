@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPRule restricts the client addresses that may reach a group of routes.
+// Deny entries win over allow entries; an empty allow list admits every
+// address that isn't denied.
+type IPRule struct {
+	// Path prefixes the rule applies to
+	Paths []string `json:"paths"`
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type compiledIPRule struct {
+	paths []string
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// Parsed form of config.IPRules
+var ipRules []compiledIPRule
+
+func compileIPRules(rules []IPRule) ([]compiledIPRule, error) {
+	var compiled []compiledIPRule
+	for i, rule := range rules {
+		if len(rule.Paths) == 0 {
+			return nil, fmt.Errorf("ip_rules[%d] has no paths", i)
+		}
+		allow, err := parseCIDRs(rule.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("ip_rules[%d].allow: %w", i, err)
+		}
+		deny, err := parseCIDRs(rule.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("ip_rules[%d].deny: %w", i, err)
+		}
+		compiled = append(compiled, compiledIPRule{paths: rule.Paths, allow: allow, deny: deny})
+	}
+	return compiled, nil
+}
+
+// ipRuleFor returns the first rule covering path.
+func ipRuleFor(path string) (compiledIPRule, bool) {
+	for _, rule := range ipRules {
+		for _, prefix := range rule.paths {
+			if strings.HasPrefix(path, prefix) {
+				return rule, true
+			}
+		}
+	}
+	return compiledIPRule{}, false
+}
+
+// ipFilter rejects requests from client addresses a rule doesn't admit.
+// The client address is taken from X-Forwarded-For only when the request
+// comes through a trusted proxy.
+func ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := ipRuleFor(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if ipInNets(ip, rule.deny) || (len(rule.allow) > 0 && !ipInNets(ip, rule.allow)) {
+			log.Printf("event=ip_blocked ip=%s path=%s", ip, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// In-process job queue for long-running work: pipeline runs, backups and
+// exports.
+// Jobs wait in priority order (higher first, then oldest first) until
+// their type is below its concurrency limit and no job of the same lock
+// group runs. The queue is kept in processing/jobs.json, so queued jobs
+// survive a restart; jobs that were running are marked interrupted.
+
+// jobKind describes a job type.
+type jobKind struct {
+	// API key scope needed to submit or cancel the job
+	scope string
+	// Jobs of one lock group never run at the same time
+	lockGroup string
+	// Hard limit on concurrent jobs, whatever the config says
+	maxConcurrency int
+	// submit validates the parameters and queues the job
+	submit func(r *http.Request, j *job) error
+	run    func(ctx context.Context, j *job) (interface{}, error)
+}
+
+var jobKinds map[string]*jobKind
+
+func init() {
+	jobKinds = map[string]*jobKind{
+		"pipeline": {scope: scopePipeline, lockGroup: "geopackage", maxConcurrency: 1, submit: submitPipelineJob, run: runPipelineJob},
+		"backup":   {scope: scopeAdmin, lockGroup: "geopackage", maxConcurrency: 1, submit: submitJob, run: runBackupJob},
+		"export":   {scope: scopeExport, maxConcurrency: 4, submit: submitExportJob, run: runExportJob},
+	}
+}
+
+type job struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Priority int             `json:"priority"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	// "queued", "running", "done", "failed", "cancelled" or "interrupted"
+	Status   string          `json:"status"`
+	Error    string          `json:"error,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	User     string          `json:"user,omitempty"`
+	Created  time.Time       `json:"created"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	// Step a running job is at, for jobs that report one
+	Progress string `json:"progress,omitempty"`
+
+	cancel          context.CancelFunc
+	cancelRequested bool
+}
+
+func (j *job) active() bool {
+	return j.Status == "queued" || j.Status == "running"
+}
+
+const (
+	// Finished jobs kept for GET /api/jobs
+	jobHistory          = 200
+	jobsDefaultPageSize = 50
+	jobsMaxPageSize     = 500
+)
+
+var (
+	errJobActive   = errors.New("a job of this type is already queued or running")
+	errJobNotFound = errors.New("job not found")
+	errJobFinished = errors.New("job has already finished")
+)
+
+type jobQueue struct {
+	mu      sync.Mutex
+	path    string
+	jobs    []*job
+	running map[string]int
+	locked  map[string]bool
+}
+
+var jobs = &jobQueue{running: make(map[string]int), locked: make(map[string]bool)}
+
+// load restores the queue from jobs.json and starts the queued jobs.
+func (q *jobQueue) load(processingDir string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.path = filepath.Join(processingDir, "jobs.json")
+	data, err := os.ReadFile(q.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &q.jobs); err != nil {
+			return fmt.Errorf("parsing %s: %w", q.path, err)
+		}
+	}
+	now := time.Now().UTC()
+	for _, j := range q.jobs {
+		if j.Status == "running" {
+			log.Printf("Job %s (%s) was interrupted by a restart", j.ID, j.Type)
+			j.Status = "interrupted"
+			j.Finished = &now
+		}
+		if j.Status == "queued" && jobKinds[j.Type] == nil {
+			j.Status = "failed"
+			j.Error = "unknown job type"
+			j.Finished = &now
+		}
+	}
+	q.saveLocked()
+	q.dispatchLocked()
+	return nil
+}
+
+func (q *jobQueue) saveLocked() {
+	data, err := json.MarshalIndent(q.jobs, "", "  ")
+	if err == nil {
+		if err = os.WriteFile(q.path+".tmp", data, 0644); err == nil {
+			err = os.Rename(q.path+".tmp", q.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save job queue: %v", err)
+	}
+}
+
+// submit queues j. With unique set it is refused while another job of its
+// type is queued or running.
+func (q *jobQueue) submit(j *job, unique bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if unique {
+		for _, other := range q.jobs {
+			if other.Type == j.Type && other.active() {
+				return errJobActive
+			}
+		}
+	}
+	j.Created = time.Now().UTC()
+	if j.ID == "" {
+		j.ID = newRunID(j.Created)
+	}
+	j.Status = "queued"
+	q.jobs = append(q.jobs, j)
+	q.saveLocked()
+	q.dispatchLocked()
+	return nil
+}
+
+func jobLimit(kind string) int {
+	limit := config.JobConcurrency[kind]
+	if limit <= 0 {
+		limit = 1
+	}
+	return min(limit, jobKinds[kind].maxConcurrency)
+}
+
+// dispatchLocked starts queued jobs as far as the limits allow.
+func (q *jobQueue) dispatchLocked() {
+	var queued []*job
+	for _, j := range q.jobs {
+		if j.Status == "queued" {
+			queued = append(queued, j)
+		}
+	}
+	sort.SliceStable(queued, func(a, b int) bool { return queued[a].Priority > queued[b].Priority })
+	for _, j := range queued {
+		kind := jobKinds[j.Type]
+		if q.running[j.Type] >= jobLimit(j.Type) || (kind.lockGroup != "" && q.locked[kind.lockGroup]) {
+			continue
+		}
+		now := time.Now().UTC()
+		j.Status = "running"
+		j.Started = &now
+		q.running[j.Type]++
+		if kind.lockGroup != "" {
+			q.locked[kind.lockGroup] = true
+		}
+		var ctx context.Context
+		ctx, j.cancel = context.WithCancel(context.Background())
+		go q.execute(ctx, j, kind)
+	}
+	q.saveLocked()
+}
+
+func (q *jobQueue) execute(ctx context.Context, j *job, kind *jobKind) {
+	result, err := kind.run(ctx, j)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j.cancel()
+	now := time.Now().UTC()
+	j.Finished = &now
+	j.Progress = ""
+	switch {
+	case j.cancelRequested:
+		j.Status = "cancelled"
+	case err != nil:
+		j.Status = "failed"
+		j.Error = err.Error()
+	default:
+		j.Status = "done"
+	}
+	if result != nil {
+		j.Result, _ = json.Marshal(result)
+	}
+	q.running[j.Type]--
+	if kind.lockGroup != "" {
+		q.locked[kind.lockGroup] = false
+	}
+	q.pruneLocked()
+	q.dispatchLocked()
+}
+
+// pruneLocked forgets the oldest finished jobs beyond jobHistory.
+func (q *jobQueue) pruneLocked() {
+	finished := 0
+	for _, j := range q.jobs {
+		if !j.active() {
+			finished++
+		}
+	}
+	kept := q.jobs[:0]
+	for _, j := range q.jobs {
+		if !j.active() && finished > jobHistory {
+			finished--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	q.jobs = kept
+}
+
+// cancel stops a running job or drops a queued one. already reports a
+// cancellation that was requested before.
+func (q *jobQueue) cancel(id string) (cancelled job, already bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.findLocked(id)
+	if j == nil {
+		return job{}, false, errJobNotFound
+	}
+	if !j.active() {
+		return *j, false, errJobFinished
+	}
+	already = j.cancelRequested
+	j.cancelRequested = true
+	if j.Status == "queued" {
+		now := time.Now().UTC()
+		j.Status = "cancelled"
+		j.Finished = &now
+		q.saveLocked()
+	} else {
+		j.cancel()
+	}
+	return *j, already, nil
+}
+
+func (q *jobQueue) findLocked(id string) *job {
+	for _, j := range q.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// activeJob returns the queued or running job of a type, if any.
+func (q *jobQueue) activeJob(kind string) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.Type == kind && j.active() {
+			return *j, true
+		}
+	}
+	return job{}, false
+}
+
+func (q *jobQueue) isRunning(kind string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running[kind] > 0
+}
+
+// setProgress records the step a running job is at.
+func (q *jobQueue) setProgress(id, progress string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j := q.findLocked(id); j != nil && j.Status == "running" {
+		j.Progress = progress
+	}
+}
+
+func (q *jobQueue) get(id string) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j := q.findLocked(id); j != nil {
+		return *j, true
+	}
+	return job{}, false
+}
+
+func (q *jobQueue) list() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]job, len(q.jobs))
+	for i, j := range q.jobs {
+		list[i] = *j
+	}
+	return list
+}
+
+func submitJob(r *http.Request, j *job) error {
+	if len(j.Params) > 0 && string(j.Params) != "null" && string(j.Params) != "{}" {
+		return fmt.Errorf("%s jobs take no parameters", j.Type)
+	}
+	j.Params = nil
+	return jobs.submit(j, false)
+}
+
+func runBackupJob(ctx context.Context, j *job) (interface{}, error) {
+	return createBackup()
+}
+
+// handleListJobs returns jobs newest first, optionally filtered by
+// ?type= and ?status=, in pages of ?per_page= jobs.
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	page, perPage, ok := pageParams(w, r, jobsDefaultPageSize, jobsMaxPageSize)
+	if !ok {
+		return
+	}
+	kind, status := r.URL.Query().Get("type"), r.URL.Query().Get("status")
+	all := jobs.list()
+	matched := []job{}
+	for i := len(all) - 1; i >= 0; i-- {
+		if (kind != "" && all[i].Type != kind) || (status != "" && all[i].Status != status) {
+			continue
+		}
+		matched = append(matched, all[i])
+	}
+	total := len(matched)
+	start := min((page-1)*perPage, total)
+	end := min(start+perPage, total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jobs":     matched[start:end],
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
+
+// handleSubmitJob queues a job: {"type": "backup", "priority": 5,
+// "params": {...}}.
+func handleSubmitJob(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type     string          `json:"type"`
+		Priority int             `json:"priority"`
+		Params   json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	kind, ok := jobKinds[req.Type]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown job type %q", req.Type))
+		return
+	}
+	p, _ := authenticate(r)
+	if !p.can(kind.scope) {
+		writeJSONError(w, http.StatusForbidden, "not allowed to submit "+req.Type+" jobs")
+		return
+	}
+
+	j := &job{Type: req.Type, Priority: req.Priority, Params: req.Params, User: p.User.Username}
+	var preflight *preflightError
+	var exportErr *exportError
+	err := kind.submit(r, j)
+	switch {
+	case errors.Is(err, errJobActive), errors.Is(err, errPipelineRunning):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case errors.As(err, &preflight):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": preflight.Error(),
+			"log":   preflight.output,
+		})
+		return
+	case errors.As(err, &exportErr):
+		writeExportError(w, exportErr)
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit(r, "job_submit", "", map[string]interface{}{"job": j.ID, "type": j.Type})
+
+	submitted, _ := jobs.get(j.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(submitted)
+}
+
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	existing, ok := jobs.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if p, _ := authenticate(r); !p.can(jobKinds[existing.Type].scope) {
+		writeJSONError(w, http.StatusForbidden, "not allowed to cancel "+existing.Type+" jobs")
+		return
+	}
+	j, already, err := jobs.cancel(id)
+	if errors.Is(err, errJobFinished) {
+		writeJSONError(w, http.StatusConflict, "job has already finished")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if !already {
+		audit(r, "job_cancel", "", map[string]interface{}{"job": j.ID, "type": j.Type})
+	}
+	status := "cancelling"
+	if j.Status == "cancelled" {
+		status = "cancelled"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     j.ID,
+		"status": status,
+	})
+}
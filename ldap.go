@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP / Active Directory logins, used for usernames that aren't in the
+// local user store. With a service account (ldap_bind_dn) the user's entry
+// is searched first and then bound as; without one the user binds
+// directly with a DN built from ldap_user_dn_template.
+
+const ldapTimeout = 10 * time.Second
+
+var errLDAPNoRole = errors.New("no role mapped for LDAP user")
+
+func ldapEnabled() bool {
+	return config.LDAPURL != ""
+}
+
+func ldapConnect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.LDAPInsecureSkipVerify}
+	conn, err := ldap.DialURL(config.LDAPURL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if config.LDAPStartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ldapAuthenticate checks a username/password pair against the directory
+// and maps the user's groups to a role.
+func ldapAuthenticate(username, password string) (User, error) {
+	// An empty password would be an unauthenticated bind, which many
+	// servers accept
+	if username == "" || password == "" {
+		return User{}, errors.New("empty credentials")
+	}
+	conn, err := ldapConnect()
+	if err != nil {
+		return User{}, fmt.Errorf("connecting to %s: %w", config.LDAPURL, err)
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf(config.LDAPUserFilter, ldap.EscapeFilter(username))
+	var userDN string
+	if config.LDAPBindDN != "" {
+		if err := conn.Bind(config.LDAPBindDN, config.LDAPBindPassword); err != nil {
+			return User{}, fmt.Errorf("service bind: %w", err)
+		}
+		entry, err := ldapSearchOne(conn, filter)
+		if err != nil {
+			return User{}, err
+		}
+		userDN = entry.DN
+	} else {
+		userDN = fmt.Sprintf(config.LDAPUserDNTemplate, ldap.EscapeDN(username))
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		return User{}, err
+	}
+	entry, err := ldapSearchOne(conn, filter)
+	if err != nil {
+		return User{}, err
+	}
+
+	role := ldapRole(entry.GetAttributeValues(config.LDAPGroupAttribute))
+	if role == "" {
+		return User{}, errLDAPNoRole
+	}
+	return User{Username: username, Role: role, Provider: "ldap"}, nil
+}
+
+// ldapUserExists reports whether username resolves to an entry in the
+// directory; false when LDAP isn't configured. Without a service account
+// the DN built from ldap_user_dn_template is looked up anonymously.
+func ldapUserExists(username string) (bool, error) {
+	if !ldapEnabled() {
+		return false, nil
+	}
+	conn, err := ldapConnect()
+	if err != nil {
+		return false, fmt.Errorf("connecting to %s: %w", config.LDAPURL, err)
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf(config.LDAPUserFilter, ldap.EscapeFilter(username))
+	req := ldap.NewSearchRequest(config.LDAPBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		1, int(ldapTimeout.Seconds()), false, filter, []string{"dn"}, nil)
+	if config.LDAPBindDN != "" {
+		if err := conn.Bind(config.LDAPBindDN, config.LDAPBindPassword); err != nil {
+			return false, fmt.Errorf("service bind: %w", err)
+		}
+	} else {
+		userDN := fmt.Sprintf(config.LDAPUserDNTemplate, ldap.EscapeDN(username))
+		req = ldap.NewSearchRequest(userDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			1, int(ldapTimeout.Seconds()), false, "(objectClass=*)", []string{"dn"}, nil)
+	}
+	res, err := conn.Search(req)
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		return false, nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		return true, nil
+	case err != nil:
+		return false, fmt.Errorf("looking up %q: %w", username, err)
+	}
+	return len(res.Entries) > 0, nil
+}
+
+func ldapSearchOne(conn *ldap.Conn, filter string) (*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(config.LDAPBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false, filter, []string{"dn", config.LDAPGroupAttribute}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, fmt.Errorf("searching %q: %w", filter, err)
+	}
+	if len(res.Entries) != 1 {
+		return nil, fmt.Errorf("searching %q: %d entries found", filter, len(res.Entries))
+	}
+	return res.Entries[0], nil
+}
+
+// ldapRole maps group memberships to a role. Mapping keys match a group's
+// full DN or its CN, case-insensitively; admin wins over user.
+func ldapRole(groups []string) string {
+	role := ""
+	for _, group := range groups {
+		cn := ""
+		if dn, err := ldap.ParseDN(group); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			cn = dn.RDNs[0].Attributes[0].Value
+		}
+		for key, mapped := range config.LDAPRoleMapping {
+			if strings.EqualFold(key, group) || (cn != "" && strings.EqualFold(key, cn)) {
+				if mapped == roleAdmin {
+					return roleAdmin
+				}
+				role = mapped
+			}
+		}
+	}
+	if role == "" {
+		role = config.LDAPDefaultRole
+	}
+	return role
+}
+
+// authenticatePassword checks credentials against the local user store
+// and, for usernames not in it, the directory.
+func authenticatePassword(username, password string) (User, bool) {
+	if _, local := users.Get(username); local || !ldapEnabled() {
+		return users.Authenticate(username, password)
+	}
+	user, err := ldapAuthenticate(username, password)
+	if err != nil {
+		log.Printf("LDAP login for %q failed: %v", username, err)
+		return User{}, false
+	}
+	return user, true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// lineRing keeps the last lines written to it. The pipeline output is
+// teed into one so clients attaching mid-run can be sent the recent
+// history before following the live log.
+type lineRing struct {
+	mu      sync.Mutex
+	lines   []string
+	next    int
+	full    bool
+	partial []byte
+
+	// Live followers, and how the run ended once it has
+	followers map[chan string]bool
+	done      bool
+	exitCode  int
+	status    string
+}
+
+// Lines a follower may fall behind before it is dropped
+const followerBuffer = 256
+
+func newLineRing(size int) *lineRing {
+	if size < 1 {
+		size = 1
+	}
+	return &lineRing{lines: make([]string, size), followers: make(map[chan string]bool)}
+}
+
+func (r *lineRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimSuffix(data[:i], []byte("\r")))
+		r.lines[r.next] = line
+		for ch := range r.followers {
+			select {
+			case ch <- line:
+			default:
+				delete(r.followers, ch)
+				close(ch)
+			}
+		}
+		r.next = (r.next + 1) % len(r.lines)
+		if r.next == 0 {
+			r.full = true
+		}
+		data = data[i+1:]
+	}
+	r.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// Lines returns the buffered lines, oldest first.
+func (r *lineRing) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.linesLocked()
+}
+
+func (r *lineRing) linesLocked() []string {
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	out := make([]string, 0, len(r.lines))
+	out = append(out, r.lines[r.next:]...)
+	return append(out, r.lines[:r.next]...)
+}
+
+// Follow returns the buffered lines and a channel receiving every line
+// written after them. The channel is closed when the run finishes, or
+// early if the follower doesn't keep up; stop must be called when done.
+func (r *lineRing) Follow() (backlog []string, lines <-chan string, stop func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch := make(chan string, followerBuffer)
+	if r.done {
+		close(ch)
+	} else {
+		r.followers[ch] = true
+	}
+	stop = func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.followers[ch] {
+			delete(r.followers, ch)
+			close(ch)
+		}
+	}
+	return r.linesLocked(), ch, stop
+}
+
+// Finish records how the run ended and ends all follows.
+func (r *lineRing) Finish(exitCode int, status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = true
+	r.exitCode = exitCode
+	r.status = status
+	for ch := range r.followers {
+		delete(r.followers, ch)
+		close(ch)
+	}
+}
+
+// Result reports whether the run has finished, its exit code and status.
+func (r *lineRing) Result() (done bool, exitCode int, status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done, r.exitCode, r.status
+}
+
+var (
+	pipelineLogBuffer      *lineRing
+	pipelineLogBufferMutex sync.Mutex
+)
+
+// resetPipelineLogBuffer starts an empty buffer for a new run.
+func resetPipelineLogBuffer() *lineRing {
+	ring := newLineRing(config.PipelineLogBufferLines)
+	pipelineLogBufferMutex.Lock()
+	pipelineLogBuffer = ring
+	pipelineLogBufferMutex.Unlock()
+	return ring
+}
+
+// currentPipelineLogBuffer returns the buffer of the current or last run,
+// or nil if no run has happened since startup.
+func currentPipelineLogBuffer() *lineRing {
+	pipelineLogBufferMutex.Lock()
+	defer pipelineLogBufferMutex.Unlock()
+	return pipelineLogBuffer
+}
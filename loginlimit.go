@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Delay after the first failed login; it doubles with each further failure
+const (
+	loginBackoffBase = time.Second
+	loginBackoffMax  = time.Minute
+)
+
+type loginFailures struct {
+	Count       int
+	Last        time.Time
+	LockedUntil time.Time
+}
+
+var (
+	loginAttempts      = make(map[string]*loginFailures)
+	loginAttemptsMutex sync.Mutex
+)
+
+// loginLimitKeys returns the counters a login attempt is charged to: the
+// client IP and, if present, the browser's session cookie.
+func loginLimitKeys(r *http.Request) []string {
+	keys := []string{"ip:" + clientIP(r).String()}
+	if cookie, err := r.Cookie("session"); err == nil && cookie.Value != "" {
+		sum := sha256.Sum256([]byte(cookie.Value))
+		keys = append(keys, "cookie:"+hex.EncodeToString(sum[:8]))
+	}
+	return keys
+}
+
+func loginBackoff(count int) time.Duration {
+	if count <= 0 {
+		return 0
+	}
+	d := loginBackoffBase << (count - 1)
+	if d > loginBackoffMax || d <= 0 {
+		d = loginBackoffMax
+	}
+	return d
+}
+
+// loginAllowedIn reports how long a client has to wait before its next
+// login attempt; zero means it may try now.
+func loginAllowedIn(keys []string) time.Duration {
+	loginAttemptsMutex.Lock()
+	defer loginAttemptsMutex.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		f, ok := loginAttempts[key]
+		if !ok {
+			continue
+		}
+		until := f.Last.Add(loginBackoff(f.Count))
+		if f.LockedUntil.After(until) {
+			until = f.LockedUntil
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func recordLoginFailure(r *http.Request, keys []string, username string) {
+	loginAttemptsMutex.Lock()
+	defer loginAttemptsMutex.Unlock()
+	now := time.Now()
+	lockout := time.Duration(config.LoginLockoutMinutes) * time.Minute
+
+	// Forget counters that have been quiet for a full lockout period
+	for key, f := range loginAttempts {
+		if now.Sub(f.Last) > lockout && now.After(f.LockedUntil) {
+			delete(loginAttempts, key)
+		}
+	}
+
+	for _, key := range keys {
+		f, ok := loginAttempts[key]
+		if !ok {
+			f = &loginFailures{}
+			loginAttempts[key] = f
+		}
+		f.Count++
+		f.Last = now
+		if f.Count >= config.LoginMaxFailures && f.LockedUntil.Before(now) {
+			f.LockedUntil = now.Add(lockout)
+			log.Printf("event=login_lockout key=%s failures=%d locked_until=%s",
+				key, f.Count, f.LockedUntil.UTC().Format(time.RFC3339))
+		}
+	}
+	log.Printf("event=login_failed ip=%s user=%q user_agent=%q", clientIP(r), username, r.UserAgent())
+}
+
+func resetLoginFailures(keys []string) {
+	loginAttemptsMutex.Lock()
+	defer loginAttemptsMutex.Unlock()
+	for _, key := range keys {
+		delete(loginAttempts, key)
+	}
+}
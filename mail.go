@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lines of the run log included in failure mails
+const failureMailLogLines = 50
+
+// sendMail sends a plain text mail through the configured SMTP server,
+// which is asked for STARTTLS when it offers it.
+func sendMail(to []string, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, config.SMTPHost)
+	}
+	addr := net.JoinHostPort(config.SMTPHost, strconv.Itoa(config.SMTPPort))
+	return smtp.SendMail(addr, auth, config.SMTPFrom, to, msg.Bytes())
+}
+
+// failureMails limits failure mails to pipeline_failure_mails_per_hour,
+// counting the ones held back so the next mail can mention them.
+var failureMails struct {
+	sync.Mutex
+	sent       []time.Time
+	suppressed int
+}
+
+// mailPipelineFailure mails a summary of a failed run to
+// pipeline_failure_mail_to in the background: the stage that failed, the
+// error and the end of the log. Cancelled runs are not reported.
+func mailPipelineFailure(run *pipelineRun, status string) {
+	if len(config.PipelineFailureMailTo) == 0 || status == "success" || status == "cancelled" {
+		return
+	}
+
+	failureMails.Lock()
+	now := time.Now()
+	recent := failureMails.sent[:0]
+	for _, t := range failureMails.sent {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	failureMails.sent = recent
+	if len(recent) >= config.PipelineFailureMailsPerHour {
+		failureMails.suppressed++
+		failureMails.Unlock()
+		log.Printf("Not mailing failure of run %s: %d mails sent in the last hour", run.ID, len(recent))
+		return
+	}
+	failureMails.sent = append(failureMails.sent, now)
+	suppressed := failureMails.suppressed
+	failureMails.suppressed = 0
+	failureMails.Unlock()
+
+	stage, errMsg := pipelineStatusTracker.failure(run.ID)
+	var body strings.Builder
+	fmt.Fprintf(&body, "Pipeline run %s of %q ended with status %s.\n\n", run.ID, run.Pipeline, status)
+	fmt.Fprintf(&body, "Started:  %s\n", run.Started.Format(time.RFC3339))
+	if run.Finished != nil {
+		fmt.Fprintf(&body, "Finished: %s\n", run.Finished.Format(time.RFC3339))
+	}
+	if run.User != "" {
+		fmt.Fprintf(&body, "Started by: %s\n", run.User)
+	}
+	if run.Schedule != "" {
+		fmt.Fprintf(&body, "Schedule: %s\n", run.Schedule)
+	}
+	if run.ExitCode != nil {
+		fmt.Fprintf(&body, "Exit code: %d\n", *run.ExitCode)
+	}
+	if stage != "" {
+		fmt.Fprintf(&body, "Failed stage: %s\n", stage)
+	}
+	if errMsg != "" {
+		fmt.Fprintf(&body, "Error: %s\n", errMsg)
+	}
+	if suppressed > 0 {
+		fmt.Fprintf(&body, "\n%d earlier failure(s) were not mailed because of the rate limit.\n", suppressed)
+	}
+	if data, err := os.ReadFile(runLogPath(run.ID)); err == nil {
+		fmt.Fprintf(&body, "\nLast %d log lines:\n\n%s\n", failureMailLogLines, strings.Join(lastLines(string(data), failureMailLogLines), "\n"))
+	}
+
+	subject := fmt.Sprintf("Pipeline %s: run %s %s", run.Pipeline, run.ID, status)
+	go func() {
+		if err := sendMail(config.PipelineFailureMailTo, subject, body.String()); err != nil {
+			log.Printf("Failed to mail failure of run %s: %v", run.ID, err)
+		}
+	}()
+}
@@ -2,37 +2,88 @@ package main
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"holzeinschlag-austria/pipeline"
 )
 
 var (
-	pipelineRunning bool
-	pipelineMutex   sync.Mutex
-
-	// Valid passwords
-	validPasswords = []string{
-		"fridolin2026",
-		"lutz2026",
-	}
-
 	// Session tokens (in-memory, cleared on restart)
-	sessions     = make(map[string]time.Time)
+	sessions     = make(map[string]session)
 	sessionMutex sync.RWMutex
 )
 
-const sessionDuration = 24 * time.Hour
+type session struct {
+	Username string
+	// Hard limit; activity doesn't extend it
+	Expiry time.Time
+	// Last authenticated request, for the idle timeout
+	LastSeen time.Time
+	// "Remember me" sessions use the longer remember duration for both
+	Remember bool
+	// Set for users authenticated by an external provider, who are not
+	// in the local user store
+	Provider string
+	Role     string
+	// Expected in X-CSRF-Token or the csrf_token form field on POSTs
+	CSRFToken string
+	Created   time.Time
+	// Client address at login
+	IP string
+}
+
+// Activity within this interval of the last recorded one isn't written
+// back, to keep the session lock uncontended
+const sessionTouchInterval = time.Minute
+
+func sessionIdleTimeout(sess session) time.Duration {
+	if sess.Remember {
+		return config.rememberDuration()
+	}
+	return time.Duration(config.SessionIdleMinutes) * time.Minute
+}
+
+// sessionExpiresAt is when a session ends unless it is used before.
+func sessionExpiresAt(sess session) time.Time {
+	idle := sess.LastSeen.Add(sessionIdleTimeout(sess))
+	if idle.Before(sess.Expiry) {
+		return idle
+	}
+	return sess.Expiry
+}
+
+func sessionActive(sess session) bool {
+	return time.Now().Before(sessionExpiresAt(sess))
+}
+
+// touchSession records activity on a session, sliding its idle timeout.
+func touchSession(token string) {
+	now := time.Now()
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	if sess, ok := sessions[token]; ok && now.Sub(sess.LastSeen) >= sessionTouchInterval {
+		sess.LastSeen = now
+		sessions[token] = sess
+	}
+}
 
 func generateToken() string {
 	b := make([]byte, 32)
@@ -40,48 +91,169 @@ func generateToken() string {
 	return hex.EncodeToString(b)
 }
 
-func checkPassword(password string) bool {
-	for _, validPwd := range validPasswords {
-		pwdHash := sha256.Sum256([]byte(password))
-		validHash := sha256.Sum256([]byte(validPwd))
-		if subtle.ConstantTimeCompare(pwdHash[:], validHash[:]) == 1 {
-			return true
-		}
-	}
-	return false
-}
-
-func isValidSession(r *http.Request) bool {
+// sessionUser returns the logged-in user of a request. Users removed from
+// the store since login no longer count as logged in.
+func sessionUser(r *http.Request) (User, bool) {
 	cookie, err := r.Cookie("session")
 	if err != nil {
-		log.Printf("No session cookie found: %v", err)
-		return false
+		return User{}, false
 	}
 
 	sessionMutex.RLock()
-	expiry, exists := sessions[cookie.Value]
+	sess, exists := sessions[cookie.Value]
 	sessionMutex.RUnlock()
 
-	log.Printf("Session check: token=%s..., exists=%v, valid=%v", cookie.Value[:8], exists, exists && time.Now().Before(expiry))
-	return exists && time.Now().Before(expiry)
+	if !exists || !sessionActive(sess) {
+		return User{}, false
+	}
+	if time.Since(sess.LastSeen) >= sessionTouchInterval {
+		touchSession(cookie.Value)
+	}
+	if sess.Provider != "" {
+		return User{Username: sess.Username, Role: sess.Role, Provider: sess.Provider}, true
+	}
+	return users.Get(sess.Username)
 }
 
-func createSession(w http.ResponseWriter, r *http.Request) {
+func isValidSession(r *http.Request) bool {
+	_, ok := sessionUser(r)
+	return ok
+}
+
+// adminOnly guards administrative endpoints. They always require an
+// admin user's session or an admin-scoped API key, even when the rest of
+// the site is public.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := authenticate(r); !ok || !p.can(scopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// revokeUserSessions deletes all sessions of a user except the one with
+// token keep, returning how many were removed.
+func revokeUserSessions(username, keep string) int {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	removed := 0
+	for token, sess := range sessions {
+		if sess.Username == username && token != keep {
+			delete(sessions, token)
+			removed++
+		}
+	}
+	return removed
+}
+
+// removeExpiredSessions deletes the sessions that ended, returning how
+// many were removed.
+func removeExpiredSessions() int {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	removed := 0
+	for token, sess := range sessions {
+		if !sessionActive(sess) {
+			delete(sessions, token)
+			removed++
+		}
+	}
+	return removed
+}
+
+// startSessionCleanup removes expired sessions every ten minutes. They
+// would otherwise stay in memory until the server restarts.
+func startSessionCleanup() {
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			removeExpiredSessions()
+		}
+	}()
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   requestIsSecure(r),
+		MaxAge:   -1,
+	})
+}
+
+// handleLogout ends the current session. With ?all=1 every session of the
+// same user is revoked as well.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("session"); err == nil {
+		sessionMutex.Lock()
+		sess, exists := sessions[cookie.Value]
+		delete(sessions, cookie.Value)
+		sessionMutex.Unlock()
+
+		if exists {
+			removed := 0
+			if r.URL.Query().Get("all") == "1" {
+				removed = revokeUserSessions(sess.Username, "")
+			}
+			log.Printf("Logout: user=%s, other_sessions_revoked=%d", sess.Username, removed)
+			audit(r, "logout", sess.Username, map[string]interface{}{"other_sessions_revoked": removed})
+		}
+	}
+	clearSessionCookie(w, r)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// createSession logs the user in. remember extends the session and its
+// cookie to survive browser restarts and long pauses.
+func createSession(w http.ResponseWriter, r *http.Request, user User, remember bool) {
 	token := generateToken()
+	csrfToken := generateToken()
+	now := time.Now()
+	lifetime := time.Duration(config.SessionMaxHours) * time.Hour
+	if remember {
+		lifetime = config.rememberDuration()
+	}
 
 	sessionMutex.Lock()
-	sessions[token] = time.Now().Add(sessionDuration)
+	sessions[token] = session{
+		Username:  user.Username,
+		Expiry:    now.Add(lifetime),
+		LastSeen:  now,
+		Remember:  remember,
+		Provider:  user.Provider,
+		Role:      user.Role,
+		CSRFToken: csrfToken,
+		Created:   now,
+		IP:        clientIP(r).String(),
+	}
 	sessionMutex.Unlock()
+	setCSRFCookie(w, r, csrfToken)
 
 	// Check if behind HTTPS proxy
-	isSecure := r.Header.Get("X-Forwarded-Proto") == "https" || r.TLS != nil
+	isSecure := requestIsSecure(r)
 
-	log.Printf("Creating session: token=%s, secure=%v, X-Forwarded-Proto=%s", token[:8]+"...", isSecure, r.Header.Get("X-Forwarded-Proto"))
+	log.Printf("Creating session: token=%s, secure=%v, remember=%v, X-Forwarded-Proto=%s", token[:8]+"...", isSecure, remember, r.Header.Get("X-Forwarded-Proto"))
 
 	sameSite := http.SameSiteLaxMode
 	if isSecure {
 		sameSite = http.SameSiteNoneMode
 	}
+	switch config.CookieSameSite {
+	case "Lax":
+		sameSite = http.SameSiteLaxMode
+	case "Strict":
+		sameSite = http.SameSiteStrictMode
+	case "None":
+		sameSite = http.SameSiteNoneMode
+		if !isSecure {
+			// Browsers reject SameSite=None cookies without Secure
+			log.Printf("cookie_samesite is None on a non-HTTPS request, forcing Secure cookie")
+			isSecure = true
+		}
+	}
 
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session",
@@ -90,10 +262,107 @@ func createSession(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		Secure:   isSecure,
 		SameSite: sameSite,
-		MaxAge:   int(sessionDuration.Seconds()),
+		MaxAge:   int(lifetime.Seconds()),
 	})
 }
 
+var loginTemplate = template.Must(template.New("login").Parse(loginPage))
+
+type loginData struct {
+	Status     int
+	Error      bool
+	RetryAfter int
+	Next       string
+	Username   string
+	SSO        bool
+	CSRFToken  string
+	// Second login step, asking for the TOTP or a recovery code
+	TOTP bool
+	// Invitation token, showing the set-password form instead
+	Invite      string
+	InviteError string
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, data loginData) {
+	data.SSO = oidcEnabled()
+	data.CSRFToken = csrfTokenFor(w, r)
+	w.Header().Set("Content-Type", "text/html")
+	if data.Status != 0 {
+		w.WriteHeader(data.Status)
+	}
+	if err := loginTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render login page: %v", err)
+	}
+}
+
+// safeRedirectTarget returns next if it is a local path, "/" otherwise,
+// so the login form can't be used as an open redirect.
+func safeRedirectTarget(next string) string {
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return next
+}
+
+// handleLogin serves the login page and checks the credentials posted
+// from it.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		renderLogin(w, r, loginData{Next: safeRedirectTarget(r.URL.Query().Get("next"))})
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			if isBodyTooLarge(err) {
+				writeBodyTooLarge(w)
+			} else {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+			}
+			return
+		}
+		username := strings.TrimSpace(r.FormValue("username"))
+		password := r.FormValue("password")
+		next := safeRedirectTarget(r.FormValue("next"))
+		remember := r.FormValue("remember") == "1"
+
+		limitKeys := loginLimitKeys(r)
+		if wait := loginAllowedIn(limitKeys); wait > 0 {
+			retryAfter := int(wait.Round(time.Second).Seconds())
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			log.Printf("event=login_throttled ip=%s user=%q retry_after=%d", clientIP(r), username, retryAfter)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			renderLogin(w, r, loginData{Status: http.StatusTooManyRequests, RetryAfter: retryAfter, Next: next, Username: username})
+			return
+		}
+
+		if user, ok := authenticatePassword(username, password); ok {
+			resetLoginFailures(limitKeys)
+			if user.TOTPSecret != "" {
+				startPendingLogin(w, r, user, next, remember)
+				http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
+				return
+			}
+			log.Printf("Login: user=%s", user.Username)
+			audit(r, "login", user.Username, nil)
+			createSession(w, r, user, remember)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		// Wrong password - show error
+		recordLoginFailure(r, limitKeys, username)
+		audit(r, "login_failed", username, nil)
+		renderLogin(w, r, loginData{Error: true, Next: next, Username: username})
+		return
+	}
+}
+
 var loginPage = `<!DOCTYPE html>
 <html lang="de">
 <head>
@@ -139,7 +408,13 @@ var loginPage = `<!DOCTYPE html>
             font-size: 0.85rem;
             margin-bottom: 0.5rem;
         }
-        input[type="password"] {
+        .remember label {
+            display: flex;
+            align-items: center;
+            gap: 0.5rem;
+            cursor: pointer;
+        }
+        input[type="text"], input[type="password"] {
             width: 100%;
             padding: 0.75rem 1rem;
             border: 2px solid #e0e0e0;
@@ -147,7 +422,7 @@ var loginPage = `<!DOCTYPE html>
             font-size: 1rem;
             transition: border-color 0.2s;
         }
-        input[type="password"]:focus {
+        input[type="text"]:focus, input[type="password"]:focus {
             outline: none;
             border-color: #2d5a27;
         }
@@ -174,150 +449,208 @@ var loginPage = `<!DOCTYPE html>
             display: none;
         }
         .error.show { display: block; }
+        .sso {
+            display: block;
+            margin-top: 1rem;
+            padding: 0.75rem;
+            border: 2px solid #2d5a27;
+            border-radius: 8px;
+            color: #2d5a27;
+            text-align: center;
+            text-decoration: none;
+            font-weight: 600;
+        }
+        .sso:hover { background: #f0f5ef; }
     </style>
 </head>
 <body>
     <div class="login-box">
         <h1>🌲 Holzeinschlag Österreich</h1>
-        <p class="subtitle">Bitte Passwort eingeben</p>
+        {{if .Invite}}
+        <p class="subtitle">Willkommen, {{.Username}}! Bitte ein Passwort festlegen</p>
+        <form method="POST" action="/invite/{{.Invite}}">
+            <input type="hidden" name="username" value="{{.Username}}" autocomplete="username">
+            <div class="form-group">
+                <label for="password">Neues Passwort</label>
+                <input type="password" id="password" name="password" autocomplete="new-password" required autofocus>
+            </div>
+            <div class="form-group">
+                <label for="password_confirm">Passwort wiederholen</label>
+                <input type="password" id="password_confirm" name="password_confirm" autocomplete="new-password" required>
+            </div>
+            <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+            <button type="submit">Konto anlegen</button>
+        </form>
+        {{if .InviteError}}<p class="error show">{{.InviteError}}</p>{{end}}
+        {{else if .InviteError}}
+        <p class="error show">{{.InviteError}}</p>
+        {{else if .TOTP}}
+        <p class="subtitle">Bestätigungscode eingeben</p>
+        <form method="POST" action="/login/totp">
+            <div class="form-group">
+                <label for="code">Code aus der Authenticator-App oder Wiederherstellungscode</label>
+                <input type="text" id="code" name="code" inputmode="numeric" autocomplete="one-time-code" required autofocus>
+            </div>
+            <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+            <button type="submit">Bestätigen</button>
+        </form>
+        <p class="error {{if .Error}}show{{end}}">Ungültiger Code</p>
+        {{else}}
+        <p class="subtitle">Bitte anmelden</p>
         <form method="POST" action="/login">
+            <div class="form-group">
+                <label for="username">Benutzername</label>
+                <input type="text" id="username" name="username" value="{{.Username}}" autocomplete="username" required {{if not .Username}}autofocus{{end}}>
+            </div>
             <div class="form-group">
                 <label for="password">Passwort</label>
-                <input type="password" id="password" name="password" required autofocus>
+                <input type="password" id="password" name="password" autocomplete="current-password" required {{if .Username}}autofocus{{end}}>
             </div>
+            <div class="form-group remember">
+                <label><input type="checkbox" name="remember" value="1"> Angemeldet bleiben</label>
+            </div>
+            {{if .Next}}<input type="hidden" name="next" value="{{.Next}}">{{end}}
+            <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
             <button type="submit">Anmelden</button>
         </form>
-        <p class="error {{if .Error}}show{{end}}">Falsches Passwort</p>
+        {{if .SSO}}<a class="sso" href="/login/oidc{{if .Next}}?next={{.Next}}{{end}}">Mit Organisationskonto anmelden</a>{{end}}
+        <p class="error {{if .Error}}show{{end}}">Falscher Benutzername oder falsches Passwort</p>
+        {{end}}
+        {{if .RetryAfter}}<p class="error show">Zu viele Fehlversuche. Bitte in {{.RetryAfter}} Sekunden erneut versuchen.</p>{{end}}
     </div>
 </body>
 </html>`
 
+// ogr2ogrCommand prepares an ogr2ogr invocation with the configured
+// GDAL/PROJ data paths in its environment.
+func ogr2ogrCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("ogr2ogr", args...)
+	var env []string
+	if config.GDALDataPath != "" {
+		env = append(env, "GDAL_DATA="+config.GDALDataPath)
+	}
+	if config.ProjLib != "" {
+		env = append(env, "PROJ_LIB="+config.ProjLib)
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+// ogr2ogrAvailable reports whether ogr2ogr is installed.
+func ogr2ogrAvailable() bool {
+	_, err := exec.LookPath("ogr2ogr")
+	return err == nil
+}
+
 func main() {
-	publicDir := filepath.Join(".", "public")
-	dataDir := filepath.Join(".", "data")
-	processingDir := filepath.Join(".", "processing")
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		runHashPassword()
+		return
+	}
 
-	// Login page
-	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
-			w.Header().Set("Content-Type", "text/html")
-			w.Write([]byte(loginPage))
-			return
-		}
+	var err error
+	config, err = loadConfig(configPath())
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	log.Printf("GDAL_DATA=%q PROJ_LIB=%q", config.GDALDataPath, config.ProjLib)
+	trustedProxyNets, err = parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted_proxies entry: %v", err)
+	}
+	ipRules, err = compileIPRules(config.IPRules)
+	if err != nil {
+		log.Fatalf("Invalid ip_rules: %v", err)
+	}
 
-		if r.Method == "POST" {
-			password := r.FormValue("password")
-			if checkPassword(password) {
-				createSession(w, r)
-				http.Redirect(w, r, "/", http.StatusSeeOther)
-				return
+	// Formats we serve that Go's MIME table doesn't know
+	mime.AddExtensionType(".geojson", "application/geo+json")
+	mime.AddExtensionType(".gpkg", "application/geopackage+sqlite3")
+
+	if err := users.Load(config.UsersFile); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("User file %s does not exist; create it with at least one admin account (see users.example.json)", config.UsersFile)
+		}
+		log.Fatalf("Failed to load users: %v", err)
+	}
+	if err := apiKeys.Load(config.APIKeysFile); err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	startAPIKeyPersistence()
+	initInvitationKey()
+	initDownloadKey()
+	initExportWorkers()
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := users.Reload(); err != nil {
+				log.Printf("User store reload failed: %v", err)
 			}
-			// Wrong password - show error
-			w.Header().Set("Content-Type", "text/html")
-			errorPage := `<!DOCTYPE html>
-<html lang="de">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Login - Holzeinschlag Österreich</title>
-    <style>
-        * { margin: 0; padding: 0; box-sizing: border-box; }
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
-            background: linear-gradient(135deg, #2d5a27 0%, #1e3d1a 100%);
-            min-height: 100vh;
-            display: flex;
-            align-items: center;
-            justify-content: center;
-        }
-        .login-box {
-            background: white;
-            padding: 2.5rem;
-            border-radius: 12px;
-            box-shadow: 0 10px 40px rgba(0,0,0,0.3);
-            width: 100%;
-            max-width: 360px;
-        }
-        h1 {
-            color: #2d5a27;
-            font-size: 1.4rem;
-            margin-bottom: 0.5rem;
-            text-align: center;
-        }
-        .subtitle {
-            color: #7f8c8d;
-            font-size: 0.85rem;
-            text-align: center;
-            margin-bottom: 1.5rem;
-        }
-        .form-group {
-            margin-bottom: 1rem;
-        }
-        label {
-            display: block;
-            color: #2c3e50;
-            font-size: 0.85rem;
-            margin-bottom: 0.5rem;
-        }
-        input[type="password"] {
-            width: 100%;
-            padding: 0.75rem 1rem;
-            border: 2px solid #e0e0e0;
-            border-radius: 8px;
-            font-size: 1rem;
-            transition: border-color 0.2s;
-        }
-        input[type="password"]:focus {
-            outline: none;
-            border-color: #2d5a27;
-        }
-        button {
-            width: 100%;
-            padding: 0.875rem;
-            background: #2d5a27;
-            color: white;
-            border: none;
-            border-radius: 8px;
-            font-size: 1rem;
-            font-weight: 600;
-            cursor: pointer;
-            transition: background 0.2s;
-        }
-        button:hover {
-            background: #1e3d1a;
-        }
-        .error {
-            color: #c0392b;
-            font-size: 0.85rem;
-            text-align: center;
-            margin-top: 1rem;
-        }
-    </style>
-</head>
-<body>
-    <div class="login-box">
-        <h1>🌲 Holzeinschlag Österreich</h1>
-        <p class="subtitle">Bitte Passwort eingeben</p>
-        <form method="POST" action="/login">
-            <div class="form-group">
-                <label for="password">Passwort</label>
-                <input type="password" id="password" name="password" required autofocus>
-            </div>
-            <button type="submit">Anmelden</button>
-        </form>
-        <p class="error">Falsches Passwort</p>
-    </div>
-</body>
-</html>`
-			w.Write([]byte(errorPage))
-			return
 		}
-	})
+	}()
+
+	if err := validateDirectories(config); err != nil {
+		log.Fatalf("Directory check failed:\n%v", err)
+	}
 
-	// Auth middleware for all other routes
-	// Auth middleware disabled - public access
+	publicDir := config.PublicDir
+	dataDir := config.DataDir
+	processingDir := config.ProcessingDir
+	gpkgPath := geoPackagePath()
+
+	if err := reloadDB(); err != nil {
+		log.Fatalf("Failed to open GeoPackage: %v", err)
+	}
+	if _, err := os.Stat(gpkgPath); err != nil {
+		log.Printf("Warning: %s not found, exports are unavailable until the pipeline has run", gpkgPath)
+	} else {
+		warmupDB(gpkgDB())
+	}
+
+	// Login page
+	http.HandleFunc("/login", handleLogin)
+
+	http.HandleFunc("GET /login/totp", handleLoginTOTP)
+	http.HandleFunc("POST /login/totp", handleLoginTOTP)
+	http.HandleFunc("POST /logout", handleLogout)
+	http.HandleFunc("GET /invite/{token}", handleInvite)
+	http.HandleFunc("POST /invite/{token}", handleInvite)
+	if oidcEnabled() {
+		http.HandleFunc("GET /login/oidc", handleOIDCLogin)
+		http.HandleFunc("GET /login/oidc/callback", handleOIDCCallback)
+	}
+
+	// Auth middleware for all other routes, following the route policies
 	authMiddleware := func(next http.Handler) http.Handler {
-		return next
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if routeAccess(r.URL.Path) == accessPublic {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p, ok := authenticate(r)
+			if ok && p.can(scopeForPath(r.URL.Path)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if _, isBearer := bearerToken(r); isBearer {
+				writeJSONError(w, http.StatusUnauthorized, "invalid API key or missing scope")
+				return
+			}
+			// Logging in again would not help
+			if ok {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if wantsBasicChallenge(r) {
+				w.Header().Set("WWW-Authenticate", basicAuthRealm)
+				writeJSONError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		})
 	}
 
 	// Public files (SEO, social sharing)
@@ -332,23 +665,11 @@ func main() {
 	})
 
 	// Protected file servers
-	http.Handle("/", authMiddleware(http.FileServer(http.Dir(publicDir))))
-	http.Handle("/data/", authMiddleware(http.StripPrefix("/data/", http.FileServer(http.Dir(dataDir)))))
+	http.Handle("/", authMiddleware(unscopedDataFiles(http.FileServer(http.Dir(publicDir)))))
+	http.Handle("/data/", authMiddleware(unscopedOnly(http.StripPrefix("/data/", dataFileServer(dataDir)))))
 
 	// Protected API endpoints
-	http.Handle("/api/status", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		statusFile := filepath.Join(processingDir, "status.json")
-		data, err := os.ReadFile(statusFile)
-		if err != nil {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"status":  "not_started",
-				"message": "Processing pipeline has not been run yet",
-			})
-			return
-		}
-		w.Write(data)
-	})))
+	http.Handle("/api/status", authMiddleware(http.HandlerFunc(handleStatus)))
 
 	http.Handle("/api/start-pipeline", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
@@ -356,196 +677,228 @@ func main() {
 			return
 		}
 
-		pipelineMutex.Lock()
-		if pipelineRunning {
-			pipelineMutex.Unlock()
+		// The body is optional: a timeout, the run's parameters and
+		// whether to only plan the run
+		var body struct {
+			pipeline.Params
+			TimeoutMinutes int  `json:"timeout_minutes"`
+			DryRun         bool `json:"dry_run"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			if isBodyTooLarge(err) {
+				writeBodyTooLarge(w)
+				return
+			}
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if err := validTimeout(body.TimeoutMinutes); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		params, err := checkParameters(&body.Params)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if body.DryRun {
+			plan, err := dryRunPipeline("default", params)
+			if err != nil {
+				log.Printf("Cannot plan pipeline: %v", err)
+				http.Error(w, "Pipeline script not available", http.StatusInternalServerError)
+				return
+			}
+			audit(r, "pipeline_dry_run", "", map[string]interface{}{"pipeline": "default", "parameters": params, "ok": plan.OK})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Status string `json:"status"`
+				*dryRun
+			}{"dry_run", plan})
+			return
+		}
+
+		run := &pipelineRun{Pipeline: "default", TimeoutMinutes: body.TimeoutMinutes, Parameters: params}
+		if p, ok := authenticate(r); ok {
+			run.User = p.User.Username
+		}
+		err = startPipeline(run, 0)
+		var preflight *preflightError
+		switch {
+		case errors.Is(err, errPipelineRunning):
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"status":  "already_running",
 				"message": "Pipeline is already running",
 			})
 			return
+		case errors.As(err, &preflight):
+			audit(r, "pipeline_start", "", map[string]interface{}{"pipeline": "default", "run": run.ID, "parameters": params})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "preflight_failed",
+				"run_id": run.ID,
+				"log":    preflight.output,
+			})
+			return
+		case err != nil:
+			log.Printf("Cannot start pipeline: %v", err)
+			http.Error(w, "Pipeline script not available", http.StatusInternalServerError)
+			return
 		}
-		pipelineRunning = true
-		pipelineMutex.Unlock()
-
-		go func() {
-			defer func() {
-				pipelineMutex.Lock()
-				pipelineRunning = false
-				pipelineMutex.Unlock()
-			}()
-
-			script := filepath.Join(processingDir, "run_pipeline.sh")
-			logFile := filepath.Join(processingDir, "pipeline.log")
-
-			log.Println("Starting processing pipeline...")
-
-			f, err := os.Create(logFile)
-			if err != nil {
-				log.Printf("Failed to create log file: %v", err)
-				return
-			}
-			defer f.Close()
-
-			cmd := exec.Command("/bin/bash", script)
-			cmd.Stdout = f
-			cmd.Stderr = f
-			cmd.Dir = processingDir
-
-			if err := cmd.Run(); err != nil {
-				log.Printf("Pipeline failed: %v", err)
-			} else {
-				log.Println("Pipeline completed successfully")
-			}
-		}()
+		audit(r, "pipeline_start", "", map[string]interface{}{"pipeline": "default", "run": run.ID, "parameters": params})
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status":  "started",
+			"run_id":  run.ID,
 			"message": "Processing pipeline started",
 		})
 	})))
 
-	http.Handle("/api/pipeline-log", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logFile := filepath.Join(processingDir, "pipeline.log")
-		data, err := os.ReadFile(logFile)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{
-				"log": "No log file found",
-			})
+	http.Handle("POST /api/cancel-pipeline", authMiddleware(http.HandlerFunc(handleCancelPipeline)))
+
+	http.Handle("/api/pipeline/script", adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write(data)
-	})))
-
-	// Dynamic GPKG export with filtering
-	http.Handle("/api/export", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		yearsParam := r.URL.Query().Get("years")
-		gemeindenParam := r.URL.Query().Get("gemeinden") // Combined municipalities to merge
-
-		srcGpkg := filepath.Join(publicDir, "holzeinschlag_austria.gpkg")
-		tmpPath := filepath.Join(os.TempDir(), fmt.Sprintf("export_%d.gpkg", time.Now().UnixNano()))
-		defer os.Remove(tmpPath)
-
-		// Build column selection based on years
-		var yearCols []string
-		var sumCols []string
-		if yearsParam != "" {
-			years := strings.Split(yearsParam, ",")
-			for _, year := range years {
-				y := strings.TrimSpace(year)
-				yearCols = append(yearCols,
-					fmt.Sprintf("loss_pixels_%s", y),
-					fmt.Sprintf("loss_area_ha_%s", y),
-					fmt.Sprintf("harvest_efm_%s", y),
-					fmt.Sprintf("value_eur_%s", y),
-					fmt.Sprintf("co2_tonnes_%s", y),
-					fmt.Sprintf("ets_eur_%s", y),
-					fmt.Sprintf("ets_per_capita_%s", y),
-				)
-				sumCols = append(sumCols,
-					fmt.Sprintf("SUM(loss_pixels_%s) as loss_pixels_%s", y, y),
-					fmt.Sprintf("SUM(loss_area_ha_%s) as loss_area_ha_%s", y, y),
-					fmt.Sprintf("SUM(harvest_efm_%s) as harvest_efm_%s", y, y),
-					fmt.Sprintf("SUM(value_eur_%s) as value_eur_%s", y, y),
-					fmt.Sprintf("SUM(co2_tonnes_%s) as co2_tonnes_%s", y, y),
-					fmt.Sprintf("SUM(ets_eur_%s) as ets_eur_%s", y, y),
-					fmt.Sprintf("SUM(ets_per_capita_%s) as ets_per_capita_%s", y, y),
-				)
-			}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "default"
 		}
 
-		var selectCols string
-		if len(yearCols) > 0 {
-			selectCols = "fid, geom, name, iso, state, population, " + strings.Join(yearCols, ", ")
-		} else {
-			selectCols = "*"
+		script, err := pipelineScriptPath(processingDir, name)
+		if err == errPathTraversal {
+			log.Printf("Refusing to serve pipeline script %q: %v", name, err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
 		}
-
-		// First: export all municipalities
-		sql := fmt.Sprintf("SELECT %s FROM gemeinden", selectCols)
-		cmd := exec.Command("ogr2ogr",
-			"-f", "GPKG",
-			tmpPath,
-			srcGpkg,
-			"-sql", sql,
-			"-nln", "gemeinden",
-		)
-		output, err := cmd.CombinedOutput()
 		if err != nil {
-			log.Printf("ogr2ogr error: %v, output: %s", err, string(output))
-			http.Error(w, "Failed to generate export", http.StatusInternalServerError)
+			http.Error(w, "Script not found", http.StatusNotFound)
 			return
 		}
-
-		// If gemeinden are specified, add a merged feature
-		if gemeindenParam != "" && len(sumCols) > 0 {
-			isos := strings.Split(gemeindenParam, ",")
-			if len(isos) > 1 {
-				quoted := make([]string, len(isos))
-				for i, iso := range isos {
-					quoted[i] = fmt.Sprintf("'%s'", strings.TrimSpace(iso))
-				}
-				whereClause := fmt.Sprintf("iso IN (%s)", strings.Join(quoted, ","))
-
-				// Create merged feature with ST_Union and summed values
-				mergeSql := fmt.Sprintf(
-					"SELECT ST_Union(geom) as geom, 'Kombiniert: ' || GROUP_CONCAT(name, ', ') as name, "+
-						"'COMBINED' as iso, 'Kombiniert' as state, SUM(population) as population, %s "+
-						"FROM gemeinden WHERE %s",
-					strings.Join(sumCols, ", "),
-					whereClause,
-				)
-
-				// Append to existing GPKG
-				cmd2 := exec.Command("ogr2ogr",
-					"-f", "GPKG",
-					"-update", "-append",
-					tmpPath,
-					srcGpkg,
-					"-sql", mergeSql,
-					"-nln", "gemeinden",
-				)
-				output2, err2 := cmd2.CombinedOutput()
-				if err2 != nil {
-					log.Printf("ogr2ogr merge error: %v, output: %s", err2, string(output2))
-					// Continue anyway - we still have the base export
-				}
-			}
-		}
-
-		// Read and send file
-		data, err := os.ReadFile(tmpPath)
+		data, err := os.ReadFile(script)
 		if err != nil {
-			http.Error(w, "Failed to read export file", http.StatusInternalServerError)
+			http.Error(w, "Script not found", http.StatusNotFound)
 			return
 		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+	})))
 
-		// Generate filename
-		filename := "holzeinschlag_austria"
-		if yearsParam != "" {
-			yearList := strings.Split(yearsParam, ",")
-			if len(yearList) > 3 {
-				filename += fmt.Sprintf("_%s-%s", yearList[0], yearList[len(yearList)-1])
-			} else {
-				filename += "_" + strings.ReplaceAll(yearsParam, ",", "-")
-			}
-		}
-		filename += ".gpkg"
+	http.Handle("GET /api/admin/api-keys", adminOnly(http.HandlerFunc(handleListAPIKeys)))
+	http.Handle("POST /api/admin/api-keys", adminOnly(http.HandlerFunc(handleCreateAPIKey)))
+	http.Handle("DELETE /api/admin/api-keys/{id}", adminOnly(http.HandlerFunc(handleRevokeAPIKey)))
+	http.Handle("GET /api/admin/sessions", adminOnly(http.HandlerFunc(handleListSessions)))
+	http.Handle("DELETE /api/admin/sessions/{id}", adminOnly(http.HandlerFunc(handleRevokeSession)))
+	http.Handle("POST /api/admin/users/reload", adminOnly(http.HandlerFunc(handleReloadUsers)))
+	http.Handle("POST /api/admin/backup", adminOnly(http.HandlerFunc(handleBackup)))
+	http.Handle("POST /api/admin/restore", adminOnly(http.HandlerFunc(handleRestore)))
+	http.Handle("POST /api/admin/clear-export-cache", adminOnly(http.HandlerFunc(handleClearExportCache)))
+	http.Handle("GET /api/admin/export-quotas", adminOnly(http.HandlerFunc(handleListExportQuotas)))
+	http.Handle("DELETE /api/admin/export-quotas/{client}", adminOnly(http.HandlerFunc(handleResetExportQuota)))
+	http.Handle("POST /api/admin/upstream/check", adminOnly(http.HandlerFunc(handleUpstreamCheck)))
+	http.Handle("GET /api/admin/audit", adminOnly(http.HandlerFunc(handleAuditLog)))
+	http.Handle("POST /api/admin/invitations", adminOnly(http.HandlerFunc(handleCreateInvitation)))
+
+	// Account settings of the logged-in user
+	http.HandleFunc("POST /api/account/password", handleChangePassword)
+	http.HandleFunc("POST /api/account/totp/enroll", handleTOTPEnroll)
+	http.HandleFunc("GET /api/account/totp/qr", handleTOTPQR)
+	http.HandleFunc("POST /api/account/totp/confirm", handleTOTPConfirm)
+	http.HandleFunc("POST /api/account/totp/disable", handleTOTPDisable)
 
-		w.Header().Set("Content-Type", "application/geopackage+sqlite3")
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	http.Handle("/api/pipeline-log", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logFile := pipelineLogPath(processingDir, "default")
+		data, err := os.ReadFile(logFile)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"log": "No log file found",
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
 		w.Write(data)
 	})))
 
-	log.Println("Starting server on :8000 (public access)")
+	http.Handle("GET /api/pipeline-log/stream", authMiddleware(http.HandlerFunc(handlePipelineLogStream)))
+	http.Handle("GET /ws/pipeline", authMiddleware(http.HandlerFunc(handlePipelineWS)))
+	http.Handle("GET /api/runs", authMiddleware(http.HandlerFunc(handleListRuns)))
+	http.Handle("GET /api/artifacts", authMiddleware(http.HandlerFunc(handleArtifacts)))
+	http.Handle("GET /api/publish", authMiddleware(http.HandlerFunc(handlePublishState)))
+	http.Handle("POST /api/publish", adminOnly(http.HandlerFunc(handlePublish)))
+	http.Handle("POST /api/publish/rollback", adminOnly(http.HandlerFunc(handleRollback)))
+	http.Handle("POST /api/upload", adminOnly(http.HandlerFunc(handleUpload)))
+	http.Handle("GET /api/runs/{id}/log", authMiddleware(http.HandlerFunc(handleRunLog)))
+	http.Handle("GET /api/runs/{id}/stages/{stage}/log", authMiddleware(http.HandlerFunc(handleStageLog)))
+	http.Handle("GET /api/jobs", authMiddleware(http.HandlerFunc(handleListJobs)))
+	http.Handle("GET /api/jobs/{id}", authMiddleware(http.HandlerFunc(handleGetJob)))
+	http.Handle("POST /api/jobs", authMiddleware(http.HandlerFunc(handleSubmitJob)))
+	http.Handle("DELETE /api/jobs/{id}", authMiddleware(http.HandlerFunc(handleCancelJob)))
+	http.Handle("GET /api/schedule", authMiddleware(http.HandlerFunc(handleGetSchedule)))
+	http.Handle("PUT /api/schedule", adminOnly(http.HandlerFunc(handlePutSchedule)))
+
+	http.Handle("/api/export/columns", authMiddleware(http.HandlerFunc(handleExportColumns)))
+	http.Handle("GET /api/gemeinden", authMiddleware(http.HandlerFunc(handleListGemeinden)))
+	http.Handle("GET /api/gemeinden/{iso}", authMiddleware(http.HandlerFunc(handleGetGemeinde)))
+	http.Handle("GET /api/gemeinden/{iso}/timeseries", authMiddleware(http.HandlerFunc(handleGemeindeTimeseries)))
+	http.Handle("GET /api/aggregate", authMiddleware(http.HandlerFunc(handleAggregate)))
+	http.Handle("GET /api/summary", authMiddleware(http.HandlerFunc(handleSummary)))
+	http.Handle("GET /api/rankings", authMiddleware(http.HandlerFunc(handleRankings)))
+	http.Handle("GET /ogc", authMiddleware(http.HandlerFunc(handleOGCLanding)))
+	http.Handle("GET /ogc/{$}", authMiddleware(http.HandlerFunc(handleOGCLanding)))
+	http.Handle("GET /ogc/conformance", authMiddleware(http.HandlerFunc(handleOGCConformance)))
+	http.Handle("GET /ogc/collections", authMiddleware(http.HandlerFunc(handleOGCCollections)))
+	http.Handle("GET /ogc/collections/gemeinden", authMiddleware(http.HandlerFunc(handleOGCCollection)))
+	http.Handle("GET /ogc/collections/gemeinden/items", authMiddleware(http.HandlerFunc(handleOGCItems)))
+	http.Handle("GET /ogc/collections/gemeinden/items/{featureId}", authMiddleware(http.HandlerFunc(handleOGCItem)))
+	http.Handle("GET /api/gemeinden/export-size-estimate", authMiddleware(http.HandlerFunc(handleExportSizeEstimate)))
+
+	http.Handle("GET /api/pipeline/{name}/log/download", authMiddleware(http.HandlerFunc(handlePipelineLogDownload)))
+
+	http.Handle("GET /api/data/archives", authMiddleware(unscopedOnly(http.HandlerFunc(handleListArchives))))
+	http.Handle("GET /api/data/archives/{name}", authMiddleware(unscopedOnly(http.HandlerFunc(handleGetArchive))))
+
+	http.Handle("GET /api/metrics/exports", adminOnly(http.HandlerFunc(handleExportMetrics)))
+	http.Handle("GET /metrics", authMiddleware(http.HandlerFunc(handlePrometheusMetrics)))
+
+	http.Handle("/api/export", authMiddleware(pausedDuringPipeline(http.HandlerFunc(handleExport))))
+	http.Handle("GET /api/export/estimate", authMiddleware(http.HandlerFunc(handleExportEstimate)))
+	http.Handle("POST /api/export/jobs", authMiddleware(pausedDuringPipeline(http.HandlerFunc(handleSubmitExportJob))))
+	http.Handle("GET /api/export/jobs/{id}", authMiddleware(http.HandlerFunc(handleGetExportJob)))
+	// Signed links, usable without credentials
+	http.HandleFunc("GET /api/export/jobs/{id}/download", handleExportDownload)
+
+	startDataArchiver()
+	startExportMetrics()
+	if err := openPipelineCgroup(); err != nil {
+		log.Fatalf("Failed to open pipeline cgroup: %v", err)
+	}
+	if err := openPipelineLock(); err != nil {
+		log.Fatalf("Failed to open pipeline lock: %v", err)
+	}
+	if err := initRuns(); err != nil {
+		log.Fatalf("Failed to load pipeline runs: %v", err)
+	}
+	if err := jobs.load(processingDir); err != nil {
+		log.Fatalf("Failed to load job queue: %v", err)
+	}
+	startExportCleanup()
+	startSessionCleanup()
+	if err := startScheduler(processingDir); err != nil {
+		log.Fatalf("Failed to start scheduler: %v", err)
+	}
+	startUpstreamWatch()
+
+	if config.RequireLogin {
+		log.Printf("Starting server on :8000 (login required, %d route policies)", len(config.RoutePolicies))
+	} else {
+		log.Printf("Starting server on :8000 (public access, %d route policies)", len(config.RoutePolicies))
+	}
 	log.Println("View at http://localhost:8000")
 
-	if err := http.ListenAndServe(":8000", nil); err != nil {
+	if err := http.ListenAndServe(":8000", securityHeaders(ipFilter(gzipMiddleware(limitRequestBody(csrfProtect(http.DefaultServeMux)))))); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSessionsConcurrentAccess validates sessions from 50 goroutines
+// while they are touched, and while other sessions are created and
+// revoked by user and by ID. It is meant for go test -race.
+func TestSessionsConcurrentAccess(t *testing.T) {
+	users.mu.Lock()
+	savedUsers := users.users
+	users.users = map[string]User{
+		"race":    {Username: "race", Role: roleUser},
+		"revoked": {Username: "revoked", Role: roleUser},
+	}
+	users.mu.Unlock()
+	// Revocations by ID are audited
+	processingDir := config.ProcessingDir
+	config.ProcessingDir = t.TempDir()
+	t.Cleanup(func() {
+		users.mu.Lock()
+		users.users = savedUsers
+		users.mu.Unlock()
+		config.ProcessingDir = processingDir
+		sessionMutex.Lock()
+		clear(sessions)
+		sessionMutex.Unlock()
+	})
+
+	// Sessions are idle for longer than sessionTouchInterval, so the
+	// next validation writes LastSeen back
+	addSession := func(token, username string) {
+		stale := time.Now().Add(-2 * sessionTouchInterval)
+		sessionMutex.Lock()
+		sessions[token] = session{Username: username, Expiry: time.Now().Add(time.Hour), LastSeen: stale, Created: stale}
+		sessionMutex.Unlock()
+	}
+	kept := make([]string, 10)
+	for i := range kept {
+		kept[i] = fmt.Sprintf("%0*d-kept", sessionIDLength, i)
+		addSession(kept[i], "race")
+	}
+	revoked := make([]string, 10)
+	for i := range revoked {
+		revoked[i] = fmt.Sprintf("%0*d-revoked", sessionIDLength, len(kept)+i)
+	}
+
+	// Released once all goroutines are running, so they overlap
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 500; i++ {
+				token := kept[(g+i)%len(kept)]
+				switch g % 5 {
+				case 0:
+					addSession(token, "race")
+					touchSession(token)
+				case 1:
+					addSession(revoked[i%len(revoked)], "revoked")
+				case 2:
+					revokeUserSessions("revoked", "")
+				case 3:
+					id := revoked[i%len(revoked)][:sessionIDLength]
+					req := httptest.NewRequest("DELETE", "/api/admin/sessions/"+id, nil)
+					req.SetPathValue("id", id)
+					rec := httptest.NewRecorder()
+					handleRevokeSession(rec, req)
+					if rec.Code != http.StatusNoContent && rec.Code != http.StatusNotFound {
+						t.Errorf("revoking session %s: status %d", id, rec.Code)
+					}
+				}
+				req := httptest.NewRequest("GET", "/api/gemeinden", nil)
+				req.Header.Set("Cookie", "session="+token)
+				if !isValidSession(req) {
+					t.Errorf("session %s not valid", token)
+				}
+			}
+		}(g)
+	}
+	close(start)
+	wg.Wait()
+
+	revokeUserSessions("race", "")
+	req := httptest.NewRequest("GET", "/api/gemeinden", nil)
+	req.Header.Set("Cookie", "session="+kept[0])
+	if isValidSession(req) {
+		t.Fatal("revoked session still valid")
+	}
+}
+
+func TestRemoveExpiredSessions(t *testing.T) {
+	t.Cleanup(func() {
+		sessionMutex.Lock()
+		clear(sessions)
+		sessionMutex.Unlock()
+	})
+	now := time.Now()
+	sessionMutex.Lock()
+	sessions["active"] = session{Username: "someone", Expiry: now.Add(time.Hour), LastSeen: now, Created: now}
+	sessions["expired"] = session{Username: "someone", Expiry: now.Add(-time.Minute), LastSeen: now, Created: now.Add(-time.Hour)}
+	sessions["idle"] = session{Username: "someone", Expiry: now.Add(time.Hour), LastSeen: now.Add(-sessionIdleTimeout(session{}) - time.Minute), Created: now}
+	sessionMutex.Unlock()
+
+	if n := removeExpiredSessions(); n != 2 {
+		t.Fatalf("removed %d sessions, want 2", n)
+	}
+	sessionMutex.RLock()
+	defer sessionMutex.RUnlock()
+	if _, ok := sessions["active"]; !ok || len(sessions) != 1 {
+		t.Fatalf("sessions left: %v", sessions)
+	}
+}
+
+// BenchmarkIsValidSession measures session validation from 8 goroutines
+// per CPU, to judge whether the session map needs sharding.
+func BenchmarkIsValidSession(b *testing.B) {
+	users.mu.Lock()
+	savedUsers := users.users
+	users.users = map[string]User{"bench": {Username: "bench", Role: roleUser}}
+	users.mu.Unlock()
+	sessionMutex.Lock()
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		sessions["bench-"+strconv.Itoa(i)] = session{Username: "bench", Expiry: now.Add(time.Hour), LastSeen: now, Created: now}
+	}
+	sessionMutex.Unlock()
+	b.Cleanup(func() {
+		users.mu.Lock()
+		users.users = savedUsers
+		users.mu.Unlock()
+		sessionMutex.Lock()
+		clear(sessions)
+		sessionMutex.Unlock()
+	})
+
+	b.SetParallelism(8)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := httptest.NewRequest("GET", "/api/gemeinden", nil)
+		req.Header.Set("Cookie", "session=bench-42")
+		for pb.Next() {
+			if !isValidSession(req) {
+				b.Fatal("session not valid")
+			}
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// Export manifests record where an export comes from: the dataset
+// version and the pipeline run that produced it, the export parameters,
+// the sources to cite and the license. GeoPackages carry the manifest in
+// their gpkg_metadata table; with manifest=zip any export is zipped
+// together with it as metadata.json.
+
+type exportSource struct {
+	Name     string `json:"name"`
+	Citation string `json:"citation"`
+	URL      string `json:"url"`
+	License  string `json:"license,omitempty"`
+}
+
+var exportSources = []exportSource{
+	{
+		Name:     "Hansen Global Forest Change",
+		Citation: "Hansen, M. C. et al. (2013): High-Resolution Global Maps of 21st-Century Forest Cover Change. Science 342, 850–853.",
+		URL:      "https://glad.umd.edu/dataset/global-forest-change",
+		License:  "CC BY 4.0",
+	},
+	{
+		Name:     "Statistik Austria",
+		Citation: "Statistik Austria: Gemeindegrenzen und Bevölkerung nach Gemeinden.",
+		URL:      "https://www.statistik.at",
+		License:  "CC BY 4.0",
+	},
+	{
+		Name:     "BML Holzeinschlagsmeldung",
+		Citation: "Bundesministerium für Land- und Forstwirtschaft: Holzeinschlagsmeldung, Einschlag nach Bundesländern.",
+		URL:      "https://www.bmluk.gv.at",
+	},
+}
+
+type exportManifest struct {
+	Title     string    `json:"title"`
+	Generated time.Time `json:"generated"`
+	Dataset   struct {
+		// Modification time of the GeoPackage the export was made from
+		Version       string     `json:"version"`
+		HansenRelease string     `json:"hansen_release,omitempty"`
+		PipelineRun   string     `json:"pipeline_run,omitempty"`
+		Published     *time.Time `json:"published,omitempty"`
+	} `json:"dataset"`
+	Export struct {
+		Format    string   `json:"format"`
+		File      string   `json:"file,omitempty"`
+		Formats   []string `json:"formats,omitempty"`
+		Files     []string `json:"files,omitempty"`
+		Years     []string `json:"years,omitempty"`
+		Gemeinden []string `json:"gemeinden,omitempty"`
+		States    []string `json:"states,omitempty"`
+		Layers    []string `json:"layers"`
+		Area      string   `json:"area,omitempty"`
+		SRS       string   `json:"srs"`
+		Simplify  float64  `json:"simplify_m,omitempty"`
+		Precision *int     `json:"precision,omitempty"`
+	} `json:"export"`
+	Sources []exportSource `json:"sources"`
+	License string         `json:"license"`
+}
+
+// buildExportManifest describes the export of req, made of the data
+// files, several for bundles.
+func buildExportManifest(req exportRequest, files []bundleFile) exportManifest {
+	var m exportManifest
+	m.Title = "Holzeinschlag Österreich"
+	m.Generated = time.Now().UTC().Truncate(time.Second)
+	if info, err := os.Stat(geoPackagePath()); err == nil {
+		m.Dataset.Version = info.ModTime().UTC().Format(time.RFC3339)
+	}
+	if state, err := loadUpstreamState(); err == nil {
+		m.Dataset.HansenRelease = state.CurrentRelease
+	}
+	// The published release names its run; data published straight by
+	// the pipeline comes from its latest successful run
+	if state, err := loadPublishState(); err == nil && state.Published != nil {
+		m.Dataset.PipelineRun = state.Published.RunID
+		m.Dataset.Published = state.Published.Published
+	} else if runs, err := loadRuns(); err == nil {
+		for _, run := range runs {
+			if run.Status == "success" {
+				m.Dataset.PipelineRun = run.ID
+				m.Dataset.Published = run.Finished
+				break
+			}
+		}
+	}
+
+	m.Export.Format = req.formatName
+	if req.formatName == "bundle" {
+		m.Export.Formats = req.formats
+		for _, f := range files {
+			m.Export.Files = append(m.Export.Files, f.name)
+		}
+	} else {
+		m.Export.File = files[0].name
+	}
+	m.Export.Years = req.yearList
+	if req.gemeinden != "" {
+		m.Export.Gemeinden = strings.Split(req.gemeinden, ",")
+	}
+	m.Export.States = req.states
+	m.Export.Layers = req.layers
+	m.Export.Area = req.areaKey
+	m.Export.SRS = "EPSG:4326"
+	if req.opts.srs != "" {
+		m.Export.SRS = req.opts.srs
+	}
+	m.Export.Simplify = req.opts.simplify
+	if req.opts.precision >= 0 {
+		m.Export.Precision = &req.opts.precision
+	}
+	m.Sources = exportSources
+	m.License = config.ExportLicense
+	return m
+}
+
+// embedManifest stores the manifest in the metadata tables of the
+// GeoPackage at path, as JSON describing the whole GeoPackage.
+func embedManifest(path string, m exportManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS gpkg_metadata (
+			id INTEGER CONSTRAINT m_pk PRIMARY KEY ASC NOT NULL, md_scope TEXT NOT NULL DEFAULT 'dataset',
+			md_standard_uri TEXT NOT NULL, mime_type TEXT NOT NULL DEFAULT 'text/xml', metadata TEXT NOT NULL DEFAULT '')`,
+		`CREATE TABLE IF NOT EXISTS gpkg_metadata_reference (
+			reference_scope TEXT NOT NULL, table_name TEXT, column_name TEXT, row_id_value INTEGER,
+			timestamp DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')), md_file_id INTEGER NOT NULL,
+			md_parent_id INTEGER, CONSTRAINT crmr_mfi_fk FOREIGN KEY (md_file_id) REFERENCES gpkg_metadata(id),
+			CONSTRAINT crmr_mpi_fk FOREIGN KEY (md_parent_id) REFERENCES gpkg_metadata(id))`,
+		`INSERT INTO gpkg_extensions (table_name, column_name, extension_name, definition, scope)
+			SELECT t, NULL, 'gpkg_metadata', 'http://www.geopackage.org/spec120/#extension_metadata', 'read-write'
+			FROM (SELECT 'gpkg_metadata' AS t UNION ALL SELECT 'gpkg_metadata_reference')
+			WHERE t NOT IN (SELECT table_name FROM gpkg_extensions WHERE extension_name = 'gpkg_metadata')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	res, err := db.Exec("INSERT INTO gpkg_metadata (md_scope, md_standard_uri, mime_type, metadata) VALUES ('dataset', 'https://www.json.org', 'application/json', ?)", string(data))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO gpkg_metadata_reference (reference_scope, md_file_id) VALUES ('geopackage', ?)", id); err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// bundleFile is a data file of an export and its name in the download.
+type bundleFile struct {
+	path string
+	name string
+}
+
+// bundleExport writes the zip dst holding the data files and the
+// manifest as metadata.json. Data that is a zip itself, like Shapefiles,
+// has its entries copied instead.
+func bundleExport(dst string, files []bundleFile, m exportManifest) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	for _, file := range files {
+		if err := addToBundle(zw, file); err != nil {
+			return err
+		}
+	}
+	w, err := zw.Create("metadata.json")
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func addToBundle(zw *zip.Writer, file bundleFile) error {
+	if !strings.HasSuffix(file.name, ".zip") {
+		return addFileToZip(zw, file.path, file.name)
+	}
+	zr, err := zip.OpenReader(file.path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if err := zw.Copy(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type exportMetricKey struct {
+	Format       string `json:"format"`
+	HasYears     bool   `json:"has_year_filter"`
+	HasGemeinden bool   `json:"has_gemeinden_filter"`
+	HasBBox      bool   `json:"has_bbox_filter"`
+}
+
+type exportMetric struct {
+	exportMetricKey
+	Count int64 `json:"count"`
+}
+
+var (
+	exportMetrics      = make(map[exportMetricKey]int64)
+	exportMetricsDirty bool
+	exportMetricsMutex sync.Mutex
+)
+
+const exportMetricsFlushInterval = 5 * time.Minute
+
+func exportMetricsPath() string {
+	return filepath.Join(config.ProcessingDir, "export_metrics.json")
+}
+
+// recordExport counts one successful export.
+func recordExport(key exportMetricKey) {
+	exportMetricsMutex.Lock()
+	exportMetrics[key]++
+	exportMetricsDirty = true
+	exportMetricsMutex.Unlock()
+}
+
+func exportMetricsSnapshot() []exportMetric {
+	exportMetricsMutex.Lock()
+	defer exportMetricsMutex.Unlock()
+	list := make([]exportMetric, 0, len(exportMetrics))
+	for key, count := range exportMetrics {
+		list = append(list, exportMetric{key, count})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Count > list[j].Count })
+	return list
+}
+
+func loadExportMetrics() {
+	data, err := os.ReadFile(exportMetricsPath())
+	if err != nil {
+		return
+	}
+	var list []exportMetric
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Ignoring unreadable %s: %v", exportMetricsPath(), err)
+		return
+	}
+	exportMetricsMutex.Lock()
+	for _, m := range list {
+		exportMetrics[m.exportMetricKey] += m.Count
+	}
+	exportMetricsMutex.Unlock()
+}
+
+func saveExportMetrics() {
+	exportMetricsMutex.Lock()
+	dirty := exportMetricsDirty
+	exportMetricsDirty = false
+	exportMetricsMutex.Unlock()
+	if !dirty {
+		return
+	}
+
+	data, _ := json.MarshalIndent(exportMetricsSnapshot(), "", "  ")
+	tmp := exportMetricsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Failed to save export metrics: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, exportMetricsPath()); err != nil {
+		log.Printf("Failed to save export metrics: %v", err)
+	}
+}
+
+// startExportMetrics loads the persisted counters and saves them
+// periodically.
+func startExportMetrics() {
+	loadExportMetrics()
+	go func() {
+		for range time.Tick(exportMetricsFlushInterval) {
+			saveExportMetrics()
+		}
+	}()
+}
+
+func handleExportMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := exportMetricsSnapshot()
+	if r.URL.Query().Get("reset") == "1" {
+		exportMetricsMutex.Lock()
+		exportMetrics = make(map[exportMetricKey]int64)
+		exportMetricsDirty = true
+		exportMetricsMutex.Unlock()
+		saveExportMetrics()
+		log.Println("Export metrics reset")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
+
+// Pipeline metrics in the Prometheus text format, for the latest
+// successful run of each pipeline: how long its stages took, how many
+// bytes they processed and how many features they produced. Also the
+// load of the export workers.
+
+type promMetric struct {
+	name, help string
+	// gauge unless set
+	typ     string
+	samples []string
+}
+
+func (m *promMetric) add(value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(m.name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], promLabelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(&b, " %s", strconv.FormatFloat(value, 'g', -1, 64))
+	m.samples = append(m.samples, b.String())
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	runs, err := loadRuns()
+	if err != nil {
+		log.Printf("Failed to list runs: %v", err)
+		http.Error(w, "Failed to list runs", http.StatusInternalServerError)
+		return
+	}
+
+	runDuration := &promMetric{name: "holzeinschlag_pipeline_run_duration_seconds", help: "Duration of the latest successful run of the pipeline."}
+	lastSuccess := &promMetric{name: "holzeinschlag_pipeline_last_success_timestamp_seconds", help: "When the latest successful run of the pipeline finished."}
+	runCount := &promMetric{name: "holzeinschlag_pipeline_runs", help: "Runs of the pipeline in the run history, by status."}
+	stageDuration := &promMetric{name: "holzeinschlag_pipeline_stage_duration_seconds", help: "Duration of the stage in the latest successful run of the pipeline."}
+	stageAttempts := &promMetric{name: "holzeinschlag_pipeline_stage_attempts", help: "Attempts the stage took in the latest successful run of the pipeline."}
+	stageBytes := &promMetric{name: "holzeinschlag_pipeline_stage_bytes", help: "Input bytes the stage processed in the latest successful run of the pipeline."}
+	stageFeatures := &promMetric{name: "holzeinschlag_pipeline_stage_features", help: "Features in the outputs of the stage in the latest successful run of the pipeline."}
+
+	// Runs are newest first
+	counts := make(map[[2]string]int)
+	var countKeys [][2]string
+	seen := make(map[string]bool)
+	for _, run := range runs {
+		key := [2]string{run.Pipeline, run.Status}
+		if counts[key] == 0 {
+			countKeys = append(countKeys, key)
+		}
+		counts[key]++
+		if run.Status != "success" || run.Finished == nil || seen[run.Pipeline] {
+			continue
+		}
+		seen[run.Pipeline] = true
+		runDuration.add(run.Finished.Sub(run.Started).Seconds(), "pipeline", run.Pipeline)
+		lastSuccess.add(float64(run.Finished.Unix()), "pipeline", run.Pipeline)
+
+		// Stages completed by earlier attempts were skipped by later
+		// ones; the last time a stage ran counts
+		latest := make(map[string]stageRun)
+		var order []string
+		for _, a := range run.Attempts {
+			for _, s := range a.Stages {
+				if _, ok := latest[s.Stage]; !ok {
+					order = append(order, s.Stage)
+				}
+				latest[s.Stage] = s
+			}
+		}
+		for _, name := range order {
+			s := latest[name]
+			labels := []string{"pipeline", run.Pipeline, "stage", s.Stage, "status", s.Status}
+			stageDuration.add(s.DurationSeconds, labels...)
+			stageAttempts.add(float64(s.Attempts), labels...)
+			stageBytes.add(float64(s.Bytes), labels...)
+			stageFeatures.add(float64(s.Features), labels...)
+		}
+	}
+	for _, key := range countKeys {
+		runCount.add(float64(counts[key]), "pipeline", key[0], "status", key[1])
+	}
+
+	exportsRunning := &promMetric{name: "holzeinschlag_exports_running", help: "Exports being generated."}
+	exportsRunning.add(float64(len(exportWorkers)))
+	exportQueue := &promMetric{name: "holzeinschlag_export_queue_depth", help: "Exports waiting for a worker."}
+	exportQueue.add(float64(exportWaiting.Load()))
+	exportsRejected := &promMetric{name: "holzeinschlag_exports_rejected_total", help: "Export requests turned away because the queue was full.", typ: "counter"}
+	exportsRejected.add(float64(exportRejected.Load()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range []*promMetric{runDuration, lastSuccess, runCount, stageDuration, stageAttempts, stageBytes, stageFeatures, exportsRunning, exportQueue, exportsRejected} {
+		typ := m.typ
+		if typ == "" {
+			typ = "gauge"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, typ)
+		for _, s := range m.samples {
+			fmt.Fprintln(w, s)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// securityHeaders sets response headers that apply to every route.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if config.XFrameOptions != "" {
+			w.Header().Set("X-Frame-Options", config.XFrameOptions)
+		}
+		if config.XFrameOptions == "SAMEORIGIN" {
+			// Modern browsers prefer the CSP directive over X-Frame-Options
+			w.Header().Set("Content-Security-Policy", "frame-ancestors 'self'")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dataFileServer serves dataDir. Files whose extension has no registered
+// MIME type are sent as application/octet-stream instead of being sniffed.
+// Files get an ETag besides their modification time, so interrupted
+// downloads can be resumed with If-Range.
+func dataFileServer(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ext := path.Ext(r.URL.Path)
+		if ext != "" && mime.TypeByExtension(ext) == "" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		// Keep the archiver away from files being downloaded
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		acquireServing(name)
+		defer releaseServing(name)
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err == nil && info.Mode().IsRegular() {
+			w.Header().Set("ETag", fileETag(info))
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// fileETag is a strong entity tag for a file that is replaced rather than
+// rewritten in place, from its size and modification time.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// Content types worth compressing; everything else (GeoPackages, images,
+// archives) is passed through untouched.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/geo+json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func isCompressible(contentType string) bool {
+	// Compressing would hold back events until a block fills up
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipMiddleware compresses text-like responses for clients that accept
+// gzip. Vary is always set so caches keep both variants apart.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// WebSocket upgrades need the connection itself
+		if r.Method == "HEAD" || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" ||
+			!strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	// Informational responses like 100 Continue precede the real one
+	if code >= 100 && code < 200 {
+		g.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	h := g.Header()
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		// The compressed bytes differ from those ranges are taken from
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// limitRequestBody caps the body size of state-changing requests. Bodies
+// announcing a larger Content-Length are rejected up front; for chunked
+// bodies the handler sees an *http.MaxBytesError when reading too far.
+func limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Uploads have a limit of their own
+		if (r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH") && r.URL.Path != "/api/upload" {
+			if r.ContentLength > config.MaxRequestBodyBytes {
+				writeBodyTooLarge(w)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, config.MaxRequestBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter) {
+	writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+}
+
+// isBodyTooLarge reports whether err came from exceeding the body limit.
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
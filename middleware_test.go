@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLimitRequestBodyLogin(t *testing.T) {
+	// Failed logins are audited
+	processingDir := config.ProcessingDir
+	config.ProcessingDir = t.TempDir()
+	t.Cleanup(func() { config.ProcessingDir = processingDir })
+
+	form := url.Values{"username": {"someone"}, "password": {strings.Repeat("x", 2<<20)}}.Encode()
+	handler := limitRequestBody(http.HandlerFunc(handleLogin))
+
+	t.Run("content length", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("status = %d, want 413", rec.Code)
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		// Without a Content-Length the limit is hit while reading
+		req := httptest.NewRequest("POST", "/login", io.NopCloser(bytes.NewReader([]byte(form))))
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("status = %d, want 413", rec.Code)
+		}
+	})
+
+	t.Run("small body", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader("username=someone&password=secret"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+	})
+}
+
+func TestGzipVary(t *testing.T) {
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"gemeinden": []}`)
+	}))
+
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		req := httptest.NewRequest("GET", "/api/gemeinden", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary = %q, want Accept-Encoding", acceptEncoding, got)
+		}
+		wantEncoding := ""
+		if acceptEncoding == "gzip" {
+			wantEncoding = "gzip"
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != wantEncoding {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want %q", acceptEncoding, got, wantEncoding)
+		}
+	}
+}
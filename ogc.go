@@ -0,0 +1,650 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The /ogc routes serve the Gemeinden as an OGC API – Features service,
+// so QGIS and ArcGIS can add the layer from the URL and fetch only what
+// is on the map. The core, GeoJSON and HTML conformance classes are
+// implemented; coordinates are longitude/latitude (CRS84) as stored in
+// the GeoPackage. Like the Gemeinden API it only covers the Gemeinden of
+// the caller's data scope.
+
+const (
+	ogcCollectionID = "gemeinden"
+	defaultOGCLimit = 10
+	// Larger limits are lowered to this, as the standard asks, rather
+	// than refused
+	maxOGCLimit = 1000
+)
+
+var ogcConformance = []string{
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/html",
+}
+
+// Query parameters of the items request; anything else is refused so a
+// mistyped filter doesn't silently return everything
+var ogcItemsParams = []string{"f", "limit", "offset", "bbox", "datetime", "name", "iso", "state"}
+
+const ogcCRS84 = "http://www.opengis.net/def/crs/OGC/1.3/CRS84"
+
+type ogcLink struct {
+	Href  string `json:"href"`
+	Rel   string `json:"rel"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+type ogcSpatialExtent struct {
+	BBox [][4]float64 `json:"bbox"`
+	CRS  string       `json:"crs"`
+}
+
+type ogcTemporalExtent struct {
+	Interval [][2]string `json:"interval"`
+	TRS      string      `json:"trs"`
+}
+
+type ogcExtent struct {
+	Spatial  *ogcSpatialExtent  `json:"spatial,omitempty"`
+	Temporal *ogcTemporalExtent `json:"temporal,omitempty"`
+}
+
+type ogcCollection struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Extent      ogcExtent `json:"extent"`
+	ItemType    string    `json:"itemType"`
+	CRS         []string  `json:"crs"`
+	Links       []ogcLink `json:"links"`
+}
+
+// ogcFeature is a Gemeinde as a GeoJSON feature. The properties are the
+// columns of the GeoPackage; of the indicators only those of the years
+// asked for.
+type ogcFeature struct {
+	Type       string                 `json:"type"`
+	ID         int64                  `json:"id"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+	Links      []ogcLink              `json:"links,omitempty"`
+}
+
+// ogcPage is what the HTML form of a resource shows.
+type ogcPage struct {
+	Title       string
+	Description string
+	// Collections or conformance classes
+	Entries []ogcLink
+	// Rows of an items page
+	Features []ogcFeatureRow
+	Matched  int64
+	// Properties of a single feature, in column order
+	Properties []ogcProperty
+	Links      []ogcLink
+}
+
+type ogcFeatureRow struct {
+	Href, Name, ISO, State, Population string
+	ID                                 int64
+}
+
+type ogcProperty struct {
+	Name, Value string
+}
+
+var ogcPageTemplate = template.Must(template.New("ogc").Parse(ogcPageHTML))
+
+// ogcFormat returns "json" or "html", from ?f= or else the Accept
+// header; clients that don't ask for HTML get JSON.
+func ogcFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("f"); f {
+	case "json", "html":
+		return f, nil
+	case "":
+	default:
+		return "", errors.New("f must be json or html")
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return "html", nil
+	}
+	return "json", nil
+}
+
+// ogcURL returns the absolute URL of path with query, as the client
+// reached us.
+func ogcURL(r *http.Request, path string, query url.Values) string {
+	scheme := "http"
+	if requestIsSecure(r) {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// ogcDocLinks returns the self link of the requested resource in format
+// and the alternate link in the other one. jsonType is the media type of
+// its JSON form.
+func ogcDocLinks(r *http.Request, format, jsonType string) []ogcLink {
+	asJSON := ogcLink{Type: jsonType, Title: "This document as JSON"}
+	asHTML := ogcLink{Type: "text/html", Title: "This document as HTML"}
+	query := r.URL.Query()
+	query.Set("f", "json")
+	asJSON.Href = ogcURL(r, r.URL.Path, query)
+	query.Set("f", "html")
+	asHTML.Href = ogcURL(r, r.URL.Path, query)
+	if format == "html" {
+		asHTML.Rel, asJSON.Rel = "self", "alternate"
+		return []ogcLink{asHTML, asJSON}
+	}
+	asJSON.Rel, asHTML.Rel = "self", "alternate"
+	return []ogcLink{asJSON, asHTML}
+}
+
+// writeOGC writes doc as JSON of contentType, or the page as HTML.
+func writeOGC(w http.ResponseWriter, format, contentType string, doc interface{}, page ogcPage) {
+	if format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := ogcPageTemplate.Execute(w, page); err != nil {
+			log.Printf("Failed to render OGC page: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// handleOGCLanding serves the landing page, linking to the conformance
+// declaration and the collections.
+func handleOGCLanding(w http.ResponseWriter, r *http.Request) {
+	format, err := ogcFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	links := append(ogcDocLinks(r, format, "application/json"),
+		ogcLink{Href: ogcURL(r, "/ogc/conformance", nil), Rel: "conformance", Type: "application/json", Title: "Conformance classes"},
+		ogcLink{Href: ogcURL(r, "/ogc/collections", nil), Rel: "data", Type: "application/json", Title: "Collections"},
+	)
+	title := "Holzeinschlag Österreich"
+	description := "Timber harvest indicators of the Austrian Gemeinden as OGC API – Features"
+	writeOGC(w, format, "application/json", map[string]interface{}{
+		"title":       title,
+		"description": description,
+		"links":       links,
+	}, ogcPage{Title: title, Description: description, Links: links})
+}
+
+func handleOGCConformance(w http.ResponseWriter, r *http.Request) {
+	format, err := ogcFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page := ogcPage{Title: "Conformance", Links: ogcDocLinks(r, format, "application/json")}
+	for _, class := range ogcConformance {
+		page.Entries = append(page.Entries, ogcLink{Href: class, Title: class})
+	}
+	writeOGC(w, format, "application/json", map[string]interface{}{"conformsTo": ogcConformance}, page)
+}
+
+// gemeindenCollection describes the Gemeinden layer: its extent from the
+// GeoPackage contents and the years with data.
+func gemeindenCollection(r *http.Request) (ogcCollection, error) {
+	c := ogcCollection{
+		ID:          ogcCollectionID,
+		Title:       "Gemeinden",
+		Description: "Austrian Gemeinden with their yearly timber harvest indicators",
+		ItemType:    "feature",
+		CRS:         []string{ogcCRS84},
+	}
+	var minX, minY, maxX, maxY sql.NullFloat64
+	err := gpkgDB().QueryRow("SELECT min_x, min_y, max_x, max_y FROM gpkg_contents WHERE table_name = 'gemeinden'").Scan(&minX, &minY, &maxX, &maxY)
+	if err != nil {
+		return c, err
+	}
+	if minX.Valid && minY.Valid && maxX.Valid && maxY.Valid {
+		c.Extent.Spatial = &ogcSpatialExtent{
+			BBox: [][4]float64{{minX.Float64, minY.Float64, maxX.Float64, maxY.Float64}},
+			CRS:  ogcCRS84,
+		}
+	}
+	years, err := datasetYears()
+	if err != nil {
+		return c, err
+	}
+	if len(years) > 0 {
+		c.Extent.Temporal = &ogcTemporalExtent{
+			Interval: [][2]string{{years[0] + "-01-01T00:00:00Z", years[len(years)-1] + "-12-31T23:59:59Z"}},
+			TRS:      "http://www.opengis.net/def/uom/ISO-8601/0/Gregorian",
+		}
+	}
+	items := "/ogc/collections/" + ogcCollectionID + "/items"
+	c.Links = []ogcLink{
+		{Href: ogcURL(r, items, url.Values{"f": {"json"}}), Rel: "items", Type: "application/geo+json", Title: "Gemeinden as GeoJSON"},
+		{Href: ogcURL(r, items, url.Values{"f": {"html"}}), Rel: "items", Type: "text/html", Title: "Gemeinden as HTML"},
+	}
+	return c, nil
+}
+
+func handleOGCCollections(w http.ResponseWriter, r *http.Request) {
+	format, err := ogcFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	c, err := gemeindenCollection(r)
+	if err != nil {
+		log.Printf("Describing OGC collection failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to describe collections")
+		return
+	}
+	collection := ogcURL(r, "/ogc/collections/"+ogcCollectionID, nil)
+	c.Links = append(c.Links, ogcLink{Href: collection, Rel: "self", Type: "application/json", Title: c.Title})
+	links := ogcDocLinks(r, format, "application/json")
+	writeOGC(w, format, "application/json", map[string]interface{}{
+		"links":       links,
+		"collections": []ogcCollection{c},
+	}, ogcPage{
+		Title:   "Collections",
+		Entries: []ogcLink{{Href: collection + "?f=html", Title: c.Title + " – " + c.Description}},
+		Links:   links,
+	})
+}
+
+func handleOGCCollection(w http.ResponseWriter, r *http.Request) {
+	format, err := ogcFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	c, err := gemeindenCollection(r)
+	if err != nil {
+		log.Printf("Describing OGC collection failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to describe collection")
+		return
+	}
+	c.Links = append(ogcDocLinks(r, format, "application/json"), c.Links...)
+	writeOGC(w, format, "application/json", c, ogcPage{Title: c.Title, Description: c.Description, Links: c.Links})
+}
+
+// datetimeYear returns the year of one end of a datetime parameter: a
+// year, a date or an RFC 3339 timestamp. An open end ("..") is open.
+func datetimeYear(s string, open int) (int, error) {
+	if s == ".." {
+		return open, nil
+	}
+	for _, layout := range []string{"2006", "2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Year(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid datetime %q; use a date, a timestamp or an interval like 2020-01-01/2022-12-31", s)
+}
+
+// parseOGCDatetime returns the available years within datetime, an
+// instant or an interval of two instants, either of which may be "..".
+func parseOGCDatetime(datetime string, available []string) ([]string, error) {
+	start, end, interval := strings.Cut(datetime, "/")
+	if !interval {
+		end = start
+	}
+	from, err := datetimeYear(start, math.MinInt)
+	if err != nil {
+		return nil, err
+	}
+	to, err := datetimeYear(end, math.MaxInt)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, errors.New("datetime interval ends before it starts")
+	}
+	years := []string{}
+	for _, year := range available {
+		if y, _ := strconv.Atoi(year); y >= from && y <= to {
+			years = append(years, year)
+		}
+	}
+	return years, nil
+}
+
+// parseOGCItemsQuery reads the filters of an items request into an SQL
+// condition, and returns the years whose indicators are included.
+func parseOGCItemsQuery(query url.Values, available []string) (gemeindenFilter, []string, error) {
+	var f gemeindenFilter
+	for param := range query {
+		if !slices.Contains(ogcItemsParams, param) {
+			return f, nil, fmt.Errorf("unknown parameter %q", param)
+		}
+	}
+	// Properties filter by equality, as the standard has it
+	for _, property := range []string{"name", "iso", "state"} {
+		if value := query.Get(property); value != "" {
+			f.conds = append(f.conds, property+" = ?")
+			f.args = append(f.args, value)
+		}
+	}
+	if bbox := query.Get("bbox"); bbox != "" {
+		b, err := parseBBox(bbox)
+		if err != nil {
+			return f, nil, err
+		}
+		fids, err := gemeindenInArea(bboxPolygon(b))
+		if err != nil {
+			return f, nil, err
+		}
+		if len(fids) == 0 {
+			f.conds = append(f.conds, "0")
+		} else {
+			f.conds = append(f.conds, "fid IN ("+strings.Join(fids, ",")+")")
+		}
+	}
+	years := available
+	if datetime := query.Get("datetime"); datetime != "" {
+		var err error
+		if years, err = parseOGCDatetime(datetime, available); err != nil {
+			return f, nil, err
+		}
+		// Every Gemeinde has every year; outside them there are none
+		if len(years) == 0 {
+			f.conds = append(f.conds, "0")
+		}
+	}
+	return f, years, nil
+}
+
+// scanOGCFeatures reads the rows of SELECT * FROM gemeinden as features,
+// keeping of the indicators those of years. It also returns the names of
+// the properties in column order.
+func scanOGCFeatures(rows *sql.Rows, years []string) ([]ogcFeature, []string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	var properties []string
+	for _, column := range columns {
+		if m := yearColumnPattern.FindStringSubmatch(column); m != nil && slices.Contains(indicators, m[1]) && !slices.Contains(years, m[2]) {
+			continue
+		}
+		if column != "fid" && column != "geom" {
+			properties = append(properties, column)
+		}
+	}
+	features := []ogcFeature{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, err
+		}
+		f := ogcFeature{Type: "Feature", Properties: make(map[string]interface{}, len(properties))}
+		for i, column := range columns {
+			switch {
+			case column == "fid":
+				f.ID, _ = values[i].(int64)
+			case column == "geom":
+				blob, _ := values[i].([]byte)
+				if blob == nil {
+					continue
+				}
+				shape, err := parseGeoPackageGeometry(blob)
+				if err != nil {
+					return nil, nil, fmt.Errorf("geometry of feature %d: %w", f.ID, err)
+				}
+				geometry := shape.geoJSON()
+				f.Geometry = &geometry
+			case slices.Contains(properties, column):
+				f.Properties[column] = values[i]
+			}
+		}
+		features = append(features, f)
+	}
+	return features, properties, rows.Err()
+}
+
+// ogcValue formats a property for the HTML pages.
+func ogcValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// handleOGCItems returns a page of ?limit= Gemeinden from ?offset=,
+// within ?bbox= and with the indicators of the years in ?datetime=,
+// filtered by ?name=, ?iso= and ?state=.
+func handleOGCItems(w http.ResponseWriter, r *http.Request) {
+	format, err := ogcFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultOGCLimit
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = min(limit, maxOGCLimit)
+	}
+	offset := 0
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must not be negative")
+			return
+		}
+	}
+	available, err := datasetYears()
+	if err != nil {
+		log.Printf("Reading dataset years failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read features")
+		return
+	}
+	filter, years, err := parseOGCItemsQuery(query, available)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	where := filter.where(dataScopeCondition(r))
+	var matched int64
+	if err := gpkgDB().QueryRow("SELECT COUNT(*) FROM gemeinden WHERE "+where, filter.args...).Scan(&matched); err != nil {
+		log.Printf("Counting OGC features failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read features")
+		return
+	}
+	rows, err := gpkgDB().Query("SELECT * FROM gemeinden WHERE "+where+" ORDER BY fid LIMIT ? OFFSET ?",
+		append(filter.args, limit, offset)...)
+	if err != nil {
+		log.Printf("Reading OGC features failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read features")
+		return
+	}
+	defer rows.Close()
+	features, _, err := scanOGCFeatures(rows, years)
+	if err != nil {
+		log.Printf("Reading OGC features failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read features")
+		return
+	}
+
+	links := ogcDocLinks(r, format, "application/geo+json")
+	contentType := "application/geo+json"
+	if format == "html" {
+		contentType = "text/html"
+	}
+	page := func(rel, title string, start int) ogcLink {
+		q := r.URL.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(start))
+		return ogcLink{Href: ogcURL(r, r.URL.Path, q), Rel: rel, Type: contentType, Title: title}
+	}
+	if int64(offset+len(features)) < matched {
+		links = append(links, page("next", "Next page", offset+limit))
+	}
+	if offset > 0 {
+		links = append(links, page("prev", "Previous page", max(offset-limit, 0)))
+	}
+	links = append(links, ogcLink{Href: ogcURL(r, "/ogc/collections/"+ogcCollectionID, nil), Rel: "collection", Type: "application/json", Title: "Gemeinden"})
+
+	html := ogcPage{Title: "Gemeinden", Matched: matched, Links: links}
+	if format == "html" {
+		for _, f := range features {
+			html.Features = append(html.Features, ogcFeatureRow{
+				Href:       ogcURL(r, fmt.Sprintf("/ogc/collections/%s/items/%d", ogcCollectionID, f.ID), url.Values{"f": {"html"}}),
+				ID:         f.ID,
+				Name:       ogcValue(f.Properties["name"]),
+				ISO:        ogcValue(f.Properties["iso"]),
+				State:      ogcValue(f.Properties["state"]),
+				Population: ogcValue(f.Properties["population"]),
+			})
+		}
+	}
+	writeOGC(w, format, "application/geo+json", map[string]interface{}{
+		"type":           "FeatureCollection",
+		"features":       features,
+		"numberMatched":  matched,
+		"numberReturned": len(features),
+		"timeStamp":      time.Now().UTC().Format(time.RFC3339),
+		"links":          links,
+	}, html)
+}
+
+// handleOGCItem returns one Gemeinde by fid, with the indicators of the
+// years in ?datetime=.
+func handleOGCItem(w http.ResponseWriter, r *http.Request) {
+	format, err := ogcFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fid, err := strconv.ParseInt(r.PathValue("featureId"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "feature not found")
+		return
+	}
+	available, err := datasetYears()
+	if err != nil {
+		log.Printf("Reading dataset years failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read feature")
+		return
+	}
+	years := available
+	if datetime := r.URL.Query().Get("datetime"); datetime != "" {
+		if years, err = parseOGCDatetime(datetime, available); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	where := "fid = ?"
+	if cond := dataScopeCondition(r); cond != "" {
+		where += " AND " + cond
+	}
+	rows, err := gpkgDB().Query("SELECT * FROM gemeinden WHERE "+where, fid)
+	if err != nil {
+		log.Printf("Reading OGC feature %d failed: %v", fid, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read feature")
+		return
+	}
+	defer rows.Close()
+	features, properties, err := scanOGCFeatures(rows, years)
+	if err != nil {
+		log.Printf("Reading OGC feature %d failed: %v", fid, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read feature")
+		return
+	}
+	if len(features) == 0 {
+		writeJSONError(w, http.StatusNotFound, "feature not found")
+		return
+	}
+
+	f := features[0]
+	collection := "/ogc/collections/" + ogcCollectionID
+	f.Links = append(ogcDocLinks(r, format, "application/geo+json"),
+		ogcLink{Href: ogcURL(r, collection, nil), Rel: "collection", Type: "application/json", Title: "Gemeinden"})
+	page := ogcPage{Title: ogcValue(f.Properties["name"]), Links: f.Links}
+	for _, property := range properties {
+		page.Properties = append(page.Properties, ogcProperty{Name: property, Value: ogcValue(f.Properties[property])})
+	}
+	writeOGC(w, format, "application/geo+json", f, page)
+}
+
+var ogcPageHTML = `<!DOCTYPE html>
+<html lang="de">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Title}} - Holzeinschlag Österreich</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            margin: 0;
+            color: #222;
+        }
+        header { background: #2d5a27; color: white; padding: 16px 24px; }
+        header h1 { font-size: 22px; font-weight: 600; }
+        main { padding: 16px 24px; max-width: 1100px; }
+        h2 { font-size: 17px; margin: 24px 0 8px; }
+        a { color: #2d5a27; }
+        table { border-collapse: collapse; }
+        th, td { border-bottom: 1px solid #ddd; padding: 4px 12px 4px 0; text-align: left; }
+        .muted { color: #666; }
+    </style>
+</head>
+<body>
+    <header><h1>{{.Title}}</h1></header>
+    <main>
+        {{if .Description}}<p>{{.Description}}</p>{{end}}
+        {{if .Entries}}
+        <ul>
+            {{range .Entries}}<li><a href="{{.Href}}">{{.Title}}</a></li>
+            {{end}}
+        </ul>
+        {{end}}
+        {{if .Features}}
+        <p class="muted">{{len .Features}} of {{.Matched}} Gemeinden</p>
+        <table>
+            <tr><th>ID</th><th>Name</th><th>Gemeindekennziffer</th><th>Bundesland</th><th>Einwohner</th></tr>
+            {{range .Features}}<tr><td><a href="{{.Href}}">{{.ID}}</a></td><td>{{.Name}}</td><td>{{.ISO}}</td><td>{{.State}}</td><td>{{.Population}}</td></tr>
+            {{end}}
+        </table>
+        {{end}}
+        {{if .Properties}}
+        <table>
+            {{range .Properties}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+            {{end}}
+        </table>
+        {{end}}
+        <h2>Links</h2>
+        <ul>
+            {{range .Links}}<li><a href="{{.Href}}">{{.Title}}</a> <span class="muted">({{.Rel}}, {{.Type}})</span></li>
+            {{end}}
+        </ul>
+    </main>
+</body>
+</html>
+`
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Pending authorization requests expire after this long
+const oidcLoginTimeout = 10 * time.Minute
+
+type oidcPending struct {
+	Verifier string
+	Nonce    string
+	Next     string
+	Expiry   time.Time
+}
+
+var (
+	oidcMutex    sync.Mutex
+	oidcProvider *oidc.Provider
+	oidcPendings = make(map[string]oidcPending) // by state
+)
+
+func oidcEnabled() bool {
+	return config.OIDCIssuerURL != ""
+}
+
+// oidcClient discovers the issuer on first use, so the server still starts
+// while the identity provider is unreachable.
+func oidcClient(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+	if oidcProvider == nil {
+		provider, err := oidc.NewProvider(ctx, config.OIDCIssuerURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("OIDC discovery failed: %w", err)
+		}
+		oidcProvider = provider
+	}
+	oauth := &oauth2.Config{
+		ClientID:     config.OIDCClientID,
+		ClientSecret: config.OIDCClientSecret,
+		RedirectURL:  config.OIDCRedirectURL,
+		Endpoint:     oidcProvider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+	verifier := oidcProvider.Verifier(&oidc.Config{ClientID: config.OIDCClientID})
+	return oauth, verifier, nil
+}
+
+// handleOIDCLogin starts the authorization code flow with PKCE.
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	oauth, _, err := oidcClient(r.Context())
+	if err != nil {
+		log.Printf("OIDC login unavailable: %v", err)
+		http.Error(w, "Single sign-on is currently unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := generateToken()
+	pending := oidcPending{
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    generateToken(),
+		Next:     safeRedirectTarget(r.URL.Query().Get("next")),
+		Expiry:   time.Now().Add(oidcLoginTimeout),
+	}
+	oidcMutex.Lock()
+	for s, p := range oidcPendings {
+		if time.Now().After(p.Expiry) {
+			delete(oidcPendings, s)
+		}
+	}
+	oidcPendings[state] = pending
+	oidcMutex.Unlock()
+
+	http.Redirect(w, r, oauth.AuthCodeURL(state,
+		oauth2.S256ChallengeOption(pending.Verifier),
+		oidc.Nonce(pending.Nonce),
+	), http.StatusFound)
+}
+
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	oidcMutex.Lock()
+	pending, ok := oidcPendings[state]
+	delete(oidcPendings, state)
+	oidcMutex.Unlock()
+	if !ok || time.Now().After(pending.Expiry) {
+		http.Error(w, "Login request expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		log.Printf("OIDC login rejected by provider: %s", errCode)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	oauth, verifier, err := oidcClient(r.Context())
+	if err != nil {
+		log.Printf("OIDC callback failed: %v", err)
+		http.Error(w, "Single sign-on is currently unavailable", http.StatusBadGateway)
+		return
+	}
+	token, err := oauth.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(pending.Verifier))
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Printf("OIDC token response without id_token")
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := verifier.Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != pending.Nonce {
+		log.Printf("OIDC ID token rejected: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		log.Printf("OIDC claims unreadable: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	username, _ := claims[config.OIDCUsernameClaim].(string)
+	role := oidcRole(claims)
+	if username == "" || role == "" {
+		log.Printf("OIDC login denied: subject=%s, username=%q, no matching role", idToken.Subject, username)
+		http.Error(w, "Your account has no access to this application", http.StatusForbidden)
+		return
+	}
+
+	log.Printf("Login: user=%s, provider=oidc, role=%s", username, role)
+	audit(r, "login", username, map[string]interface{}{"provider": "oidc"})
+	createSession(w, r, User{Username: username, Role: role, Provider: "oidc"}, false)
+	http.Redirect(w, r, pending.Next, http.StatusSeeOther)
+}
+
+// oidcRole maps the values of the configured role claim (a string or a
+// list of strings, e.g. Keycloak groups) to a local role. Admin wins if
+// several values match; without a match the default role applies.
+func oidcRole(claims map[string]interface{}) string {
+	var values []string
+	switch v := claims[config.OIDCRoleClaim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	role := config.OIDCDefaultRole
+	for _, value := range values {
+		switch config.OIDCRoleMapping[value] {
+		case roleAdmin:
+			return roleAdmin
+		case roleUser:
+			role = roleUser
+		}
+	}
+	return role
+}
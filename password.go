@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters for new hashes (RFC 9106 second recommended option,
+// with a smaller memory footprint suited to a small VM)
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 2
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// Smallest salt and key accepted in a stored hash (RFC 9106, section 3.1)
+const (
+	argonMinSaltLen = 8
+	argonMinKeyLen  = 4
+)
+
+var errInvalidHash = errors.New("invalid argon2id hash")
+
+// hashPassword returns an argon2id hash in the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// argonHash is a decoded argon2id hash.
+type argonHash struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+// decodeHash parses a hash in the format of hashPassword. Parameters
+// argon2.IDKey would panic on, or that RFC 9106 does not allow, are
+// rejected, so a bad hash in users.json fails at load rather than at login.
+func decodeHash(encoded string) (argonHash, error) {
+	var h argonHash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return h, errInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, errInvalidHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, errInvalidHash
+	}
+	if h.time < 1 || h.threads < 1 || h.memory < 8*uint32(h.threads) {
+		return h, errInvalidHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.salt) < argonMinSaltLen {
+		return h, errInvalidHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) < argonMinKeyLen {
+		return h, errInvalidHash
+	}
+	return h, nil
+}
+
+// verifyPassword checks password against a hash produced by hashPassword,
+// honoring the parameters stored in the hash.
+func verifyPassword(encoded, password string) (bool, error) {
+	h, err := decodeHash(encoded)
+	if err != nil {
+		return false, err
+	}
+	candidate := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(h.key, candidate) == 1, nil
+}
+
+// Hash of a random password, verified against for unknown usernames so
+// that failed logins take the same time either way
+var dummyPasswordHash = func() string {
+	h, err := hashPassword(generateToken())
+	if err != nil {
+		panic(err)
+	}
+	return h
+}()
+
+// runHashPassword implements the hash-password subcommand: it reads a
+// password from the first line of stdin and prints its hash for users.json.
+// This is how the first admin account is set up:
+//
+//	./holzeinschlag-austria hash-password
+//
+// and paste the output as password_hash into a copy of
+// users.example.json.
+func runHashPassword() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, "no password given")
+		os.Exit(1)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "no password given")
+		os.Exit(1)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hashing failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(hash)
+}
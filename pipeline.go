@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"holzeinschlag-austria/pipeline"
+)
+
+var (
+	errUnknownPipeline = errors.New("unknown pipeline")
+	errPathTraversal   = errors.New("script path escapes the processing directory")
+	errBuiltinPipeline = errors.New("built-in pipelines have no script")
+)
+
+// Pipelines configured as "builtin:<name>" run in the Go pipeline engine
+// instead of a script
+const builtinPipelinePrefix = "builtin:"
+
+func builtinPipeline(script string) (*pipeline.Pipeline, bool) {
+	name, ok := strings.CutPrefix(script, builtinPipelinePrefix)
+	if !ok {
+		return nil, false
+	}
+	return pipeline.Builtin(name)
+}
+
+// pipelineScriptPath resolves the script configured for a named pipeline
+// and makes sure it stays inside processingDir, following symlinks.
+func pipelineScriptPath(processingDir, name string) (string, error) {
+	script, ok := config.Pipelines[name]
+	if !ok {
+		return "", errUnknownPipeline
+	}
+	if strings.HasPrefix(script, builtinPipelinePrefix) {
+		return "", errBuiltinPipeline
+	}
+	return resolveScript(processingDir, script)
+}
+
+// pipelineRunner returns how to run a named pipeline with the given
+// parameters: its script through bash, or the built-in Go pipeline. The
+// output goes to out; built-in pipelines also write a log per stage into
+// stageLogDir and return the stages they ran. They skip the stages in
+// done and add the ones they complete; scripts always start over.
+func pipelineRunner(processingDir, name string, params *pipeline.Params) (func(ctx context.Context, out io.Writer, stageLogDir string, done map[string]bool) ([]stageRun, error), error) {
+	staging, err := filepath.Abs(stagingDir())
+	if err != nil {
+		return nil, err
+	}
+	env := append(params.Environ(), "PIPELINE_PUBLIC_DIR="+staging)
+	if params != nil && params.Inputs {
+		inputs, err := filepath.Abs(inputsDir())
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, "PIPELINE_INPUTS_DIR="+inputs)
+	}
+	if p, ok := builtinPipeline(config.Pipelines[name]); ok {
+		return func(ctx context.Context, out io.Writer, stageLogDir string, done map[string]bool) ([]stageRun, error) {
+			var mu sync.Mutex
+			var stages []stageRun
+			report := statusReporter{finished: func(stage string, result pipeline.StageResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				stages = append(stages, newStageRun(stage, result))
+			}}
+			env := &pipeline.Env{
+				Dir:     processingDir,
+				Log:     out,
+				Report:  report,
+				Params:  params,
+				Workers: config.PipelineWorkers,
+				StageLog: func(stage string) (io.WriteCloser, error) {
+					return openStageLog(stageLogDir, stage)
+				},
+				Exec: func(ctx context.Context, stage *pipeline.Env, name string, args ...string) error {
+					return runPipelineCommand(ctx, processingDir, stage.Log, slices.Concat(env, []string{"PIPELINE_STAGE=" + stage.Stage}), stage.Measure, name, args...)
+				},
+			}
+			err := p.Run(ctx, env, done)
+			return stages, err
+		}, nil
+	}
+	script, err := pipelineScriptPath(processingDir, name)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, out io.Writer, stageLogDir string, done map[string]bool) ([]stageRun, error) {
+		return nil, runPipelineCommand(ctx, processingDir, out, env, nil, "/bin/bash", script)
+	}, nil
+}
+
+// runPipelineCommand runs a program of a pipeline in processingDir with
+// the status pipe attached and env added to its environment. Metrics it
+// reports go to measure, if set.
+func runPipelineCommand(ctx context.Context, processingDir string, out io.Writer, env []string, measure func(bytes, features int64), name string, args ...string) error {
+	cmd, stopKill := pipelineCommand(ctx, name, args...)
+	defer stopKill()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Dir = processingDir
+	cmd.Env = append(cmd.Environ(), env...)
+	return runWithStatusPipe(cmd, measure)
+}
+
+// resolveScript resolves a script path relative to processingDir and
+// rejects paths that end up outside of it.
+func resolveScript(processingDir, script string) (string, error) {
+	root, err := filepath.Abs(processingDir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, script)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+		if resolvedRoot, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolvedRoot
+		}
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errPathTraversal
+	}
+	return path, nil
+}
+
+// pipelineLogPath returns the log file of a named pipeline. The default
+// pipeline keeps the historical pipeline.log name.
+func pipelineLogPath(processingDir, name string) string {
+	if name == "default" {
+		return filepath.Join(processingDir, "pipeline.log")
+	}
+	return filepath.Join(processingDir, fmt.Sprintf("pipeline_%s.log", name))
+}
+
+func handlePipelineLogDownload(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := config.Pipelines[name]; !ok {
+		http.Error(w, "Unknown pipeline", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(pipelineLogPath(config.ProcessingDir, name))
+	if err != nil {
+		http.Error(w, "No log file found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read log file", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("pipeline_%s_%s.log", name, info.ModTime().Format("20060102_150405"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	http.ServeContent(w, r, filename, info.ModTime(), f)
+}
+
+const preFlightTimeout = 60 * time.Second
+
+// runPreFlight runs the configured validation script and returns its
+// combined output. The output is also kept in preflight.log.
+func runPreFlight(processingDir string) (string, error) {
+	script, err := resolveScript(processingDir, config.PipelinePreFlight)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), preFlightTimeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/bash", script)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Dir = processingDir
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("pre-flight check timed out")
+	}
+
+	logFile := filepath.Join(processingDir, "preflight.log")
+	if writeErr := os.WriteFile(logFile, out.Bytes(), 0644); writeErr != nil {
+		log.Printf("Failed to write pre-flight log: %v", writeErr)
+	}
+	return out.String(), err
+}
+
+const postFlightTimeout = 10 * time.Minute
+
+// runPostFlight runs the configured hook after a successful pipeline run.
+// Its output goes to postflight.log.
+func runPostFlight(processingDir, name string, exitCode int) error {
+	script, err := resolveScript(processingDir, config.PipelinePostFlight)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), postFlightTimeout)
+	defer cancel()
+
+	f, err := os.Create(filepath.Join(processingDir, "postflight.log"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := exec.CommandContext(ctx, "/bin/bash", script)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	cmd.Dir = processingDir
+	cmd.Env = append(os.Environ(),
+		"PIPELINE_NAME="+name,
+		fmt.Sprintf("PIPELINE_EXIT_CODE=%d", exitCode),
+	)
+	return cmd.Run()
+}
+
+// exitCode extracts a process exit code from the error of cmd.Run; -1
+// means the process couldn't be started or was killed by a signal.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// runStatus names the outcome of a run for status events; ctxErr is
+// the error of the run's context.
+func runStatus(exitCode int, ctxErr error) string {
+	switch {
+	case errors.Is(ctxErr, context.Canceled):
+		return "cancelled"
+	case errors.Is(ctxErr, context.DeadlineExceeded):
+		return "timed_out"
+	case exitCode != 0:
+		return "failed"
+	default:
+		return "success"
+	}
+}
+
+// Time a cancelled pipeline gets to exit after SIGTERM before it is killed
+const pipelineCancelGrace = 10 * time.Second
+
+// pipelineCommand runs a pipeline program in its own process group, so
+// cancelling ctx reaches the Python steps it started as well: they get
+// SIGTERM, then SIGKILL once the grace period is over. The returned func
+// must be called once Wait has returned; it stops a pending SIGKILL, whose
+// process group id could have been reused by then.
+func pipelineCommand(ctx context.Context, name string, args ...string) (*exec.Cmd, func()) {
+	name, args = throttleArgs(name, args)
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	throttleCommand(cmd)
+	var mu sync.Mutex
+	var killTimer *time.Timer
+	exited := false
+	cmd.Cancel = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		killTimer = time.AfterFunc(pipelineCancelGrace, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !exited {
+				killProcessGroup(cmd)
+			}
+		})
+		return terminateProcessGroup(cmd)
+	}
+	// Don't wait forever for output pipes held open by stray children
+	cmd.WaitDelay = pipelineCancelGrace + 5*time.Second
+	return cmd, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		exited = true
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+	}
+}
+
+// handleCancelPipeline stops the queued or running pipeline job.
+func handleCancelPipeline(w http.ResponseWriter, r *http.Request) {
+	active, ok := jobs.activeJob("pipeline")
+	if !ok {
+		writeJSONError(w, http.StatusConflict, "pipeline is not running")
+		return
+	}
+	j, already, err := jobs.cancel(active.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, "pipeline is not running")
+		return
+	}
+
+	if !already {
+		log.Printf("Pipeline cancellation requested")
+		var params pipelineJobParams
+		json.Unmarshal(j.Params, &params)
+		audit(r, "pipeline_cancel", "", map[string]interface{}{"pipeline": params.Pipeline, "run": j.ID})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "cancelling",
+		"message": "Pipeline is being stopped",
+	})
+}
+
+// Interval of SSE comments keeping idle proxies from closing the stream
+const sseKeepAlive = 15 * time.Second
+
+// handlePipelineLogStream sends the current run's log as Server-Sent
+// Events: the buffered history, then live lines as "log" events, and an
+// "end" event with the exit status when the run finishes.
+func handlePipelineLogStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	ring := currentPipelineLogBuffer()
+	if ring == nil {
+		writeSSE(w, "end", `{"status":"idle"}`)
+		flusher.Flush()
+		return
+	}
+	backlog, lines, stop := ring.Follow()
+	defer stop()
+	for _, line := range backlog {
+		writeSSE(w, "log", line)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				done, code, status := ring.Result()
+				if !done {
+					// Dropped for falling behind; the client reconnects
+					return
+				}
+				data, _ := json.Marshal(map[string]interface{}{"status": status, "exit_code": code})
+				writeSSE(w, "end", string(data))
+				flusher.Flush()
+				return
+			}
+			writeSSE(w, "log", line)
+			// Send whatever else is already queued in the same flush
+			for pending := len(lines); pending > 0; pending-- {
+				if line, ok := <-lines; ok {
+					writeSSE(w, "log", line)
+				}
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeSSE(w io.Writer, event, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+var errPipelineRunning = errors.New("pipeline is already running")
+
+// preflightError is returned by startPipeline when the pre-flight check
+// refused the run.
+type preflightError struct {
+	output string
+	err    error
+}
+
+func (e *preflightError) Error() string {
+	return "pre-flight check failed: " + e.err.Error()
+}
+
+// RetryPolicy decides whether and when a failed run is tried again.
+type RetryPolicy struct {
+	// Attempts per run including the first; 1 disables retries
+	MaxAttempts int `json:"max_attempts"`
+	// Wait before the first retry, multiplied by Multiplier for every
+	// further one up to MaxDelaySeconds
+	InitialDelaySeconds int     `json:"initial_delay_seconds"`
+	MaxDelaySeconds     int     `json:"max_delay_seconds"`
+	Multiplier          float64 `json:"multiplier"`
+	// Have built-in pipelines skip the stages completed by earlier
+	// attempts rather than start over; script pipelines always start over
+	OnlyFailedStage bool `json:"only_failed_stage"`
+}
+
+// delay returns the wait after the given failed attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialDelaySeconds) * math.Pow(p.Multiplier, float64(attempt-1))
+	return time.Duration(min(d, float64(p.MaxDelaySeconds))) * time.Second
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("pipeline_retry: max_attempts must be at least 1")
+	}
+	if p.InitialDelaySeconds < 0 || p.MaxDelaySeconds < p.InitialDelaySeconds {
+		return errors.New("pipeline_retry: delays must be positive, max_delay_seconds at least initial_delay_seconds")
+	}
+	if p.Multiplier < 1 {
+		return errors.New("pipeline_retry: multiplier must be at least 1")
+	}
+	return nil
+}
+
+// Parameters of a pipeline job
+type pipelineJobParams struct {
+	Pipeline string `json:"pipeline"`
+	Schedule string `json:"schedule,omitempty"`
+	// Overrides pipeline_timeout_minutes
+	TimeoutMinutes int              `json:"timeout_minutes,omitempty"`
+	Parameters     *pipeline.Params `json:"parameters,omitempty"`
+}
+
+// Coarsest resolution a run may ask for, in metres
+const maxResolution = 1000
+
+// checkParameters validates the parameters of a run request and returns
+// them with the years sorted and duplicates removed, or nil if none are
+// set.
+func checkParameters(p *pipeline.Params) (*pipeline.Params, error) {
+	if p == nil || (len(p.Years) == 0 && len(p.States) == 0 && p.Resolution == 0 && p.Release == "" && !p.Inputs) {
+		return nil, nil
+	}
+	lastYear := pipeline.LastYear
+	if p.Release != "" {
+		year, _, ok := pipeline.ParseRelease(p.Release)
+		if !ok || year < pipeline.LastYear {
+			return nil, fmt.Errorf("release must be %s or a later GFC-<year>-v1.<n>", pipeline.Release)
+		}
+		lastYear = year
+	}
+	for _, y := range p.Years {
+		if y < pipeline.FirstYear || y > lastYear {
+			return nil, fmt.Errorf("years: %d is outside %d-%d", y, pipeline.FirstYear, lastYear)
+		}
+	}
+	for _, s := range p.States {
+		if !bundeslaender[s] {
+			return nil, fmt.Errorf("states: unknown Bundesland %q", s)
+		}
+	}
+	if p.Inputs && !hasUploadedInputs() {
+		return nil, errors.New("inputs: no input files have been uploaded")
+	}
+	if p.Resolution != 0 && (p.Resolution < pipeline.NativeResolution || p.Resolution > maxResolution) {
+		return nil, fmt.Errorf("resolution must be between %d and %d metres", pipeline.NativeResolution, maxResolution)
+	}
+	checked := *p
+	checked.Years = slices.Clone(p.Years)
+	slices.Sort(checked.Years)
+	checked.Years = slices.Compact(checked.Years)
+	checked.States = slices.Clone(p.States)
+	slices.Sort(checked.States)
+	checked.States = slices.Compact(checked.States)
+	return &checked, nil
+}
+
+// validTimeout checks a requested timeout override.
+func validTimeout(minutes int) error {
+	if minutes < 0 {
+		return errors.New("timeout_minutes must not be negative")
+	}
+	return nil
+}
+
+// startPipeline runs the pre-flight check and queues a job running
+// run.Pipeline; the run gets the job's ID. Only one pipeline job may be
+// queued or running at a time. Refused pre-flight checks are kept in the
+// run history.
+func startPipeline(run *pipelineRun, priority int) error {
+	processingDir := config.ProcessingDir
+	if _, err := pipelineRunner(processingDir, run.Pipeline, run.Parameters); err != nil {
+		return err
+	}
+	if _, active := jobs.activeJob("pipeline"); active || lockedElsewhere() {
+		return errPipelineRunning
+	}
+
+	run.ID = newRunID(time.Now())
+	if config.PipelinePreFlight != "" {
+		output, err := runPreFlight(processingDir)
+		if err != nil {
+			log.Printf("Pipeline pre-flight check failed: %v", err)
+			run.Started = time.Now().UTC()
+			saveRun(run)
+			pipelineStatusTracker.begin(run)
+			pipelineStatusTracker.end("preflight_failed", nil, "pre-flight check failed: "+err.Error(), lastLines(output, statusLogTailLines))
+			if writeErr := os.WriteFile(runLogPath(run.ID), []byte(output), 0644); writeErr != nil {
+				log.Printf("Failed to write run log: %v", writeErr)
+			}
+			finishRun(run, "preflight_failed", nil)
+			notifyPipelineWebhooks(run, "preflight_failed")
+			mailPipelineFailure(run, "preflight_failed")
+			return &preflightError{output: output, err: err}
+		}
+	}
+
+	params, _ := json.Marshal(pipelineJobParams{Pipeline: run.Pipeline, Schedule: run.Schedule, TimeoutMinutes: run.TimeoutMinutes, Parameters: run.Parameters})
+	err := jobs.submit(&job{ID: run.ID, Type: "pipeline", Priority: priority, Params: params, User: run.User}, true)
+	if errors.Is(err, errJobActive) {
+		return errPipelineRunning
+	}
+	return err
+}
+
+// submitPipelineJob queues a pipeline job submitted through /api/jobs.
+func submitPipelineJob(r *http.Request, j *job) error {
+	params := pipelineJobParams{Pipeline: "default"}
+	if len(j.Params) > 0 {
+		if err := json.Unmarshal(j.Params, &params); err != nil {
+			return fmt.Errorf("invalid pipeline parameters: %w", err)
+		}
+	}
+	if params.Schedule != "" {
+		return errors.New("schedule cannot be set for submitted jobs")
+	}
+	if err := validTimeout(params.TimeoutMinutes); err != nil {
+		return err
+	}
+	checked, err := checkParameters(params.Parameters)
+	if err != nil {
+		return err
+	}
+	run := &pipelineRun{Pipeline: params.Pipeline, User: j.User, TimeoutMinutes: params.TimeoutMinutes, Parameters: checked}
+	if err := startPipeline(run, j.Priority); err != nil {
+		return err
+	}
+	j.ID = run.ID
+	return nil
+}
+
+func runPipelineJob(ctx context.Context, j *job) (interface{}, error) {
+	var params pipelineJobParams
+	if err := json.Unmarshal(j.Params, &params); err != nil {
+		return nil, err
+	}
+	run := &pipelineRun{ID: j.ID, Pipeline: params.Pipeline, User: j.User, Schedule: params.Schedule, TimeoutMinutes: params.TimeoutMinutes, Parameters: params.Parameters}
+	release, err := acquirePipelineLock(run.ID)
+	if err != nil {
+		log.Printf("Not starting run %s: %v", run.ID, err)
+		return nil, err
+	}
+	defer release()
+	status, err := executeRun(ctx, run)
+	// Sent here rather than from executeRun so post-flight failures count
+	notifyPipelineWebhooks(run, status)
+	mailPipelineFailure(run, status)
+	return map[string]interface{}{"run_id": run.ID, "status": status}, err
+}
+
+// executeRun runs a pipeline and records it in the run history, the
+// status document and the log buffer. It returns the run's status. A run
+// that exceeds its timeout is stopped like a cancelled one and ends as
+// "timed_out".
+func executeRun(ctx context.Context, run *pipelineRun) (string, error) {
+	processingDir := config.ProcessingDir
+	if run.TimeoutMinutes == 0 {
+		run.TimeoutMinutes = config.PipelineTimeoutMinutes
+	}
+	run.Started = time.Now().UTC()
+	run.Status = "running"
+	saveRun(run)
+	if run.TimeoutMinutes > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(run.TimeoutMinutes)*time.Minute)
+		defer cancel()
+	}
+
+	runPipeline, err := pipelineRunner(processingDir, run.Pipeline, run.Parameters)
+	if err != nil {
+		finishRun(run, "failed", nil)
+		return "failed", err
+	}
+
+	log.Printf("Starting processing pipeline %q (run %s)...", run.Pipeline, run.ID)
+
+	f, err := os.Create(pipelineLogPath(processingDir, run.Pipeline))
+	if err != nil {
+		finishRun(run, "failed", nil)
+		return "failed", fmt.Errorf("creating log file: %w", err)
+	}
+	defer f.Close()
+	runLog, err := os.Create(runLogPath(run.ID))
+	if err != nil {
+		finishRun(run, "failed", nil)
+		return "failed", fmt.Errorf("creating run log: %w", err)
+	}
+	defer runLog.Close()
+
+	if err := resetStaging(run.ID); err != nil {
+		finishRun(run, "failed", nil)
+		return "failed", fmt.Errorf("resetting staging directory: %w", err)
+	}
+
+	ring := resetPipelineLogBuffer()
+	out := io.MultiWriter(f, runLog, ring)
+
+	pipelineStatusTracker.begin(run)
+	pipelineProgress.broadcast(progressEvent{Type: "started"})
+	notifyPipelineWebhooks(run, "running")
+
+	policy := config.PipelineRetry
+	done := make(map[string]bool)
+	var code int
+	for attempt := 1; ; attempt++ {
+		a := runAttempt{Attempt: attempt, Started: time.Now().UTC()}
+		for stage := range done {
+			a.SkippedStages = append(a.SkippedStages, stage)
+		}
+		sort.Strings(a.SkippedStages)
+		a.Stages, err = runPipeline(ctx, out, runStageLogDir(run.ID), done)
+		code = exitCode(err)
+		a.Finished, a.ExitCode = time.Now().UTC(), code
+		var stageErr *pipeline.StageError
+		if errors.As(err, &stageErr) {
+			a.FailedStage = stageErr.Stage
+		}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		run.Attempts = append(run.Attempts, a)
+		if err == nil || ctx.Err() != nil || attempt >= policy.MaxAttempts {
+			break
+		}
+
+		if !policy.OnlyFailedStage {
+			clear(done)
+		}
+		delay := policy.delay(attempt)
+		retryAt := time.Now().UTC().Add(delay)
+		run.RetryAt = &retryAt
+		saveRun(run)
+		log.Printf("Pipeline attempt %d of run %s failed: %v; retrying in %s", attempt, run.ID, err, delay)
+		fmt.Fprintf(out, "=== Attempt %d failed: %v; retrying in %s\n", attempt, err, delay)
+		pipelineStatusTracker.retrying(attempt, retryAt, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		run.RetryAt = nil
+		if ctx.Err() != nil {
+			break
+		}
+		pipelineStatusTracker.resume(attempt + 1)
+	}
+	status := runStatus(code, ctx.Err())
+	ring.Finish(code, status)
+	switch {
+	case status == "cancelled":
+		pipelineStatusTracker.end(status, &code, "cancelled", nil)
+	case status == "timed_out":
+		err = fmt.Errorf("timed out after %d minutes", run.TimeoutMinutes)
+		lines := ring.Lines()
+		pipelineStatusTracker.end(status, &code, err.Error(), lines[max(0, len(lines)-statusLogTailLines):])
+	case err != nil:
+		lines := ring.Lines()
+		pipelineStatusTracker.end(status, &code, err.Error(), lines[max(0, len(lines)-statusLogTailLines):])
+	default:
+		pipelineStatusTracker.end(status, &code, "", nil)
+	}
+	pipelineProgress.broadcast(progressEvent{Type: "finished", Status: status, ExitCode: &code})
+	switch {
+	case status == "cancelled":
+		log.Printf("Pipeline cancelled")
+		err = ctx.Err()
+	case err != nil:
+		log.Printf("Pipeline failed: %v", err)
+	default:
+		log.Println("Pipeline completed successfully")
+		status, err = publishRunOutputs(run, processingDir)
+	}
+
+	// Recorded only now, so the run history shows failures in staging,
+	// publishing and the post-flight hook
+	if err != nil {
+		run.Error = err.Error()
+	}
+	finishRun(run, status, &code)
+	return status, err
+}
+
+// publishRunOutputs stages and publishes the outputs of a successful run
+// and runs the post-flight hook. It returns the run's final status.
+func publishRunOutputs(run *pipelineRun, processingDir string) (string, error) {
+	// Outputs for public_dir are registered once they are published
+	var unstaged []string
+	for _, p := range pipelineStatusTracker.reportedArtifacts(run.ID) {
+		if !isStaged(p) {
+			unstaged = append(unstaged, p)
+		}
+	}
+	registerArtifacts(run.ID, unstaged)
+	staged, err := stageOutputs(run.ID)
+	if err != nil {
+		log.Printf("Pipeline outputs not published: %v", err)
+		pipelineStatusTracker.fail("validation_failed", err.Error())
+		return "validation_failed", err
+	}
+	if staged != nil && !config.PipelineManualPublish {
+		if _, err := publishStaged(); err != nil {
+			log.Printf("Publishing pipeline outputs failed: %v", err)
+			err = fmt.Errorf("publishing outputs failed: %w", err)
+			pipelineStatusTracker.fail("publish_failed", err.Error())
+			return "publish_failed", err
+		}
+	}
+	releaseProcessed(upstreamRelease(run))
+
+	if config.PipelinePostFlight != "" {
+		if err := runPostFlight(processingDir, run.Pipeline, 0); err != nil {
+			log.Printf("Pipeline post-flight hook failed: %v", err)
+			err = fmt.Errorf("post-flight hook failed: %w", err)
+			pipelineStatusTracker.fail("postflight_failed", err.Error())
+			return "postflight_failed", err
+		}
+	}
+	return "success", nil
+}
@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Download fetches url to dest, reporting progress as step of stage. A
+// dest that exists is kept. Partial downloads are kept next to dest and
+// resumed by the next attempt.
+func Download(ctx context.Context, env *Env, stage, step, url, dest string) error {
+	if info, err := os.Stat(dest); err == nil {
+		env.logf("%s: %s exists, skipping", step, dest)
+		env.Report.Step(stage, step, "complete", 100, fmt.Sprintf("File exists (%.1f MB)", megabytes(info.Size())))
+		return nil
+	}
+
+	part := dest + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	env.logf("%s: downloading %s", step, url)
+	env.Report.Step(stage, step, "running", 0, "Starting download")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		env.Report.Step(stage, step, "error", 0, err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+		env.logf("%s: resuming at %.1f MB", step, megabytes(offset))
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	default:
+		err := fmt.Errorf("GET %s: %s", url, resp.Status)
+		env.Report.Step(stage, step, "error", 0, err.Error())
+		return err
+	}
+	total := offset + resp.ContentLength
+	if resp.ContentLength < 0 {
+		total = -1
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	pw := &progressWriter{env: env, stage: stage, step: step, written: offset, total: total}
+	_, err = io.Copy(f, io.TeeReader(resp.Body, pw))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		env.Report.Step(stage, step, "error", pw.percent(), err.Error())
+		return fmt.Errorf("downloading %s: %w", url, err)
+	}
+	if err := os.Rename(part, dest); err != nil {
+		return err
+	}
+	env.Measure(pw.written-offset, 0)
+	env.logf("%s: complete, %.1f MB", step, megabytes(pw.written))
+	env.Report.Step(stage, step, "complete", 100, fmt.Sprintf("Downloaded %.1f MB", megabytes(pw.written)))
+	return nil
+}
+
+// Minimum time between progress reports of a download
+const progressInterval = 2 * time.Second
+
+type progressWriter struct {
+	env         *Env
+	stage, step string
+	written     int64
+	total       int64
+	lastReport  time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if time.Since(p.lastReport) >= progressInterval {
+		p.lastReport = time.Now()
+		msg := fmt.Sprintf("Downloading: %.1f MB", megabytes(p.written))
+		if p.total > 0 {
+			msg = "Downloading: " + strconv.Itoa(int(p.percent())) + "%"
+		}
+		p.env.Report.Step(p.stage, p.step, "running", p.percent(), msg)
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) percent() float64 {
+	if p.total <= 0 {
+		return 0
+	}
+	return min(float64(p.written)*100/float64(p.total), 100)
+}
+
+func megabytes(n int64) float64 {
+	return float64(n) / 1024 / 1024
+}
@@ -0,0 +1,246 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Hansen pipeline, as run_pipeline.sh runs it: download the Global
+// Forest Change tiles, clip them to Austria, aggregate the loss by state.
+// Clipping calls gdalwarp directly; the zonal statistics need numpy and
+// the GDAL Python bindings and stay in aggregate_by_state.py.
+
+// Hansen Global Forest Change releases are published once a year as
+// GFC-<last loss year>-v1.<n>; tile 50N_010E covers Austria
+const (
+	Release      = "GFC-2023-v1.11"
+	hansenBucket = "https://storage.googleapis.com/earthenginepartners-hansen"
+)
+
+var releasePattern = regexp.MustCompile(`^GFC-(\d{4})-v1\.(\d+)$`)
+
+// ParseRelease returns the last loss year and the minor version of a
+// release name.
+func ParseRelease(release string) (year, minor int, ok bool) {
+	m := releasePattern.FindStringSubmatch(release)
+	if m == nil {
+		return 0, 0, false
+	}
+	year, _ = strconv.Atoi(m[1])
+	minor, _ = strconv.Atoi(m[2])
+	return year, minor, true
+}
+
+// NextReleases returns the names the release after release may have:
+// one more loss year and usually the next minor version, sometimes one
+// skipped.
+func NextReleases(release string) []string {
+	year, minor, ok := ParseRelease(release)
+	if !ok {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("GFC-%d-v1.%d", year+1, minor+1),
+		fmt.Sprintf("GFC-%d-v1.%d", year+1, minor+2),
+	}
+}
+
+// TileURL returns where a layer of a release is downloaded from.
+func TileURL(release, layer string) string {
+	return fmt.Sprintf("%s/%s/Hansen_%s_%s_50N_010E.tif", hansenBucket, release, release, layer)
+}
+
+// Layers are the Hansen layers the pipeline processes.
+var Layers = []string{"lossyear", "treecover2000"}
+
+// How layers are resampled when clipped at a coarser resolution: loss
+// years are categories, tree cover is a percentage
+var hansenResampling = map[string]string{"lossyear": "mode", "treecover2000": "average"}
+
+// Austria's bounding box with a small buffer: minX minY maxX maxY
+var austriaBBox = []string{"9.5", "46.3", "17.2", "49.1"}
+
+func rasterDir(env *Env) string {
+	return filepath.Join(env.Dir, "..", "raster")
+}
+
+// Bundesländer as named in the state boundaries
+var States = []string{
+	"Burgenland", "Kärnten", "Niederösterreich", "Oberösterreich", "Salzburg",
+	"Steiermark", "Tirol", "Vorarlberg", "Wien",
+}
+
+// Hansen returns the Hansen processing pipeline. Each layer is downloaded
+// and clipped on its own and each state analysed on its own, so these
+// run in parallel; the state results are merged at the end.
+func Hansen() *Pipeline {
+	p := &Pipeline{Name: "hansen"}
+	for _, layer := range Layers {
+		p.Stages = append(p.Stages,
+			Stage{Name: "download/" + layer, Retries: 3, RetryDelay: 30 * time.Second, Run: downloadHansen(layer), Plan: planDownload(layer)},
+			Stage{Name: "clip/" + layer, DependsOn: []string{"download/" + layer}, Retries: 1, RetryDelay: 5 * time.Second, Run: clipHansen(layer), Plan: planClip(layer)},
+		)
+	}
+	merge := Stage{Name: "analyze/aggregate", Run: Script("aggregate_by_state.py", "--merge"), Plan: planCommand("python3 aggregate_by_state.py --merge")}
+	for _, state := range States {
+		p.Stages = append(p.Stages, Stage{Name: "analyze/" + state, DependsOn: []string{"clip/lossyear"}, Run: analyzeState(state), Plan: planAnalyzeState(state)})
+		merge.DependsOn = append(merge.DependsOn, "analyze/"+state)
+	}
+	p.Stages = append(p.Stages, merge)
+	return p
+}
+
+func downloadHansen(layer string) func(context.Context, *Env) error {
+	return func(ctx context.Context, env *Env) error {
+		if err := os.MkdirAll(rasterDir(env), 0755); err != nil {
+			return err
+		}
+		release := env.Params.release()
+		dest := TilePath(env.Dir, layer)
+		have := tileRelease(dest)
+		if have != release {
+			env.logf("%s: replacing %s with %s", layer, have, release)
+			os.Remove(dest)
+			os.Remove(dest + ".part")
+		}
+		if err := Download(ctx, env, "download", layer, TileURL(release, layer), dest); err != nil {
+			return err
+		}
+		return os.WriteFile(dest+".release", []byte(release+"\n"), 0644)
+	}
+}
+
+// TilePath is where the Hansen tile of a layer is kept for the
+// processing directory dir.
+func TilePath(dir, layer string) string {
+	return filepath.Join(dir, "..", "raster", "hansen_"+layer+".tif")
+}
+
+// tileRelease returns the release of the tile at path, recorded next to
+// it; tiles from before that was recorded are of the default release.
+func tileRelease(path string) string {
+	if data, err := os.ReadFile(path + ".release"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return Release
+}
+
+// tileCurrent reports whether the tile of layer exists and is of the
+// release the run asks for, so the download stage would keep it.
+func tileCurrent(env *Env, layer string) bool {
+	path := TilePath(env.Dir, layer)
+	_, err := os.Stat(path)
+	return err == nil && tileRelease(path) == env.Params.release()
+}
+
+func planDownload(layer string) func(*Env) string {
+	return func(env *Env) string {
+		if tileCurrent(env, layer) {
+			return "keep " + filepath.Base(TilePath(env.Dir, layer)) + " (" + env.Params.release() + ")"
+		}
+		return "download " + TileURL(env.Params.release(), layer)
+	}
+}
+
+func clipHansen(layer string) func(context.Context, *Env) error {
+	return func(ctx context.Context, env *Env) error {
+		res := env.Params.resolution()
+		input := TilePath(env.Dir, layer)
+		output := filepath.Join(rasterDir(env), ClippedRaster(layer, res))
+		info, err := os.Stat(input)
+		if err != nil {
+			env.Report.Step("clip", layer, "error", 0, "Input file missing")
+			return err
+		}
+		// A clipped raster older than its input is of an older release
+		if out, err := os.Stat(output); err == nil && !out.ModTime().Before(info.ModTime()) {
+			env.Report.Step("clip", layer, "complete", 100, "File exists")
+			env.Report.Artifact(filepath.Join("..", "raster", filepath.Base(output)))
+			return nil
+		}
+
+		env.Report.Step("clip", layer, "running", 0, "Clipping raster")
+		// Write next to the output so a failed run leaves no partial file
+		tmp := output + ".tmp.tif"
+		args := append([]string{"-overwrite", "-te"}, austriaBBox...)
+		if res != NativeResolution {
+			deg := strconv.FormatFloat(nativeDegrees*float64(res)/NativeResolution, 'f', -1, 64)
+			args = append(args, "-tr", deg, deg, "-r", hansenResampling[layer])
+		}
+		args = append(args, "-co", "COMPRESS=LZW", "-co", "TILED=YES", input, tmp)
+		if err := env.Command(ctx, "gdalwarp", args...); err != nil {
+			os.Remove(tmp)
+			env.Report.Step("clip", layer, "error", 0, err.Error())
+			return fmt.Errorf("gdalwarp %s: %w", layer, err)
+		}
+		if err := os.Rename(tmp, output); err != nil {
+			return err
+		}
+		env.Measure(info.Size(), 0)
+		env.Report.Step("clip", layer, "complete", 100, "Clipped successfully")
+		env.Report.Artifact(filepath.Join("..", "raster", filepath.Base(output)))
+		return nil
+	}
+}
+
+func planClip(layer string) func(*Env) string {
+	return func(env *Env) string {
+		output := ClippedRaster(layer, env.Params.resolution())
+		in, inErr := os.Stat(TilePath(env.Dir, layer))
+		out, outErr := os.Stat(filepath.Join(rasterDir(env), output))
+		if tileCurrent(env, layer) && inErr == nil && outErr == nil && !out.ModTime().Before(in.ModTime()) {
+			return "keep " + output
+		}
+		return fmt.Sprintf("gdalwarp hansen_%s.tif to %s at %d m", layer, output, env.Params.resolution())
+	}
+}
+
+// analyzeState counts a state's loss, unless the run is limited to other
+// states.
+func analyzeState(state string) func(context.Context, *Env) error {
+	return func(ctx context.Context, env *Env) error {
+		if env.Params != nil && len(env.Params.States) > 0 && !slices.Contains(env.Params.States, state) {
+			return ErrSkipped
+		}
+		return env.Command(ctx, "python3", "aggregate_by_state.py", "--state", state)
+	}
+}
+
+func planAnalyzeState(state string) func(*Env) string {
+	return func(env *Env) string {
+		if env.Params != nil && len(env.Params.States) > 0 && !slices.Contains(env.Params.States, state) {
+			return "skip, not among the requested states"
+		}
+		return "python3 aggregate_by_state.py --state " + state
+	}
+}
+
+// planCommand describes a stage that runs a fixed command.
+func planCommand(command string) func(*Env) string {
+	return func(*Env) string {
+		return command
+	}
+}
+
+// Script runs a Python processing script from the processing directory.
+func Script(name string, args ...string) func(context.Context, *Env) error {
+	return func(ctx context.Context, env *Env) error {
+		return env.Command(ctx, "python3", append([]string{name}, args...)...)
+	}
+}
+
+// Builtin returns the built-in pipeline of the given name.
+func Builtin(name string) (*Pipeline, bool) {
+	switch name {
+	case "hansen":
+		return Hansen(), true
+	}
+	return nil, false
+}
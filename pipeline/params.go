@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Loss years covered by the Hansen release the pipeline uses by default,
+// and its pixel size in metres
+const (
+	FirstYear        = 2001
+	LastYear         = 2023
+	NativeResolution = 30
+)
+
+// Hansen's pixel size in degrees, which NativeResolution approximates
+const nativeDegrees = 0.00025
+
+// Params narrow down what a run computes, so that part of the results can
+// be recomputed. A nil Params computes everything.
+type Params struct {
+	// Loss years to aggregate
+	Years []int `json:"years,omitempty"`
+	// Bundesländer to aggregate
+	States []string `json:"states,omitempty"`
+	// Pixel size of the clipped rasters in metres; 0 keeps the native one
+	Resolution int `json:"resolution,omitempty"`
+	// Hansen release to process, like GFC-2024-v1.12; empty for Release
+	Release string `json:"release,omitempty"`
+	// Read the uploaded input files instead of the ones in data/
+	Inputs bool `json:"inputs,omitempty"`
+}
+
+// Environ returns the parameters that are set as environment variables
+// for the processing scripts: PIPELINE_YEARS and PIPELINE_STATES as
+// comma-separated lists, PIPELINE_RESOLUTION and PIPELINE_RELEASE.
+// Inputs is left to the caller, which knows where uploads are stored.
+func (p *Params) Environ() []string {
+	if p == nil {
+		return nil
+	}
+	var env []string
+	if len(p.Years) > 0 {
+		years := make([]string, len(p.Years))
+		for i, y := range p.Years {
+			years[i] = strconv.Itoa(y)
+		}
+		env = append(env, "PIPELINE_YEARS="+strings.Join(years, ","))
+	}
+	if len(p.States) > 0 {
+		env = append(env, "PIPELINE_STATES="+strings.Join(p.States, ","))
+	}
+	if p.Resolution != 0 {
+		env = append(env, "PIPELINE_RESOLUTION="+strconv.Itoa(p.Resolution))
+	}
+	if p.Release != "" {
+		env = append(env, "PIPELINE_RELEASE="+p.Release)
+	}
+	return env
+}
+
+func (p *Params) release() string {
+	if p == nil || p.Release == "" {
+		return Release
+	}
+	return p.Release
+}
+
+func (p *Params) resolution() int {
+	if p == nil || p.Resolution == 0 {
+		return NativeResolution
+	}
+	return p.Resolution
+}
+
+// ClippedRaster returns the file name of a layer clipped to Austria at
+// the given resolution; clip_to_austria.py uses the same names.
+func ClippedRaster(layer string, resolution int) string {
+	if resolution == 0 || resolution == NativeResolution {
+		return "austria_" + layer + ".tif"
+	}
+	return fmt.Sprintf("austria_%s_%dm.tif", layer, resolution)
+}
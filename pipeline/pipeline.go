@@ -0,0 +1,345 @@
+// Package pipeline runs the processing stages in dependency order,
+// independent ones in parallel, retrying failed stages and reporting
+// progress as it goes.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Reporter receives progress. Statuses are "running", "complete",
+// "skipped" and "error". Artifact names an output file of the run,
+// relative to the processing directory. Finished describes each stage
+// once it is done with.
+type Reporter interface {
+	Stage(stage, status, message string)
+	Step(stage, step, status string, percent float64, message string)
+	Artifact(path string)
+	Finished(stage string, result StageResult)
+}
+
+// StageResult is how a stage went and what it measured.
+type StageResult struct {
+	// "complete", "skipped" or "error"
+	Status   string
+	Started  time.Time
+	Duration time.Duration
+	Attempts int
+	// Input the stage processed, and features in its outputs
+	Bytes    int64
+	Features int64
+}
+
+// Env is what stages run in.
+type Env struct {
+	// Processing directory; rasters live in ../raster, data in ../data
+	Dir string
+	// Stage output, kept in the run's log
+	Log io.Writer
+	// Opens the log of a single stage, which gets the stage's output in
+	// addition to Log; nil for none
+	StageLog func(stage string) (io.WriteCloser, error)
+	Report   Reporter
+	// What the run was asked to compute; nil for everything
+	Params *Params
+	// Stages run at the same time at most; below 1 means one
+	Workers int
+	// Exec runs an external program in Dir for the stage env was given
+	// to, with its output going to env.Log. The caller decides how it is
+	// cancelled, how it reports status and how what it measured gets to
+	// env.Measure.
+	Exec func(ctx context.Context, env *Env, name string, args ...string) error
+
+	// Stage the Env was given to, and what it measured so far
+	Stage   string
+	metrics *metrics
+}
+
+type metrics struct {
+	bytes, features atomic.Int64
+}
+
+// Measure adds to the input bytes processed and the output features of
+// the stage env was given to. Outside of stages it does nothing.
+func (env *Env) Measure(bytes, features int64) {
+	if env.metrics != nil {
+		env.metrics.bytes.Add(bytes)
+		env.metrics.features.Add(features)
+	}
+}
+
+func (env *Env) logf(format string, args ...interface{}) {
+	fmt.Fprintf(env.Log, format+"\n", args...)
+}
+
+// Command runs an external program through Exec, with its output going
+// to Log.
+func (env *Env) Command(ctx context.Context, name string, args ...string) error {
+	return env.Exec(ctx, env, name, args...)
+}
+
+// Stage is one unit of work. Run reports its steps itself; the stage's
+// own status is reported by the pipeline, as a step of group for stages
+// named <group>/<step>.
+type Stage struct {
+	Name      string
+	DependsOn []string
+	// Further attempts after a failure, RetryDelay apart
+	Retries    int
+	RetryDelay time.Duration
+	Run        func(ctx context.Context, env *Env) error
+	// Plan describes what Run would do in env, without doing it; nil
+	// if the name says it all
+	Plan func(env *Env) string
+}
+
+// PlannedStage is a stage as a dry run shows it.
+type PlannedStage struct {
+	Name      string   `json:"name"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	Action    string   `json:"action,omitempty"`
+}
+
+// Pipeline is a named set of stages.
+type Pipeline struct {
+	Name   string
+	Stages []Stage
+}
+
+// StageError is returned when a stage failed on its last attempt.
+type StageError struct {
+	Stage    string
+	Attempts int
+	Err      error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %s failed after %d attempt(s): %v", e.Stage, e.Attempts, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Order returns the stages so that each comes after its dependencies,
+// otherwise keeping their declared order.
+func (p *Pipeline) Order() ([]Stage, error) {
+	index := make(map[string]int)
+	for i, s := range p.Stages {
+		if _, dup := index[s.Name]; dup {
+			return nil, fmt.Errorf("pipeline %s: duplicate stage %q", p.Name, s.Name)
+		}
+		index[s.Name] = i
+	}
+	for _, s := range p.Stages {
+		for _, dep := range s.DependsOn {
+			if _, ok := index[dep]; !ok {
+				return nil, fmt.Errorf("pipeline %s: stage %q depends on unknown stage %q", p.Name, s.Name, dep)
+			}
+		}
+	}
+
+	order := make([]Stage, 0, len(p.Stages))
+	placed := make(map[string]bool)
+	for len(order) < len(p.Stages) {
+		progress := false
+		for _, s := range p.Stages {
+			if placed[s.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range s.DependsOn {
+				ready = ready && placed[dep]
+			}
+			if ready {
+				order = append(order, s)
+				placed[s.Name] = true
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, fmt.Errorf("pipeline %s: dependency cycle among its stages", p.Name)
+		}
+	}
+	return order, nil
+}
+
+// Plan lists the stages in the order Run would start them with one
+// worker, and what each would do in env. Nothing is run or changed.
+func (p *Pipeline) Plan(env *Env) ([]PlannedStage, error) {
+	stages, err := p.Order()
+	if err != nil {
+		return nil, err
+	}
+	plan := make([]PlannedStage, len(stages))
+	for i, s := range stages {
+		plan[i] = PlannedStage{Name: s.Name, DependsOn: s.DependsOn}
+		if s.Plan != nil {
+			plan[i].Action = s.Plan(env)
+		}
+	}
+	return plan, nil
+}
+
+// ErrSkipped is returned by a stage that had nothing to do in this run.
+// It counts as completed.
+var ErrSkipped = errors.New("skipped")
+
+// Run executes the stages, each once the stages it depends on have
+// completed, running up to env.Workers of them at a time. Stages in done
+// are skipped as completed by an earlier attempt, and the ones completing
+// now are added to it. After the first stage fails for good no further
+// stages are started; Run returns its error once the running ones have
+// finished.
+func (p *Pipeline) Run(ctx context.Context, env *Env, done map[string]bool) error {
+	stages, err := p.Order()
+	if err != nil {
+		return err
+	}
+	workers := max(env.Workers, 1)
+
+	type result struct {
+		stage string
+		err   error
+	}
+	results := make(chan result)
+	var pending []Stage
+	for _, s := range stages {
+		if !done[s.Name] {
+			pending = append(pending, s)
+		}
+	}
+	running := 0
+	var firstErr error
+	for {
+		if firstErr == nil && ctx.Err() == nil {
+			waiting := pending[:0]
+			for _, s := range pending {
+				if running == workers || !ready(s, done) {
+					waiting = append(waiting, s)
+					continue
+				}
+				running++
+				go func(s Stage) {
+					results <- result{s.Name, runStage(ctx, env, s)}
+				}(s)
+			}
+			pending = waiting
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		if r.err == nil {
+			done[r.stage] = true
+		} else if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(pending) > 0 {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func ready(s Stage, done map[string]bool) bool {
+	for _, dep := range s.DependsOn {
+		if !done[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// report reports a stage's status. Stages named <group>/<step> are
+// reported as a step of group, so that related stages show as one.
+func report(env *Env, s Stage, status, message string) {
+	group, step, ok := strings.Cut(s.Name, "/")
+	if !ok {
+		env.Report.Stage(s.Name, status, message)
+		return
+	}
+	percent := 0.0
+	if status == "complete" || status == "skipped" {
+		percent = 100
+	}
+	env.Report.Step(group, step, status, percent, message)
+}
+
+// runStage runs s with its own copy of env, which stages running in
+// parallel don't share.
+func runStage(ctx context.Context, parent *Env, s Stage) error {
+	stageEnv := *parent
+	env := &stageEnv
+	env.Stage, env.metrics = s.Name, &metrics{}
+	if env.StageLog != nil {
+		stageLog, err := env.StageLog(s.Name)
+		if err != nil {
+			env.logf("=== %s: no stage log: %v", s.Name, err)
+		} else {
+			defer stageLog.Close()
+			env.Log = io.MultiWriter(parent.Log, stageLog)
+		}
+	}
+	env.logf("=== %s", s.Name)
+	report(env, s, "running", "")
+	started := time.Now()
+	attempts, err := runAttempts(ctx, env, s)
+	result := StageResult{
+		Status:   "complete",
+		Started:  started.UTC(),
+		Duration: time.Since(started),
+		Attempts: attempts,
+		Bytes:    env.metrics.bytes.Load(),
+		Features: env.metrics.features.Load(),
+	}
+	switch {
+	case errors.Is(err, ErrSkipped):
+		env.logf("=== %s skipped", s.Name)
+		report(env, s, "skipped", "")
+		err, result.Status = nil, "skipped"
+	case err != nil:
+		env.logf("=== %s failed: %v", s.Name, err)
+		report(env, s, "error", err.Error())
+		result.Status = "error"
+	default:
+		env.logf("=== %s complete in %s", s.Name, result.Duration.Round(time.Millisecond))
+		report(env, s, "complete", "")
+	}
+	env.Report.Finished(s.Name, result)
+	return err
+}
+
+// runAttempts runs s until it succeeds or runs out of retries, and
+// returns how many attempts it took.
+func runAttempts(ctx context.Context, env *Env, s Stage) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := s.Run(ctx, env)
+		if err == nil || errors.Is(err, ErrSkipped) {
+			return attempt, err
+		}
+		if ctx.Err() != nil {
+			return attempt, ctx.Err()
+		}
+		if attempt > s.Retries {
+			return attempt, &StageError{Stage: s.Name, Attempts: attempt, Err: err}
+		}
+		env.logf("=== %s attempt %d failed: %v; retrying in %s", s.Name, attempt, err, s.RetryDelay)
+		report(env, s, "running", fmt.Sprintf("attempt %d failed, retrying", attempt))
+		select {
+		case <-time.After(s.RetryDelay):
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// Without process groups only the pipeline program itself is stopped,
+// and there is no gentler signal to send it first.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Pipeline lock shared by all instances using the same processing
+// directory, so replicas behind the proxy never run the pipeline at the
+// same time. It is a row in an SQLite database next to the runs; the
+// holder refreshes its heartbeat while the run goes on, and a lock whose
+// heartbeat is older than pipeline_lock_stale_seconds is taken over, as
+// its holder has crashed or hangs.
+
+type lockOwner struct {
+	Instance  string    `json:"instance"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	RunID     string    `json:"run_id"`
+	Acquired  time.Time `json:"acquired"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Stale     bool      `json:"stale"`
+}
+
+// lockedError is returned when another instance holds the lock.
+type lockedError struct {
+	owner *lockOwner
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("pipeline is running on %s (pid %d, run %s)", e.owner.Host, e.owner.PID, e.owner.RunID)
+}
+
+var (
+	lockDB *sql.DB
+	// Identifies this server process among the instances sharing the lock
+	instanceID string
+)
+
+func pipelineLockPath() string {
+	return filepath.Join(config.ProcessingDir, "pipeline_lock.db")
+}
+
+func pipelineLockStaleAfter() time.Duration {
+	return time.Duration(config.PipelineLockStaleSeconds) * time.Second
+}
+
+// openPipelineLock opens the lock database, creating it if needed.
+func openPipelineLock() error {
+	b := make([]byte, 8)
+	rand.Read(b)
+	instanceID = hex.EncodeToString(b)
+
+	db, err := sql.Open("sqlite", "file:"+pipelineLockPath()+"?_txlock=immediate&_pragma=busy_timeout(10000)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS locks (
+		name TEXT PRIMARY KEY,
+		instance TEXT NOT NULL,
+		host TEXT NOT NULL,
+		pid INTEGER NOT NULL,
+		run_id TEXT NOT NULL,
+		acquired TEXT NOT NULL,
+		heartbeat TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	lockDB = db
+	return nil
+}
+
+func queryLockOwner(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}) (*lockOwner, error) {
+	var o lockOwner
+	var acquired, heartbeat string
+	err := q.QueryRowContext(ctx, "SELECT instance, host, pid, run_id, acquired, heartbeat FROM locks WHERE name = 'pipeline'").
+		Scan(&o.Instance, &o.Host, &o.PID, &o.RunID, &acquired, &heartbeat)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.Acquired, _ = time.Parse(time.RFC3339Nano, acquired)
+	o.Heartbeat, _ = time.Parse(time.RFC3339Nano, heartbeat)
+	o.Stale = time.Since(o.Heartbeat) > pipelineLockStaleAfter()
+	return &o, nil
+}
+
+// pipelineLockOwner returns who holds the pipeline lock, or nil.
+func pipelineLockOwner() (*lockOwner, error) {
+	if lockDB == nil {
+		return nil, nil
+	}
+	return queryLockOwner(context.Background(), lockDB)
+}
+
+// lockedElsewhere reports whether another instance holds the lock.
+func lockedElsewhere() bool {
+	owner, err := pipelineLockOwner()
+	if err != nil {
+		log.Printf("Failed to read pipeline lock: %v", err)
+		return false
+	}
+	return owner != nil && !owner.Stale && owner.Instance != instanceID
+}
+
+// acquirePipelineLock takes the lock for run runID and keeps its
+// heartbeat going until the returned function releases it. If another
+// instance holds the lock, the error is a *lockedError.
+func acquirePipelineLock(runID string) (func(), error) {
+	ctx := context.Background()
+	tx, err := lockDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	owner, err := queryLockOwner(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil && !owner.Stale && owner.Instance != instanceID {
+		return nil, &lockedError{owner: owner}
+	}
+	if owner != nil && owner.Stale {
+		log.Printf("Taking over stale pipeline lock of %s (pid %d, run %s, last heartbeat %s)",
+			owner.Host, owner.PID, owner.RunID, owner.Heartbeat.Format(time.RFC3339))
+	}
+
+	host, _ := os.Hostname()
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO locks (name, instance, host, pid, run_id, acquired, heartbeat)
+		VALUES ('pipeline', ?, ?, ?, ?, ?, ?)`, instanceID, host, os.Getpid(), runID, now, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(pipelineLockStaleAfter() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			res, err := lockDB.Exec("UPDATE locks SET heartbeat = ? WHERE name = 'pipeline' AND instance = ? AND run_id = ?",
+				time.Now().UTC().Format(time.RFC3339Nano), instanceID, runID)
+			if err != nil {
+				log.Printf("Failed to refresh pipeline lock: %v", err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				log.Printf("Pipeline lock of run %s was taken over by another instance", runID)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		_, err := lockDB.Exec("DELETE FROM locks WHERE name = 'pipeline' AND instance = ? AND run_id = ?", instanceID, runID)
+		if err != nil {
+			log.Printf("Failed to release pipeline lock: %v", err)
+		}
+	}, nil
+}
@@ -5,6 +5,7 @@ Distribute state-level harvest data proportionally based on Hansen loss pixels
 """
 
 import json
+import os
 import numpy as np
 from pathlib import Path
 from osgeo import gdal, ogr, osr
@@ -32,7 +33,20 @@ ISO_TO_STATE = {
     '9': 'Wien'
 }
 
+def input_path(name):
+    """Input file from DATA_DIR, or its uploaded replacement if the run uses uploads"""
+    inputs = os.environ.get("PIPELINE_INPUTS_DIR")
+    if inputs and (Path(inputs) / name).exists():
+        return Path(inputs) / name
+    return DATA_DIR / name
+
 def update_status(phase, task, status, progress=0, message=""):
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        # Run by the server, which keeps status.json itself
+        line = "step %s/%s %s %s %s\n" % (phase, task, status, progress, " ".join(str(message).split()))
+        os.write(int(fd), line.encode())
+        return
     status_data = {}
     if STATUS_FILE.exists():
         with open(STATUS_FILE) as f:
@@ -104,7 +118,7 @@ def analyze_gemeinden():
     weighted_avg_price = timber_values['prices']['weighted_avg_eur_efm']
     
     # Load municipality boundaries
-    geojson_path = DATA_DIR / "austria_gemeinden.geojson"
+    geojson_path = input_path("austria_gemeinden.geojson")
     ds = ogr.Open(str(geojson_path))
     layer = ds.GetLayer()
     
@@ -5,6 +5,7 @@ Uses gdal_rasterize to create a single labeled raster, then numpy for counting
 """
 
 import json
+import os
 import subprocess
 import numpy as np
 from pathlib import Path
@@ -34,7 +35,20 @@ ISO_TO_STATE = {
     '9': 'Wien'
 }
 
+def input_path(name):
+    """Input file from DATA_DIR, or its uploaded replacement if the run uses uploads"""
+    inputs = os.environ.get("PIPELINE_INPUTS_DIR")
+    if inputs and (Path(inputs) / name).exists():
+        return Path(inputs) / name
+    return DATA_DIR / name
+
 def update_status(phase, task, status, progress=0, message=""):
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        # Run by the server, which keeps status.json itself
+        line = "step %s/%s %s %s %s\n" % (phase, task, status, progress, " ".join(str(message).split()))
+        os.write(int(fd), line.encode())
+        return
     status_data = {}
     if STATUS_FILE.exists():
         with open(STATUS_FILE) as f:
@@ -57,7 +71,7 @@ def create_gemeinde_raster():
     
     lossyear_path = RASTER_DIR / "austria_lossyear.tif"
     gemeinde_raster_path = RASTER_DIR / "gemeinde_ids.tif"
-    geojson_path = DATA_DIR / "austria_gemeinden.geojson"
+    geojson_path = input_path("austria_gemeinden.geojson")
     
     if gemeinde_raster_path.exists():
         print("Gemeinde raster already exists, skipping...")
@@ -121,7 +135,7 @@ def analyze_gemeinden():
     print(f"Raster shapes: lossyear={lossyear_data.shape}, gemeinde={gemeinde_data.shape}")
     
     # Load reference data
-    with open(DATA_DIR / "austria_gemeinden.geojson") as f:
+    with open(input_path("austria_gemeinden.geojson")) as f:
         geojson = json.load(f)
     
     with open(DATA_DIR / "hansen_state_analysis.json") as f:
@@ -9,6 +9,7 @@ Highly optimized version using numpy unique for aggregation.
 """
 
 import json
+import os
 import numpy as np
 from pathlib import Path
 from osgeo import gdal
@@ -38,7 +39,20 @@ ISO_TO_STATE = {
     '9': 'Wien'
 }
 
+def input_path(name):
+    """Input file from DATA_DIR, or its uploaded replacement if the run uses uploads"""
+    inputs = os.environ.get("PIPELINE_INPUTS_DIR")
+    if inputs and (Path(inputs) / name).exists():
+        return Path(inputs) / name
+    return DATA_DIR / name
+
 def update_status(phase, task, status, progress=0, message=""):
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        # Run by the server, which keeps status.json itself
+        line = "step %s/%s %s %s %s\n" % (phase, task, status, progress, " ".join(str(message).split()))
+        os.write(int(fd), line.encode())
+        return
     status_data = {}
     if STATUS_FILE.exists():
         with open(STATUS_FILE) as f:
@@ -84,7 +98,7 @@ def main():
     print(f"Pixel area: {PIXEL_AREA_HA:.4f} ha")
     
     # Load municipality reference data
-    with open(DATA_DIR / "austria_gemeinden.geojson") as f:
+    with open(input_path("austria_gemeinden.geojson")) as f:
         geojson = json.load(f)
     
     # Build ISO -> name mapping
@@ -4,9 +4,14 @@ Phase B Tasks 4-6: Aggregate Hansen forest loss by Bundesland
 - Calculate forest loss area per pixel per year
 - Aggregate loss pixels by Bundesland
 - Create ratio: Hansen_loss_state / Official_harvest_state
+
+Run without arguments for all states in one go; the server's built-in
+pipeline runs --state for each Bundesland in parallel and then --merge.
 """
 
+import argparse
 import json
+import os
 import numpy as np
 from pathlib import Path
 from osgeo import gdal, ogr, osr
@@ -18,11 +23,30 @@ DATA_DIR = BASE_DIR / "data"
 STATUS_FILE = BASE_DIR / "processing" / "status.json"
 
 # Hansen pixel resolution at 47°N (Austria's center latitude)
-# Hansen data is ~30m resolution (1 arcsecond)
-PIXEL_SIZE_M = 30.0  # meters
+# Hansen data is ~30m resolution (1 arcsecond); runs may ask for the
+# rasters to be clipped at a coarser one
+PIXEL_SIZE_M = float(os.environ.get("PIPELINE_RESOLUTION") or 30)  # meters
 PIXEL_AREA_HA = (PIXEL_SIZE_M ** 2) / 10000  # hectares per pixel
 
+# Runs started with parameters only recompute these years and states and
+# keep the rest of the previous results
+YEARS = [int(y) for y in os.environ.get("PIPELINE_YEARS", "").split(",") if y]
+STATES = [s for s in os.environ.get("PIPELINE_STATES", "").split(",") if s]
+
+def input_path(name):
+    """Input file from DATA_DIR, or its uploaded replacement if the run uses uploads"""
+    inputs = os.environ.get("PIPELINE_INPUTS_DIR")
+    if inputs and (Path(inputs) / name).exists():
+        return Path(inputs) / name
+    return DATA_DIR / name
+
 def update_status(phase, task, status, progress=0, message=""):
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        # Run by the server, which keeps status.json itself
+        line = "step %s/%s %s %s %s\n" % (phase, task, status, progress, " ".join(str(message).split()))
+        os.write(int(fd), line.encode())
+        return
     status_data = {}
     if STATUS_FILE.exists():
         with open(STATUS_FILE) as f:
@@ -33,9 +57,21 @@ def update_status(phase, task, status, progress=0, message=""):
     with open(STATUS_FILE, "w") as f:
         json.dump(status_data, f, indent=2)
 
+def register_artifact(path):
+    """Report an output file to the server running the pipeline, if any"""
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        os.write(int(fd), f"artifact {Path(path).resolve()}\n".encode())
+
+def report_metric(name, count):
+    """Add input bytes or output features to the server's stage metrics"""
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        os.write(int(fd), f"metric {name} {int(count)}\n".encode())
+
 def load_state_boundaries():
     """Load Austrian state boundaries from GeoJSON"""
-    geojson_path = DATA_DIR / "austria_states.geojson"
+    geojson_path = input_path("austria_states.geojson")
     ds = ogr.Open(str(geojson_path))
     layer = ds.GetLayer()
     
@@ -79,51 +115,124 @@ def rasterize_state(state_name, state_geom, raster_ds):
     mask = mask_ds.GetRasterBand(1).ReadAsArray()
     return mask
 
-def analyze_forest_loss():
-    """Main analysis: aggregate forest loss by state and year"""
-    update_status("analyze", "aggregate", "running", 0, "Starting analysis...")
-    
-    # Load clipped lossyear raster
-    lossyear_path = RASTER_DIR / "austria_lossyear.tif"
+OUTPUT_PATH = DATA_DIR / "hansen_state_analysis.json"
+# Per-state results of --state runs, combined by --merge
+PARTIAL_DIR = RASTER_DIR / "state_analysis"
+# Hansen GFC-2023 covers 2001-2023 (values 1-23); later releases, named
+# after their last loss year, add a year each
+RELEASE = os.environ.get("PIPELINE_RELEASE") or "GFC-2023-v1.11"
+ALL_YEARS = list(range(2001, int(RELEASE.split("-")[1]) + 1))
+
+def load_lossyear(task):
+    """Open the clipped lossyear raster; None, None if it is missing"""
+    if PIXEL_SIZE_M == 30:
+        lossyear_path = RASTER_DIR / "austria_lossyear.tif"
+    else:
+        lossyear_path = RASTER_DIR / f"austria_lossyear_{int(PIXEL_SIZE_M)}m.tif"
     if not lossyear_path.exists():
         print(f"Error: {lossyear_path} not found")
-        update_status("analyze", "aggregate", "error", 0, "Clipped raster not found")
-        return None
+        update_status("analyze", task, "error", 0, "Clipped raster not found")
+        return None, None
     
     lossyear_ds = gdal.Open(str(lossyear_path))
     lossyear_band = lossyear_ds.GetRasterBand(1)
     lossyear_data = lossyear_band.ReadAsArray()
+    report_metric("bytes", lossyear_data.nbytes)
     
     print(f"Raster size: {lossyear_data.shape}")
     print(f"Loss year range: {lossyear_data[lossyear_data > 0].min()} - {lossyear_data.max()}")
+    return lossyear_ds, lossyear_data
+
+def count_yearly(loss_data, years):
+    """Loss pixels and area per year"""
+    yearly = {}
+    for year in years:
+        pixel_count = np.sum(loss_data == year - 2000)  # 1-23 = 2001-2023
+        yearly[str(year)] = {
+            "pixels": int(pixel_count),
+            "area_ha": float(pixel_count * PIXEL_AREA_HA)
+        }
+    return yearly
+
+def load_results():
+    """Results to add to: the previous ones when recomputing part of them"""
+    if (YEARS or STATES) and OUTPUT_PATH.exists():
+        # Partial recomputation: start from the previous results
+        with open(OUTPUT_PATH) as f:
+            results = json.load(f)
+        print(f"Recomputing years {YEARS or 'all'}, states {STATES or 'all'}")
+        return results
+    return {
+        "pixel_area_ha": PIXEL_AREA_HA,
+        "years": ALL_YEARS,
+        "states": {},
+        "austria_total": {}
+    }
+
+def add_state(results, official_data, state_name, yearly):
+    """Store a state's yearly loss, keeping previous results for other years"""
+    yearly_data = results["states"].get(state_name, {}).get("yearly", {})
+    yearly_data.update(yearly)
+    total_pixels = sum(y["pixels"] for y in yearly_data.values())
+    total_area_ha = sum(y["area_ha"] for y in yearly_data.values())
+    
+    # Get official harvest data for this state
+    official_harvest = official_data["states"].get(state_name, {})
+    harvest_2024 = official_harvest.get("harvest_2024", 0)
+    
+    # Calculate Hansen to Official ratio (proxy for m³/ha)
+    if total_area_ha > 0:
+        efm_per_ha = harvest_2024 / total_area_ha
+    else:
+        efm_per_ha = 0
+    
+    results["states"][state_name] = {
+        "yearly": yearly_data,
+        "total_pixels": int(total_pixels),
+        "total_area_ha": float(total_area_ha),
+        "official_harvest_2024": harvest_2024,
+        "efm_per_ha_ratio": float(efm_per_ha),  # This is our downscaling factor
+    }
+    
+    print(f"{state_name}:")
+    print(f"  Total loss pixels: {total_pixels:,}")
+    print(f"  Total loss area: {total_area_ha:,.1f} ha")
+    print(f"  Official harvest 2024: {harvest_2024:,.0f} Efm")
+    print(f"  Implied Efm/ha: {efm_per_ha:,.1f}")
+
+def load_official_data():
+    with open(DATA_DIR / "holzeinschlag_full.json") as f:
+        return json.load(f)
+
+def save_results(results):
+    with open(OUTPUT_PATH, "w") as f:
+        json.dump(results, f, indent=2)
+    register_artifact(OUTPUT_PATH)
+    report_metric("features", len(results["states"]))
+    print(f"\nResults saved to {OUTPUT_PATH}")
+
+def analyze_forest_loss():
+    """Main analysis: aggregate forest loss by state and year"""
+    update_status("analyze", "aggregate", "running", 0, "Starting analysis...")
+    
+    lossyear_ds, lossyear_data = load_lossyear("aggregate")
+    if lossyear_ds is None:
+        return None
     
     # Load state boundaries
     states = load_state_boundaries()
     print(f"Loaded {len(states)} states")
     
-    # Load official harvest data
-    with open(DATA_DIR / "holzeinschlag_full.json") as f:
-        official_data = json.load(f)
-    
-    results = {
-        "pixel_area_ha": PIXEL_AREA_HA,
-        "years": list(range(2001, 2024)),  # Hansen covers 2001-2023 (values 1-23)
-        "states": {},
-        "austria_total": {}
-    }
+    official_data = load_official_data()
+    results = load_results()
+    years = YEARS or ALL_YEARS
     
     # Aggregate by year for all of Austria
-    austria_yearly = {}
-    for year_val in range(1, 24):  # 1-23 = 2001-2023
-        year = 2000 + year_val
-        pixel_count = np.sum(lossyear_data == year_val)
-        austria_yearly[year] = {
-            "pixels": int(pixel_count),
-            "area_ha": float(pixel_count * PIXEL_AREA_HA)
-        }
-    results["austria_total"] = austria_yearly
+    results["austria_total"].update(count_yearly(lossyear_data, years))
     
     # Aggregate by state
+    if STATES:
+        states = {name: geom for name, geom in states.items() if name in STATES}
     n_states = len(states)
     for i, (state_name, state_geom) in enumerate(states.items()):
         progress = int((i / n_states) * 100)
@@ -135,59 +244,81 @@ def analyze_forest_loss():
         
         # Apply mask to loss data
         state_loss = lossyear_data * mask
-        
-        # Count pixels by year
-        yearly_data = {}
-        total_pixels = 0
-        for year_val in range(1, 24):
-            year = 2000 + year_val
-            pixel_count = np.sum(state_loss == year_val)
-            total_pixels += pixel_count
-            yearly_data[year] = {
-                "pixels": int(pixel_count),
-                "area_ha": float(pixel_count * PIXEL_AREA_HA)
-            }
-        
-        # Get official harvest data for this state
-        official_harvest = official_data["states"].get(state_name, {})
-        harvest_2024 = official_harvest.get("harvest_2024", 0)
-        
-        # Calculate Hansen to Official ratio (proxy for m³/ha)
-        total_area_ha = total_pixels * PIXEL_AREA_HA
-        if total_area_ha > 0:
-            efm_per_ha = harvest_2024 / total_area_ha
-        else:
-            efm_per_ha = 0
-        
-        results["states"][state_name] = {
-            "yearly": yearly_data,
-            "total_pixels": int(total_pixels),
-            "total_area_ha": float(total_area_ha),
-            "official_harvest_2024": harvest_2024,
-            "efm_per_ha_ratio": float(efm_per_ha),  # This is our downscaling factor
-        }
-        
-        print(f"  Total loss pixels: {total_pixels:,}")
-        print(f"  Total loss area: {total_area_ha:,.1f} ha")
-        print(f"  Official harvest 2024: {harvest_2024:,.0f} Efm")
-        print(f"  Implied Efm/ha: {efm_per_ha:,.1f}")
-    
-    # Save results
-    output_path = DATA_DIR / "hansen_state_analysis.json"
-    with open(output_path, "w") as f:
-        json.dump(results, f, indent=2)
+        add_state(results, official_data, state_name, count_yearly(state_loss, years))
+    
+    save_results(results)
+    update_status("analyze", "aggregate", "complete", 100, f"Saved to {OUTPUT_PATH}")
+    return results
+
+def analyze_state(state_name):
+    """Count one state's loss and leave it in PARTIAL_DIR for --merge"""
+    update_status("analyze", state_name, "running", 0, "Starting analysis...")
+    lossyear_ds, lossyear_data = load_lossyear(state_name)
+    if lossyear_ds is None:
+        return False
+    states = load_state_boundaries()
+    if state_name not in states:
+        print(f"Error: no boundary for {state_name}")
+        update_status("analyze", state_name, "error", 0, "State boundary not found")
+        return False
     
-    update_status("analyze", "aggregate", "complete", 100, f"Saved to {output_path}")
-    print(f"\nResults saved to {output_path}")
+    update_status("analyze", state_name, "running", 50, "Counting loss pixels...")
+    mask = rasterize_state(state_name, states[state_name], lossyear_ds)
+    yearly = count_yearly(lossyear_data * mask, YEARS or ALL_YEARS)
     
+    PARTIAL_DIR.mkdir(exist_ok=True)
+    partial_path = PARTIAL_DIR / f"{state_name}.json"
+    tmp_path = partial_path.with_suffix(".tmp")
+    with open(tmp_path, "w") as f:
+        json.dump(yearly, f)
+    tmp_path.rename(partial_path)
+    report_metric("features", len(yearly))
+    
+    total = sum(y["pixels"] for y in yearly.values())
+    update_status("analyze", state_name, "complete", 100, f"{total:,} loss pixels")
+    print(f"{state_name}: {total:,} loss pixels")
+    return True
+
+def merge_states():
+    """Combine the results of the --state runs with the Austria totals"""
+    update_status("analyze", "aggregate", "running", 0, "Merging states...")
+    lossyear_ds, lossyear_data = load_lossyear("aggregate")
+    if lossyear_ds is None:
+        return None
+    
+    official_data = load_official_data()
+    results = load_results()
+    results["austria_total"].update(count_yearly(lossyear_data, YEARS or ALL_YEARS))
+    
+    for state_name in STATES or load_state_boundaries():
+        partial_path = PARTIAL_DIR / f"{state_name}.json"
+        if not partial_path.exists():
+            print(f"Error: no results for {state_name}")
+            update_status("analyze", "aggregate", "error", 0, f"No results for {state_name}")
+            return None
+        with open(partial_path) as f:
+            add_state(results, official_data, state_name, json.load(f))
+    
+    save_results(results)
+    for partial_path in PARTIAL_DIR.glob("*.json"):
+        partial_path.unlink()
+    update_status("analyze", "aggregate", "complete", 100, f"Saved to {OUTPUT_PATH}")
     return results
 
 def main():
+    parser = argparse.ArgumentParser(description=__doc__.strip().splitlines()[0])
+    parser.add_argument("--state", help="only count one Bundesland, for a later --merge")
+    parser.add_argument("--merge", action="store_true", help="combine the --state results")
+    args = parser.parse_args()
+    
+    if args.state:
+        sys.exit(0 if analyze_state(args.state) else 1)
+    
     print("="*60)
     print("Hansen Forest Loss Analysis by Bundesland")
     print("="*60)
     
-    results = analyze_forest_loss()
+    results = merge_states() if args.merge else analyze_forest_loss()
     
     if results:
         print("\n" + "="*60)
@@ -195,6 +326,8 @@ def main():
         print("="*60)
         for state, data in sorted(results["states"].items(), key=lambda x: -x[1]["total_pixels"]):
             print(f"{state}: {data['total_pixels']:,} pixels, {data['total_area_ha']:,.0f} ha loss, {data['efm_per_ha_ratio']:.0f} Efm/ha")
+    elif args.merge:
+        sys.exit(1)
 
 if __name__ == "__main__":
     main()
@@ -6,6 +6,7 @@ Uses GDAL to clip the large Hansen tiles to Austria extent
 
 import subprocess
 import json
+import os
 from pathlib import Path
 
 BASE_DIR = Path(__file__).parent.parent
@@ -16,8 +17,27 @@ STATUS_FILE = BASE_DIR / "processing" / "status.json"
 # Austria bounding box (with small buffer)
 AUSTRIA_BBOX = "9.5 46.3 17.2 49.1"  # minX minY maxX maxY
 
+# Target pixel size in meters, set by the server for runs asking for a
+# coarser one. Hansen's ~30m pixels are 0.00025 degrees.
+NATIVE_RESOLUTION = 30
+RESOLUTION = int(os.environ.get("PIPELINE_RESOLUTION") or NATIVE_RESOLUTION)
+# Loss years are categories, tree cover is a percentage
+RESAMPLING = {"lossyear": "mode", "treecover2000": "average"}
+
+def clipped_name(layer):
+    """File name of a clipped layer, as the server's built-in pipeline names it"""
+    if RESOLUTION == NATIVE_RESOLUTION:
+        return f"austria_{layer}.tif"
+    return f"austria_{layer}_{RESOLUTION}m.tif"
+
 def update_status(phase, task, status, progress=0, message=""):
     """Update processing status file"""
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        # Run by the server, which keeps status.json itself
+        line = "step %s/%s %s %s %s\n" % (phase, task, status, progress, " ".join(str(message).split()))
+        os.write(int(fd), line.encode())
+        return
     status_data = {}
     if STATUS_FILE.exists():
         with open(STATUS_FILE) as f:
@@ -35,6 +55,12 @@ def update_status(phase, task, status, progress=0, message=""):
     with open(STATUS_FILE, "w") as f:
         json.dump(status_data, f, indent=2)
 
+def register_artifact(path):
+    """Report an output file to the server running the pipeline, if any"""
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        os.write(int(fd), f"artifact {Path(path).resolve()}\n".encode())
+
 def clip_raster(input_path, output_path, task_name):
     """Clip raster to Austria boundary using gdalwarp"""
     print(f"\nClipping {task_name}...")
@@ -42,6 +68,7 @@ def clip_raster(input_path, output_path, task_name):
     if output_path.exists():
         print(f"  Output exists, skipping: {output_path}")
         update_status("clip", task_name, "complete", 100, "File exists")
+        register_artifact(output_path)
         return True
     
     if not input_path.exists():
@@ -57,6 +84,11 @@ def clip_raster(input_path, output_path, task_name):
     cmd = [
         "gdalwarp",
         "-te", *AUSTRIA_BBOX.split(),
+    ]
+    if RESOLUTION != NATIVE_RESOLUTION:
+        deg = str(0.00025 * RESOLUTION / NATIVE_RESOLUTION)
+        cmd += ["-tr", deg, deg, "-r", RESAMPLING[task_name]]
+    cmd += [
         "-co", "COMPRESS=LZW",
         "-co", "TILED=YES",
         str(input_path),
@@ -69,6 +101,7 @@ def clip_raster(input_path, output_path, task_name):
         result = subprocess.run(cmd, capture_output=True, text=True, check=True)
         print(f"  Complete: {output_path}")
         update_status("clip", task_name, "complete", 100, "Clipped successfully")
+        register_artifact(output_path)
         return True
     except subprocess.CalledProcessError as e:
         print(f"  Error: {e.stderr}")
@@ -81,8 +114,8 @@ def main():
     print("="*60)
     
     rasters = [
-        ("lossyear", "hansen_lossyear.tif", "austria_lossyear.tif"),
-        ("treecover2000", "hansen_treecover2000.tif", "austria_treecover2000.tif"),
+        ("lossyear", "hansen_lossyear.tif", clipped_name("lossyear")),
+        ("treecover2000", "hansen_treecover2000.tif", clipped_name("treecover2000")),
     ]
     
     for name, input_name, output_name in rasters:
@@ -5,6 +5,7 @@ Combines GeoJSON boundaries with emissions/harvest data.
 """
 
 import json
+import os
 import subprocess
 from pathlib import Path
 import tempfile
@@ -12,13 +13,28 @@ import shutil
 
 BASE_DIR = Path(__file__).parent.parent
 DATA_DIR = BASE_DIR / "data"
-PUBLIC_DIR = BASE_DIR / "public"
+# The server has outputs written to a staging directory and publishes
+# them once they are validated
+PUBLIC_DIR = Path(os.environ.get("PIPELINE_PUBLIC_DIR", BASE_DIR / "public"))
+
+def input_path(name):
+    """Input file from DATA_DIR, or its uploaded replacement if the run uses uploads"""
+    inputs = os.environ.get("PIPELINE_INPUTS_DIR")
+    if inputs and (Path(inputs) / name).exists():
+        return Path(inputs) / name
+    return DATA_DIR / name
+
+def register_artifact(path):
+    """Report an output file to the server running the pipeline, if any"""
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        os.write(int(fd), f"artifact {Path(path).resolve()}\n".encode())
 
 def main():
     print("Creating GeoPackage export...")
     
     # Load base GeoJSON
-    with open(DATA_DIR / "austria_gemeinden.geojson") as f:
+    with open(input_path("austria_gemeinden.geojson")) as f:
         geojson = json.load(f)
     
     # Load metadata
@@ -100,6 +116,7 @@ def main():
     print(f"Size: {size_mb:.1f} MB")
     print(f"Features: {len(geojson['features'])}")
     print(f"Years: {years[0]} - {years[-1]}")
+    register_artifact(output_gpkg)
 
 if __name__ == "__main__":
     main()
@@ -8,6 +8,7 @@ to provide complete coverage of Austria including Vorarlberg.
 import subprocess
 from pathlib import Path
 import json
+import os
 
 BASE_DIR = Path(__file__).parent.parent
 RASTER_DIR = BASE_DIR / "raster"
@@ -15,6 +16,12 @@ DATA_DIR = BASE_DIR / "data"
 STATUS_FILE = BASE_DIR / "processing" / "status.json"
 
 def update_status(phase, task, status, progress=0, message=""):
+    fd = os.environ.get("PIPELINE_STATUS_FD")
+    if fd:
+        # Run by the server, which keeps status.json itself
+        line = "step %s/%s %s %s %s\n" % (phase, task, status, progress, " ".join(str(message).split()))
+        os.write(int(fd), line.encode())
+        return
     status_data = {}
     if STATUS_FILE.exists():
         with open(STATUS_FILE) as f:
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Pipeline progress for the dashboard, pushed over /ws/pipeline. Every
+// status line the pipeline reports is broadcast as an event.
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	// Events a client may fall behind before it is disconnected
+	wsClientBuffer = 64
+)
+
+type progressEvent struct {
+	// "started", "progress" or "finished"
+	Type string `json:"type"`
+	// Stage and step as reported by the pipeline, e.g. "download"/"lossyear";
+	// no step for stage events
+	Stage   string  `json:"stage,omitempty"`
+	Step    string  `json:"step,omitempty"`
+	Status  string  `json:"status,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+	// Estimated seconds until the step completes, when it can be told
+	ETASeconds *int   `json:"eta_seconds,omitempty"`
+	Message    string `json:"message,omitempty"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Time       string `json:"time"`
+}
+
+type progressHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+	// Latest event per step of the current run, replayed to new clients
+	steps map[string]progressEvent
+	run   *progressEvent
+}
+
+var pipelineProgress = &progressHub{
+	clients: make(map[chan []byte]bool),
+	steps:   make(map[string]progressEvent),
+}
+
+func (h *progressHub) broadcast(ev progressEvent) {
+	ev.Time = time.Now().UTC().Format(time.RFC3339)
+	data, _ := json.Marshal(ev)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch ev.Type {
+	case "started":
+		h.steps = make(map[string]progressEvent)
+		h.run = &ev
+	case "finished":
+		h.run = &ev
+	default:
+		h.steps[ev.Stage+"/"+ev.Step] = ev
+	}
+	for ch := range h.clients {
+		select {
+		case ch <- data:
+		default:
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a client and returns the events describing the
+// current state, to send before the live ones.
+func (h *progressHub) subscribe() (chan []byte, [][]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var snapshot [][]byte
+	if h.run != nil {
+		data, _ := json.Marshal(h.run)
+		snapshot = append(snapshot, data)
+	}
+	keys := make([]string, 0, len(h.steps))
+	for k := range h.steps {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		data, _ := json.Marshal(h.steps[k])
+		snapshot = append(snapshot, data)
+	}
+	ch := make(chan []byte, wsClientBuffer)
+	h.clients[ch] = true
+	return ch, snapshot
+}
+
+func (h *progressHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[ch] {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// Same-origin check is gorilla's default when CheckOrigin is unset
+var wsUpgrader = websocket.Upgrader{}
+
+// handlePipelineWS streams progress events to a dashboard. Messages from
+// the client are ignored.
+func handlePipelineWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	events, snapshot := pipelineProgress.subscribe()
+	defer pipelineProgress.unsubscribe(events)
+
+	// Reading is needed to process pings and notice the client leaving
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(data []byte) bool {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, data) == nil
+	}
+	for _, data := range snapshot {
+		if !send(data) {
+			return
+		}
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case data, ok := <-events:
+			if !ok || !send(data) {
+				return
+			}
+		case <-ping.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
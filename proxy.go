@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Parsed form of config.TrustedProxies
+var trustedProxyNets []*net.IPNet
+
+// parseCIDRs accepts CIDR ranges and bare IP addresses.
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedProxy reports whether the direct peer is one of the configured
+// reverse proxies, whose forwarding headers we may believe.
+func isTrustedProxy(r *http.Request) bool {
+	return ipInNets(remoteIP(r), trustedProxyNets)
+}
+
+// requestIsSecure reports whether the client reached us over HTTPS, either
+// directly or through a TLS-terminating proxy.
+func requestIsSecure(r *http.Request) bool {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return true
+	}
+	if len(config.TrustedSSLHeaders) == 0 || !isTrustedProxy(r) {
+		return false
+	}
+	for header, value := range config.TrustedSSLHeaders {
+		if strings.EqualFold(r.Header.Get(header), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the actual client. Behind a trusted
+// proxy it is the right-most X-Forwarded-For entry that isn't itself a
+// trusted proxy; entries further left can be forged by the client.
+func clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !ipInNets(ip, trustedProxyNets) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !ipInNets(hop, trustedProxyNets) {
+			break
+		}
+	}
+	return ip
+}
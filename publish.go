@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publishing of pipeline outputs. Runs write the files meant for
+// public_dir into a staging directory, passed to them as
+// PIPELINE_PUBLIC_DIR, so nobody downloads a half-written GeoPackage.
+// After a successful run the staged files are validated and moved into
+// public_dir, each with an atomic rename. The files they replace are
+// kept in processing/publish/previous until the next publish, so the
+// latest release can be rolled back.
+
+// release is a set of pipeline outputs, with paths relative to
+// public_dir.
+type release struct {
+	RunID     string     `json:"run_id"`
+	Files     []string   `json:"files"`
+	Staged    time.Time  `json:"staged"`
+	Published *time.Time `json:"published,omitempty"`
+	// Validation problems; releases that have them are not published
+	Errors []string `json:"errors,omitempty"`
+	// Files that replaced existing ones rather than being added
+	Replaced []string `json:"replaced,omitempty"`
+}
+
+type publishState struct {
+	Staged    *release `json:"staged,omitempty"`
+	Published *release `json:"published,omitempty"`
+	// Release the published one replaced, and whether its files are
+	// still around to roll back to
+	Previous          *release `json:"previous,omitempty"`
+	RollbackAvailable bool     `json:"rollback_available"`
+}
+
+var (
+	errNothingStaged     = errors.New("no outputs are staged")
+	errStagedInvalid     = errors.New("staged outputs failed validation")
+	errNothingToRollBack = errors.New("no release to roll back")
+
+	// Guards the state file and the files being swapped
+	publishMutex sync.Mutex
+)
+
+func publishDir() string {
+	return filepath.Join(config.ProcessingDir, "publish")
+}
+
+func stagingDir() string {
+	return filepath.Join(publishDir(), "staging")
+}
+
+func previousDir() string {
+	return filepath.Join(publishDir(), "previous")
+}
+
+func publishStatePath() string {
+	return filepath.Join(publishDir(), "state.json")
+}
+
+func loadPublishState() (*publishState, error) {
+	state := &publishState{}
+	data, err := os.ReadFile(publishStatePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", publishStatePath(), err)
+	}
+	return state, nil
+}
+
+func savePublishState(state *publishState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := publishStatePath()
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// resetStaging empties the staging directory for a new run. Outputs of
+// an earlier run that were never published are dropped.
+func resetStaging(runID string) error {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	state, err := loadPublishState()
+	if err != nil {
+		return err
+	}
+	if state.Staged != nil {
+		log.Printf("Dropping unpublished outputs of run %s for run %s", state.Staged.RunID, runID)
+		state.Staged = nil
+		if err := savePublishState(state); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(stagingDir()); err != nil {
+		return err
+	}
+	return os.MkdirAll(stagingDir(), 0755)
+}
+
+// isStaged reports whether path, absolute or relative to the processing
+// directory, lies in the staging directory.
+func isStaged(path string) bool {
+	staging, err := filepath.Abs(stagingDir())
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(config.ProcessingDir, path)
+	}
+	path, err = filepath.Abs(path)
+	return err == nil && strings.HasPrefix(path, staging+string(filepath.Separator))
+}
+
+// stageOutputs validates what run runID left in the staging directory
+// and records it as the staged release. It returns nil if the run
+// staged nothing, and errStagedInvalid along with the release if any
+// file failed validation.
+func stageOutputs(runID string) (*release, error) {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	rel := &release{RunID: runID, Files: []string{}, Staged: time.Now().UTC()}
+	err := filepath.WalkDir(stagingDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(stagingDir(), path)
+		if err != nil {
+			return err
+		}
+		rel.Files = append(rel.Files, filepath.ToSlash(name))
+		if err := validateOutput(path); err != nil {
+			rel.Errors = append(rel.Errors, fmt.Sprintf("%s: %v", filepath.ToSlash(name), err))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(rel.Files) == 0 {
+		return nil, nil
+	}
+
+	state, err := loadPublishState()
+	if err != nil {
+		return nil, err
+	}
+	state.Staged = rel
+	if err := savePublishState(state); err != nil {
+		return nil, err
+	}
+	if len(rel.Errors) > 0 {
+		return rel, fmt.Errorf("%w: %s", errStagedInvalid, strings.Join(rel.Errors, "; "))
+	}
+	return rel, nil
+}
+
+// validateOutput checks that a staged file is complete enough to be
+// served: GeoPackages must open and list their layers, and the main one
+// must have the schema the handlers expect; JSON files must parse.
+func validateOutput(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	if info.Size() == 0 {
+		return errors.New("empty file")
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpkg":
+		layers, err := geoPackageLayers(path)
+		if err != nil {
+			return err
+		}
+		if len(layers) == 0 {
+			return errors.New("GeoPackage has no layers")
+		}
+		if filepath.Base(path) != gpkgName {
+			return nil
+		}
+		db, err := openDB(path)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		count, err := checkGeoPackage(db)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.New("GeoPackage table gemeinden is empty")
+		}
+	case ".json", ".geojson":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(data) {
+			return errors.New("invalid JSON")
+		}
+	}
+	return nil
+}
+
+// moveFile renames src to dst, falling back to copying when they are on
+// different file systems. dst is replaced atomically either way.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if _, err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// publishStaged moves the staged release into public_dir. The files it
+// replaces are copied to the previous directory first; if a swap fails
+// half-way, the files already swapped are put back.
+func publishStaged() (*release, error) {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	state, err := loadPublishState()
+	if err != nil {
+		return nil, err
+	}
+	rel := state.Staged
+	if rel == nil {
+		return nil, errNothingStaged
+	}
+	if len(rel.Errors) > 0 {
+		return nil, errStagedInvalid
+	}
+
+	if err := os.RemoveAll(previousDir()); err != nil {
+		return nil, err
+	}
+	rel.Replaced = nil
+	for _, name := range rel.Files {
+		live := filepath.Join(config.PublicDir, filepath.FromSlash(name))
+		if _, err := os.Stat(live); err != nil {
+			continue
+		}
+		keep := filepath.Join(previousDir(), filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(keep), 0755); err != nil {
+			return nil, err
+		}
+		if _, err := copyFile(live, keep); err != nil {
+			return nil, fmt.Errorf("keeping %s: %w", name, err)
+		}
+		rel.Replaced = append(rel.Replaced, name)
+	}
+
+	for i, name := range rel.Files {
+		live := filepath.Join(config.PublicDir, filepath.FromSlash(name))
+		if err := moveFile(filepath.Join(stagingDir(), filepath.FromSlash(name)), live); err != nil {
+			restoreFiles(rel.Files[:i], rel.Replaced)
+			return nil, fmt.Errorf("publishing %s: %w", name, err)
+		}
+	}
+	os.RemoveAll(stagingDir())
+
+	now := time.Now().UTC()
+	rel.Published = &now
+	state.Previous, state.Published, state.Staged = state.Published, rel, nil
+	state.RollbackAvailable = true
+	if err := savePublishState(state); err != nil {
+		log.Printf("Failed to save publish state: %v", err)
+	}
+	invalidateCaches()
+
+	if public, err := filepath.Abs(config.PublicDir); err == nil {
+		var paths []string
+		for _, name := range rel.Files {
+			paths = append(paths, filepath.Join(public, filepath.FromSlash(name)))
+		}
+		registerArtifacts(rel.RunID, paths)
+	}
+	log.Printf("Published %d outputs of run %s", len(rel.Files), rel.RunID)
+	return rel, nil
+}
+
+// restoreFiles puts the previous versions of files back into public_dir
+// and removes the ones that had none.
+func restoreFiles(files, replaced []string) error {
+	var errs []error
+	for _, name := range files {
+		live := filepath.Join(config.PublicDir, filepath.FromSlash(name))
+		var err error
+		if slices.Contains(replaced, name) {
+			_, err = copyFile(filepath.Join(previousDir(), filepath.FromSlash(name)), live)
+		} else if err = os.Remove(live); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rollbackRelease restores the files the latest publish replaced.
+func rollbackRelease() (*publishState, error) {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	state, err := loadPublishState()
+	if err != nil {
+		return nil, err
+	}
+	if state.Published == nil || !state.RollbackAvailable {
+		return nil, errNothingToRollBack
+	}
+	err = restoreFiles(state.Published.Files, state.Published.Replaced)
+	invalidateCaches()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Rolled back outputs of run %s", state.Published.RunID)
+	os.RemoveAll(previousDir())
+	state.Published, state.Previous = state.Previous, nil
+	state.RollbackAvailable = false
+	if err := savePublishState(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func handlePublishState(w http.ResponseWriter, r *http.Request) {
+	publishMutex.Lock()
+	state, err := loadPublishState()
+	publishMutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to load publish state: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to load publish state")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func handlePublish(w http.ResponseWriter, r *http.Request) {
+	if isPipelineRunning() {
+		writeJSONError(w, http.StatusConflict, "pipeline is running")
+		return
+	}
+	rel, err := publishStaged()
+	switch {
+	case errors.Is(err, errNothingStaged):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case errors.Is(err, errStagedInvalid):
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case err != nil:
+		log.Printf("Publishing failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to publish outputs")
+		return
+	}
+	audit(r, "publish", "", map[string]interface{}{"run_id": rel.RunID, "files": rel.Files})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rel)
+}
+
+func handleRollback(w http.ResponseWriter, r *http.Request) {
+	if isPipelineRunning() {
+		writeJSONError(w, http.StatusConflict, "pipeline is running")
+		return
+	}
+	state, err := rollbackRelease()
+	if errors.Is(err, errNothingToRollBack) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Rollback failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to roll back outputs")
+		return
+	}
+	audit(r, "rollback", "", nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
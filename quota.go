@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Export quotas: each client may start export_quota.per_hour exports in
+// any hour and download export_quota.bytes_per_day in any 24 hours.
+// Clients are API keys ("key:<id>"), logged-in users ("user:<name>") and
+// otherwise addresses ("ip:<addr>"); export_quota_overrides sets other
+// limits for some of them. Admins have none, except through API keys.
+// The limits and what is left of them are sent in X-RateLimit-* and
+// X-Export-Bytes-* headers.
+
+type exportQuota struct {
+	// 0 for no limit
+	PerHour     int   `json:"per_hour"`
+	BytesPerDay int64 `json:"bytes_per_day"`
+}
+
+// exportUse is one export charged to a client.
+type exportUse struct {
+	at    time.Time
+	bytes int64
+}
+
+var (
+	exportUsage      = make(map[string][]exportUse)
+	exportUsageMutex sync.Mutex
+)
+
+// exportClient identifies the client of r for quotas and returns its
+// limits; unlimited is set for admins logged in.
+func exportClient(r *http.Request) (client string, quota exportQuota, unlimited bool) {
+	p, ok := authenticate(r)
+	switch {
+	case ok && p.APIKey != nil:
+		client = "key:" + p.APIKey.ID
+	case ok:
+		client = "user:" + p.User.Username
+	default:
+		client = "ip:" + clientIP(r).String()
+	}
+	quota = config.ExportQuota
+	if override, ok := config.ExportQuotaOverrides[client]; ok {
+		quota = override
+	}
+	return client, quota, ok && p.APIKey == nil && p.User.Role == roleAdmin
+}
+
+// exportUsesLocked drops the client's uses older than a day and returns
+// the rest.
+func exportUsesLocked(client string, now time.Time) []exportUse {
+	uses := exportUsage[client]
+	i := 0
+	for i < len(uses) && now.Sub(uses[i].at) >= 24*time.Hour {
+		i++
+	}
+	uses = uses[i:]
+	if len(uses) == 0 {
+		delete(exportUsage, client)
+	} else {
+		exportUsage[client] = uses
+	}
+	return uses
+}
+
+// chargeExport counts an export against the quota of the client of r.
+// It returns the client, for recordExportBytes, and the quota headers;
+// if the quota is used up, the export isn't counted and err says so.
+func chargeExport(r *http.Request) (client string, headers http.Header, err error) {
+	client, quota, unlimited := exportClient(r)
+	headers = http.Header{}
+	if unlimited {
+		return client, headers, nil
+	}
+	exportUsageMutex.Lock()
+	defer exportUsageMutex.Unlock()
+	now := time.Now()
+	uses := exportUsesLocked(client, now)
+
+	var hourly int
+	var bytes int64
+	var retry time.Duration
+	for _, u := range uses {
+		bytes += u.bytes
+		if now.Sub(u.at) < time.Hour {
+			if hourly == 0 {
+				retry = time.Hour - now.Sub(u.at)
+			}
+			hourly++
+		}
+	}
+	hourFull := quota.PerHour > 0 && hourly >= quota.PerHour
+	dayFull := quota.BytesPerDay > 0 && bytes >= quota.BytesPerDay
+	if !hourFull {
+		hourly++
+	}
+	if quota.PerHour > 0 {
+		headers.Set("X-RateLimit-Limit", strconv.Itoa(quota.PerHour))
+		headers.Set("X-RateLimit-Remaining", strconv.Itoa(max(quota.PerHour-hourly, 0)))
+	}
+	if quota.BytesPerDay > 0 {
+		headers.Set("X-Export-Bytes-Limit", strconv.FormatInt(quota.BytesPerDay, 10))
+		headers.Set("X-Export-Bytes-Remaining", strconv.FormatInt(max(quota.BytesPerDay-bytes, 0), 10))
+	}
+
+	var msg string
+	switch {
+	case hourFull:
+		msg = fmt.Sprintf("Export quota of %d exports per hour used up", quota.PerHour)
+	case dayFull:
+		msg = fmt.Sprintf("Export quota of %d bytes per day used up", quota.BytesPerDay)
+		// Until enough of the oldest downloads are a day old
+		var freed int64
+		for _, u := range uses {
+			freed += u.bytes
+			if bytes-freed < quota.BytesPerDay {
+				retry = 24*time.Hour - now.Sub(u.at)
+				break
+			}
+		}
+	default:
+		exportUsage[client] = append(uses, exportUse{at: now})
+		return client, headers, nil
+	}
+	return client, headers, &exportError{status: http.StatusTooManyRequests, msg: msg, code: "quota_exceeded", retryAfter: int(retry.Seconds()) + 1}
+}
+
+// recordExportBytes adds the size of a delivered export to the client's
+// latest export.
+func recordExportBytes(client string, n int64) {
+	exportUsageMutex.Lock()
+	defer exportUsageMutex.Unlock()
+	if uses := exportUsage[client]; len(uses) > 0 {
+		uses[len(uses)-1].bytes += n
+	}
+}
+
+type exportUsageView struct {
+	Client     string      `json:"client"`
+	LastHour   int         `json:"exports_last_hour"`
+	BytesToday int64       `json:"bytes_last_day"`
+	Quota      exportQuota `json:"quota"`
+}
+
+// handleListExportQuotas lists the clients that exported in the last
+// day and their usage.
+func handleListExportQuotas(w http.ResponseWriter, r *http.Request) {
+	exportUsageMutex.Lock()
+	now := time.Now()
+	views := []exportUsageView{}
+	for client := range exportUsage {
+		view := exportUsageView{Client: client, Quota: config.ExportQuota}
+		if override, ok := config.ExportQuotaOverrides[client]; ok {
+			view.Quota = override
+		}
+		for _, u := range exportUsesLocked(client, now) {
+			view.BytesToday += u.bytes
+			if now.Sub(u.at) < time.Hour {
+				view.LastHour++
+			}
+		}
+		views = append(views, view)
+	}
+	exportUsageMutex.Unlock()
+	sort.Slice(views, func(i, j int) bool { return views[i].Client < views[j].Client })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// handleResetExportQuota clears the usage of a client, lifting its
+// quota until it exports again.
+func handleResetExportQuota(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	exportUsageMutex.Lock()
+	_, found := exportUsage[client]
+	delete(exportUsage, client)
+	exportUsageMutex.Unlock()
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "no exports by this client")
+		return
+	}
+	audit(r, "export_quota_reset", client, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rankings order the Gemeinden by an indicator in one year, optionally
+// per inhabitant or per hectare of the Gemeinde's area. Areas are
+// measured from the outlines once per dataset version.
+
+const (
+	defaultRankingLimit = 20
+	// Wien as a whole would rank next to its own districts
+	rankingExclude = "iso <> '" + wienWhole + "'"
+)
+
+var (
+	gemeindeAreaCache        map[int64]float64
+	gemeindeAreaCacheVersion string
+	gemeindeAreaMutex        sync.Mutex
+)
+
+// gemeindeAreas returns the area in hectares of each Gemeinde by fid.
+func gemeindeAreas() (map[int64]float64, error) {
+	gemeindeAreaMutex.Lock()
+	defer gemeindeAreaMutex.Unlock()
+	version, err := datasetVersion()
+	if err != nil {
+		return nil, err
+	}
+	if gemeindeAreaCache != nil && gemeindeAreaCacheVersion == version {
+		return gemeindeAreaCache, nil
+	}
+	rows, err := gpkgDB().Query("SELECT fid, geom FROM gemeinden")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	areas := make(map[int64]float64)
+	for rows.Next() {
+		var fid int64
+		var geom []byte
+		if err := rows.Scan(&fid, &geom); err != nil {
+			return nil, err
+		}
+		shape, err := parseGeoPackageGeometry(geom)
+		if err != nil {
+			return nil, fmt.Errorf("geometry of feature %d: %w", fid, err)
+		}
+		areas[fid] = shape.areaHectares()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	gemeindeAreaCache, gemeindeAreaCacheVersion = areas, version
+	return areas, nil
+}
+
+type rankingEntry struct {
+	Rank       int     `json:"rank"`
+	ISO        string  `json:"iso"`
+	Name       string  `json:"name"`
+	State      string  `json:"state"`
+	Population *int64  `json:"population"`
+	Value      float64 `json:"value"`
+	// The value per inhabitant or hectare, which the ranking is by
+	Normalized *float64 `json:"normalized,omitempty"`
+	AreaHa     *float64 `json:"area_ha,omitempty"`
+	score      float64
+}
+
+// handleRankings returns the ?limit= Gemeinden with the highest values
+// of ?indicator= in ?year= (the latest by default), or the lowest with
+// ?order=asc. ?normalize=per_capita or per_area ranks by the value per
+// inhabitant or per hectare. The filters of /api/gemeinden apply.
+func handleRankings(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	indicator := query.Get("indicator")
+	if !slices.Contains(indicators, indicator) {
+		writeJSONError(w, http.StatusBadRequest, "indicator must be one of "+strings.Join(indicators, ", "))
+		return
+	}
+	normalize := query.Get("normalize")
+	switch normalize {
+	case "", "per_capita", "per_area":
+	default:
+		writeJSONError(w, http.StatusBadRequest, "normalize must be per_capita or per_area")
+		return
+	}
+	if normalize != "" && strings.HasSuffix(indicator, "_per_capita") {
+		writeJSONError(w, http.StatusBadRequest, indicator+" is already normalized")
+		return
+	}
+	order := query.Get("order")
+	switch order {
+	case "":
+		order = "desc"
+	case "asc", "desc":
+	default:
+		writeJSONError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+	limit := defaultRankingLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxGemeindenLimit {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxGemeindenLimit))
+			return
+		}
+		limit = n
+	}
+	available, err := datasetYears()
+	if err != nil {
+		log.Printf("Reading dataset years failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to rank Gemeinden")
+		return
+	}
+	year, err := indicatorYear(query, available)
+	if err == nil && year == "" {
+		err = errors.New("the dataset has no yearly data")
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseGemeindenFilter(query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var areas map[int64]float64
+	if normalize == "per_area" {
+		if areas, err = gemeindeAreas(); err != nil {
+			log.Printf("Measuring Gemeinde areas failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to rank Gemeinden")
+			return
+		}
+	}
+
+	column := fmt.Sprintf("%q", indicator+"_"+year)
+	filter.conds = append(filter.conds, rankingExclude, column+" IS NOT NULL")
+	rows, err := gpkgDB().Query("SELECT fid, iso, name, state, population, "+column+" FROM gemeinden WHERE "+filter.where(dataScopeCondition(r))+" ORDER BY iso", filter.args...)
+	if err != nil {
+		log.Printf("Ranking Gemeinden failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to rank Gemeinden")
+		return
+	}
+	defer rows.Close()
+	entries := []rankingEntry{}
+	for rows.Next() {
+		var e rankingEntry
+		var fid int64
+		var population sql.NullInt64
+		if err := rows.Scan(&fid, &e.ISO, &e.Name, &e.State, &population, &e.Value); err != nil {
+			log.Printf("Ranking Gemeinden failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to rank Gemeinden")
+			return
+		}
+		if population.Valid {
+			e.Population = &population.Int64
+		}
+		e.score = e.Value
+		switch normalize {
+		case "per_capita":
+			// Gemeinden without inhabitants have no value per inhabitant
+			if population.Int64 <= 0 {
+				continue
+			}
+			e.score = e.Value / float64(population.Int64)
+		case "per_area":
+			area := areas[fid]
+			if area <= 0 {
+				continue
+			}
+			e.AreaHa = roundDerived(area)
+			e.score = e.Value / area
+		}
+		if normalize != "" {
+			e.Normalized = roundDerived(e.score)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Ranking Gemeinden failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to rank Gemeinden")
+		return
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if order == "asc" {
+			return entries[i].score < entries[j].score
+		}
+		return entries[i].score > entries[j].score
+	})
+	ranked := entries[:min(limit, len(entries))]
+	for i := range ranked {
+		// Equal values share a rank
+		ranked[i].Rank = i + 1
+		if i > 0 && ranked[i].score == ranked[i-1].score {
+			ranked[i].Rank = ranked[i-1].Rank
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"indicator": indicator,
+		"year":      year,
+		"normalize": normalize,
+		"order":     order,
+		"total":     len(entries),
+		"rankings":  ranked,
+	})
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"holzeinschlag-austria/pipeline"
+)
+
+// Pipeline run history. Every run gets an ID and two files in
+// processing/runs: <id>.json with its metadata and <id>.log with its
+// output. Runs of built-in pipelines also log each stage separately, in
+// <id>/<stage>.log. pipeline.log keeps holding the latest run as before.
+
+// pipelineRun describes one run of a pipeline.
+type pipelineRun struct {
+	ID       string `json:"id"`
+	Pipeline string `json:"pipeline"`
+	// Who started the run: a user, or a schedule
+	User       string           `json:"user,omitempty"`
+	Schedule   string           `json:"schedule,omitempty"`
+	Parameters *pipeline.Params `json:"parameters,omitempty"`
+	// Minutes the run may take; 0 for no limit
+	TimeoutMinutes int `json:"timeout_minutes,omitempty"`
+	// "running", "success", "failed", "cancelled", "timed_out",
+	// "preflight_failed", "validation_failed", "publish_failed",
+	// "postflight_failed", or "interrupted" for runs the server was
+	// restarted during
+	Status   string `json:"status"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	// Why a run that did not succeed ended
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// One entry per try under the retry policy; RetryAt is set while
+	// waiting for the next one
+	Attempts []runAttempt `json:"attempts,omitempty"`
+	RetryAt  *time.Time   `json:"retry_at,omitempty"`
+}
+
+type runAttempt struct {
+	Attempt  int       `json:"attempt"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+	// Stage the attempt failed in, and the stages it skipped because
+	// earlier attempts completed them
+	FailedStage   string   `json:"failed_stage,omitempty"`
+	SkippedStages []string `json:"skipped_stages,omitempty"`
+	// Stages of built-in pipelines the attempt ran, in the order they
+	// finished
+	Stages []stageRun `json:"stages,omitempty"`
+}
+
+// stageRun is how a stage went and what it measured: the input bytes it
+// processed and the features in its outputs.
+type stageRun struct {
+	Stage           string    `json:"stage"`
+	Status          string    `json:"status"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Attempts        int       `json:"attempts"`
+	Bytes           int64     `json:"bytes"`
+	Features        int64     `json:"features"`
+}
+
+func newStageRun(stage string, r pipeline.StageResult) stageRun {
+	return stageRun{
+		Stage:           stage,
+		Status:          r.Status,
+		Started:         r.Started,
+		DurationSeconds: r.Duration.Seconds(),
+		Attempts:        r.Attempts,
+		Bytes:           r.Bytes,
+		Features:        r.Features,
+	}
+}
+
+const (
+	runsDefaultPageSize = 50
+	runsMaxPageSize     = 500
+	stageLogMaxTail     = 10000
+)
+
+var (
+	runIDPattern = regexp.MustCompile(`^\d{8}-\d{6}-[0-9a-f]{6}$`)
+	// Stage names are <stage> or <group>/<step>, like analyze/Kärnten
+	stageNamePattern = regexp.MustCompile(`^[\pL\pN_-][\pL\pN_.-]*(/[\pL\pN_-][\pL\pN_.-]*)?$`)
+	runsMutex        sync.Mutex
+)
+
+func runsDir() string {
+	return filepath.Join(config.ProcessingDir, "runs")
+}
+
+// newRunID returns an ID that sorts by start time.
+func newRunID(started time.Time) string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return started.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+func runLogPath(id string) string {
+	return filepath.Join(runsDir(), id+".log")
+}
+
+func runStageLogDir(id string) string {
+	return filepath.Join(runsDir(), id)
+}
+
+// openStageLog opens the log of a stage for appending, so that retries
+// of the run add to it.
+func openStageLog(dir, stage string) (io.WriteCloser, error) {
+	if !stageNamePattern.MatchString(stage) {
+		return nil, fmt.Errorf("invalid stage name %q", stage)
+	}
+	path := filepath.Join(dir, filepath.FromSlash(stage)+".log")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// saveRun writes the run's metadata file.
+func saveRun(run *pipelineRun) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err == nil {
+		path := filepath.Join(runsDir(), run.ID+".json")
+		if err = os.WriteFile(path+".tmp", data, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save run %s: %v", run.ID, err)
+	}
+}
+
+// finishRun records how a run ended and prunes old runs.
+func finishRun(run *pipelineRun, status string, exitCode *int) {
+	now := time.Now().UTC()
+	run.Status = status
+	run.ExitCode = exitCode
+	run.Finished = &now
+	saveRun(run)
+	pruneRuns()
+}
+
+// loadRuns reads all run metadata, newest first.
+func loadRuns() ([]pipelineRun, error) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+	entries, err := os.ReadDir(runsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runs []pipelineRun
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !runIDPattern.MatchString(id) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(runsDir(), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var run pipelineRun
+		if err := json.Unmarshal(data, &run); err != nil {
+			log.Printf("Skipping unreadable run %s: %v", id, err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID > runs[j].ID })
+	return runs, nil
+}
+
+// pruneRuns deletes all but the newest pipeline_run_history runs.
+func pruneRuns() {
+	if config.PipelineRunHistory <= 0 {
+		return
+	}
+	runs, err := loadRuns()
+	if err != nil {
+		log.Printf("Failed to list runs: %v", err)
+		return
+	}
+	if len(runs) <= config.PipelineRunHistory {
+		return
+	}
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+	for _, run := range runs[config.PipelineRunHistory:] {
+		if run.Status == "running" {
+			continue
+		}
+		os.Remove(filepath.Join(runsDir(), run.ID+".json"))
+		os.Remove(runLogPath(run.ID))
+		os.RemoveAll(runStageLogDir(run.ID))
+	}
+}
+
+// initRuns creates the runs directory and marks runs that were still
+// going when the server stopped as interrupted. A run another instance
+// holds the pipeline lock for is left alone.
+func initRuns() error {
+	if err := os.MkdirAll(runsDir(), 0755); err != nil {
+		return err
+	}
+	runs, err := loadRuns()
+	if err != nil {
+		return err
+	}
+	owner, err := pipelineLockOwner()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	if owner != nil && (owner.Stale || owner.Host == host && owner.PID == os.Getpid()) {
+		owner = nil
+	}
+	for i := range runs {
+		if runs[i].Status != "running" {
+			continue
+		}
+		if owner != nil && runs[i].ID == owner.RunID {
+			log.Printf("Run %s is going on at %s (pid %d)", runs[i].ID, owner.Host, owner.PID)
+		} else {
+			log.Printf("Run %s was interrupted by a restart", runs[i].ID)
+			finishRun(&runs[i], "interrupted", nil)
+		}
+	}
+	return nil
+}
+
+// handleListRuns returns runs newest first, optionally filtered by
+// ?pipeline= and ?status=, in pages of ?per_page= runs.
+func handleListRuns(w http.ResponseWriter, r *http.Request) {
+	page, perPage, ok := pageParams(w, r, runsDefaultPageSize, runsMaxPageSize)
+	if !ok {
+		return
+	}
+	runs, err := loadRuns()
+	if err != nil {
+		log.Printf("Failed to list runs: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list runs")
+		return
+	}
+	pipeline, status := r.URL.Query().Get("pipeline"), r.URL.Query().Get("status")
+	matched := []pipelineRun{}
+	for _, run := range runs {
+		if (pipeline != "" && run.Pipeline != pipeline) || (status != "" && run.Status != status) {
+			continue
+		}
+		matched = append(matched, run)
+	}
+
+	total := len(matched)
+	start := min((page-1)*perPage, total)
+	end := min(start+perPage, total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"runs":     matched[start:end],
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+func handleRunLog(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !runIDPattern.MatchString(id) {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(runLogPath(id))
+	if err != nil {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read log file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, id+".log", info.ModTime(), f)
+}
+
+// handleStageLog returns the log of one stage of a run, the stage name
+// with its slash escaped as %2F. ?offset= returns the log from that byte
+// on, for fetching it incrementally, and ?tail= its last lines. The
+// X-Log-Size header holds the size of the whole log, the offset to
+// continue from.
+func handleStageLog(w http.ResponseWriter, r *http.Request) {
+	id, stage := r.PathValue("id"), r.PathValue("stage")
+	if !runIDPattern.MatchString(id) || !stageNamePattern.MatchString(stage) {
+		http.Error(w, "Stage log not found", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if q.Has("offset") && q.Has("tail") {
+		writeJSONError(w, http.StatusBadRequest, "offset and tail cannot be combined")
+		return
+	}
+	offset, tail := int64(0), 0
+	var err error
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil || offset < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+	if v := q.Get("tail"); v != "" {
+		if tail, err = strconv.Atoi(v); err != nil || tail < 1 || tail > stageLogMaxTail {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("tail must be between 1 and %d", stageLogMaxTail))
+			return
+		}
+	}
+
+	f, err := os.Open(filepath.Join(runStageLogDir(id), filepath.FromSlash(stage)+".log"))
+	if err != nil {
+		http.Error(w, "Stage log not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read log file", http.StatusInternalServerError)
+		return
+	}
+	size := info.Size()
+	if tail > 0 {
+		if offset, err = tailOffset(f, size, tail); err != nil {
+			log.Printf("Failed to read stage log %s/%s: %v", id, stage, err)
+			http.Error(w, "Failed to read log file", http.StatusInternalServerError)
+			return
+		}
+	}
+	offset = min(offset, size)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Log-Size", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Length", strconv.FormatInt(size-offset, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, io.NewSectionReader(f, offset, size-offset))
+}
+
+// tailOffset returns where the last n lines of the first size bytes of
+// f start, reading backwards from the end.
+func tailOffset(f *os.File, size int64, n int) (int64, error) {
+	buf := make([]byte, 32*1024)
+	end := size
+	// A trailing newline ends the last line rather than starting a new one
+	if end > 0 {
+		if _, err := f.ReadAt(buf[:1], end-1); err != nil {
+			return 0, err
+		}
+		if buf[0] == '\n' {
+			end--
+		}
+	}
+	for pos := end; pos > 0; {
+		chunk := min(int64(len(buf)), pos)
+		pos -= chunk
+		if _, err := f.ReadAt(buf[:chunk], pos); err != nil {
+			return 0, err
+		}
+		for i := chunk - 1; i >= 0; i-- {
+			if buf[i] == '\n' {
+				if n--; n == 0 {
+					return pos + i + 1, nil
+				}
+			}
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Built-in pipeline scheduler. Schedules come from the config file until
+// they are replaced through PUT /api/schedule; from then on the set in
+// schedule.json wins. The last and next run of every schedule are kept in
+// the same file, so runs missed while the server was down can be noticed
+// on startup.
+
+// Schedule starts a pipeline at the times given by a cron expression.
+type Schedule struct {
+	Name string `json:"name"`
+	// Five-field cron expression or descriptor such as "@daily", in the
+	// server's local time zone
+	Cron     string `json:"cron"`
+	Pipeline string `json:"pipeline"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// Run once on startup if a run was due while the server was down;
+	// otherwise missed runs are skipped
+	CatchUp bool `json:"catch_up,omitempty"`
+}
+
+// scheduleState is what the scheduler remembers about a schedule.
+type scheduleState struct {
+	// Expression the next run was computed from; a changed expression
+	// discards the pending next run
+	Cron       string     `json:"cron"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastResult string     `json:"last_result,omitempty"`
+	NextRun    *time.Time `json:"next_run,omitempty"`
+}
+
+type scheduleFile struct {
+	// nil until schedules are set through the API
+	Schedules []Schedule                `json:"schedules"`
+	State     map[string]*scheduleState `json:"state"`
+}
+
+// Longest the scheduler sleeps, so clock changes are picked up
+const scheduleMaxSleep = time.Minute
+
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+func (s Schedule) validate(pipelines map[string]string) error {
+	if s.Name == "" {
+		return errors.New("schedule name must not be empty")
+	}
+	if _, err := cronParser.Parse(s.Cron); err != nil {
+		return fmt.Errorf("schedule %q: invalid cron expression: %w", s.Name, err)
+	}
+	if _, ok := pipelines[s.Pipeline]; !ok {
+		return fmt.Errorf("schedule %q: unknown pipeline %q", s.Name, s.Pipeline)
+	}
+	return nil
+}
+
+func validateSchedules(list []Schedule, pipelines map[string]string) error {
+	seen := make(map[string]bool)
+	for _, s := range list {
+		if err := s.validate(pipelines); err != nil {
+			return err
+		}
+		if seen[s.Name] {
+			return fmt.Errorf("duplicate schedule name %q", s.Name)
+		}
+		seen[s.Name] = true
+	}
+	return nil
+}
+
+type scheduler struct {
+	mu        sync.Mutex
+	path      string
+	schedules []Schedule
+	// Set once the schedules were replaced through the API
+	fromAPI bool
+	state   map[string]*scheduleState
+	wake    chan struct{}
+}
+
+var pipelineScheduler *scheduler
+
+// startScheduler loads the schedules and their state and starts the
+// scheduling loop. Runs missed during downtime are started right away
+// for schedules with catch_up, and skipped for the others.
+func startScheduler(processingDir string) error {
+	s := &scheduler{
+		path:      filepath.Join(processingDir, "schedule.json"),
+		schedules: config.Schedules,
+		state:     make(map[string]*scheduleState),
+		wake:      make(chan struct{}, 1),
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var file scheduleFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("parsing %s: %w", s.path, err)
+		}
+		if file.Schedules != nil {
+			if err := validateSchedules(file.Schedules, config.Pipelines); err != nil {
+				return fmt.Errorf("%s: %w", s.path, err)
+			}
+			s.schedules = file.Schedules
+			s.fromAPI = true
+		}
+		if file.State != nil {
+			s.state = file.State
+		}
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	for _, sched := range s.schedules {
+		st := s.state[sched.Name]
+		if sched.Disabled || st == nil || st.Cron != sched.Cron || st.NextRun == nil || st.NextRun.After(now) {
+			continue
+		}
+		if sched.CatchUp {
+			log.Printf("Schedule %q missed its run at %s, catching up", sched.Name, st.NextRun.Format(time.RFC3339))
+			due := now
+			st.NextRun = &due
+		} else {
+			log.Printf("Schedule %q missed its run at %s, skipping it", sched.Name, st.NextRun.Format(time.RFC3339))
+			st.NextRun = nil
+		}
+	}
+	s.planLocked(now)
+	err = s.saveLocked()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	pipelineScheduler = s
+	go s.loop()
+	return nil
+}
+
+// planLocked drops the state of removed schedules and computes the next
+// run of schedules that have none.
+func (s *scheduler) planLocked(now time.Time) {
+	state := make(map[string]*scheduleState)
+	for _, sched := range s.schedules {
+		st := s.state[sched.Name]
+		if st == nil {
+			st = &scheduleState{}
+		}
+		if st.Cron != sched.Cron {
+			st.Cron = sched.Cron
+			st.NextRun = nil
+		}
+		if sched.Disabled {
+			st.NextRun = nil
+		} else if st.NextRun == nil {
+			parsed, _ := cronParser.Parse(sched.Cron)
+			next := parsed.Next(now)
+			st.NextRun = &next
+		}
+		state[sched.Name] = st
+	}
+	s.state = state
+}
+
+func (s *scheduler) saveLocked() error {
+	file := scheduleFile{State: s.state}
+	if s.fromAPI {
+		file.Schedules = s.schedules
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *scheduler) loop() {
+	for {
+		s.mu.Lock()
+		sleep := scheduleMaxSleep
+		for _, st := range s.state {
+			if st.NextRun != nil {
+				if d := time.Until(*st.NextRun); d < sleep {
+					sleep = d
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+		s.runDue(time.Now())
+	}
+}
+
+// runDue starts the pipelines of all schedules whose next run has come.
+// A schedule coming due while a pipeline is running skips that run.
+func (s *scheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	var due []Schedule
+	for _, sched := range s.schedules {
+		if st := s.state[sched.Name]; st.NextRun != nil && !st.NextRun.After(now) {
+			due = append(due, sched)
+		}
+	}
+	s.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	results := make(map[string]string)
+	for _, sched := range due {
+		result := "started"
+		run := &pipelineRun{Pipeline: sched.Pipeline, Schedule: sched.Name}
+		err := startPipeline(run, 0)
+		var preflight *preflightError
+		switch {
+		case errors.Is(err, errPipelineRunning):
+			result = "skipped_running"
+		case errors.As(err, &preflight):
+			result = "preflight_failed"
+		case err != nil:
+			result = "error: " + err.Error()
+		}
+		log.Printf("Schedule %q: pipeline %q %s", sched.Name, sched.Pipeline, result)
+		appendAuditLog(auditEntry{
+			Action: "pipeline_start",
+			Params: map[string]interface{}{"pipeline": sched.Pipeline, "schedule": sched.Name, "run": run.ID, "result": result},
+		})
+		results[sched.Name] = result
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, result := range results {
+		// The schedule may have been changed or removed meanwhile
+		st := s.state[name]
+		if st == nil {
+			continue
+		}
+		ran := now
+		st.LastRun = &ran
+		st.LastResult = result
+		st.NextRun = nil
+	}
+	s.planLocked(now)
+	if err := s.saveLocked(); err != nil {
+		log.Printf("Failed to save schedule state: %v", err)
+	}
+}
+
+type scheduleView struct {
+	Schedule
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastResult string     `json:"last_result,omitempty"`
+	NextRun    *time.Time `json:"next_run,omitempty"`
+}
+
+func (s *scheduler) view() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]scheduleView, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		v := scheduleView{Schedule: sched}
+		if st := s.state[sched.Name]; st != nil {
+			v.LastRun, v.LastResult, v.NextRun = st.LastRun, st.LastResult, st.NextRun
+		}
+		list = append(list, v)
+	}
+	zone, _ := time.Now().Zone()
+	return map[string]interface{}{
+		"schedules": list,
+		"timezone":  zone,
+	}
+}
+
+func handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pipelineScheduler.view())
+}
+
+// handlePutSchedule replaces all schedules. Schedules keeping their name
+// and expression keep their pending next run.
+func handlePutSchedule(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Schedules []Schedule `json:"schedules"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Schedules == nil {
+		req.Schedules = []Schedule{}
+	}
+	if err := validateSchedules(req.Schedules, config.Pipelines); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s := pipelineScheduler
+	s.mu.Lock()
+	s.schedules = req.Schedules
+	s.fromAPI = true
+	s.planLocked(time.Now())
+	err := s.saveLocked()
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to save schedules: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to save schedules")
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	names := make([]string, len(req.Schedules))
+	for i, sched := range req.Schedules {
+		names[i] = sched.Name
+	}
+	audit(r, "schedule_update", "", map[string]interface{}{"schedules": names})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.view())
+}
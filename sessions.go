@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Length of the token prefix that identifies a session in the admin API;
+// the full token is never shown.
+const sessionIDLength = 8
+
+type sessionView struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Provider string    `json:"provider,omitempty"`
+	IP       string    `json:"ip"`
+	Created  time.Time `json:"created_at"`
+	Expiry   time.Time `json:"expires_at"`
+	Remember bool      `json:"remember"`
+	Current  bool      `json:"current"`
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	current := ""
+	if cookie, err := r.Cookie("session"); err == nil {
+		current = cookie.Value
+	}
+
+	views := []sessionView{}
+	sessionMutex.RLock()
+	for token, sess := range sessions {
+		if !sessionActive(sess) {
+			continue
+		}
+		views = append(views, sessionView{
+			ID:       token[:sessionIDLength],
+			Username: sess.Username,
+			Provider: sess.Provider,
+			IP:       sess.IP,
+			Created:  sess.Created,
+			Expiry:   sessionExpiresAt(sess),
+			Remember: sess.Remember,
+			Current:  token == current,
+		})
+	}
+	sessionMutex.RUnlock()
+	sort.Slice(views, func(i, j int) bool { return views[i].Created.After(views[j].Created) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// handleRevokeSession ends the session whose token starts with the given
+// ID.
+func handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if len(id) != sessionIDLength {
+		writeJSONError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	// The admin may be revoking their own session
+	actor, _ := authenticate(r)
+
+	sessionMutex.Lock()
+	var matches []string
+	for token := range sessions {
+		if strings.HasPrefix(token, id) {
+			matches = append(matches, token)
+		}
+	}
+	var username string
+	if len(matches) == 1 {
+		username = sessions[matches[0]].Username
+		delete(sessions, matches[0])
+	}
+	sessionMutex.Unlock()
+
+	switch len(matches) {
+	case 0:
+		writeJSONError(w, http.StatusNotFound, "session not found")
+	case 1:
+		log.Printf("Revoked session %s... of user %s", id, username)
+		audit(r, "session_revoked", actor.User.Username, map[string]interface{}{"session": id, "session_user": username})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusConflict, "session ID is ambiguous")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Shapefile exports: ogr2ogr writes the .shp/.shx/.dbf/.prj/.cpg set,
+// which is zipped. dBASE limits field names to 10 characters, so most
+// yearly columns get shortened; the zip then has a fields.csv mapping
+// the original column names to the ones in the .dbf.
+
+const shapefileBase = "holzeinschlag_austria"
+
+var shapefileParts = []string{".shp", ".shx", ".dbf", ".prj", ".cpg"}
+
+func convertShapefile(src, dst string, opts exportOptions) ([]string, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(dst), "shp_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runOgr2ogr("-f", "ESRI Shapefile", filepath.Join(dir, shapefileBase+".shp"), src, "gemeinden", "-lco", "ENCODING=UTF-8"); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, ext := range shapefileParts {
+		if _, err := os.Stat(filepath.Join(dir, shapefileBase+ext)); err == nil {
+			names = append(names, shapefileBase+ext)
+		}
+	}
+
+	var warnings []string
+	renamed, err := truncatedFields(src, filepath.Join(dir, shapefileBase+".dbf"))
+	if err != nil {
+		return nil, err
+	}
+	if len(renamed) > 0 {
+		if err := writeFieldMapping(filepath.Join(dir, "fields.csv"), renamed); err != nil {
+			return nil, err
+		}
+		names = append(names, "fields.csv")
+		warnings = append(warnings, fmt.Sprintf("%d field names truncated to 10 characters, see fields.csv", len(renamed)))
+	}
+	return warnings, writeZip(dst, dir, names)
+}
+
+// truncatedFields pairs the attribute columns of the GeoPackage export
+// with the fields of the .dbf written from it, which keep their order,
+// and returns the pairs whose names differ.
+func truncatedFields(gpkgPath, dbfPath string) ([][2]string, error) {
+	db, err := openDB(gpkgPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT name FROM pragma_table_info('gemeinden') WHERE pk = 0 AND name != 'geom' ORDER BY cid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fields, err := dbfFieldNames(dbfPath)
+	if err != nil {
+		return nil, err
+	}
+	var renamed [][2]string
+	for i := 0; i < len(columns) && i < len(fields); i++ {
+		if columns[i] != fields[i] {
+			renamed = append(renamed, [2]string{columns[i], fields[i]})
+		}
+	}
+	return renamed, nil
+}
+
+// dbfFieldNames reads the field names from the header of a dBASE file:
+// 32-byte descriptors after the 32-byte file header, up to a 0x0D.
+func dbfFieldNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filepath.Base(path), err)
+	}
+	headerLen := int(binary.LittleEndian.Uint16(header[8:10]))
+	if headerLen < 33 {
+		return nil, errors.New("invalid dBASE header")
+	}
+	descriptors := make([]byte, headerLen-32)
+	if _, err := io.ReadFull(f, descriptors); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filepath.Base(path), err)
+	}
+	var names []string
+	for i := 0; i+32 <= len(descriptors) && descriptors[i] != 0x0D; i += 32 {
+		name, _, _ := strings.Cut(string(descriptors[i:i+11]), "\x00")
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func writeFieldMapping(path string, renamed [][2]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cw := csv.NewWriter(f)
+	cw.Write([]string{"column", "shapefile_field"})
+	for _, pair := range renamed {
+		cw.Write(pair[:])
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
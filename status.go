@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"holzeinschlag-austria/pipeline"
+)
+
+// Pipeline status owned by the server. During a run the pipeline reports
+// progress as lines written to the file descriptor named in
+// PIPELINE_STATUS_FD:
+//
+//	stage <stage> <status> [message]
+//	step <stage>/<step> <status> <percent> [message]
+//	artifact <path>
+//	metric bytes|features <count>
+//
+// where status is running, complete, skipped or error. The server folds
+// them into the document served by /api/status and kept in status.json.
+// Stages without stage lines take their status from their steps.
+// Artifact lines name output files, absolute or relative to the processing
+// directory; they are registered once the run succeeds. Metric lines add
+// to the input bytes and output features of the stage of a built-in
+// pipeline the program runs for, named in PIPELINE_STAGE.
+
+const (
+	// The first of cmd.ExtraFiles becomes descriptor 3 in the child
+	statusFD = 3
+	// How long lines still in the pipe are read after the pipeline exits
+	statusPipeDrain = time.Second
+)
+
+// Output lines kept in the status of a failed run
+const statusLogTailLines = 20
+
+var stepStatuses = map[string]bool{"running": true, "complete": true, "skipped": true, "error": true}
+
+type pipelineStatus struct {
+	// "running", "retrying", "success", "failed", "cancelled",
+	// "timed_out", "preflight_failed" or "postflight_failed"
+	Status   string         `json:"status"`
+	RunID    string         `json:"run_id,omitempty"`
+	Pipeline string         `json:"pipeline,omitempty"`
+	Started  *time.Time     `json:"started,omitempty"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	ExitCode *int           `json:"exit_code,omitempty"`
+	Stages   []*stageStatus `json:"stages"`
+	// What went wrong, with the last lines of output
+	Error   string   `json:"error,omitempty"`
+	LogTail []string `json:"log_tail,omitempty"`
+	// Current attempt under the retry policy, and when a run waiting to
+	// be retried ("retrying") continues
+	Attempt int        `json:"attempt"`
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+type stageStatus struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Progress float64       `json:"progress"`
+	Message  string        `json:"message,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Started  *time.Time    `json:"started,omitempty"`
+	Finished *time.Time    `json:"finished,omitempty"`
+	Steps    []*stepStatus `json:"steps"`
+	// Status was set by a stage line rather than derived from the steps
+	explicit bool
+}
+
+type stepStatus struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"`
+	Progress float64    `json:"progress"`
+	Message  string     `json:"message,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Progress at the time the step started, for the ETA estimate
+	startProgress float64
+}
+
+type statusTracker struct {
+	mu  sync.Mutex
+	doc *pipelineStatus
+	// Outputs reported by the current run
+	artifacts []string
+}
+
+var pipelineStatusTracker = &statusTracker{}
+
+// begin resets the status document for a new run.
+func (t *statusTracker) begin(run *pipelineRun) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	started := run.Started
+	t.doc = &pipelineStatus{
+		Status:   "running",
+		RunID:    run.ID,
+		Pipeline: run.Pipeline,
+		Started:  &started,
+		Stages:   []*stageStatus{},
+		Attempt:  1,
+	}
+	t.artifacts = nil
+	t.saveLocked()
+}
+
+// reportedArtifacts returns the outputs run runID reported, without
+// duplicates.
+func (t *statusTracker) reportedArtifacts(runID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doc == nil || t.doc.RunID != runID {
+		return nil
+	}
+	paths := slices.Clone(t.artifacts)
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// retrying records that an attempt failed and the run continues at
+// retryAt.
+func (t *statusTracker) retrying(attempt int, retryAt time.Time, errMsg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doc == nil {
+		return
+	}
+	t.doc.Status = "retrying"
+	t.doc.Attempt = attempt
+	t.doc.RetryAt = &retryAt
+	t.doc.Error = errMsg
+	t.saveLocked()
+}
+
+// resume starts the next attempt.
+func (t *statusTracker) resume(attempt int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doc == nil {
+		return
+	}
+	t.doc.Status = "running"
+	t.doc.Attempt = attempt
+	t.doc.RetryAt = nil
+	t.doc.Error = ""
+	t.saveLocked()
+}
+
+// end records how the run ended. Stages and steps still running are
+// marked with the outcome.
+func (t *statusTracker) end(status string, exitCode *int, errMsg string, logTail []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doc == nil {
+		return
+	}
+	now := time.Now().UTC()
+	left := "error"
+	if status == "cancelled" {
+		left = "cancelled"
+	}
+	for _, stage := range t.doc.Stages {
+		for _, step := range stage.Steps {
+			if step.Status == "running" {
+				step.Status = left
+				step.Finished = &now
+			}
+		}
+		if stage.Status == "running" {
+			stage.Status = left
+			stage.Finished = &now
+		}
+	}
+	t.doc.Status = status
+	t.doc.ExitCode = exitCode
+	t.doc.Finished = &now
+	t.doc.RetryAt = nil
+	t.doc.Error = errMsg
+	t.doc.LogTail = logTail
+	t.saveLocked()
+}
+
+// fail changes the status of the finished run, for a failing post-flight
+// hook.
+func (t *statusTracker) fail(status, errMsg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doc == nil {
+		return
+	}
+	t.doc.Status = status
+	t.doc.Error = errMsg
+	t.saveLocked()
+}
+
+// apply folds one protocol line into the document and broadcasts the
+// change as a progress event.
+func (t *statusTracker) apply(line string) error {
+	if path, ok := strings.CutPrefix(line, "artifact "); ok {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			return fmt.Errorf("missing path")
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.doc == nil {
+			return fmt.Errorf("no run in progress")
+		}
+		t.artifacts = append(t.artifacts, path)
+		return nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return fmt.Errorf("too few fields")
+	}
+	kind, name, status := fields[0], fields[1], fields[2]
+	if !stepStatuses[status] {
+		return fmt.Errorf("unknown status %q", status)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doc == nil {
+		return fmt.Errorf("no run in progress")
+	}
+	now := time.Now().UTC()
+	ev := progressEvent{Type: "progress", Status: status}
+
+	switch kind {
+	case "stage":
+		stage := t.stageLocked(name, now)
+		stage.explicit = true
+		stage.Status = status
+		stage.Message = strings.Join(fields[3:], " ")
+		if status == "error" {
+			stage.Error = stage.Message
+		}
+		if status == "complete" || status == "skipped" {
+			stage.Progress = 100
+		}
+		if status != "running" && stage.Finished == nil {
+			stage.Finished = &now
+		}
+		ev.Stage, ev.Percent, ev.Message = stage.Name, stage.Progress, stage.Message
+
+	case "step":
+		stageName, stepName, ok := strings.Cut(name, "/")
+		if !ok || stageName == "" || stepName == "" {
+			return fmt.Errorf("step %q is not <stage>/<step>", name)
+		}
+		if len(fields) < 4 {
+			return fmt.Errorf("missing percent")
+		}
+		percent, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return fmt.Errorf("invalid percent %q", fields[3])
+		}
+		stage := t.stageLocked(stageName, now)
+		step := stageStep(stage, stepName, now, percent)
+		step.Status = status
+		step.Progress = percent
+		step.Message = strings.Join(fields[4:], " ")
+		step.Error = ""
+		if status == "error" {
+			step.Error = step.Message
+		}
+		if status == "running" {
+			step.Finished = nil
+		} else if step.Finished == nil {
+			step.Finished = &now
+		}
+		refreshStage(stage, now)
+
+		ev.Stage, ev.Step, ev.Percent, ev.Message = stageName, stepName, percent, step.Message
+		if done := percent - step.startProgress; status == "running" && done > 0 && percent < 100 {
+			eta := int(now.Sub(*step.Started).Seconds() * (100 - percent) / done)
+			ev.ETASeconds = &eta
+		}
+
+	default:
+		return fmt.Errorf("unknown line type %q", kind)
+	}
+
+	t.saveLocked()
+	pipelineProgress.broadcast(ev)
+	return nil
+}
+
+func (t *statusTracker) stageLocked(name string, now time.Time) *stageStatus {
+	for _, stage := range t.doc.Stages {
+		if stage.Name == name {
+			return stage
+		}
+	}
+	stage := &stageStatus{Name: name, Status: "running", Started: &now, Steps: []*stepStatus{}}
+	t.doc.Stages = append(t.doc.Stages, stage)
+	return stage
+}
+
+func stageStep(stage *stageStatus, name string, now time.Time, percent float64) *stepStatus {
+	for _, step := range stage.Steps {
+		if step.Name == name {
+			return step
+		}
+	}
+	step := &stepStatus{Name: name, Started: &now, startProgress: percent}
+	stage.Steps = append(stage.Steps, step)
+	return step
+}
+
+// refreshStage derives a stage's progress, and its status unless a stage
+// line set it, from its steps.
+func refreshStage(stage *stageStatus, now time.Time) {
+	total, done := 0.0, true
+	failed := ""
+	for _, step := range stage.Steps {
+		switch step.Status {
+		case "complete", "skipped":
+			total += 100
+		case "error":
+			failed = step.Name + ": " + step.Error
+		default:
+			total += step.Progress
+			done = false
+		}
+	}
+	stage.Progress = total / float64(len(stage.Steps))
+	if stage.explicit {
+		return
+	}
+	switch {
+	case failed != "":
+		stage.Status, stage.Error = "error", failed
+	case done:
+		stage.Status, stage.Error = "complete", ""
+	default:
+		stage.Status, stage.Error = "running", ""
+	}
+	if stage.Status == "running" {
+		stage.Finished = nil
+	} else if stage.Finished == nil {
+		stage.Finished = &now
+	}
+}
+
+// saveLocked writes the document to status.json for /api/status after a
+// restart.
+func (t *statusTracker) saveLocked() {
+	data, err := json.MarshalIndent(t.doc, "", "  ")
+	if err == nil {
+		path := filepath.Join(config.ProcessingDir, "status.json")
+		if err = os.WriteFile(path+".tmp", data, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write status.json: %v", err)
+	}
+}
+
+func (t *statusTracker) snapshot() ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doc == nil {
+		return nil, false
+	}
+	data, err := json.Marshal(t.doc)
+	return data, err == nil
+}
+
+// failure returns the first stage that failed in run runID and the
+// run's error, as far as they are known.
+func (t *statusTracker) failure(runID string) (stage, errMsg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doc == nil || t.doc.RunID != runID {
+		return "", ""
+	}
+	for _, s := range t.doc.Stages {
+		if s.Status == "error" {
+			stage = s.Name
+			break
+		}
+	}
+	return stage, t.doc.Error
+}
+
+// statusReporter feeds the progress of built-in pipelines to the tracker,
+// and finished stages to finished.
+type statusReporter struct {
+	finished func(stage string, result pipeline.StageResult)
+}
+
+func (statusReporter) Stage(stage, status, message string) {
+	pipelineStatusTracker.report(fmt.Sprintf("stage %s %s %s", stage, status, message))
+}
+
+func (statusReporter) Step(stage, step, status string, percent float64, message string) {
+	pipelineStatusTracker.report(fmt.Sprintf("step %s/%s %s %g %s", stage, step, status, percent, message))
+}
+
+func (statusReporter) Artifact(path string) {
+	pipelineStatusTracker.report("artifact " + path)
+}
+
+func (r statusReporter) Finished(stage string, result pipeline.StageResult) {
+	if r.finished != nil {
+		r.finished(stage, result)
+	}
+}
+
+func (t *statusTracker) report(line string) {
+	if err := t.apply(line); err != nil {
+		log.Printf("Ignoring status line %q: %v", line, err)
+	}
+}
+
+// readStatusPipe applies every line the pipeline writes to the status
+// pipe until it is closed. Metric lines go to measure, and are dropped
+// without it.
+func readStatusPipe(f *os.File, measure func(bytes, features int64)) {
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		metric, ok := strings.CutPrefix(line, "metric ")
+		if !ok {
+			pipelineStatusTracker.report(line)
+			continue
+		}
+		if measure == nil {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimSpace(metric), " ")
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		switch {
+		case err != nil:
+			log.Printf("Ignoring status line %q: invalid count", line)
+		case name == "bytes":
+			measure(n, 0)
+		case name == "features":
+			measure(0, n)
+		default:
+			log.Printf("Ignoring status line %q: unknown metric", line)
+		}
+	}
+}
+
+// runWithStatusPipe runs cmd with the write end of a status pipe as
+// statusFD and applies the lines read from it. Children outliving cmd
+// and keeping the pipe open are not waited for.
+func runWithStatusPipe(cmd *exec.Cmd, measure func(bytes, features int64)) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(cmd.Environ(), fmt.Sprintf("PIPELINE_STATUS_FD=%d", statusFD))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readStatusPipe(r, measure)
+	}()
+
+	err = cmd.Start()
+	w.Close()
+	if err == nil {
+		err = cmd.Wait()
+	}
+	select {
+	case <-done:
+	case <-time.After(statusPipeDrain):
+		r.Close()
+		<-done
+	}
+	return err
+}
+
+// handleStatus serves the status of the current or last run. Before the
+// first run since startup it falls back to status.json.
+// handleStatus returns the status document, with the holder of the
+// pipeline lock, which may be another instance, as "lock" and the Hansen
+// releases processed and available as "upstream".
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	owner, err := pipelineLockOwner()
+	if err != nil {
+		log.Printf("Failed to read pipeline lock: %v", err)
+	}
+	doc := map[string]interface{}{}
+	data, ok := pipelineStatusTracker.snapshot()
+	if !ok {
+		data, err = os.ReadFile(filepath.Join(config.ProcessingDir, "status.json"))
+		if err != nil {
+			data = nil
+			doc["status"] = "not_started"
+			doc["message"] = "Processing pipeline has not been run yet"
+		}
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			log.Printf("Failed to parse status document: %v", err)
+		}
+	}
+	doc["lock"] = owner
+	if upstream, err := loadUpstreamState(); err == nil {
+		doc["upstream"] = upstream
+	} else {
+		log.Printf("Failed to load upstream state: %v", err)
+	}
+	json.NewEncoder(w).Encode(doc)
+}
+
+// lastLines returns up to n trailing lines of text.
+func lastLines(text string, n int) []string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	return lines[max(0, len(lines)-n):]
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The summary holds national totals and the spread of each indicator
+// per year. It is built when data is published and kept until the
+// GeoPackage changes; accounts with a data scope get a summary of their
+// Gemeinden, built for each request.
+
+// Gemeinden listed at each end of an indicator's ranking
+const summaryTopCount = 5
+
+type summaryGemeinde struct {
+	ISO   string  `json:"iso"`
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// indicatorSummary is an indicator in one year over all Gemeinden with a
+// value. Per-capita indicators have no total.
+type indicatorSummary struct {
+	Total  *float64          `json:"total"`
+	Min    float64           `json:"min"`
+	Max    float64           `json:"max"`
+	Median float64           `json:"median"`
+	Top    []summaryGemeinde `json:"top"`
+	Bottom []summaryGemeinde `json:"bottom"`
+}
+
+type datasetSummary struct {
+	// Modification time of the GeoPackage summarized
+	Version    string                                 `json:"version"`
+	Generated  time.Time                              `json:"generated"`
+	Gemeinden  int                                    `json:"gemeinden"`
+	Population int64                                  `json:"population"`
+	Years      map[string]map[string]indicatorSummary `json:"years"`
+}
+
+var (
+	nationalSummaryCache *datasetSummary
+	summaryMutex         sync.Mutex
+)
+
+func datasetVersion() (string, error) {
+	info, err := os.Stat(geoPackagePath())
+	if err != nil {
+		return "", err
+	}
+	return info.ModTime().UTC().Format(time.RFC3339Nano), nil
+}
+
+// nationalSummary returns the summary of all Gemeinden, building it if
+// the GeoPackage changed since.
+func nationalSummary() (*datasetSummary, error) {
+	summaryMutex.Lock()
+	defer summaryMutex.Unlock()
+	version, err := datasetVersion()
+	if err != nil {
+		return nil, err
+	}
+	if nationalSummaryCache != nil && nationalSummaryCache.Version == version {
+		return nationalSummaryCache, nil
+	}
+	s, err := buildSummary("", version)
+	if err != nil {
+		return nil, err
+	}
+	nationalSummaryCache = s
+	return s, nil
+}
+
+// buildSummary summarizes the Gemeinden of scopeCond, all if empty, in
+// the given version of the dataset. Wien as a whole is left out, as in
+// aggregates.
+func buildSummary(scopeCond, version string) (*datasetSummary, error) {
+	years, err := datasetYears()
+	if err != nil {
+		return nil, err
+	}
+	columns := []string{"iso", "name", "population"}
+	for _, year := range years {
+		for _, indicator := range indicators {
+			columns = append(columns, indicator+"_"+year)
+		}
+	}
+	where := "iso <> '" + wienWhole + "'"
+	if scopeCond != "" {
+		where += " AND " + scopeCond
+	}
+	rows, err := gpkgDB().Query(fmt.Sprintf("SELECT %s FROM gemeinden WHERE %s", quoteIdentifiers(columns), where))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	s := &datasetSummary{Version: version, Generated: time.Now().UTC().Truncate(time.Second), Years: make(map[string]map[string]indicatorSummary, len(years))}
+	// Values of each column, in the order of columns[3:]
+	values := make([][]summaryGemeinde, len(columns)-3)
+	for rows.Next() {
+		var iso, name string
+		var population sql.NullInt64
+		row := make([]sql.NullFloat64, len(values))
+		dest := []interface{}{&iso, &name, &population}
+		for i := range row {
+			dest = append(dest, &row[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		s.Gemeinden++
+		s.Population += population.Int64
+		for i, v := range row {
+			if v.Valid {
+				values[i] = append(values[i], summaryGemeinde{ISO: iso, Name: name, Value: v.Float64})
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for y, year := range years {
+		s.Years[year] = make(map[string]indicatorSummary, len(indicators))
+		for i, indicator := range indicators {
+			column := values[y*len(indicators)+i]
+			if len(column) == 0 {
+				continue
+			}
+			s.Years[year][indicator] = summarizeIndicator(column, !strings.HasSuffix(indicator, "_per_capita"))
+		}
+	}
+	return s, nil
+}
+
+// summarizeIndicator ranks the values of an indicator, highest first.
+func summarizeIndicator(values []summaryGemeinde, additive bool) indicatorSummary {
+	sort.SliceStable(values, func(i, j int) bool { return values[i].Value > values[j].Value })
+	n := len(values)
+	var stats indicatorSummary
+	if additive {
+		var total float64
+		for _, v := range values {
+			total += v.Value
+		}
+		stats.Total = roundDerived(total)
+	}
+	stats.Max = values[0].Value
+	stats.Min = values[n-1].Value
+	stats.Median = values[n/2].Value
+	if n%2 == 0 {
+		stats.Median = *roundDerived((values[n/2-1].Value + values[n/2].Value) / 2)
+	}
+	stats.Top = slices.Clone(values[:min(summaryTopCount, n)])
+	stats.Bottom = slices.Clone(values[max(n-summaryTopCount, 0):])
+	slices.Reverse(stats.Bottom)
+	return stats
+}
+
+// handleSummary returns the summary of the caller's Gemeinden, only the
+// given year with ?year=.
+func handleSummary(w http.ResponseWriter, r *http.Request) {
+	var s *datasetSummary
+	var err error
+	if cond := dataScopeCondition(r); cond != "" {
+		var version string
+		if version, err = datasetVersion(); err == nil {
+			s, err = buildSummary(cond, version)
+		}
+	} else {
+		s, err = nationalSummary()
+	}
+	if err != nil {
+		log.Printf("Building summary failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to build summary")
+		return
+	}
+	if year := r.URL.Query().Get("year"); year != "" {
+		stats, ok := s.Years[year]
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("no data for year %q", year))
+			return
+		}
+		one := *s
+		one.Years = map[string]map[string]indicatorSummary{year: stats}
+		s = &one
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// Resource limits for pipeline processes, so a run doesn't starve the
+// HTTP handlers: CPU and I/O priority through nice and ionice, thread
+// pools of the numerical libraries, and optionally a cgroup set up by the
+// administrator with CPU and memory limits.
+
+// Environment variables sizing the thread pools of GDAL, numpy and the
+// BLAS libraries behind it
+var threadLimitVars = []string{
+	"GDAL_NUM_THREADS", "OMP_NUM_THREADS", "OPENBLAS_NUM_THREADS", "MKL_NUM_THREADS", "NUMEXPR_NUM_THREADS",
+}
+
+// File descriptor of pipeline_cgroup, open for the server's lifetime; -1
+// without one
+var pipelineCgroupFD = -1
+
+func validateThrottle(c Config) error {
+	if c.PipelineNice < 0 || c.PipelineNice > 19 {
+		return errors.New("pipeline_nice must be between 0 and 19")
+	}
+	switch c.PipelineIOClass {
+	case "", "idle":
+	case "best-effort":
+		if c.PipelineIOLevel < 0 || c.PipelineIOLevel > 7 {
+			return errors.New("pipeline_io_level must be between 0 and 7")
+		}
+	default:
+		return fmt.Errorf("pipeline_io_class must be best-effort, idle or empty, got %q", c.PipelineIOClass)
+	}
+	if c.PipelineThreads < 0 {
+		return errors.New("pipeline_threads must not be negative")
+	}
+	return nil
+}
+
+// openPipelineCgroup opens pipeline_cgroup, which must be a cgroup v2
+// directory the server may move processes into.
+func openPipelineCgroup() error {
+	if config.PipelineCgroup == "" {
+		return nil
+	}
+	if !cgroupsSupported {
+		return errors.New("pipeline_cgroup is only supported on Linux")
+	}
+	if _, err := os.Stat(filepath.Join(config.PipelineCgroup, "cgroup.procs")); err != nil {
+		return fmt.Errorf("pipeline_cgroup %q is not a cgroup v2 directory: %w", config.PipelineCgroup, err)
+	}
+	f, err := os.Open(config.PipelineCgroup)
+	if err != nil {
+		return err
+	}
+	// Kept open; the descriptor is passed to every pipeline process
+	pipelineCgroupFD = int(f.Fd())
+	return nil
+}
+
+// throttleArgs prefixes a pipeline command with nice and ionice as
+// configured. Both exec the command in place, so it keeps its PID and
+// process group.
+func throttleArgs(name string, args []string) (string, []string) {
+	var prefix []string
+	if config.PipelineNice > 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(config.PipelineNice))
+	}
+	switch config.PipelineIOClass {
+	case "idle":
+		prefix = append(prefix, "ionice", "-c", "3")
+	case "best-effort":
+		prefix = append(prefix, "ionice", "-c", "2", "-n", strconv.Itoa(config.PipelineIOLevel))
+	}
+	if len(prefix) == 0 {
+		return name, args
+	}
+	if _, err := exec.LookPath(prefix[0]); err != nil {
+		log.Printf("Not throttling pipeline command: %v", err)
+		return name, args
+	}
+	return prefix[0], append(append(prefix[1:], name), args...)
+}
+
+// throttleCommand applies the thread limit and the cgroup to cmd.
+func throttleCommand(cmd *exec.Cmd) {
+	if config.PipelineThreads > 0 {
+		env := cmd.Environ()
+		for _, v := range threadLimitVars {
+			env = append(env, v+"="+strconv.Itoa(config.PipelineThreads))
+		}
+		cmd.Env = env
+	}
+	if pipelineCgroupFD >= 0 {
+		setCgroup(cmd, pipelineCgroupFD)
+	}
+}
+
+// pausedDuringPipeline answers 503 while a pipeline runs, if
+// pause_exports_during_pipeline is set, so heavy exports don't compete
+// with it.
+func pausedDuringPipeline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.PauseExportsDuringPipeline && isPipelineRunning() {
+			w.Header().Set("Retry-After", "300")
+			http.Error(w, "Exports are paused while the processing pipeline runs", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
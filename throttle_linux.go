@@ -0,0 +1,11 @@
+package main
+
+import "os/exec"
+
+const cgroupsSupported = true
+
+// setCgroup has cmd start in the cgroup open as fd.
+func setCgroup(cmd *exec.Cmd, fd int) {
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+}
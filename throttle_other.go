@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+const cgroupsSupported = false
+
+func setCgroup(cmd *exec.Cmd, fd int) {}
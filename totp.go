@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// TOTP as in RFC 6238 with the parameters every authenticator app
+// supports: HMAC-SHA1, 6 digits, 30 second steps.
+const (
+	totpIssuer = "Holzeinschlag Österreich"
+	totpPeriod = 30
+	totpDigits = 6
+	// Accepted clock drift, in steps either side of now
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	// How long an unconfirmed enrollment and a half-finished login are kept
+	totpEnrollTimeout = 10 * time.Minute
+	totpLoginTimeout  = 5 * time.Minute
+	// Wrong codes before a pending login has to start over with the password
+	totpLoginMaxTries = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type totpEnrollment struct {
+	Secret string
+	Expiry time.Time
+}
+
+// pendingLogin is a password login waiting for its second factor.
+type pendingLogin struct {
+	Username string
+	Next     string
+	Remember bool
+	Expiry   time.Time
+	Tries    int
+}
+
+var (
+	totpMutex       sync.Mutex
+	totpEnrollments = make(map[string]totpEnrollment)
+	pendingLogins   = make(map[string]*pendingLogin)
+	// Last accepted time step per user, so a code can't be replayed
+	totpLastStep = make(map[string]int64)
+)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpMatch returns the time step code is valid for, or false.
+func totpMatch(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(key) == 0 || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// verifyTOTP checks a code against the user's secret and burns its time
+// step.
+func verifyTOTP(username, secret, code string) bool {
+	step, ok := totpMatch(secret, code, time.Now())
+	if !ok {
+		return false
+	}
+	totpMutex.Lock()
+	defer totpMutex.Unlock()
+	if step <= totpLastStep[username] {
+		return false
+	}
+	totpLastStep[username] = step
+	return true
+}
+
+func totpURL(username, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns codes to show the user once, and the hashes
+// to store.
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		rand.Read(b)
+		h := hex.EncodeToString(b)
+		code := h[:5] + "-" + h[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery
+// code, which is used up.
+func checkSecondFactor(user User, code string) bool {
+	code = strings.TrimSpace(code)
+	if verifyTOTP(user.Username, user.TOTPSecret, strings.ReplaceAll(code, " ", "")) {
+		return true
+	}
+	hash := hashRecoveryCode(code)
+	matches := func(h string) bool { return subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 }
+	found := false
+	for _, h := range user.RecoveryCodes {
+		found = found || matches(h)
+	}
+	if !found {
+		return false
+	}
+
+	used := false
+	err := users.Update(user.Username, func(u *User) {
+		for i, h := range u.RecoveryCodes {
+			if matches(h) {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+				used = true
+				return
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to save user %q after using a recovery code: %v", user.Username, err)
+		return false
+	}
+	if used {
+		log.Printf("event=recovery_code_used user=%q remaining=%d", user.Username, len(user.RecoveryCodes)-1)
+	}
+	return used
+}
+
+// accountUser returns the session user for the /api/account endpoints.
+// Accounts of external providers manage their second factor there.
+func accountUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	user, ok := sessionUser(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "login required")
+		return User{}, false
+	}
+	if user.Provider != "" {
+		writeJSONError(w, http.StatusBadRequest, "account is managed by the identity provider")
+		return User{}, false
+	}
+	return user, true
+}
+
+// readCode decodes a {"code": "..."} request body.
+func readCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+		} else {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		}
+		return "", false
+	}
+	return body.Code, true
+}
+
+// handleTOTPEnroll starts an enrollment with a fresh secret. It only takes
+// effect once a code from it is confirmed.
+func handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	user, ok := accountUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPSecret != "" {
+		writeJSONError(w, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+	secret := newTOTPSecret()
+	totpMutex.Lock()
+	totpEnrollments[user.Username] = totpEnrollment{Secret: secret, Expiry: time.Now().Add(totpEnrollTimeout)}
+	totpMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":      secret,
+		"otpauth_url": totpURL(user.Username, secret),
+		"qr_code":     "/api/account/totp/qr",
+	})
+}
+
+func pendingEnrollment(username string) (string, bool) {
+	totpMutex.Lock()
+	defer totpMutex.Unlock()
+	e, ok := totpEnrollments[username]
+	if !ok || time.Now().After(e.Expiry) {
+		delete(totpEnrollments, username)
+		return "", false
+	}
+	return e.Secret, true
+}
+
+// handleTOTPQR renders the pending enrollment as a QR code for
+// authenticator apps.
+func handleTOTPQR(w http.ResponseWriter, r *http.Request) {
+	user, ok := accountUser(w, r)
+	if !ok {
+		return
+	}
+	secret, ok := pendingEnrollment(user.Username)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no enrollment in progress")
+		return
+	}
+	png, err := qrcode.Encode(totpURL(user.Username, secret), qrcode.Medium, 256)
+	if err != nil {
+		log.Printf("Failed to render TOTP QR code: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to render QR code")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// handleTOTPConfirm enables two-factor login once the user proves their
+// app produces valid codes, and hands out the recovery codes.
+func handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	user, ok := accountUser(w, r)
+	if !ok {
+		return
+	}
+	code, ok := readCode(w, r)
+	if !ok {
+		return
+	}
+	secret, ok := pendingEnrollment(user.Username)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no enrollment in progress")
+		return
+	}
+	if !verifyTOTP(user.Username, secret, strings.TrimSpace(code)) {
+		writeJSONError(w, http.StatusBadRequest, "invalid code")
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	if err := users.Update(user.Username, func(u *User) {
+		u.TOTPSecret = secret
+		u.RecoveryCodes = hashes
+	}); err != nil {
+		log.Printf("Failed to save TOTP secret for %q: %v", user.Username, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to save user")
+		return
+	}
+	totpMutex.Lock()
+	delete(totpEnrollments, user.Username)
+	totpMutex.Unlock()
+	log.Printf("event=totp_enabled user=%q", user.Username)
+	audit(r, "totp_enabled", "", nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// handleTOTPDisable turns two-factor login off; it takes a current code
+// or a recovery code.
+func handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	user, ok := accountUser(w, r)
+	if !ok {
+		return
+	}
+	code, ok := readCode(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPSecret == "" {
+		writeJSONError(w, http.StatusConflict, "two-factor authentication is not enabled")
+		return
+	}
+	if !checkSecondFactor(user, code) {
+		writeJSONError(w, http.StatusBadRequest, "invalid code")
+		return
+	}
+	if err := users.Update(user.Username, func(u *User) {
+		u.TOTPSecret = ""
+		u.RecoveryCodes = nil
+	}); err != nil {
+		log.Printf("Failed to save user %q: %v", user.Username, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to save user")
+		return
+	}
+	log.Printf("event=totp_disabled user=%q", user.Username)
+	audit(r, "totp_disabled", "", nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startPendingLogin remembers a correct password login of a user with
+// two-factor enabled, identified by a short-lived cookie.
+func startPendingLogin(w http.ResponseWriter, r *http.Request, user User, next string, remember bool) {
+	token := generateToken()
+	totpMutex.Lock()
+	now := time.Now()
+	for t, p := range pendingLogins {
+		if now.After(p.Expiry) {
+			delete(pendingLogins, t)
+		}
+	}
+	pendingLogins[token] = &pendingLogin{Username: user.Username, Next: next, Remember: remember, Expiry: now.Add(totpLoginTimeout)}
+	totpMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login_pending",
+		Value:    token,
+		Path:     "/login",
+		HttpOnly: true,
+		Secure:   requestIsSecure(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(totpLoginTimeout.Seconds()),
+	})
+}
+
+func clearPendingLogin(w http.ResponseWriter, r *http.Request, token string) {
+	totpMutex.Lock()
+	delete(pendingLogins, token)
+	totpMutex.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login_pending",
+		Value:    "",
+		Path:     "/login",
+		HttpOnly: true,
+		Secure:   requestIsSecure(r),
+		MaxAge:   -1,
+	})
+}
+
+// handleLoginTOTP is the second login step: it asks for the code and
+// creates the session once it checks out.
+func handleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("login_pending")
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	token := cookie.Value
+	totpMutex.Lock()
+	pending, ok := pendingLogins[token]
+	var p pendingLogin
+	if ok {
+		p = *pending
+	}
+	totpMutex.Unlock()
+	if !ok || time.Now().After(p.Expiry) {
+		clearPendingLogin(w, r, token)
+		restartLogin(w, r, p.Next)
+		return
+	}
+
+	if r.Method == "GET" {
+		renderLogin(w, r, loginData{TOTP: true})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+		} else {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+		}
+		return
+	}
+
+	limitKeys := loginLimitKeys(r)
+	if wait := loginAllowedIn(limitKeys); wait > 0 {
+		retryAfter := int(wait.Round(time.Second).Seconds())
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+		renderLogin(w, r, loginData{Status: http.StatusTooManyRequests, RetryAfter: retryAfter, TOTP: true})
+		return
+	}
+
+	user, ok := users.Get(p.Username)
+	if ok && checkSecondFactor(user, r.FormValue("code")) {
+		resetLoginFailures(limitKeys)
+		clearPendingLogin(w, r, token)
+		log.Printf("Login: user=%s (two-factor)", user.Username)
+		audit(r, "login", user.Username, map[string]interface{}{"two_factor": true})
+		createSession(w, r, user, p.Remember)
+		http.Redirect(w, r, p.Next, http.StatusSeeOther)
+		return
+	}
+
+	recordLoginFailure(r, limitKeys, p.Username)
+	audit(r, "login_failed", p.Username, map[string]interface{}{"two_factor": true})
+	totpMutex.Lock()
+	pending.Tries++
+	exhausted := pending.Tries >= totpLoginMaxTries
+	totpMutex.Unlock()
+	if exhausted {
+		clearPendingLogin(w, r, token)
+		restartLogin(w, r, p.Next)
+		return
+	}
+	renderLogin(w, r, loginData{Error: true, TOTP: true})
+}
+
+// restartLogin sends the browser back to the password form.
+func restartLogin(w http.ResponseWriter, r *http.Request, next string) {
+	target := "/login"
+	if next != "" && next != "/" {
+		target += "?next=" + url.QueryEscape(next)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
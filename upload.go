@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"holzeinschlag-austria/pipeline"
+)
+
+// Uploads of corrected input files. Analysts send replacements for the
+// boundary files in data/ as multipart/form-data; they are validated
+// and stored in processing/inputs. Runs started with the "inputs"
+// parameter get that directory as PIPELINE_INPUTS_DIR, and the scripts
+// read the uploaded files from there instead of data/.
+
+// uploadChunkSize is how much of an uploaded file is read and written
+// at a time, so large files never sit in memory.
+const uploadChunkSize = 4 << 20
+
+// uploadInputs are the files that can be uploaded, with the check each
+// one has to pass. The checks return the number of features.
+var uploadInputs = map[string]func(path string) (int, error){
+	"austria_gemeinden.geojson": validateGemeindenInput,
+	"austria_states.geojson":    validateStatesInput,
+}
+
+// uploadedFile describes a stored input file.
+type uploadedFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Features int    `json:"features"`
+}
+
+func inputsDir() string {
+	return filepath.Join(config.ProcessingDir, "inputs")
+}
+
+// hasUploadedInputs reports whether any input file has been uploaded.
+func hasUploadedInputs() bool {
+	for name := range uploadInputs {
+		if _, err := os.Stat(filepath.Join(inputsDir(), name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type boundaryFeature struct {
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   *struct {
+		Type string `json:"type"`
+	} `json:"geometry"`
+}
+
+// readBoundaries reads a GeoJSON FeatureCollection of polygons.
+func readBoundaries(path string) ([]boundaryFeature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var collection struct {
+		Type     string            `json:"type"`
+		Features []boundaryFeature `json:"features"`
+	}
+	if err := json.NewDecoder(f).Decode(&collection); err != nil {
+		return nil, fmt.Errorf("not valid GeoJSON: %v", err)
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, errors.New("not a GeoJSON FeatureCollection")
+	}
+	if len(collection.Features) == 0 {
+		return nil, errors.New("no features")
+	}
+	for i, feature := range collection.Features {
+		if feature.Geometry == nil || (feature.Geometry.Type != "Polygon" && feature.Geometry.Type != "MultiPolygon") {
+			return nil, fmt.Errorf("feature %d: geometry must be a Polygon or MultiPolygon", i)
+		}
+	}
+	return collection.Features, nil
+}
+
+// validateGemeindenInput checks Gemeinde boundaries: every feature needs
+// a name and a unique five-digit iso code.
+func validateGemeindenInput(path string) (int, error) {
+	features, err := readBoundaries(path)
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool, len(features))
+	for i, feature := range features {
+		iso, _ := feature.Properties["iso"].(string)
+		if !isoPattern.MatchString(iso) {
+			return 0, fmt.Errorf("feature %d: iso must be a five-digit Gemeinde code", i)
+		}
+		if seen[iso] {
+			return 0, fmt.Errorf("feature %d: duplicate iso %s", i, iso)
+		}
+		seen[iso] = true
+		if name, _ := feature.Properties["name"].(string); name == "" {
+			return 0, fmt.Errorf("feature %d: missing name", i)
+		}
+	}
+	return len(features), nil
+}
+
+// validateStatesInput checks Bundesland boundaries: one feature for each
+// of the nine, identified by name.
+func validateStatesInput(path string) (int, error) {
+	features, err := readBoundaries(path)
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool, len(features))
+	for i, feature := range features {
+		name, _ := feature.Properties["name"].(string)
+		if !bundeslaender[name] {
+			return 0, fmt.Errorf("feature %d: unknown Bundesland %q", i, name)
+		}
+		if seen[name] {
+			return 0, fmt.Errorf("feature %d: duplicate Bundesland %s", i, name)
+		}
+		seen[name] = true
+	}
+	if len(seen) != len(bundeslaender) {
+		return 0, fmt.Errorf("expected all %d Bundesländer, got %d", len(bundeslaender), len(seen))
+	}
+	return len(features), nil
+}
+
+// receiveUpload writes an uploaded file to a temporary file in the
+// inputs directory, one chunk at a time.
+func receiveUpload(part io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(inputsDir(), ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := io.CopyBuffer(tmp, part, make([]byte, uploadChunkSize))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", n, err
+	}
+	return tmp.Name(), n, nil
+}
+
+// handleUpload stores input files sent as multipart/form-data: "file"
+// parts named after an entry of uploadInputs, and an optional
+// "pipeline" field naming a pipeline to start on them. Nothing is stored
+// unless all files pass validation.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > config.MaxUploadBytes {
+		writeBodyTooLarge(w)
+		return
+	}
+	if isPipelineRunning() {
+		writeJSONError(w, http.StatusConflict, "pipeline is running")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadBytes)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "expected a multipart/form-data body")
+		return
+	}
+	if err := os.MkdirAll(inputsDir(), 0755); err != nil {
+		log.Printf("Failed to create inputs directory: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	// Only now that the request is accepted should the client send the body
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		w.WriteHeader(http.StatusContinue)
+	}
+
+	received := map[string]string{}
+	defer func() {
+		for _, tmp := range received {
+			os.Remove(tmp)
+		}
+	}()
+	var files []uploadedFile
+	var bytesReceived int64
+	pipelineName := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if isBodyTooLarge(err) {
+				writeBodyTooLarge(w)
+				return
+			}
+			writeJSONError(w, http.StatusBadRequest, "invalid multipart body")
+			return
+		}
+		switch part.FormName() {
+		case "pipeline":
+			value, err := io.ReadAll(io.LimitReader(part, 256))
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid multipart body")
+				return
+			}
+			pipelineName = strings.TrimSpace(string(value))
+		case "file":
+			name := part.FileName()
+			validate, ok := uploadInputs[name]
+			if !ok {
+				names := make([]string, 0, len(uploadInputs))
+				for n := range uploadInputs {
+					names = append(names, n)
+				}
+				slices.Sort(names)
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown input file %q, expected one of %s", name, strings.Join(names, ", ")))
+				return
+			}
+			if _, dup := received[name]; dup {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s uploaded twice", name))
+				return
+			}
+			tmp, n, err := receiveUpload(part)
+			bytesReceived += n
+			if err != nil {
+				if isBodyTooLarge(err) {
+					writeBodyTooLarge(w)
+					return
+				}
+				log.Printf("Upload of %s failed after %d bytes: %v", name, n, err)
+				writeJSONError(w, http.StatusBadRequest, "upload of "+name+" was interrupted")
+				return
+			}
+			received[name] = tmp
+			features, err := validate(tmp)
+			if err != nil {
+				writeJSONError(w, http.StatusUnprocessableEntity, name+": "+err.Error())
+				return
+			}
+			files = append(files, uploadedFile{Name: name, Size: n, Features: features})
+		default:
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unexpected form field %q", part.FormName()))
+			return
+		}
+	}
+	if len(files) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "no file uploaded")
+		return
+	}
+	if _, ok := config.Pipelines[pipelineName]; pipelineName != "" && !ok {
+		writeJSONError(w, http.StatusBadRequest, "unknown pipeline")
+		return
+	}
+
+	for _, f := range files {
+		if err := os.Rename(received[f.Name], filepath.Join(inputsDir(), f.Name)); err != nil {
+			log.Printf("Failed to store uploaded %s: %v", f.Name, err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to store upload")
+			return
+		}
+		delete(received, f.Name)
+		log.Printf("Stored uploaded input %s (%d bytes, %d features)", f.Name, f.Size, f.Features)
+	}
+
+	resp := map[string]interface{}{
+		"status":         "complete",
+		"bytes_received": bytesReceived,
+		"files":          files,
+	}
+	auditParams := map[string]interface{}{"files": files}
+	if pipelineName != "" {
+		run := &pipelineRun{Pipeline: pipelineName, Parameters: &pipeline.Params{Inputs: true}}
+		if p, ok := authenticate(r); ok {
+			run.User = p.User.Username
+		}
+		err := startPipeline(run, 0)
+		var preflight *preflightError
+		switch {
+		case errors.Is(err, errPipelineRunning):
+			resp["run_status"] = "already_running"
+		case errors.As(err, &preflight):
+			resp["run_status"] = "preflight_failed"
+			resp["run_id"] = run.ID
+		case err != nil:
+			log.Printf("Cannot start pipeline %q on uploaded inputs: %v", pipelineName, err)
+			resp["run_status"] = "failed_to_start"
+		default:
+			resp["run_status"] = "started"
+			resp["run_id"] = run.ID
+		}
+		auditParams["pipeline"] = pipelineName
+		auditParams["run"] = run.ID
+	}
+	audit(r, "upload", "", auditParams)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
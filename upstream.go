@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"holzeinschlag-austria/pipeline"
+)
+
+// Watcher for new releases of the Hansen Global Forest Change data. It
+// periodically asks the bucket whether the next annual release exists,
+// records it as a pending update shown in /api/status, tells the
+// webhooks that want "upstream_update", and optionally starts a run on
+// the new release.
+
+// UpstreamWatch configures the watcher.
+type UpstreamWatch struct {
+	// Hours between checks; 0 disables the watcher
+	IntervalHours int `json:"interval_hours"`
+	// Pipeline started on the new release; empty only records the update
+	AutoStartPipeline string `json:"auto_start_pipeline"`
+}
+
+func (u UpstreamWatch) validate(pipelines map[string]string) error {
+	if u.IntervalHours < 0 {
+		return fmt.Errorf("upstream_watch: interval_hours must not be negative")
+	}
+	if u.AutoStartPipeline != "" {
+		if _, ok := pipelines[u.AutoStartPipeline]; !ok {
+			return fmt.Errorf("upstream_watch: unknown pipeline %q", u.AutoStartPipeline)
+		}
+	}
+	return nil
+}
+
+type upstreamState struct {
+	// Release the last successful run processed
+	CurrentRelease string `json:"current_release"`
+	// Newest release found upstream
+	LatestRelease string     `json:"latest_release"`
+	Detected      *time.Time `json:"detected,omitempty"`
+	// A release newer than the processed one is waiting for a run
+	Pending   bool       `json:"pending"`
+	Checked   *time.Time `json:"checked,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+var upstreamMutex sync.Mutex
+
+func upstreamStatePath() string {
+	return filepath.Join(config.ProcessingDir, "upstream.json")
+}
+
+func loadUpstreamState() (*upstreamState, error) {
+	state := &upstreamState{CurrentRelease: pipeline.Release, LatestRelease: pipeline.Release}
+	data, err := os.ReadFile(upstreamStatePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", upstreamStatePath(), err)
+	}
+	return state, nil
+}
+
+func saveUpstreamState(state *upstreamState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := upstreamStatePath()
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// upstreamRelease returns the release a run processes.
+func upstreamRelease(run *pipelineRun) string {
+	if run.Parameters != nil && run.Parameters.Release != "" {
+		return run.Parameters.Release
+	}
+	return pipeline.Release
+}
+
+// releaseProcessed records that a run processed release successfully,
+// which settles a pending update to it.
+func releaseProcessed(release string) {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	state, err := loadUpstreamState()
+	if err != nil {
+		log.Printf("Failed to load upstream state: %v", err)
+		return
+	}
+	if !newerRelease(state.CurrentRelease, release) {
+		state.CurrentRelease = release
+	}
+	if newerRelease(release, state.LatestRelease) {
+		state.LatestRelease = release
+	}
+	state.Pending = state.LatestRelease != state.CurrentRelease
+	if err := saveUpstreamState(state); err != nil {
+		log.Printf("Failed to save upstream state: %v", err)
+	}
+}
+
+// newerRelease reports whether release a is newer than b.
+func newerRelease(a, b string) bool {
+	ay, am, aok := pipeline.ParseRelease(a)
+	by, bm, bok := pipeline.ParseRelease(b)
+	return aok && bok && (ay > by || ay == by && am > bm)
+}
+
+// checkUpstream looks for the release after the newest one known. It
+// returns the state after the check and whether a new release was found.
+func checkUpstream() (*upstreamState, bool, error) {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	state, err := loadUpstreamState()
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now().UTC()
+	state.Checked = &now
+	state.LastError = ""
+
+	found := ""
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, release := range pipeline.NextReleases(state.LatestRelease) {
+		ok, err := releaseExists(client, release)
+		if err != nil {
+			state.LastError = err.Error()
+			break
+		}
+		if ok {
+			found = release
+			break
+		}
+	}
+	if found != "" {
+		state.LatestRelease = found
+		state.Detected = &now
+		state.Pending = true
+	}
+	if err := saveUpstreamState(state); err != nil {
+		return nil, false, err
+	}
+	if state.LastError != "" {
+		return state, false, fmt.Errorf("checking for new releases: %s", state.LastError)
+	}
+	return state, found != "", nil
+}
+
+// releaseExists asks the bucket for the lossyear tile of a release.
+func releaseExists(client *http.Client, release string) (bool, error) {
+	resp, err := client.Head(pipeline.TileURL(release, "lossyear"))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		// The bucket answers 403 for objects that don't exist
+		return false, nil
+	default:
+		return false, fmt.Errorf("HEAD %s: %s", release, resp.Status)
+	}
+}
+
+// watchUpstream runs one check and acts on a new release.
+func watchUpstream() (*upstreamState, bool, error) {
+	state, found, err := checkUpstream()
+	if err != nil || !found {
+		return state, found, err
+	}
+	log.Printf("New Hansen release %s found (processed: %s)", state.LatestRelease, state.CurrentRelease)
+	notifyUpstreamUpdate(state)
+
+	name := config.UpstreamWatch.AutoStartPipeline
+	if name == "" {
+		return state, found, nil
+	}
+	run := &pipelineRun{Pipeline: name, Schedule: "upstream:" + state.LatestRelease, Parameters: &pipeline.Params{Release: state.LatestRelease}}
+	if err := startPipeline(run, 0); err != nil {
+		log.Printf("Not starting pipeline %q for release %s: %v", name, state.LatestRelease, err)
+	} else {
+		log.Printf("Started pipeline %q for release %s (run %s)", name, state.LatestRelease, run.ID)
+	}
+	return state, found, nil
+}
+
+// startUpstreamWatch checks for new releases every interval_hours.
+func startUpstreamWatch() {
+	if config.UpstreamWatch.IntervalHours <= 0 {
+		return
+	}
+	interval := time.Duration(config.UpstreamWatch.IntervalHours) * time.Hour
+	go func() {
+		for {
+			if _, _, err := watchUpstream(); err != nil {
+				log.Printf("Upstream check failed: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// notifyUpstreamUpdate tells the webhooks that want "upstream_update"
+// about a new release.
+func notifyUpstreamUpdate(state *upstreamState) {
+	body, err := json.Marshal(map[string]interface{}{
+		"event":           "upstream_update",
+		"release":         state.LatestRelease,
+		"current_release": state.CurrentRelease,
+		"detected":        state.Detected,
+		"auto_start":      config.UpstreamWatch.AutoStartPipeline,
+	})
+	if err != nil {
+		log.Printf("Failed to encode webhook payload: %v", err)
+		return
+	}
+	for _, h := range config.PipelineWebhooks {
+		if h.wants("upstream_update") {
+			go webhookDeliver(h.URL, h.Secret, string(body))
+		}
+	}
+}
+
+// handleUpstreamCheck checks for a new release right away. When the
+// bucket cannot be reached the state is returned with 502.
+func handleUpstreamCheck(w http.ResponseWriter, r *http.Request) {
+	state, found, err := watchUpstream()
+	if state == nil {
+		log.Printf("Upstream check failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to check for new releases")
+		return
+	}
+	audit(r, "upstream_check", "", map[string]interface{}{"latest_release": state.LatestRelease, "found": found})
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		log.Printf("Upstream check failed: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(state)
+}
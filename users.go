@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+)
+
+// Shortest password accepted by the password change endpoint
+const minPasswordLength = 10
+
+// User is an account in the user store. PasswordHash is an argon2id hash
+// as printed by the hash-password subcommand. The store is not shipped
+// with any accounts; the first admin is added to users.json by hand.
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	Role         string `json:"role"`
+	// Base32 TOTP secret; when set, login asks for a second factor
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// Gemeinden the user may get data for; unset means all
+	DataScope *DataScope `json:"data_scope,omitempty"`
+	// Set for users authenticated by an external provider ("oidc")
+	Provider string `json:"-"`
+}
+
+// userStore holds the accounts from the users file. It can be reloaded
+// while the server runs (SIGHUP or POST /api/admin/users/reload).
+type userStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]User
+}
+
+var users = &userStore{users: make(map[string]User)}
+
+func (s *userStore) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var list []User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	loaded := make(map[string]User, len(list))
+	for _, u := range list {
+		if u.Username == "" || u.PasswordHash == "" {
+			return fmt.Errorf("%s: every user needs a username and password_hash", path)
+		}
+		// Catches the placeholder of users.example.json too
+		if _, err := decodeHash(u.PasswordHash); err != nil {
+			return fmt.Errorf("%s: user %q: password_hash is not an argon2id hash; create one with the hash-password subcommand", path, u.Username)
+		}
+		if u.Role != roleAdmin && u.Role != roleUser {
+			return fmt.Errorf("%s: user %q has unknown role %q", path, u.Username, u.Role)
+		}
+		if err := u.DataScope.validate(); err != nil {
+			return fmt.Errorf("%s: user %q: %w", path, u.Username, err)
+		}
+		if _, dup := loaded[u.Username]; dup {
+			return fmt.Errorf("%s: duplicate user %q", path, u.Username)
+		}
+		loaded[u.Username] = u
+	}
+
+	s.mu.Lock()
+	s.path = path
+	s.users = loaded
+	s.mu.Unlock()
+	log.Printf("Loaded %d users from %s", len(loaded), path)
+	return nil
+}
+
+func (s *userStore) Reload() error {
+	s.mu.RLock()
+	path := s.path
+	s.mu.RUnlock()
+	return s.Load(path)
+}
+
+func (s *userStore) Get(username string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	return u, ok
+}
+
+// Update applies fn to a user and writes the whole store back to the
+// users file.
+func (s *userStore) Update(username string, fn func(*User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return fmt.Errorf("unknown user %q", username)
+	}
+	old := u
+	fn(&u)
+	s.users[username] = u
+	if err := s.saveLocked(); err != nil {
+		s.users[username] = old
+		return err
+	}
+	return nil
+}
+
+var errUserExists = errors.New("user already exists")
+
+// Create adds a new user and writes the store back to the users file.
+func (s *userStore) Create(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[u.Username]; exists {
+		return errUserExists
+	}
+	s.users[u.Username] = u
+	if err := s.saveLocked(); err != nil {
+		delete(s.users, u.Username)
+		return err
+	}
+	return nil
+}
+
+func (s *userStore) saveLocked() error {
+	list := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	data, _ := json.MarshalIndent(list, "", "  ")
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Authenticate checks a username/password pair. Unknown users cost the
+// same hash computation as known ones.
+func (s *userStore) Authenticate(username, password string) (User, bool) {
+	u, ok := s.Get(username)
+	hash := u.PasswordHash
+	if !ok {
+		hash = dummyPasswordHash
+	}
+	match, err := verifyPassword(hash, password)
+	if err != nil {
+		log.Printf("Unusable password hash for user %q: %v", username, err)
+		return u, false
+	}
+	return u, ok && match
+}
+
+func handleReloadUsers(w http.ResponseWriter, r *http.Request) {
+	if err := users.Reload(); err != nil {
+		log.Printf("User store reload failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to reload users")
+		return
+	}
+	users.mu.RLock()
+	count := len(users.users)
+	users.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"users": count})
+}
+
+// handleChangePassword lets a logged-in user replace their password. All
+// their other sessions are ended.
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := accountUser(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w)
+		} else {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		}
+		return
+	}
+	if len([]rune(body.NewPassword)) < minPasswordLength {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("new password must have at least %d characters", minPasswordLength))
+		return
+	}
+
+	// Wrong current passwords count towards the login throttle
+	limitKeys := loginLimitKeys(r)
+	if wait := loginAllowedIn(limitKeys); wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+		writeJSONError(w, http.StatusTooManyRequests, "too many failed attempts")
+		return
+	}
+	if _, ok := users.Authenticate(user.Username, body.CurrentPassword); !ok {
+		recordLoginFailure(r, limitKeys, user.Username)
+		writeJSONError(w, http.StatusForbidden, "current password is wrong")
+		return
+	}
+	resetLoginFailures(limitKeys)
+
+	hash, err := hashPassword(body.NewPassword)
+	if err != nil {
+		log.Printf("Password hashing failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to change password")
+		return
+	}
+	if err := users.Update(user.Username, func(u *User) { u.PasswordHash = hash }); err != nil {
+		log.Printf("Failed to save user %q: %v", user.Username, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to change password")
+		return
+	}
+
+	current := ""
+	if cookie, err := r.Cookie("session"); err == nil {
+		current = cookie.Value
+	}
+	removed := revokeUserSessions(user.Username, current)
+	log.Printf("event=password_changed user=%q other_sessions_revoked=%d", user.Username, removed)
+	audit(r, "password_changed", "", map[string]interface{}{"other_sessions_revoked": removed})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+)
+
+// Waits before each retry of a failed webhook delivery
+var webhookRetryDelays = []time.Duration{5 * time.Second, 15 * time.Second, 45 * time.Second}
+
+// webhookDeliver POSTs payload to url, retrying with backoff on network
+// errors and non-2xx responses. When secret is set the body is signed with
+// HMAC-SHA256 in the X-Webhook-Signature header.
+func webhookDeliver(url, secret, payload string) error {
+	attempts := 0
+	var lastErr error
+	for {
+		attempts++
+		lastErr = webhookPost(url, secret, payload)
+		if lastErr == nil {
+			return nil
+		}
+		log.Printf("Webhook delivery to %s failed (attempt %d): %v", url, attempts, lastErr)
+		if attempts > len(webhookRetryDelays) {
+			break
+		}
+		time.Sleep(webhookRetryDelays[attempts-1])
+	}
+
+	appendAuditLog(auditEntry{
+		Action: "webhook_failed",
+		Params: map[string]interface{}{"url": url, "attempts": attempts},
+	})
+	return lastErr
+}
+
+func webhookPost(url, secret, payload string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(payload))
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// PipelineWebhook is told about pipeline runs starting and ending.
+type PipelineWebhook struct {
+	URL string `json:"url"`
+	// Signs the body with HMAC-SHA256 in X-Webhook-Signature
+	Secret string `json:"secret,omitempty"`
+	// "started", "success", "failure" and "upstream_update" for new
+	// releases of the Hansen data; empty for all. Failure covers every
+	// run that did not succeed, cancelled and timed out ones too.
+	Events []string `json:"events,omitempty"`
+}
+
+var pipelineWebhookEvents = map[string]bool{"started": true, "success": true, "failure": true, "upstream_update": true}
+
+func (h PipelineWebhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("pipeline_webhooks: invalid url %q", h.URL)
+	}
+	for _, e := range h.Events {
+		if !pipelineWebhookEvents[e] {
+			return fmt.Errorf("pipeline_webhooks: unknown event %q, want started, success, failure or upstream_update", e)
+		}
+	}
+	return nil
+}
+
+func (h PipelineWebhook) wants(event string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, event)
+}
+
+// notifyPipelineWebhooks sends a run's event to the webhooks that want
+// it, in the background. Finished runs are sent with status, duration,
+// exit code and the end of their log.
+func notifyPipelineWebhooks(run *pipelineRun, status string) {
+	event := "started"
+	switch {
+	case status == "success":
+		event = "success"
+	case status != "running":
+		event = "failure"
+	}
+	payload := map[string]interface{}{
+		"event":      event,
+		"run_id":     run.ID,
+		"pipeline":   run.Pipeline,
+		"status":     status,
+		"user":       run.User,
+		"schedule":   run.Schedule,
+		"parameters": run.Parameters,
+		"started":    run.Started,
+	}
+	if event != "started" {
+		finished := time.Now().UTC()
+		if run.Finished != nil {
+			finished = *run.Finished
+		}
+		payload["finished"] = finished
+		payload["duration_seconds"] = finished.Sub(run.Started).Seconds()
+		payload["exit_code"] = run.ExitCode
+		if data, err := os.ReadFile(runLogPath(run.ID)); err == nil {
+			payload["log_tail"] = lastLines(string(data), statusLogTailLines)
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook payload: %v", err)
+		return
+	}
+	for _, h := range config.PipelineWebhooks {
+		if h.wants(event) {
+			go webhookDeliver(h.URL, h.Secret, string(body))
+		}
+	}
+}
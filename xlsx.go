@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Excel workbooks for the xlsx export: a summary sheet with each
+// Gemeinde's totals over the exported years, then a sheet per year. The
+// workbook is written directly as SpreadsheetML; it only needs inline
+// strings, numbers and a few cell styles.
+
+// Cell styles, indexes into cellXfs of xlsxStyles
+const (
+	xlsxStyleText = iota
+	xlsxStyleHeader
+	xlsxStyleInteger
+	xlsxStyleDecimal
+	xlsxStyleEuro
+)
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="1"><numFmt numFmtId="164" formatCode="#,##0.00\ &quot;€&quot;"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="5">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+<xf numFmtId="3" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="4" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+</cellXfs>
+</styleSheet>`
+
+type xlsxCell struct {
+	value interface{}
+	style int
+}
+
+type xlsxSheet struct {
+	name   string
+	header []string
+	rows   [][]xlsxCell
+}
+
+// xlsxColumn returns the letters of the zero-based column i.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeXLSXSheet(w io.Writer, sheet xlsxSheet) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	bw.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	// Keep the header in view while scrolling
+	bw.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	bw.WriteString(`<sheetData>`)
+	header := make([]xlsxCell, len(sheet.header))
+	for i, h := range sheet.header {
+		header[i] = xlsxCell{h, xlsxStyleHeader}
+	}
+	for r, row := range slices.Concat([][]xlsxCell{header}, sheet.rows) {
+		fmt.Fprintf(bw, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			ref := xlsxColumn(c) + strconv.Itoa(r+1)
+			switch v := cell.value.(type) {
+			case nil:
+			case float64:
+				fmt.Fprintf(bw, `<c r="%s" s="%d"><v>%s</v></c>`, ref, cell.style, strconv.FormatFloat(v, 'f', -1, 64))
+			case int64:
+				fmt.Fprintf(bw, `<c r="%s" s="%d"><v>%d</v></c>`, ref, cell.style, v)
+			default:
+				fmt.Fprintf(bw, `<c r="%s" s="%d" t="inlineStr"><is><t>%s</t></is></c>`, ref, cell.style, xmlEscape(formatCSVValue(v)))
+			}
+		}
+		bw.WriteString(`</row>`)
+	}
+	bw.WriteString(`</sheetData></worksheet>`)
+	return bw.Flush()
+}
+
+// writeXLSX writes a workbook with the given sheets to path.
+func writeXLSX(path string, sheets []xlsxSheet) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+
+	var types, workbook, rels strings.Builder
+	types.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+`)
+	workbook.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+`)
+	for i, sheet := range sheets {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`+"\n", n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(sheet.name), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`+"\n", n, n)
+	}
+	types.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	rels.WriteString(`</Relationships>`)
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", types.String()},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", rels.String()},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, part := range parts {
+		w, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, part.content); err != nil {
+			return err
+		}
+	}
+	for i, sheet := range sheets {
+		w, err := zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := writeXLSXSheet(w, sheet); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// Identifier columns leading every sheet
+var xlsxIdentifiers = []string{"iso", "name", "state", "population"}
+
+// xlsxIndicatorStyle picks the number format for an indicator's unit.
+func xlsxIndicatorStyle(indicator string) int {
+	switch indicatorLabels[indicator].Unit {
+	case "px":
+		return xlsxStyleInteger
+	case "EUR":
+		return xlsxStyleEuro
+	default:
+		return xlsxStyleDecimal
+	}
+}
+
+func xlsxNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func convertXLSX(src, dst string, opts exportOptions) ([]string, error) {
+	var columns []string
+	var rows [][]interface{}
+	err := readExportRows(src, func(c []string) error {
+		columns = c
+		return nil
+	}, func(values []interface{}) error {
+		rows = append(rows, slices.Clone(values))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int, len(columns))
+	var years, indicators []string
+	for i, name := range columns {
+		index[name] = i
+		if m := yearColumnPattern.FindStringSubmatch(name); m != nil {
+			if _, ok := indicatorLabels[m[1]]; ok {
+				if !slices.Contains(years, m[2]) {
+					years = append(years, m[2])
+				}
+				if !slices.Contains(indicators, m[1]) {
+					indicators = append(indicators, m[1])
+				}
+			}
+		}
+	}
+	slices.Sort(years)
+
+	var header []string
+	for _, id := range xlsxIdentifiers {
+		header = append(header, baseColumnLabels[id].De)
+	}
+	identifiers := func(row []interface{}) []xlsxCell {
+		cells := make([]xlsxCell, 0, len(xlsxIdentifiers)+len(indicators))
+		for _, id := range xlsxIdentifiers {
+			style := xlsxStyleText
+			if id == "population" {
+				style = xlsxStyleInteger
+			}
+			var v interface{}
+			if i, ok := index[id]; ok {
+				v = row[i]
+			}
+			cells = append(cells, xlsxCell{v, style})
+		}
+		return cells
+	}
+	indicatorHeader := func(suffix string) []string {
+		h := slices.Clone(header)
+		for _, ind := range indicators {
+			label := indicatorLabels[ind]
+			h = append(h, label.De+suffix+" ("+label.Unit+")")
+		}
+		return h
+	}
+
+	summary := xlsxSheet{name: "Übersicht", header: indicatorHeader(" gesamt")}
+	if len(years) > 0 {
+		summary.header = indicatorHeader(" " + years[0] + "–" + years[len(years)-1])
+		if len(years) == 1 {
+			summary.header = indicatorHeader(" " + years[0])
+		}
+	}
+	for _, row := range rows {
+		cells := identifiers(row)
+		for _, ind := range indicators {
+			total, any := 0.0, false
+			for _, y := range years {
+				if i, ok := index[ind+"_"+y]; ok {
+					if v, ok := xlsxNumber(row[i]); ok {
+						total, any = total+v, true
+					}
+				}
+			}
+			var v interface{}
+			if any {
+				v = total
+			}
+			cells = append(cells, xlsxCell{v, xlsxIndicatorStyle(ind)})
+		}
+		summary.rows = append(summary.rows, cells)
+	}
+	sheets := []xlsxSheet{summary}
+
+	for _, y := range years {
+		sheet := xlsxSheet{name: y, header: indicatorHeader("")}
+		for _, row := range rows {
+			cells := identifiers(row)
+			for _, ind := range indicators {
+				var v interface{}
+				if i, ok := index[ind+"_"+y]; ok {
+					v = row[i]
+				}
+				cells = append(cells, xlsxCell{v, xlsxIndicatorStyle(ind)})
+			}
+			sheet.rows = append(sheet.rows, cells)
+		}
+		sheets = append(sheets, sheet)
+	}
+	return nil, writeXLSX(dst, sheets)
+}